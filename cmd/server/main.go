@@ -86,10 +86,34 @@ func main() {
 	userService := auth.NewUserService(db)
 	sessionManager := auth.NewSessionManager(cfg.SessionSecret, cfg.SessionMaxAge)
 	netlinkService := services.NewNetlinkService()
-	iptablesService := services.NewIPTablesService(cfg.ConfigDir)
-	routeService := services.NewIPRouteService(cfg.ConfigDir)
+	conntrackService := services.NewConntrackService()
+	var firewallService services.FirewallBackend
+	var nftablesService *services.NftablesService
+	switch cfg.FirewallBackend {
+	case "nftables":
+		nftablesService = services.NewNftablesService(cfg.ConfigDir)
+		firewallService = nftablesService
+	case "iptables":
+		firewallService = services.NewIPTablesService(cfg.ConfigDir)
+	default:
+		log.Fatalf("Unknown firewall backend: %s", cfg.FirewallBackend)
+	}
+	portForwardService := services.NewPortForwardService(firewallService)
+	objectService := services.NewFirewallObjectService(db, firewallService)
+	zoneService := services.NewZoneService(db, firewallService)
+	traceService := services.NewTraceService(firewallService)
+	analysisService := services.NewRuleAnalysisService(firewallService, netlinkService)
+	ipsetService := services.NewIPSetService(cfg.ConfigDir)
+	routeService := services.NewIPRouteService(cfg.ConfigDir, cfg.RTTablesPath)
 	ruleService := services.NewIPRuleService(cfg.ConfigDir)
 	persistService := services.NewPersistService(cfg.ConfigDir)
+	packetLogService := services.NewPacketLogService(db, cfg.NFLogGroup)
+	counterService := services.NewRuleCounterService(db, firewallService)
+	importService := services.NewRuleImportService(firewallService)
+	driftService := services.NewRuleDriftService(firewallService)
+	scheduleService := services.NewRuleScheduleService(db, firewallService, func(action, details string) {
+		userService.LogAction(nil, action, details, "")
+	})
 
 	// Ensure default admin user exists
 	if err := userService.EnsureDefaultAdmin(cfg.DefaultAdmin, cfg.DefaultPassword); err != nil {
@@ -97,10 +121,19 @@ func main() {
 	}
 
 	// Restore saved configurations
-	if err := persistService.RestoreAll(iptablesService, routeService, ruleService); err != nil {
+	if err := persistService.RestoreAll(ipsetService, firewallService, routeService, ruleService); err != nil {
 		log.Printf("Warning: Failed to restore some configurations: %v", err)
 	}
 
+	// Start collecting packets from NFLOG rules
+	packetLogService.Start()
+
+	// Add and remove scheduled rules
+	scheduleService.Start()
+
+	// Record rule counters for the traffic graphs
+	counterService.Start()
+
 	// Load templates
 	templates, err := loadTemplates(filepath.Join(webDir, "templates"))
 	if err != nil {
@@ -111,10 +144,18 @@ func main() {
 	authHandler := handlers.NewAuthHandler(templates, sessionManager, userService)
 	dashboardHandler := handlers.NewDashboardHandler(templates, netlinkService)
 	interfacesHandler := handlers.NewInterfacesHandler(templates, netlinkService, userService)
-	firewallHandler := handlers.NewFirewallHandler(templates, iptablesService, userService)
-	routesHandler := handlers.NewRoutesHandler(templates, routeService, netlinkService, userService)
+	firewallHandler := handlers.NewFirewallHandler(templates, firewallService, portForwardService, objectService, zoneService, traceService, analysisService, packetLogService, scheduleService, counterService, importService, driftService, userService)
+	var nftablesHandler *handlers.NftablesHandler
+	if nftablesService != nil {
+		nftablesHandler = handlers.NewNftablesHandler(templates, nftablesService)
+	}
+	ipsetHandler := handlers.NewIPSetHandler(templates, ipsetService, userService)
+	conntrackHandler := handlers.NewConntrackHandler(templates, conntrackService, userService)
+	counterHandler := handlers.NewCounterHandler(templates, counterService)
+	packetLogHandler := handlers.NewPacketLogHandler(templates, packetLogService, userService)
+	routesHandler := handlers.NewRoutesHandler(templates, routeService, ruleService, netlinkService, userService)
 	rulesHandler := handlers.NewRulesHandler(templates, ruleService, routeService, netlinkService, userService)
-	settingsHandler := handlers.NewSettingsHandler(templates, userService, persistService, iptablesService, routeService, ruleService)
+	settingsHandler := handlers.NewSettingsHandler(templates, userService, persistService, ipsetService, firewallService, routeService, ruleService)
 
 	// Initialize middleware
 	authMiddleware := middleware.NewAuthMiddleware(sessionManager, userService)
@@ -159,7 +200,10 @@ func main() {
 		// Firewall
 		r.Get("/firewall", firewallHandler.List)
 		r.Get("/firewall/rules", firewallHandler.GetRules)
+		r.Get("/firewall/analysis", firewallHandler.Analysis)
 		r.Post("/firewall/rules", firewallHandler.AddRule)
+		r.Get("/firewall/rules/{num}/edit", firewallHandler.EditRuleForm)
+		r.Put("/firewall/rules/{num}", firewallHandler.UpdateRule)
 		r.Delete("/firewall/rules/{num}", firewallHandler.DeleteRule)
 		r.Post("/firewall/rules/{num}/move", firewallHandler.MoveRule)
 		r.Post("/firewall/chains", firewallHandler.CreateChain)
@@ -167,6 +211,75 @@ func main() {
 		r.Put("/firewall/chains/{name}/policy", firewallHandler.SetPolicy)
 		r.Post("/firewall/save", firewallHandler.SaveRules)
 		r.Post("/firewall/flush", firewallHandler.FlushChain)
+		r.Post("/firewall/zero", firewallHandler.ZeroCounters)
+		r.Get("/firewall/pending", firewallHandler.Pending)
+		r.Post("/firewall/confirm", firewallHandler.ConfirmChanges)
+		r.Post("/firewall/rollback", firewallHandler.RollbackChanges)
+		r.Get("/firewall/forwards", firewallHandler.ListPortForwards)
+		r.Get("/firewall/forwards/list", firewallHandler.GetPortForwards)
+		r.Post("/firewall/forwards", firewallHandler.CreatePortForward)
+		r.Get("/firewall/forwards/{id}/edit", firewallHandler.EditPortForwardForm)
+		r.Put("/firewall/forwards/{id}", firewallHandler.UpdatePortForward)
+		r.Delete("/firewall/forwards/{id}", firewallHandler.DeletePortForward)
+		r.Get("/firewall/objects", firewallHandler.ListObjects)
+		r.Get("/firewall/objects/list", firewallHandler.GetObjects)
+		r.Post("/firewall/objects", firewallHandler.CreateObject)
+		r.Get("/firewall/objects/{id}/edit", firewallHandler.EditObjectForm)
+		r.Put("/firewall/objects/{id}", firewallHandler.UpdateObject)
+		r.Delete("/firewall/objects/{id}", firewallHandler.DeleteObject)
+		r.Post("/firewall/objects/rules/{id}/reapply", firewallHandler.ReapplyObjectRule)
+		r.Post("/firewall/objects/rules/{id}/forget", firewallHandler.ForgetObjectRule)
+		r.Post("/firewall/objects/rules/{id}/restore", firewallHandler.RestoreObjectRule)
+		r.Delete("/firewall/objects/rules/{id}", firewallHandler.DeleteObjectRule)
+		r.Get("/firewall/zones", firewallHandler.ListZones)
+		r.Get("/firewall/zones/list", firewallHandler.GetZones)
+		r.Post("/firewall/zones", firewallHandler.CreateZone)
+		r.Post("/firewall/zones/compile", firewallHandler.CompileZones)
+		r.Post("/firewall/zones/policies", firewallHandler.SetZonePolicy)
+		r.Delete("/firewall/zones/policies/{id}", firewallHandler.DeleteZonePolicy)
+		r.Get("/firewall/zones/{name}/edit", firewallHandler.EditZoneForm)
+		r.Put("/firewall/zones/{name}", firewallHandler.UpdateZone)
+		r.Delete("/firewall/zones/{name}", firewallHandler.DeleteZone)
+		r.Get("/firewall/trace", firewallHandler.TracePage)
+		r.Post("/firewall/trace", firewallHandler.RunTrace)
+		r.Get("/firewall/schedules", firewallHandler.ListSchedules)
+		r.Get("/firewall/schedules/list", firewallHandler.GetSchedules)
+		r.Post("/firewall/schedules", firewallHandler.CreateSchedule)
+		r.Get("/firewall/schedules/{id}/edit", firewallHandler.EditScheduleForm)
+		r.Put("/firewall/schedules/{id}", firewallHandler.UpdateSchedule)
+		r.Delete("/firewall/schedules/{id}", firewallHandler.DeleteSchedule)
+		r.Get("/firewall/drift", firewallHandler.Drift)
+		r.Get("/firewall/drift/list", firewallHandler.GetDrift)
+		r.Get("/firewall/drift/badge", firewallHandler.DriftBadge)
+		r.Get("/firewall/import", firewallHandler.ImportPage)
+		r.Post("/firewall/import/preview", firewallHandler.PreviewImport)
+		r.Post("/firewall/import/apply", firewallHandler.ApplyImport)
+		r.Get("/firewall/counters", counterHandler.List)
+		r.Get("/firewall/counters/graphs", counterHandler.GetGraphs)
+		r.Get("/firewall/log", packetLogHandler.List)
+		r.Get("/firewall/log/table", packetLogHandler.GetTable)
+		r.Post("/firewall/log/clear", packetLogHandler.Clear)
+		if nftablesHandler != nil {
+			r.Get("/firewall/nftables", nftablesHandler.List)
+		}
+
+		// IP sets
+		r.Get("/ipsets", ipsetHandler.List)
+		r.Get("/ipsets/list", ipsetHandler.GetSets)
+		r.Post("/ipsets", ipsetHandler.CreateSet)
+		r.Post("/ipsets/save", ipsetHandler.SaveSets)
+		r.Get("/ipsets/{name}", ipsetHandler.Detail)
+		r.Delete("/ipsets/{name}", ipsetHandler.DestroySet)
+		r.Get("/ipsets/{name}/entries", ipsetHandler.GetEntries)
+		r.Post("/ipsets/{name}/entries", ipsetHandler.AddEntry)
+		r.Delete("/ipsets/{name}/entries", ipsetHandler.DeleteEntry)
+		r.Post("/ipsets/{name}/import", ipsetHandler.ImportEntries)
+
+		// Connection tracking
+		r.Get("/conntrack", conntrackHandler.List)
+		r.Get("/conntrack/table", conntrackHandler.GetTable)
+		r.Delete("/conntrack/entry", conntrackHandler.DeleteEntry)
+		r.Post("/conntrack/flush", conntrackHandler.Flush)
 
 		// Routes
 		r.Get("/routes", routesHandler.List)
@@ -174,6 +287,13 @@ func main() {
 		r.Post("/routes", routesHandler.AddRoute)
 		r.Delete("/routes", routesHandler.DeleteRoute)
 		r.Post("/routes/save", routesHandler.SaveRoutes)
+		r.Get("/routes/nexthops", routesHandler.GetNexthops)
+		r.Post("/routes/nexthops", routesHandler.AddNexthop)
+		r.Delete("/routes/nexthops/{id}", routesHandler.DeleteNexthop)
+		r.Get("/routes/tables", routesHandler.GetTables)
+		r.Post("/routes/tables", routesHandler.CreateTable)
+		r.Post("/routes/tables/rename", routesHandler.RenameTable)
+		r.Delete("/routes/tables/{name}", routesHandler.DeleteTable)
 
 		// IP Rules
 		r.Get("/rules", rulesHandler.List)
@@ -257,6 +377,7 @@ func loadTemplates(templatesDir string) (*TemplateRegistry, error) {
 	funcMap := template.FuncMap{
 		"formatBytes": formatBytes,
 		"dict":        dict,
+		"endpoint":    services.ConntrackEndpoint,
 	}
 
 	registry := NewTemplateRegistry(funcMap)
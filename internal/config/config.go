@@ -13,6 +13,14 @@ type Config struct {
 	SessionMaxAge  int
 	DefaultAdmin   string
 	DefaultPassword string
+	// FirewallBackend selects the packet filter the firewall pages manage:
+	// "iptables" or "nftables"
+	FirewallBackend string
+	// NFLogGroup is the NFLOG group the packet log collector listens on
+	NFLogGroup int
+	// RTTablesPath is the iproute2 file naming the routing tables; tables
+	// created from the UI go in its .d directory
+	RTTablesPath string
 }
 
 func Load() *Config {
@@ -24,12 +32,17 @@ func Load() *Config {
 		SessionMaxAge:   getEnvInt("ROUTER_SESSION_MAX_AGE", 86400), // 24 hours
 		DefaultAdmin:    getEnvString("ROUTER_DEFAULT_ADMIN", "admin"),
 		DefaultPassword: getEnvString("ROUTER_DEFAULT_PASSWORD", "admin"),
+		FirewallBackend: getEnvString("ROUTER_FIREWALL_BACKEND", "iptables"),
+		NFLogGroup:      getEnvInt("ROUTER_NFLOG_GROUP", 100),
+		RTTablesPath:    getEnvString("ROUTER_RT_TABLES", "/etc/iproute2/rt_tables"),
 	}
 
 	// Ensure directories exist
 	os.MkdirAll(cfg.DataDir, 0755)
 	os.MkdirAll(cfg.ConfigDir, 0755)
 	os.MkdirAll(cfg.ConfigDir+"/iptables", 0755)
+	os.MkdirAll(cfg.ConfigDir+"/ipset", 0755)
+	os.MkdirAll(cfg.ConfigDir+"/nftables", 0755)
 	os.MkdirAll(cfg.ConfigDir+"/routes", 0755)
 	os.MkdirAll(cfg.ConfigDir+"/rules", 0755)
 
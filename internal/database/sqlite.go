@@ -52,6 +52,92 @@ func (d *DB) migrate() error {
 		)`,
 		`CREATE INDEX IF NOT EXISTS idx_audit_logs_user_id ON audit_logs(user_id)`,
 		`CREATE INDEX IF NOT EXISTS idx_audit_logs_created_at ON audit_logs(created_at)`,
+		`CREATE TABLE IF NOT EXISTS firewall_objects (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			name TEXT UNIQUE NOT NULL,
+			type TEXT NOT NULL,
+			description TEXT NOT NULL DEFAULT '',
+			entries TEXT NOT NULL DEFAULT '',
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		)`,
+		`CREATE TABLE IF NOT EXISTS firewall_object_rules (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			input TEXT NOT NULL,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		)`,
+		`CREATE TABLE IF NOT EXISTS firewall_object_rules_deleted (
+			id INTEGER PRIMARY KEY,
+			input TEXT NOT NULL,
+			created_at DATETIME,
+			deleted_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		)`,
+		`CREATE TABLE IF NOT EXISTS firewall_zones (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			name TEXT UNIQUE NOT NULL,
+			description TEXT NOT NULL DEFAULT '',
+			interfaces TEXT NOT NULL DEFAULT '',
+			input_action TEXT NOT NULL DEFAULT '',
+			masquerade BOOLEAN DEFAULT FALSE,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		)`,
+		`CREATE TABLE IF NOT EXISTS firewall_zone_policies (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			from_zone TEXT NOT NULL,
+			to_zone TEXT NOT NULL,
+			action TEXT NOT NULL,
+			UNIQUE (from_zone, to_zone),
+			FOREIGN KEY (from_zone) REFERENCES firewall_zones(name) ON DELETE CASCADE,
+			FOREIGN KEY (to_zone) REFERENCES firewall_zones(name) ON DELETE CASCADE
+		)`,
+		`CREATE TABLE IF NOT EXISTS packet_log (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			logged_at DATETIME NOT NULL,
+			nflog_group INTEGER NOT NULL,
+			prefix TEXT NOT NULL DEFAULT '',
+			family TEXT NOT NULL,
+			in_interface TEXT NOT NULL DEFAULT '',
+			out_interface TEXT NOT NULL DEFAULT '',
+			protocol TEXT NOT NULL,
+			source TEXT NOT NULL,
+			destination TEXT NOT NULL,
+			sport INTEGER NOT NULL DEFAULT 0,
+			dport INTEGER NOT NULL DEFAULT 0,
+			length INTEGER NOT NULL DEFAULT 0
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_packet_log_logged_at ON packet_log(logged_at)`,
+		`CREATE TABLE IF NOT EXISTS firewall_schedules (
+			id INTEGER PRIMARY KEY AUTOINCREMENT,
+			name TEXT UNIQUE NOT NULL,
+			description TEXT NOT NULL DEFAULT '',
+			family TEXT NOT NULL,
+			table_name TEXT NOT NULL,
+			start_cron TEXT NOT NULL,
+			stop_cron TEXT NOT NULL,
+			rules TEXT NOT NULL,
+			enabled BOOLEAN DEFAULT TRUE,
+			created_at DATETIME DEFAULT CURRENT_TIMESTAMP,
+			updated_at DATETIME DEFAULT CURRENT_TIMESTAMP
+		)`,
+		`CREATE TABLE IF NOT EXISTS rule_counters (
+			key TEXT PRIMARY KEY,
+			family TEXT NOT NULL,
+			table_name TEXT NOT NULL,
+			chain TEXT NOT NULL,
+			label TEXT NOT NULL DEFAULT '',
+			last_seen INTEGER NOT NULL
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_rule_counters_chain ON rule_counters(family, table_name, chain)`,
+		`CREATE TABLE IF NOT EXISTS rule_counter_samples (
+			rule_key TEXT NOT NULL,
+			resolution INTEGER NOT NULL,
+			sampled_at INTEGER NOT NULL,
+			packets INTEGER NOT NULL DEFAULT 0,
+			bytes INTEGER NOT NULL DEFAULT 0,
+			PRIMARY KEY (rule_key, resolution, sampled_at)
+		)`,
+		`CREATE INDEX IF NOT EXISTS idx_rule_counter_samples_sampled_at ON rule_counter_samples(sampled_at)`,
 	}
 
 	for _, m := range migrations {
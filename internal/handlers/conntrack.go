@@ -0,0 +1,207 @@
+package handlers
+
+import (
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"linuxtorouter/internal/auth"
+	"linuxtorouter/internal/middleware"
+	"linuxtorouter/internal/models"
+	"linuxtorouter/internal/services"
+)
+
+// conntrackPageSize is the number of entries shown per page
+const conntrackPageSize = 100
+
+type ConntrackHandler struct {
+	templates        TemplateExecutor
+	conntrackService *services.ConntrackService
+	userService      *auth.UserService
+}
+
+func NewConntrackHandler(templates TemplateExecutor, conntrackService *services.ConntrackService, userService *auth.UserService) *ConntrackHandler {
+	return &ConntrackHandler{
+		templates:        templates,
+		conntrackService: conntrackService,
+		userService:      userService,
+	}
+}
+
+func (h *ConntrackHandler) List(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUser(r)
+
+	data := h.tableData(r)
+	data["Title"] = "Connection Tracking"
+	data["ActivePage"] = "conntrack"
+	data["User"] = user
+
+	if err := h.templates.ExecuteTemplate(w, "conntrack.html", data); err != nil {
+		log.Printf("Template error: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	}
+}
+
+func (h *ConntrackHandler) GetTable(w http.ResponseWriter, r *http.Request) {
+	if err := h.templates.ExecuteTemplate(w, "conntrack_table.html", h.tableData(r)); err != nil {
+		log.Printf("Template error: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	}
+}
+
+// tableData lists the page of entries selected by the request's filter
+func (h *ConntrackHandler) tableData(r *http.Request) map[string]interface{} {
+	filter := conntrackFilterFromRequest(r)
+	page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+	if page < 1 {
+		page = 1
+	}
+
+	var loadError string
+	entries, err := h.conntrackService.List(filter)
+	if err != nil {
+		log.Printf("Failed to list conntrack entries: %v", err)
+		loadError = err.Error()
+	}
+
+	total := len(entries)
+	pages := (total + conntrackPageSize - 1) / conntrackPageSize
+	if pages < 1 {
+		pages = 1
+	}
+	if page > pages {
+		page = pages
+	}
+	start := (page - 1) * conntrackPageSize
+	end := start + conntrackPageSize
+	if end > total {
+		end = total
+	}
+
+	return map[string]interface{}{
+		"Entries":  entries[start:end],
+		"Total":    total,
+		"Page":     page,
+		"Pages":    pages,
+		"PrevPage": page - 1,
+		"NextPage": page + 1,
+		"Filter":   filter,
+		"Error":    loadError,
+	}
+}
+
+// conntrackFilterFromRequest reads the filter from the query or form
+func conntrackFilterFromRequest(r *http.Request) models.ConntrackFilter {
+	filter := models.ConntrackFilter{
+		Protocol: strings.TrimSpace(r.FormValue("protocol")),
+		State:    strings.TrimSpace(r.FormValue("state")),
+		Address:  strings.TrimSpace(r.FormValue("address")),
+		Port:     strings.TrimSpace(r.FormValue("port")),
+		Mark:     strings.TrimSpace(r.FormValue("mark")),
+	}
+	if family := r.FormValue("family"); family != "" {
+		filter.Family = models.ParseIPFamily(family)
+	}
+	return filter
+}
+
+// conntrackFilterQuery encodes a filter for the audit log
+func conntrackFilterQuery(filter models.ConntrackFilter) string {
+	values := url.Values{}
+	for key, value := range map[string]string{
+		"family":   string(filter.Family),
+		"protocol": filter.Protocol,
+		"state":    filter.State,
+		"address":  filter.Address,
+		"port":     filter.Port,
+		"mark":     filter.Mark,
+	} {
+		if value != "" {
+			values.Set(key, value)
+		}
+	}
+	return values.Encode()
+}
+
+// DeleteEntry removes a single entry identified by its original tuple
+func (h *ConntrackHandler) DeleteEntry(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUser(r)
+	query := r.URL.Query()
+
+	proto, err := strconv.ParseUint(query.Get("proto"), 10, 8)
+	if err != nil {
+		h.renderAlert(w, "error", "Invalid protocol")
+		return
+	}
+	sport, _ := strconv.ParseUint(query.Get("sport"), 10, 16)
+	dport, _ := strconv.ParseUint(query.Get("dport"), 10, 16)
+
+	entry := models.ConntrackEntry{
+		ProtocolNum: uint8(proto),
+		Original: models.ConntrackTuple{
+			Source:      query.Get("src"),
+			Destination: query.Get("dst"),
+			SPort:       uint16(sport),
+			DPort:       uint16(dport),
+		},
+	}
+	if entry.Original.Source == "" || entry.Original.Destination == "" {
+		h.renderAlert(w, "error", "Source and destination are required")
+		return
+	}
+
+	deleted, err := h.conntrackService.Delete(entry)
+	if err != nil {
+		log.Printf("Failed to delete conntrack entry: %v", err)
+		h.renderAlert(w, "error", "Failed to delete entry: "+err.Error())
+		return
+	}
+	if deleted == 0 {
+		h.renderAlert(w, "error", "Entry not found, it may have expired")
+		return
+	}
+
+	h.userService.LogAction(&user.ID, "conntrack_delete",
+		"Protocol: "+query.Get("proto")+", Source: "+services.ConntrackEndpoint(entry.Original.Source, entry.Original.SPort)+
+			", Destination: "+services.ConntrackEndpoint(entry.Original.Destination, entry.Original.DPort), getClientIP(r))
+	h.renderAlert(w, "success", "Connection entry deleted")
+}
+
+// Flush removes all entries matching the submitted filter
+func (h *ConntrackHandler) Flush(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUser(r)
+
+	if err := r.ParseForm(); err != nil {
+		h.renderAlert(w, "error", "Invalid form data")
+		return
+	}
+
+	filter := conntrackFilterFromRequest(r)
+	deleted, err := h.conntrackService.Flush(filter)
+	if err != nil {
+		log.Printf("Failed to flush conntrack entries: %v", err)
+		h.renderAlert(w, "error", "Failed to flush entries: "+err.Error())
+		return
+	}
+
+	details := "Filter: " + conntrackFilterQuery(filter)
+	if filter.IsEmpty() {
+		details = "Filter: none"
+	}
+	h.userService.LogAction(&user.ID, "conntrack_flush",
+		details+", Deleted: "+strconv.FormatUint(uint64(deleted), 10), getClientIP(r))
+	h.renderAlert(w, "success", "Flushed "+strconv.FormatUint(uint64(deleted), 10)+" connection entries")
+}
+
+func (h *ConntrackHandler) renderAlert(w http.ResponseWriter, alertType, message string) {
+	if alertType == "success" {
+		w.Header().Set("HX-Trigger", "refresh")
+	}
+	data := map[string]interface{}{
+		"Type":    alertType,
+		"Message": message,
+	}
+	h.templates.ExecuteTemplate(w, "alert.html", data)
+}
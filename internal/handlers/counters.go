@@ -0,0 +1,139 @@
+package handlers
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"linuxtorouter/internal/middleware"
+	"linuxtorouter/internal/models"
+	"linuxtorouter/internal/services"
+)
+
+// The graphs are drawn in a counterGraphWidth x counterGraphHeight viewBox
+// and stretched to the width of the page
+const (
+	counterGraphWidth  = 600
+	counterGraphHeight = 60
+)
+
+type CounterHandler struct {
+	templates      TemplateExecutor
+	counterService *services.RuleCounterService
+}
+
+func NewCounterHandler(templates TemplateExecutor, counterService *services.RuleCounterService) *CounterHandler {
+	return &CounterHandler{
+		templates:      templates,
+		counterService: counterService,
+	}
+}
+
+// counterGraph is a series with the SVG shapes of its byte rate
+type counterGraph struct {
+	models.CounterSeries
+	// Line and Area are the points of the rate polyline and of the filled
+	// polygon below it
+	Line string
+	Area string
+}
+
+func (h *CounterHandler) List(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUser(r)
+
+	data := h.graphsData(r)
+	data["Title"] = "Rule Traffic"
+	data["ActivePage"] = "firewall"
+	data["User"] = user
+	data["Families"] = models.IPFamilies
+	data["Tables"] = []string{"filter", "nat", "mangle", "raw"}
+	data["Ranges"] = models.CounterRanges
+
+	if err := h.templates.ExecuteTemplate(w, "firewall_counters.html", data); err != nil {
+		log.Printf("Template error: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	}
+}
+
+func (h *CounterHandler) GetGraphs(w http.ResponseWriter, r *http.Request) {
+	if err := h.templates.ExecuteTemplate(w, "firewall_counter_graphs.html", h.graphsData(r)); err != nil {
+		log.Printf("Template error: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	}
+}
+
+// graphsData loads the chain graphs of a table, or the rule graphs of one
+// chain when the request names it
+func (h *CounterHandler) graphsData(r *http.Request) map[string]interface{} {
+	family := models.ParseIPFamily(r.URL.Query().Get("family"))
+	table := r.URL.Query().Get("table")
+	switch table {
+	case "filter", "nat", "mangle", "raw":
+	default:
+		table = "filter"
+	}
+	chain := r.URL.Query().Get("chain")
+	rangeName, _, step := services.CounterRange(r.URL.Query().Get("range"))
+
+	var series []models.CounterSeries
+	var err error
+	if chain != "" {
+		series, err = h.counterService.RuleSeries(family, table, chain, rangeName)
+	} else {
+		series, err = h.counterService.ChainSeries(family, table, rangeName)
+	}
+
+	var loadError string
+	if err != nil {
+		log.Printf("Failed to read rule counters: %v", err)
+		loadError = err.Error()
+	}
+
+	// All graphs of a page share the scale of the busiest one
+	var peak uint64
+	for _, s := range series {
+		if s.PeakRate > peak {
+			peak = s.PeakRate
+		}
+	}
+	graphs := make([]counterGraph, len(series))
+	for i, s := range series {
+		graphs[i] = newCounterGraph(s, peak)
+	}
+
+	return map[string]interface{}{
+		"Family":    family,
+		"Table":     table,
+		"Chain":     chain,
+		"Range":     rangeName,
+		"StepLabel": step.String(),
+		"Graphs":    graphs,
+		"Error":     loadError,
+	}
+}
+
+// newCounterGraph scales the byte rate of a series so that peak reaches the
+// top of the graph
+func newCounterGraph(s models.CounterSeries, peak uint64) counterGraph {
+	graph := counterGraph{CounterSeries: s}
+	n := len(s.Samples)
+	if n == 0 {
+		return graph
+	}
+
+	seconds := uint64(s.Step.Seconds())
+	points := make([]string, n)
+	for i, sample := range s.Samples {
+		x := float64(i) * counterGraphWidth / float64(max(n-1, 1))
+		y := float64(counterGraphHeight)
+		if peak > 0 {
+			y -= float64(sample.Bytes/seconds) * (counterGraphHeight - 2) / float64(peak)
+		}
+		points[i] = strconv.FormatFloat(x, 'f', 1, 64) + "," + strconv.FormatFloat(y, 'f', 1, 64)
+	}
+	graph.Line = strings.Join(points, " ")
+	graph.Area = "0," + strconv.Itoa(counterGraphHeight) + " " + graph.Line + " " +
+		strconv.Itoa(counterGraphWidth) + "," + strconv.Itoa(counterGraphHeight)
+	return graph
+}
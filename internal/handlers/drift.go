@@ -0,0 +1,81 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"net/http"
+
+	"linuxtorouter/internal/middleware"
+	"linuxtorouter/internal/models"
+	"linuxtorouter/internal/services"
+)
+
+// Drift shows how the running rules differ from the saved rules file that
+// is restored at boot
+func (h *FirewallHandler) Drift(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUser(r)
+	family := models.ParseIPFamily(r.URL.Query().Get("family"))
+
+	data := h.driftData(family)
+	data["Title"] = "Unsaved Changes"
+	data["ActivePage"] = "firewall"
+	data["User"] = user
+	data["Families"] = models.IPFamilies
+
+	if err := h.templates.ExecuteTemplate(w, "firewall_drift.html", data); err != nil {
+		log.Printf("Template error: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	}
+}
+
+func (h *FirewallHandler) GetDrift(w http.ResponseWriter, r *http.Request) {
+	family := models.ParseIPFamily(r.URL.Query().Get("family"))
+
+	if err := h.templates.ExecuteTemplate(w, "firewall_drift_table.html", h.driftData(family)); err != nil {
+		log.Printf("Template error: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	}
+}
+
+// driftData compares the running and saved rules of a family
+func (h *FirewallHandler) driftData(family models.IPFamily) map[string]interface{} {
+	var loadError string
+	drift, err := h.driftService.Drift(family)
+	if err != nil {
+		log.Printf("Failed to compare rules: %v", err)
+		loadError = err.Error()
+		if errors.Is(err, services.ErrNotSupported) {
+			loadError = "comparing with the saved rules requires the iptables backend"
+		}
+	}
+
+	return map[string]interface{}{
+		"Family": family,
+		"Drift":  drift,
+		"Error":  loadError,
+	}
+}
+
+// DriftBadge renders the nav badge linking to the first family whose
+// running rules differ from the saved ones, or nothing
+func (h *FirewallHandler) DriftBadge(w http.ResponseWriter, r *http.Request) {
+	data := map[string]interface{}{}
+	for _, family := range models.IPFamilies {
+		drift, err := h.driftService.Drift(family)
+		if err != nil {
+			if !errors.Is(err, services.ErrNotSupported) {
+				log.Printf("Failed to compare %s rules: %v", family, err)
+			}
+			continue
+		}
+		if drift.Differs() {
+			data["Family"] = family
+			break
+		}
+	}
+
+	if err := h.templates.ExecuteTemplate(w, "firewall_drift_badge.html", data); err != nil {
+		log.Printf("Template error: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	}
+}
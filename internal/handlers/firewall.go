@@ -5,6 +5,7 @@ import (
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 
 	"linuxtorouter/internal/auth"
 	"linuxtorouter/internal/middleware"
@@ -15,33 +16,59 @@ import (
 )
 
 type FirewallHandler struct {
-	templates       TemplateExecutor
-	iptablesService *services.IPTablesService
-	userService     *auth.UserService
+	templates          TemplateExecutor
+	firewallService    services.FirewallBackend
+	portForwardService *services.PortForwardService
+	objectService      *services.FirewallObjectService
+	zoneService        *services.ZoneService
+	traceService       *services.TraceService
+	analysisService    *services.RuleAnalysisService
+	packetLogService   *services.PacketLogService
+	scheduleService    *services.RuleScheduleService
+	counterService     *services.RuleCounterService
+	importService      *services.RuleImportService
+	driftService       *services.RuleDriftService
+	userService        *auth.UserService
 }
 
-func NewFirewallHandler(templates TemplateExecutor, iptablesService *services.IPTablesService, userService *auth.UserService) *FirewallHandler {
+func NewFirewallHandler(templates TemplateExecutor, firewallService services.FirewallBackend, portForwardService *services.PortForwardService, objectService *services.FirewallObjectService, zoneService *services.ZoneService, traceService *services.TraceService, analysisService *services.RuleAnalysisService, packetLogService *services.PacketLogService, scheduleService *services.RuleScheduleService, counterService *services.RuleCounterService, importService *services.RuleImportService, driftService *services.RuleDriftService, userService *auth.UserService) *FirewallHandler {
 	return &FirewallHandler{
-		templates:       templates,
-		iptablesService: iptablesService,
-		userService:     userService,
+		templates:          templates,
+		firewallService:    firewallService,
+		portForwardService: portForwardService,
+		objectService:      objectService,
+		zoneService:        zoneService,
+		traceService:       traceService,
+		analysisService:    analysisService,
+		packetLogService:   packetLogService,
+		scheduleService:    scheduleService,
+		counterService:     counterService,
+		importService:      importService,
+		driftService:       driftService,
+		userService:        userService,
 	}
 }
 
 func (h *FirewallHandler) List(w http.ResponseWriter, r *http.Request) {
 	user := middleware.GetUser(r)
+	family := models.ParseIPFamily(r.URL.Query().Get("family"))
 	table := r.URL.Query().Get("table")
 	selectedChainName := r.URL.Query().Get("chain")
 	if table == "" {
 		table = "filter"
 	}
 
-	chains, err := h.iptablesService.ListChains(table)
+	chains, err := h.firewallService.ListChains(family, table)
 	if err != nil {
 		log.Printf("Failed to list chains: %v", err)
 		chains = []models.ChainInfo{}
 	}
 
+	objects, err := h.objectService.LoadObjects()
+	if err != nil {
+		log.Printf("Failed to load firewall objects: %v", err)
+	}
+
 	// Separate system chains from custom chains based on table
 	systemChainNames := getSystemChains(table)
 	var systemChains []models.ChainInfo
@@ -66,7 +93,17 @@ func (h *FirewallHandler) List(w http.ResponseWriter, r *http.Request) {
 		"SelectedChain":     selectedChain,
 		"SelectedChainName": selectedChainName,
 		"CurrentTable":      table,
+		"Family":            family,
+		"Families":          models.IPFamilies,
+		"Backend":           h.firewallService.Name(),
 		"Tables":            []string{"filter", "nat", "mangle", "raw"},
+		"Pending":           h.firewallService.PendingChange(),
+		"Objects":           objects,
+		"NewRule":           models.FirewallRuleInput{},
+		"LogLevels":         models.LogLevels,
+		"HashLimitModes":    models.HashLimitModes,
+		"RecentActions":     models.RecentActions,
+		"NFLogGroup":        h.packetLogService.Group(),
 	}
 
 	if err := h.templates.ExecuteTemplate(w, "firewall.html", data); err != nil {
@@ -75,6 +112,33 @@ func (h *FirewallHandler) List(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// Analysis lists shadowed and duplicate rules and other problems of a table
+func (h *FirewallHandler) Analysis(w http.ResponseWriter, r *http.Request) {
+	family := models.ParseIPFamily(r.URL.Query().Get("family"))
+	table := r.URL.Query().Get("table")
+	if table == "" {
+		table = "filter"
+	}
+
+	warnings, err := h.analysisService.Analyze(family, table)
+	if err != nil {
+		// The rules view reports the same error
+		log.Printf("Failed to analyze rules: %v", err)
+		return
+	}
+
+	data := map[string]interface{}{
+		"Warnings":     warnings,
+		"CurrentTable": table,
+		"Family":       family,
+	}
+
+	if err := h.templates.ExecuteTemplate(w, "firewall_analysis.html", data); err != nil {
+		log.Printf("Template error: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	}
+}
+
 // getSystemChains returns the built-in chain names for each iptables table
 func getSystemChains(table string) []string {
 	switch table {
@@ -102,6 +166,7 @@ func isSystemChain(name string, systemChains []string) bool {
 }
 
 func (h *FirewallHandler) GetRules(w http.ResponseWriter, r *http.Request) {
+	family := models.ParseIPFamily(r.URL.Query().Get("family"))
 	table := r.URL.Query().Get("table")
 	selectedChainName := r.URL.Query().Get("chain")
 
@@ -109,7 +174,7 @@ func (h *FirewallHandler) GetRules(w http.ResponseWriter, r *http.Request) {
 		table = "filter"
 	}
 
-	chains, err := h.iptablesService.ListChains(table)
+	chains, err := h.firewallService.ListChains(family, table)
 	if err != nil {
 		log.Printf("Failed to list chains: %v", err)
 		h.renderAlert(w, "error", "Failed to get rules: "+err.Error())
@@ -136,6 +201,7 @@ func (h *FirewallHandler) GetRules(w http.ResponseWriter, r *http.Request) {
 		"SelectedChain":     selectedChain,
 		"SelectedChainName": selectedChainName,
 		"CurrentTable":      table,
+		"Family":            family,
 	}
 
 	if err := h.templates.ExecuteTemplate(w, "firewall_table.html", data); err != nil {
@@ -152,9 +218,50 @@ func (h *FirewallHandler) AddRule(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	input := ruleInputFromForm(r)
+	if input.Table == "" {
+		input.Table = "filter"
+	}
+	// Send NFLOG packets to the packet log unless another group is set
+	if input.Target == "NFLOG" && input.NFLogGroup == "" {
+		input.NFLogGroup = strconv.Itoa(h.packetLogService.Group())
+	}
+	if input.Chain == "" || input.Target == "" {
+		h.renderAlert(w, "error", "Chain and target are required")
+		return
+	}
+
+	details := "Family: " + string(input.Family) + ", Table: " + input.Table + ", Chain: " + input.Chain + ", Target: " + input.Target
+	change := "Add rule (" + details + ")"
+	timeout, ok := h.armSafeApply(w, r, change)
+	if !ok {
+		return
+	}
+
+	if input.UsesObjects() {
+		id, err := h.objectService.AddRule(input)
+		if err != nil {
+			log.Printf("Failed to add object rule: %v", err)
+			h.renderAlert(w, "error", "Failed to add rule: "+err.Error()+h.disarmSafeApply(r, timeout, change))
+			return
+		}
+		details += ", Object Rule: " + strconv.FormatInt(id, 10) + ", Objects: " + ruleObjects(input)
+	} else if err := h.firewallService.AddRule(input); err != nil {
+		log.Printf("Failed to add rule: %v", err)
+		h.renderAlert(w, "error", "Failed to add rule: "+err.Error()+h.disarmSafeApply(r, timeout, change))
+		return
+	}
+
+	h.userService.LogAction(&user.ID, "firewall_add_rule", details, getClientIP(r))
+	h.renderAlert(w, "success", "Rule added successfully"+safeApplySuffix(timeout))
+}
+
+// ruleInputFromForm reads the rule form shared by the add and edit dialogs
+func ruleInputFromForm(r *http.Request) models.FirewallRuleInput {
 	position, _ := strconv.Atoi(r.FormValue("position"))
 
-	input := models.FirewallRuleInput{
+	return models.FirewallRuleInput{
+		Family:        models.ParseIPFamily(r.FormValue("family")),
 		Table:         r.FormValue("table"),
 		Chain:         r.FormValue("chain"),
 		Position:      position,
@@ -170,25 +277,191 @@ func (h *FirewallHandler) AddRule(w http.ResponseWriter, r *http.Request) {
 		ToSource:      strings.TrimSpace(r.FormValue("to_source")),
 		State:         r.FormValue("state"),
 		Comment:       strings.TrimSpace(r.FormValue("comment")),
+		MatchSet:      strings.TrimSpace(r.FormValue("match_set")),
+		MatchSetDir:   r.FormValue("match_set_dir"),
+		LogPrefix:     strings.TrimSpace(r.FormValue("log_prefix")),
+		LogLevel:      r.FormValue("log_level"),
+		NFLogGroup:    strings.TrimSpace(r.FormValue("nflog_group")),
+
+		Limit:          strings.TrimSpace(r.FormValue("limit")),
+		LimitBurst:     strings.TrimSpace(r.FormValue("limit_burst")),
+		HashLimit:      strings.TrimSpace(r.FormValue("hashlimit")),
+		HashLimitBurst: strings.TrimSpace(r.FormValue("hashlimit_burst")),
+		HashLimitMode:  strings.TrimSpace(r.FormValue("hashlimit_mode")),
+		HashLimitName:  strings.TrimSpace(r.FormValue("hashlimit_name")),
+		HashLimitAbove: r.FormValue("hashlimit_match") == "above",
+		ConnLimit:      strings.TrimSpace(r.FormValue("connlimit")),
+		ConnLimitMask:  strings.TrimSpace(r.FormValue("connlimit_mask")),
+		RecentName:     strings.TrimSpace(r.FormValue("recent_name")),
+		RecentAction:   r.FormValue("recent_action"),
+		RecentSeconds:  strings.TrimSpace(r.FormValue("recent_seconds")),
+		RecentHitCount: strings.TrimSpace(r.FormValue("recent_hitcount")),
+		TimeStart:      strings.TrimSpace(r.FormValue("time_start")),
+		TimeStop:       strings.TrimSpace(r.FormValue("time_stop")),
+		Weekdays:       strings.TrimSpace(r.FormValue("weekdays")),
+		DateStart:      strings.TrimSpace(r.FormValue("date_start")),
+		DateStop:       strings.TrimSpace(r.FormValue("date_stop")),
+		KernelTZ:       r.FormValue("kernel_tz") == "on",
+
+		SourceObject:      r.FormValue("source_object"),
+		DestinationObject: r.FormValue("destination_object"),
+		ServiceObject:     r.FormValue("service_object"),
+	}
+}
+
+// ruleObjects lists the objects a rule references for the audit log
+func ruleObjects(input models.FirewallRuleInput) string {
+	var refs []string
+	for _, ref := range []struct{ name, value string }{
+		{"source", input.SourceObject},
+		{"destination", input.DestinationObject},
+		{"service", input.ServiceObject},
+	} {
+		if ref.value != "" {
+			refs = append(refs, ref.name+"="+ref.value)
+		}
+	}
+	return strings.Join(refs, " ")
+}
+
+// EditRuleForm renders the edit dialog of a rule, pre-filled from its
+// current specification
+func (h *FirewallHandler) EditRuleForm(w http.ResponseWriter, r *http.Request) {
+	ruleNum, err := strconv.Atoi(chi.URLParam(r, "num"))
+	if err != nil {
+		h.renderAlert(w, "error", "Invalid rule number")
+		return
+	}
+
+	family := models.ParseIPFamily(r.URL.Query().Get("family"))
+	table := r.URL.Query().Get("table")
+	chain := r.URL.Query().Get("chain")
+
+	if table == "" {
+		table = "filter"
+	}
+	if chain == "" {
+		h.renderAlert(w, "error", "Chain is required")
+		return
+	}
+
+	input, unsupported, err := h.firewallService.RuleInput(family, table, chain, ruleNum)
+	if err != nil {
+		log.Printf("Failed to load rule: %v", err)
+		h.renderAlert(w, "error", "Failed to load rule: "+err.Error())
+		return
+	}
+
+	// Rules rendered from an object rule are edited as that rule
+	var objectRuleID int64
+	if id, ok := services.ObjectRuleID(input.Comment); ok {
+		rule, err := h.objectService.GetRule(id)
+		if err != nil {
+			log.Printf("Failed to load object rule: %v", err)
+			h.renderAlert(w, "error", "Failed to load rule: "+err.Error())
+			return
+		}
+		objectRuleID = id
+		input = &rule.Input
+		unsupported = nil
+	}
+
+	objects, err := h.objectService.LoadObjects()
+	if err != nil {
+		log.Printf("Failed to load firewall objects: %v", err)
+	}
+
+	data := map[string]interface{}{
+		"Num":            ruleNum,
+		"Rule":           input,
+		"Unsupported":    unsupported,
+		"ObjectRuleID":   objectRuleID,
+		"Objects":        objects,
+		"LogLevels":      models.LogLevels,
+		"HashLimitModes": models.HashLimitModes,
+		"RecentActions":  models.RecentActions,
+		"NFLogGroup":     h.packetLogService.Group(),
+	}
+
+	if err := h.templates.ExecuteTemplate(w, "firewall_rule_edit.html", data); err != nil {
+		log.Printf("Template error: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 	}
+}
 
+// UpdateRule replaces a rule in place, keeping its position and counters
+func (h *FirewallHandler) UpdateRule(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUser(r)
+	ruleNumStr := chi.URLParam(r, "num")
+	ruleNum, err := strconv.Atoi(ruleNumStr)
+	if err != nil {
+		h.renderAlert(w, "error", "Invalid rule number")
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		h.renderAlert(w, "error", "Invalid form data")
+		return
+	}
+
+	input := ruleInputFromForm(r)
 	if input.Table == "" {
 		input.Table = "filter"
 	}
+	// Send NFLOG packets to the packet log unless another group is set
+	if input.Target == "NFLOG" && input.NFLogGroup == "" {
+		input.NFLogGroup = strconv.Itoa(h.packetLogService.Group())
+	}
 	if input.Chain == "" || input.Target == "" {
 		h.renderAlert(w, "error", "Chain and target are required")
 		return
 	}
 
-	if err := h.iptablesService.AddRule(input); err != nil {
-		log.Printf("Failed to add rule: %v", err)
-		h.renderAlert(w, "error", "Failed to add rule: "+err.Error())
+	before, unsupported, err := h.firewallService.RuleInput(input.Family, input.Table, input.Chain, ruleNum)
+	if err != nil {
+		log.Printf("Failed to load rule: %v", err)
+		h.renderAlert(w, "error", "Failed to update rule: "+err.Error())
+		return
+	}
+	beforeSpec := strings.Join(append([]string{services.FormatRuleInput(*before)}, unsupported...), " ")
+
+	details := "Family: " + string(input.Family) + ", Table: " + input.Table + ", Chain: " + input.Chain + ", Rule: " + ruleNumStr
+	change := "Edit rule (" + details + ")"
+	timeout, ok := h.armSafeApply(w, r, change)
+	if !ok {
+		return
+	}
+
+	objectRuleID, isObjectRule := services.ObjectRuleID(before.Comment)
+	switch {
+	case isObjectRule:
+		err = h.objectService.UpdateRule(objectRuleID, input)
+		details += ", Object Rule: " + strconv.FormatInt(objectRuleID, 10)
+	case input.UsesObjects():
+		// A plain rule that now references objects becomes an object rule.
+		// Its rules go in right after the old one, which is then removed.
+		input.Position = ruleNum + 1
+		var id int64
+		if id, err = h.objectService.AddRule(input); err == nil {
+			err = h.firewallService.DeleteRule(input.Family, input.Table, input.Chain, ruleNum)
+			details += ", Object Rule: " + strconv.FormatInt(id, 10)
+		}
+	default:
+		err = h.firewallService.ReplaceRule(ruleNum, input)
+	}
+	if err != nil {
+		log.Printf("Failed to update rule: %v", err)
+		h.renderAlert(w, "error", "Failed to update rule: "+err.Error()+h.disarmSafeApply(r, timeout, change))
 		return
 	}
 
-	h.userService.LogAction(&user.ID, "firewall_add_rule",
-		"Table: "+input.Table+", Chain: "+input.Chain+", Target: "+input.Target, getClientIP(r))
-	h.renderAlert(w, "success", "Rule added successfully")
+	after := services.FormatRuleInput(input)
+	if input.UsesObjects() {
+		after += " objects " + ruleObjects(input)
+	}
+	h.userService.LogAction(&user.ID, "firewall_edit_rule",
+		details+", Before: "+beforeSpec+", After: "+after, getClientIP(r))
+	h.renderAlert(w, "success", "Rule updated successfully"+safeApplySuffix(timeout))
 }
 
 func (h *FirewallHandler) DeleteRule(w http.ResponseWriter, r *http.Request) {
@@ -200,6 +473,7 @@ func (h *FirewallHandler) DeleteRule(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	family := models.ParseIPFamily(r.URL.Query().Get("family"))
 	table := r.URL.Query().Get("table")
 	chain := r.URL.Query().Get("chain")
 
@@ -211,15 +485,36 @@ func (h *FirewallHandler) DeleteRule(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := h.iptablesService.DeleteRule(table, chain, ruleNum); err != nil {
+	details := "Family: " + string(family) + ", Table: " + table + ", Chain: " + chain + ", Rule: " + ruleNumStr
+	change := "Delete rule (" + details + ")"
+	timeout, ok := h.armSafeApply(w, r, change)
+	if !ok {
+		return
+	}
+
+	// Deleting a rule rendered from an object rule deletes all of them
+	if rule, _, err := h.firewallService.RuleInput(family, table, chain, ruleNum); err == nil {
+		if id, ok := services.ObjectRuleID(rule.Comment); ok {
+			if err := h.objectService.DeleteRule(id); err != nil {
+				log.Printf("Failed to delete object rule: %v", err)
+				h.renderAlert(w, "error", "Failed to delete rule: "+err.Error()+h.disarmSafeApply(r, timeout, change))
+				return
+			}
+			h.userService.LogAction(&user.ID, "firewall_delete_rule",
+				details+", Object Rule: "+strconv.FormatInt(id, 10), getClientIP(r))
+			h.renderAlert(w, "success", "Rule deleted successfully"+safeApplySuffix(timeout))
+			return
+		}
+	}
+
+	if err := h.firewallService.DeleteRule(family, table, chain, ruleNum); err != nil {
 		log.Printf("Failed to delete rule: %v", err)
-		h.renderAlert(w, "error", "Failed to delete rule: "+err.Error())
+		h.renderAlert(w, "error", "Failed to delete rule: "+err.Error()+h.disarmSafeApply(r, timeout, change))
 		return
 	}
 
-	h.userService.LogAction(&user.ID, "firewall_delete_rule",
-		"Table: "+table+", Chain: "+chain+", Rule: "+ruleNumStr, getClientIP(r))
-	h.renderAlert(w, "success", "Rule deleted successfully")
+	h.userService.LogAction(&user.ID, "firewall_delete_rule", details, getClientIP(r))
+	h.renderAlert(w, "success", "Rule deleted successfully"+safeApplySuffix(timeout))
 }
 
 func (h *FirewallHandler) MoveRule(w http.ResponseWriter, r *http.Request) {
@@ -236,6 +531,7 @@ func (h *FirewallHandler) MoveRule(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	family := models.ParseIPFamily(r.FormValue("family"))
 	table := r.FormValue("table")
 	chain := r.FormValue("chain")
 	direction := r.FormValue("direction")
@@ -243,9 +539,20 @@ func (h *FirewallHandler) MoveRule(w http.ResponseWriter, r *http.Request) {
 	if table == "" {
 		table = "filter"
 	}
+	if chain == "" {
+		h.renderAlert(w, "error", "Chain is required")
+		return
+	}
 
+	// An explicit target position (drag and drop) takes precedence over a direction
 	var newPos int
-	if direction == "up" {
+	if to := r.FormValue("to"); to != "" {
+		newPos, err = strconv.Atoi(to)
+		if err != nil {
+			h.renderAlert(w, "error", "Invalid target position")
+			return
+		}
+	} else if direction == "up" {
 		newPos = ruleNum - 1
 	} else {
 		newPos = ruleNum + 1
@@ -256,15 +563,21 @@ func (h *FirewallHandler) MoveRule(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := h.iptablesService.MoveRule(table, chain, ruleNum, newPos); err != nil {
+	details := "Family: " + string(family) + ", Table: " + table + ", Chain: " + chain + ", From: " + ruleNumStr + ", To: " + strconv.Itoa(newPos)
+	change := "Move rule (" + details + ")"
+	timeout, ok := h.armSafeApply(w, r, change)
+	if !ok {
+		return
+	}
+
+	if err := h.firewallService.MoveRule(family, table, chain, ruleNum, newPos); err != nil {
 		log.Printf("Failed to move rule: %v", err)
-		h.renderAlert(w, "error", "Failed to move rule: "+err.Error())
+		h.renderAlert(w, "error", "Failed to move rule: "+err.Error()+h.disarmSafeApply(r, timeout, change))
 		return
 	}
 
-	h.userService.LogAction(&user.ID, "firewall_move_rule",
-		"Table: "+table+", Chain: "+chain+", From: "+ruleNumStr+", Direction: "+direction, getClientIP(r))
-	h.renderAlert(w, "success", "Rule moved successfully")
+	h.userService.LogAction(&user.ID, "firewall_move_rule", details, getClientIP(r))
+	h.renderAlert(w, "success", "Rule moved successfully"+safeApplySuffix(timeout))
 }
 
 func (h *FirewallHandler) CreateChain(w http.ResponseWriter, r *http.Request) {
@@ -275,6 +588,7 @@ func (h *FirewallHandler) CreateChain(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	family := models.ParseIPFamily(r.FormValue("family"))
 	table := r.FormValue("table")
 	chain := strings.TrimSpace(r.FormValue("chain"))
 
@@ -286,34 +600,35 @@ func (h *FirewallHandler) CreateChain(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := h.iptablesService.CreateChain(table, chain); err != nil {
+	if err := h.firewallService.CreateChain(family, table, chain); err != nil {
 		log.Printf("Failed to create chain: %v", err)
 		h.renderAlert(w, "error", "Failed to create chain: "+err.Error())
 		return
 	}
 
 	h.userService.LogAction(&user.ID, "firewall_create_chain",
-		"Table: "+table+", Chain: "+chain, getClientIP(r))
+		"Family: "+string(family)+", Table: "+table+", Chain: "+chain, getClientIP(r))
 	h.renderAlert(w, "success", "Chain "+chain+" created successfully")
 }
 
 func (h *FirewallHandler) DeleteChain(w http.ResponseWriter, r *http.Request) {
 	user := middleware.GetUser(r)
 	chain := chi.URLParam(r, "name")
+	family := models.ParseIPFamily(r.URL.Query().Get("family"))
 	table := r.URL.Query().Get("table")
 
 	if table == "" {
 		table = "filter"
 	}
 
-	if err := h.iptablesService.DeleteChain(table, chain); err != nil {
+	if err := h.firewallService.DeleteChain(family, table, chain); err != nil {
 		log.Printf("Failed to delete chain: %v", err)
 		h.renderAlert(w, "error", "Failed to delete chain: "+err.Error())
 		return
 	}
 
 	h.userService.LogAction(&user.ID, "firewall_delete_chain",
-		"Table: "+table+", Chain: "+chain, getClientIP(r))
+		"Family: "+string(family)+", Table: "+table+", Chain: "+chain, getClientIP(r))
 	h.renderAlert(w, "success", "Chain "+chain+" deleted successfully")
 }
 
@@ -326,6 +641,7 @@ func (h *FirewallHandler) SetPolicy(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	family := models.ParseIPFamily(r.FormValue("family"))
 	table := r.FormValue("table")
 	policy := r.FormValue("policy")
 
@@ -333,27 +649,34 @@ func (h *FirewallHandler) SetPolicy(w http.ResponseWriter, r *http.Request) {
 		table = "filter"
 	}
 
-	if err := h.iptablesService.SetPolicy(table, chain, policy); err != nil {
+	details := "Family: " + string(family) + ", Table: " + table + ", Chain: " + chain + ", Policy: " + policy
+	change := "Set policy (" + details + ")"
+	timeout, ok := h.armSafeApply(w, r, change)
+	if !ok {
+		return
+	}
+
+	if err := h.firewallService.SetPolicy(family, table, chain, policy); err != nil {
 		log.Printf("Failed to set policy: %v", err)
-		h.renderAlert(w, "error", "Failed to set policy: "+err.Error())
+		h.renderAlert(w, "error", "Failed to set policy: "+err.Error()+h.disarmSafeApply(r, timeout, change))
 		return
 	}
 
-	h.userService.LogAction(&user.ID, "firewall_set_policy",
-		"Table: "+table+", Chain: "+chain+", Policy: "+policy, getClientIP(r))
-	h.renderAlert(w, "success", "Policy set to "+policy+" for chain "+chain)
+	h.userService.LogAction(&user.ID, "firewall_set_policy", details, getClientIP(r))
+	h.renderAlert(w, "success", "Policy set to "+policy+" for chain "+chain+safeApplySuffix(timeout))
 }
 
 func (h *FirewallHandler) SaveRules(w http.ResponseWriter, r *http.Request) {
 	user := middleware.GetUser(r)
+	family := models.ParseIPFamily(r.FormValue("family"))
 
-	if err := h.iptablesService.SaveRules(); err != nil {
+	if err := h.firewallService.SaveRules(family); err != nil {
 		log.Printf("Failed to save rules: %v", err)
 		h.renderAlert(w, "error", "Failed to save rules: "+err.Error())
 		return
 	}
 
-	h.userService.LogAction(&user.ID, "firewall_save", "", getClientIP(r))
+	h.userService.LogAction(&user.ID, "firewall_save", "Family: "+string(family), getClientIP(r))
 	h.renderAlert(w, "success", "Firewall rules saved successfully")
 }
 
@@ -365,6 +688,7 @@ func (h *FirewallHandler) FlushChain(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	family := models.ParseIPFamily(r.FormValue("family"))
 	table := r.FormValue("table")
 	chain := r.FormValue("chain")
 
@@ -372,19 +696,183 @@ func (h *FirewallHandler) FlushChain(w http.ResponseWriter, r *http.Request) {
 		table = "filter"
 	}
 
-	if err := h.iptablesService.FlushChain(table, chain); err != nil {
+	details := "Family: " + string(family) + ", Table: " + table + ", Chain: " + chain
+	change := "Flush (" + details + ")"
+	timeout, ok := h.armSafeApply(w, r, change)
+	if !ok {
+		return
+	}
+
+	if err := h.firewallService.FlushChain(family, table, chain); err != nil {
 		log.Printf("Failed to flush chain: %v", err)
-		h.renderAlert(w, "error", "Failed to flush chain: "+err.Error())
+		h.renderAlert(w, "error", "Failed to flush chain: "+err.Error()+h.disarmSafeApply(r, timeout, change))
+		return
+	}
+
+	target := "all chains"
+	if chain != "" {
+		target = "chain " + chain
+	}
+	h.userService.LogAction(&user.ID, "firewall_flush", details, getClientIP(r))
+	h.renderAlert(w, "success", "Flushed "+target+" in "+table+" table"+safeApplySuffix(timeout))
+}
+
+// ZeroCounters resets the packet and byte counters of a table, a chain or,
+// when num is given, a single rule
+func (h *FirewallHandler) ZeroCounters(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUser(r)
+
+	if err := r.ParseForm(); err != nil {
+		h.renderAlert(w, "error", "Invalid form data")
 		return
 	}
 
+	family := models.ParseIPFamily(r.FormValue("family"))
+	table := r.FormValue("table")
+	chain := r.FormValue("chain")
+	ruleNum := 0
+	if numStr := r.FormValue("num"); numStr != "" {
+		n, err := strconv.Atoi(numStr)
+		if err != nil || n < 1 || chain == "" {
+			h.renderAlert(w, "error", "Invalid rule number")
+			return
+		}
+		ruleNum = n
+	}
+
+	if table == "" {
+		table = "filter"
+	}
+
+	if err := h.counterService.ZeroCounters(family, table, chain, ruleNum); err != nil {
+		log.Printf("Failed to zero counters: %v", err)
+		h.renderAlert(w, "error", "Failed to zero counters: "+err.Error())
+		return
+	}
+
+	details := "Family: " + string(family) + ", Table: " + table
 	target := "all chains"
 	if chain != "" {
+		details += ", Chain: " + chain
 		target = "chain " + chain
 	}
-	h.userService.LogAction(&user.ID, "firewall_flush",
-		"Table: "+table+", Chain: "+chain, getClientIP(r))
-	h.renderAlert(w, "success", "Flushed "+target+" in "+table+" table")
+	if ruleNum > 0 {
+		details += ", Rule: " + strconv.Itoa(ruleNum)
+		target = "rule " + strconv.Itoa(ruleNum) + " of " + chain
+	}
+	h.userService.LogAction(&user.ID, "firewall_zero_counters", details, getClientIP(r))
+	h.renderAlert(w, "success", "Counters zeroed for "+target+" in "+table+" table")
+}
+
+// armSafeApply starts a commit-confirm window when the request carries a
+// confirm_timeout (in seconds). It returns the timeout (0 when safe-apply
+// was not requested) and false if an error alert was rendered.
+func (h *FirewallHandler) armSafeApply(w http.ResponseWriter, r *http.Request, description string) (int, bool) {
+	timeoutStr := strings.TrimSpace(r.FormValue("confirm_timeout"))
+	if timeoutStr == "" {
+		return 0, true
+	}
+
+	timeout, err := strconv.Atoi(timeoutStr)
+	if err != nil || timeout < 10 || timeout > 3600 {
+		h.renderAlert(w, "error", "Confirm timeout must be between 10 and 3600 seconds")
+		return 0, false
+	}
+
+	if err := h.firewallService.BeginSafeApply(time.Duration(timeout)*time.Second, description, h.logRollback); err != nil {
+		log.Printf("Failed to start safe apply: %v", err)
+		h.renderAlert(w, "error", "Failed to start safe apply: "+err.Error())
+		return 0, false
+	}
+
+	user := middleware.GetUser(r)
+	h.userService.LogAction(&user.ID, "firewall_safe_apply",
+		description+", Rollback in: "+timeoutStr+"s", getClientIP(r))
+
+	return timeout, true
+}
+
+// disarmSafeApply withdraws what armSafeApply started when the change it
+// was armed for failed. If the failed change still modified the ruleset the
+// rollback stays pending, which is recorded in the audit log; the returned
+// note tells the user so and is empty otherwise.
+func (h *FirewallHandler) disarmSafeApply(r *http.Request, timeout int, description string) string {
+	if timeout == 0 {
+		return ""
+	}
+	user := middleware.GetUser(r)
+
+	cancelled, err := h.firewallService.CancelSafeApply(description)
+	if err != nil {
+		log.Printf("Failed to cancel safe apply: %v", err)
+	}
+	if !cancelled {
+		h.userService.LogAction(&user.ID, "firewall_safe_apply_partial",
+			description+" (change failed part way, rollback still pending)", getClientIP(r))
+		return ". The change was partly applied: confirm it or roll it back"
+	}
+
+	h.userService.LogAction(&user.ID, "firewall_safe_apply_cancel", description+" (change failed)", getClientIP(r))
+	return ""
+}
+
+// logRollback records an automatic rollback in the audit log
+func (h *FirewallHandler) logRollback(change models.PendingFirewallChange, err error) {
+	details := strings.Join(change.Changes, "; ")
+	if err != nil {
+		log.Printf("Failed to roll back firewall changes: %v", err)
+		details += " (rollback failed: " + err.Error() + ")"
+	} else {
+		log.Printf("Firewall changes not confirmed, rolled back: %s", details)
+	}
+	h.userService.LogAction(nil, "firewall_rollback", details, "")
+}
+
+func safeApplySuffix(timeout int) string {
+	if timeout == 0 {
+		return ""
+	}
+	return ". Confirm within " + strconv.Itoa(timeout) + " seconds or it will be rolled back."
+}
+
+func (h *FirewallHandler) Pending(w http.ResponseWriter, r *http.Request) {
+	data := map[string]interface{}{
+		"Pending": h.firewallService.PendingChange(),
+	}
+
+	if err := h.templates.ExecuteTemplate(w, "firewall_pending.html", data); err != nil {
+		log.Printf("Template error: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	}
+}
+
+func (h *FirewallHandler) ConfirmChanges(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUser(r)
+
+	change, err := h.firewallService.ConfirmChanges()
+	if err != nil {
+		h.renderAlert(w, "error", "Failed to confirm changes: "+err.Error())
+		return
+	}
+
+	h.userService.LogAction(&user.ID, "firewall_confirm",
+		strings.Join(change.Changes, "; "), getClientIP(r))
+	h.renderAlert(w, "success", "Firewall changes confirmed")
+}
+
+func (h *FirewallHandler) RollbackChanges(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUser(r)
+
+	change, err := h.firewallService.RollbackChanges()
+	if err != nil {
+		log.Printf("Failed to roll back changes: %v", err)
+		h.renderAlert(w, "error", "Failed to roll back changes: "+err.Error())
+		return
+	}
+
+	h.userService.LogAction(&user.ID, "firewall_rollback",
+		strings.Join(change.Changes, "; "), getClientIP(r))
+	h.renderAlert(w, "success", "Firewall changes rolled back")
 }
 
 func (h *FirewallHandler) renderAlert(w http.ResponseWriter, alertType, message string) {
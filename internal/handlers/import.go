@@ -0,0 +1,123 @@
+package handlers
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"linuxtorouter/internal/middleware"
+	"linuxtorouter/internal/models"
+	"linuxtorouter/internal/services"
+)
+
+func (h *FirewallHandler) ImportPage(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUser(r)
+
+	data := map[string]interface{}{
+		"Title":      "Import Rules",
+		"ActivePage": "firewall",
+		"User":       user,
+		"Backend":    h.firewallService.Name(),
+		"Formats":    models.ImportFormats,
+		"Families":   models.IPFamilies,
+		"Family":     models.ParseIPFamily(r.URL.Query().Get("family")),
+	}
+
+	if err := h.templates.ExecuteTemplate(w, "firewall_import.html", data); err != nil {
+		log.Printf("Template error: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	}
+}
+
+// importFromForm reads the import form, taking the file content from the
+// upload if there is one and from the pasted text otherwise
+func importFromForm(r *http.Request) (models.ImportRequest, error) {
+	if err := r.ParseMultipartForm(32 << 20); err != nil && err != http.ErrNotMultipart {
+		return models.ImportRequest{}, errors.New("Invalid form data")
+	}
+
+	req := models.ImportRequest{
+		Format:  r.FormValue("format"),
+		Family:  models.ParseIPFamily(r.FormValue("family")),
+		Mode:    r.FormValue("mode"),
+		Content: r.FormValue("content"),
+		Running: r.FormValue("running"),
+	}
+	if file, _, err := r.FormFile("file"); err == nil {
+		defer file.Close()
+		var b strings.Builder
+		if _, err := io.Copy(&b, file); err != nil {
+			return req, errors.New("Failed to read file")
+		}
+		req.Content = b.String()
+	}
+	req.Content = strings.ReplaceAll(req.Content, "\r\n", "\n")
+
+	return req, nil
+}
+
+// importDetails describes an import for the audit log
+func importDetails(preview *models.ImportPreview) string {
+	return "Format: " + preview.Request.Format + ", Family: " + string(preview.Request.Family) +
+		", Mode: " + preview.Request.Mode + ", Tables: " + strings.Join(preview.Tables, " ") +
+		", Rules: " + strconv.Itoa(len(preview.Rules)) + ", Skipped: " + strconv.Itoa(len(preview.Skipped))
+}
+
+// PreviewImport converts an uploaded ruleset and renders the rules, the
+// parts that need manual review and the diff against the running rules
+func (h *FirewallHandler) PreviewImport(w http.ResponseWriter, r *http.Request) {
+	req, err := importFromForm(r)
+	if err != nil {
+		h.renderAlert(w, "error", err.Error())
+		return
+	}
+
+	preview, err := h.importService.Preview(req)
+	if err != nil {
+		log.Printf("Failed to preview import: %v", err)
+		h.renderAlert(w, "error", "Failed to convert rules: "+err.Error())
+		return
+	}
+
+	if err := h.templates.ExecuteTemplate(w, "firewall_import_preview.html", preview); err != nil {
+		log.Printf("Template error: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	}
+}
+
+// ApplyImport converts the previewed ruleset again and loads it in a single
+// iptables-restore transaction, unless the running rules changed since the
+// preview
+func (h *FirewallHandler) ApplyImport(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUser(r)
+
+	req, err := importFromForm(r)
+	if err != nil {
+		h.renderAlert(w, "error", err.Error())
+		return
+	}
+
+	change := "Import rules (Format: " + req.Format + ", Family: " + string(req.Family) + ")"
+	timeout, ok := h.armSafeApply(w, r, change)
+	if !ok {
+		return
+	}
+
+	preview, err := h.importService.Apply(req)
+	if err != nil {
+		log.Printf("Failed to import rules: %v", err)
+		if errors.Is(err, services.ErrNotSupported) {
+			h.renderAlert(w, "error", "Importing rules requires the iptables backend"+h.disarmSafeApply(r, timeout, change))
+			return
+		}
+		h.renderAlert(w, "error", "Failed to import rules: "+err.Error()+h.disarmSafeApply(r, timeout, change))
+		return
+	}
+
+	h.userService.LogAction(&user.ID, "firewall_import", importDetails(preview), getClientIP(r))
+	h.renderAlert(w, "success", "Imported "+strconv.Itoa(len(preview.Rules))+" rules into the "+
+		strings.Join(preview.Tables, ", ")+" tables"+safeApplySuffix(timeout))
+}
@@ -0,0 +1,272 @@
+package handlers
+
+import (
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"linuxtorouter/internal/auth"
+	"linuxtorouter/internal/middleware"
+	"linuxtorouter/internal/models"
+	"linuxtorouter/internal/services"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// ipsetEntryLimit caps the entries rendered on the set detail page
+const ipsetEntryLimit = 500
+
+type IPSetHandler struct {
+	templates    TemplateExecutor
+	ipsetService *services.IPSetService
+	userService  *auth.UserService
+}
+
+func NewIPSetHandler(templates TemplateExecutor, ipsetService *services.IPSetService, userService *auth.UserService) *IPSetHandler {
+	return &IPSetHandler{
+		templates:    templates,
+		ipsetService: ipsetService,
+		userService:  userService,
+	}
+}
+
+func (h *IPSetHandler) List(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUser(r)
+
+	var loadError string
+	sets, err := h.ipsetService.ListSets()
+	if err != nil {
+		log.Printf("Failed to list ipsets: %v", err)
+		loadError = err.Error()
+		sets = []models.IPSet{}
+	}
+
+	data := map[string]interface{}{
+		"Title":      "IP Sets",
+		"ActivePage": "firewall",
+		"User":       user,
+		"Sets":       sets,
+		"Types":      models.IPSetTypes,
+		"Error":      loadError,
+	}
+
+	if err := h.templates.ExecuteTemplate(w, "ipsets.html", data); err != nil {
+		log.Printf("Template error: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	}
+}
+
+func (h *IPSetHandler) GetSets(w http.ResponseWriter, r *http.Request) {
+	sets, err := h.ipsetService.ListSets()
+	if err != nil {
+		log.Printf("Failed to list ipsets: %v", err)
+		h.renderAlert(w, "error", "Failed to get ipsets: "+err.Error())
+		return
+	}
+
+	data := map[string]interface{}{
+		"Sets": sets,
+	}
+
+	if err := h.templates.ExecuteTemplate(w, "ipset_table.html", data); err != nil {
+		log.Printf("Template error: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	}
+}
+
+func (h *IPSetHandler) Detail(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUser(r)
+	name := chi.URLParam(r, "name")
+
+	var loadError string
+	set, err := h.ipsetService.GetSet(name)
+	if err != nil {
+		log.Printf("Failed to get ipset: %v", err)
+		loadError = err.Error()
+		set = &models.IPSet{Name: name}
+	}
+
+	data := map[string]interface{}{
+		"Title":      "IP Set " + name,
+		"ActivePage": "firewall",
+		"User":       user,
+		"Error":      loadError,
+	}
+	for k, v := range ipsetEntriesData(set, r.URL.Query().Get("q")) {
+		data[k] = v
+	}
+
+	if err := h.templates.ExecuteTemplate(w, "ipset_detail.html", data); err != nil {
+		log.Printf("Template error: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	}
+}
+
+func (h *IPSetHandler) GetEntries(w http.ResponseWriter, r *http.Request) {
+	set, err := h.ipsetService.GetSet(chi.URLParam(r, "name"))
+	if err != nil {
+		log.Printf("Failed to get ipset: %v", err)
+		h.renderAlert(w, "error", "Failed to get ipset: "+err.Error())
+		return
+	}
+
+	if err := h.templates.ExecuteTemplate(w, "ipset_entries.html", ipsetEntriesData(set, r.URL.Query().Get("q"))); err != nil {
+		log.Printf("Template error: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	}
+}
+
+// ipsetEntriesData filters a set's entries by a substring and caps them at
+// ipsetEntryLimit
+func ipsetEntriesData(set *models.IPSet, query string) map[string]interface{} {
+	query = strings.TrimSpace(query)
+	var entries []string
+	matched := 0
+	for _, entry := range set.Entries {
+		if query != "" && !strings.Contains(entry, query) {
+			continue
+		}
+		matched++
+		if len(entries) < ipsetEntryLimit {
+			entries = append(entries, entry)
+		}
+	}
+
+	return map[string]interface{}{
+		"Set":     set,
+		"Entries": entries,
+		"Matched": matched,
+		"Query":   query,
+	}
+}
+
+func (h *IPSetHandler) CreateSet(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUser(r)
+
+	if err := r.ParseForm(); err != nil {
+		h.renderAlert(w, "error", "Invalid form data")
+		return
+	}
+
+	name := strings.TrimSpace(r.FormValue("name"))
+	setType := r.FormValue("type")
+	family := models.ParseIPFamily(r.FormValue("family"))
+
+	if err := h.ipsetService.CreateSet(name, setType, family); err != nil {
+		log.Printf("Failed to create ipset: %v", err)
+		h.renderAlert(w, "error", "Failed to create ipset: "+err.Error())
+		return
+	}
+
+	h.userService.LogAction(&user.ID, "ipset_create",
+		"Name: "+name+", Type: "+setType+", Family: "+string(family), getClientIP(r))
+	h.renderAlert(w, "success", "IP set "+name+" created successfully")
+}
+
+func (h *IPSetHandler) DestroySet(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUser(r)
+	name := chi.URLParam(r, "name")
+
+	if err := h.ipsetService.DestroySet(name); err != nil {
+		log.Printf("Failed to destroy ipset: %v", err)
+		h.renderAlert(w, "error", "Failed to destroy ipset: "+err.Error())
+		return
+	}
+
+	h.userService.LogAction(&user.ID, "ipset_destroy", "Name: "+name, getClientIP(r))
+	h.renderAlert(w, "success", "IP set "+name+" destroyed")
+}
+
+func (h *IPSetHandler) AddEntry(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUser(r)
+	name := chi.URLParam(r, "name")
+
+	if err := r.ParseForm(); err != nil {
+		h.renderAlert(w, "error", "Invalid form data")
+		return
+	}
+
+	entry := strings.TrimSpace(r.FormValue("entry"))
+	if err := h.ipsetService.AddEntry(name, entry); err != nil {
+		log.Printf("Failed to add ipset entry: %v", err)
+		h.renderAlert(w, "error", "Failed to add entry: "+err.Error())
+		return
+	}
+
+	h.userService.LogAction(&user.ID, "ipset_add_entry", "Name: "+name+", Entry: "+entry, getClientIP(r))
+	h.renderAlert(w, "success", "Added "+entry+" to "+name)
+}
+
+func (h *IPSetHandler) DeleteEntry(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUser(r)
+	name := chi.URLParam(r, "name")
+	entry := r.URL.Query().Get("entry")
+
+	if err := h.ipsetService.DeleteEntry(name, entry); err != nil {
+		log.Printf("Failed to delete ipset entry: %v", err)
+		h.renderAlert(w, "error", "Failed to delete entry: "+err.Error())
+		return
+	}
+
+	h.userService.LogAction(&user.ID, "ipset_delete_entry", "Name: "+name+", Entry: "+entry, getClientIP(r))
+	h.renderAlert(w, "success", "Removed "+entry+" from "+name)
+}
+
+// ImportEntries adds the entries of a pasted or uploaded list, one per line
+func (h *IPSetHandler) ImportEntries(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUser(r)
+	name := chi.URLParam(r, "name")
+
+	if err := r.ParseMultipartForm(32 << 20); err != nil && err != http.ErrNotMultipart {
+		h.renderAlert(w, "error", "Invalid form data")
+		return
+	}
+
+	entries := r.FormValue("entries")
+	if file, _, err := r.FormFile("file"); err == nil {
+		defer file.Close()
+		var b strings.Builder
+		if _, err := io.Copy(&b, file); err != nil {
+			h.renderAlert(w, "error", "Failed to read file")
+			return
+		}
+		entries += "\n" + b.String()
+	}
+
+	count, err := h.ipsetService.ImportEntries(name, entries)
+	if err != nil {
+		log.Printf("Failed to import ipset entries: %v", err)
+		h.renderAlert(w, "error", "Failed to import entries: "+err.Error())
+		return
+	}
+
+	h.userService.LogAction(&user.ID, "ipset_import",
+		"Name: "+name+", Entries: "+strconv.Itoa(count), getClientIP(r))
+	h.renderAlert(w, "success", "Imported "+strconv.Itoa(count)+" entries into "+name)
+}
+
+func (h *IPSetHandler) SaveSets(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUser(r)
+
+	if err := h.ipsetService.SaveSets(); err != nil {
+		log.Printf("Failed to save ipsets: %v", err)
+		h.renderAlert(w, "error", "Failed to save ipsets: "+err.Error())
+		return
+	}
+
+	h.userService.LogAction(&user.ID, "ipset_save", "", getClientIP(r))
+	h.renderAlert(w, "success", "IP sets saved successfully")
+}
+
+func (h *IPSetHandler) renderAlert(w http.ResponseWriter, alertType, message string) {
+	if alertType == "success" {
+		w.Header().Set("HX-Trigger", "refresh")
+	}
+	data := map[string]interface{}{
+		"Type":    alertType,
+		"Message": message,
+	}
+	h.templates.ExecuteTemplate(w, "alert.html", data)
+}
@@ -0,0 +1,49 @@
+package handlers
+
+import (
+	"log"
+	"net/http"
+
+	"linuxtorouter/internal/middleware"
+	"linuxtorouter/internal/models"
+	"linuxtorouter/internal/services"
+)
+
+// NftablesHandler shows the raw nftables objects (tables, chains, sets)
+// when the nftables firewall backend is selected
+type NftablesHandler struct {
+	templates       TemplateExecutor
+	nftablesService *services.NftablesService
+}
+
+func NewNftablesHandler(templates TemplateExecutor, nftablesService *services.NftablesService) *NftablesHandler {
+	return &NftablesHandler{
+		templates:       templates,
+		nftablesService: nftablesService,
+	}
+}
+
+func (h *NftablesHandler) List(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUser(r)
+
+	var loadError string
+	tables, err := h.nftablesService.ListTables()
+	if err != nil {
+		log.Printf("Failed to list nftables tables: %v", err)
+		loadError = err.Error()
+		tables = []models.NftTable{}
+	}
+
+	data := map[string]interface{}{
+		"Title":      "nftables",
+		"ActivePage": "firewall",
+		"User":       user,
+		"Tables":     tables,
+		"Error":      loadError,
+	}
+
+	if err := h.templates.ExecuteTemplate(w, "nftables.html", data); err != nil {
+		log.Printf("Template error: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,294 @@
+package handlers
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"linuxtorouter/internal/middleware"
+	"linuxtorouter/internal/models"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func (h *FirewallHandler) ListObjects(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUser(r)
+
+	var loadError string
+	objects, rules, err := h.objectService.ListObjectsAndRules()
+	if err != nil {
+		log.Printf("Failed to list firewall objects: %v", err)
+		loadError = err.Error()
+		objects = []models.FirewallObject{}
+	}
+
+	data := map[string]interface{}{
+		"Title":      "Firewall Objects",
+		"ActivePage": "firewall",
+		"User":       user,
+		"Objects":    objects,
+		"Rules":      rules,
+		"NewObject":  models.FirewallObject{Type: models.ObjectTypeAddress},
+		"Types":      models.FirewallObjectTypes,
+		"Error":      loadError,
+		"Pending":    h.firewallService.PendingChange(),
+	}
+
+	if err := h.templates.ExecuteTemplate(w, "firewall_objects.html", data); err != nil {
+		log.Printf("Template error: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	}
+}
+
+func (h *FirewallHandler) GetObjects(w http.ResponseWriter, r *http.Request) {
+	objects, rules, err := h.objectService.ListObjectsAndRules()
+	if err != nil {
+		log.Printf("Failed to list firewall objects: %v", err)
+		h.renderAlert(w, "error", "Failed to get objects: "+err.Error())
+		return
+	}
+
+	data := map[string]interface{}{
+		"Objects": objects,
+		"Rules":   rules,
+	}
+
+	if err := h.templates.ExecuteTemplate(w, "firewall_object_table.html", data); err != nil {
+		log.Printf("Template error: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	}
+}
+
+// objectFromForm reads the object form shared by the add and edit dialogs.
+// Values are entered one per line or separated by commas, except for
+// service entries whose port lists contain commas.
+func objectFromForm(r *http.Request) models.FirewallObject {
+	obj := models.FirewallObject{
+		Name:        strings.TrimSpace(r.FormValue("name")),
+		Type:        r.FormValue("type"),
+		Description: strings.TrimSpace(r.FormValue("description")),
+	}
+
+	values := strings.ReplaceAll(r.FormValue("values"), "\r", "")
+	if obj.Type != models.ObjectTypeService {
+		values = strings.ReplaceAll(values, ",", "\n")
+	}
+	obj.Values = strings.Split(values, "\n")
+
+	return obj
+}
+
+func (h *FirewallHandler) CreateObject(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUser(r)
+
+	if err := r.ParseForm(); err != nil {
+		h.renderAlert(w, "error", "Invalid form data")
+		return
+	}
+
+	obj := objectFromForm(r)
+	id, err := h.objectService.CreateObject(obj)
+	if err != nil {
+		log.Printf("Failed to create firewall object: %v", err)
+		h.renderAlert(w, "error", "Failed to create object: "+err.Error())
+		return
+	}
+
+	h.userService.LogAction(&user.ID, "firewall_create_object",
+		"ID: "+strconv.FormatInt(id, 10)+", Name: "+obj.Name+", Type: "+obj.Type, getClientIP(r))
+	h.renderAlert(w, "success", "Object "+obj.Name+" created successfully")
+}
+
+// EditObjectForm renders the edit dialog of an object
+func (h *FirewallHandler) EditObjectForm(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		h.renderAlert(w, "error", "Invalid object ID")
+		return
+	}
+
+	obj, err := h.objectService.GetObject(id)
+	if err != nil {
+		log.Printf("Failed to load firewall object: %v", err)
+		h.renderAlert(w, "error", "Failed to load object: "+err.Error())
+		return
+	}
+
+	data := map[string]interface{}{
+		"Object": obj,
+		"Types":  models.FirewallObjectTypes,
+	}
+
+	if err := h.templates.ExecuteTemplate(w, "firewall_object_form.html", data); err != nil {
+		log.Printf("Template error: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	}
+}
+
+// UpdateObject saves an object and re-applies the rules that use it
+func (h *FirewallHandler) UpdateObject(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUser(r)
+	idStr := chi.URLParam(r, "id")
+	id, err := strconv.ParseInt(idStr, 10, 64)
+	if err != nil {
+		h.renderAlert(w, "error", "Invalid object ID")
+		return
+	}
+
+	if err := r.ParseForm(); err != nil {
+		h.renderAlert(w, "error", "Invalid form data")
+		return
+	}
+
+	old, err := h.objectService.GetObject(id)
+	if err != nil {
+		log.Printf("Failed to load firewall object: %v", err)
+		h.renderAlert(w, "error", "Failed to update object: "+err.Error())
+		return
+	}
+
+	obj := objectFromForm(r)
+	obj.ID = id
+	obj.Name = old.Name
+	obj.Type = old.Type
+
+	details := "ID: " + idStr + ", Name: " + old.Name +
+		", Before: " + strings.Join(old.Values, " ") + ", After: " + strings.Join(obj.Values, " ")
+	change := "Edit object " + old.Name
+	timeout, ok := h.armSafeApply(w, r, change)
+	if !ok {
+		return
+	}
+
+	applied, err := h.objectService.UpdateObject(obj)
+	if err != nil {
+		log.Printf("Failed to update firewall object: %v", err)
+		h.renderAlert(w, "error", "Failed to update object: "+err.Error()+h.disarmSafeApply(r, timeout, change))
+		return
+	}
+
+	h.userService.LogAction(&user.ID, "firewall_edit_object",
+		details+", Rules: "+strconv.Itoa(applied), getClientIP(r))
+	h.renderAlert(w, "success", "Object "+old.Name+" updated, "+strconv.Itoa(applied)+" rule(s) re-applied"+safeApplySuffix(timeout))
+}
+
+func (h *FirewallHandler) DeleteObject(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUser(r)
+	idStr := chi.URLParam(r, "id")
+	id, err := strconv.ParseInt(idStr, 10, 64)
+	if err != nil {
+		h.renderAlert(w, "error", "Invalid object ID")
+		return
+	}
+
+	obj, err := h.objectService.GetObject(id)
+	if err != nil {
+		log.Printf("Failed to load firewall object: %v", err)
+		h.renderAlert(w, "error", "Failed to delete object: "+err.Error())
+		return
+	}
+
+	if err := h.objectService.DeleteObject(id); err != nil {
+		log.Printf("Failed to delete firewall object: %v", err)
+		h.renderAlert(w, "error", "Failed to delete object: "+err.Error())
+		return
+	}
+
+	h.userService.LogAction(&user.ID, "firewall_delete_object", "ID: "+idStr+", Name: "+obj.Name, getClientIP(r))
+	h.renderAlert(w, "success", "Object "+obj.Name+" deleted")
+}
+
+// ReapplyObjectRule renders an object rule into the firewall again, e.g.
+// after its rules were flushed
+func (h *FirewallHandler) ReapplyObjectRule(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUser(r)
+	idStr := chi.URLParam(r, "id")
+	id, err := strconv.ParseInt(idStr, 10, 64)
+	if err != nil {
+		h.renderAlert(w, "error", "Invalid object rule ID")
+		return
+	}
+
+	change := "Re-apply object rule " + idStr
+	timeout, ok := h.armSafeApply(w, r, change)
+	if !ok {
+		return
+	}
+
+	if err := h.objectService.ReapplyRule(id); err != nil {
+		log.Printf("Failed to re-apply object rule: %v", err)
+		h.renderAlert(w, "error", "Failed to re-apply rule: "+err.Error()+h.disarmSafeApply(r, timeout, change))
+		return
+	}
+
+	h.userService.LogAction(&user.ID, "firewall_reapply_object_rule", "Object Rule: "+idStr, getClientIP(r))
+	h.renderAlert(w, "success", "Object rule "+idStr+" re-applied"+safeApplySuffix(timeout))
+}
+
+// ForgetObjectRule deletes an object rule that is no longer in the firewall
+func (h *FirewallHandler) ForgetObjectRule(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUser(r)
+	idStr := chi.URLParam(r, "id")
+	id, err := strconv.ParseInt(idStr, 10, 64)
+	if err != nil {
+		h.renderAlert(w, "error", "Invalid object rule ID")
+		return
+	}
+
+	if err := h.objectService.ForgetRule(id); err != nil {
+		log.Printf("Failed to forget object rule: %v", err)
+		h.renderAlert(w, "error", "Failed to forget rule: "+err.Error())
+		return
+	}
+
+	h.userService.LogAction(&user.ID, "firewall_forget_object_rule", "Object Rule: "+idStr, getClientIP(r))
+	h.renderAlert(w, "success", "Object rule "+idStr+" forgotten")
+}
+
+// RestoreObjectRule stores a deleted object rule again whose rules are back
+// in the firewall
+func (h *FirewallHandler) RestoreObjectRule(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUser(r)
+	idStr := chi.URLParam(r, "id")
+	id, err := strconv.ParseInt(idStr, 10, 64)
+	if err != nil {
+		h.renderAlert(w, "error", "Invalid object rule ID")
+		return
+	}
+
+	if err := h.objectService.RestoreRule(id); err != nil {
+		log.Printf("Failed to restore object rule: %v", err)
+		h.renderAlert(w, "error", "Failed to restore rule: "+err.Error())
+		return
+	}
+
+	h.userService.LogAction(&user.ID, "firewall_restore_object_rule", "Object Rule: "+idStr, getClientIP(r))
+	h.renderAlert(w, "success", "Object rule "+idStr+" restored")
+}
+
+// DeleteObjectRule removes the rules rendered from an object rule
+func (h *FirewallHandler) DeleteObjectRule(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUser(r)
+	idStr := chi.URLParam(r, "id")
+	id, err := strconv.ParseInt(idStr, 10, 64)
+	if err != nil {
+		h.renderAlert(w, "error", "Invalid object rule ID")
+		return
+	}
+
+	change := "Delete object rule " + idStr
+	timeout, ok := h.armSafeApply(w, r, change)
+	if !ok {
+		return
+	}
+
+	if err := h.objectService.DeleteRule(id); err != nil {
+		log.Printf("Failed to delete object rule: %v", err)
+		h.renderAlert(w, "error", "Failed to delete rule: "+err.Error()+h.disarmSafeApply(r, timeout, change))
+		return
+	}
+
+	h.userService.LogAction(&user.ID, "firewall_delete_rule", "Object Rule: "+idStr, getClientIP(r))
+	h.renderAlert(w, "success", "Object rule "+idStr+" deleted"+safeApplySuffix(timeout))
+}
@@ -0,0 +1,121 @@
+package handlers
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"linuxtorouter/internal/auth"
+	"linuxtorouter/internal/middleware"
+	"linuxtorouter/internal/models"
+	"linuxtorouter/internal/services"
+)
+
+// packetLogPageSize is the number of packets shown
+const packetLogPageSize = 200
+
+type PacketLogHandler struct {
+	templates        TemplateExecutor
+	packetLogService *services.PacketLogService
+	userService      *auth.UserService
+}
+
+func NewPacketLogHandler(templates TemplateExecutor, packetLogService *services.PacketLogService, userService *auth.UserService) *PacketLogHandler {
+	return &PacketLogHandler{
+		templates:        templates,
+		packetLogService: packetLogService,
+		userService:      userService,
+	}
+}
+
+func (h *PacketLogHandler) List(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUser(r)
+
+	data := h.tableData(r)
+	data["Title"] = "Packet Log"
+	data["ActivePage"] = "firewall"
+	data["User"] = user
+
+	if err := h.templates.ExecuteTemplate(w, "firewall_log.html", data); err != nil {
+		log.Printf("Template error: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	}
+}
+
+func (h *PacketLogHandler) GetTable(w http.ResponseWriter, r *http.Request) {
+	if err := h.templates.ExecuteTemplate(w, "firewall_log_table.html", h.tableData(r)); err != nil {
+		log.Printf("Template error: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	}
+}
+
+// tableData lists the packets selected by the request's filter. Live mode
+// reads the in-memory buffer, history mode searches the database.
+func (h *PacketLogHandler) tableData(r *http.Request) map[string]interface{} {
+	filter := models.PacketLogFilter{
+		Prefix:  strings.TrimSpace(r.FormValue("prefix")),
+		Address: strings.TrimSpace(r.FormValue("address")),
+		Port:    strings.TrimSpace(r.FormValue("port")),
+	}
+	mode := r.FormValue("mode")
+	if mode != "history" {
+		mode = "live"
+	}
+
+	var entries []models.PacketLogEntry
+	var err error
+	if mode == "history" {
+		entries, err = h.packetLogService.Search(filter, packetLogPageSize)
+	} else {
+		entries, err = h.packetLogService.Recent(filter, packetLogPageSize)
+	}
+
+	var loadError string
+	if err != nil {
+		log.Printf("Failed to read packet log: %v", err)
+		loadError = err.Error()
+	}
+
+	running, collectorErr := h.packetLogService.Status()
+	var collectorError string
+	if collectorErr != nil {
+		collectorError = collectorErr.Error()
+	}
+
+	return map[string]interface{}{
+		"Entries":        entries,
+		"Limit":          packetLogPageSize,
+		"Filter":         filter,
+		"Mode":           mode,
+		"Group":          h.packetLogService.Group(),
+		"Running":        running,
+		"CollectorError": collectorError,
+		"Error":          loadError,
+	}
+}
+
+// Clear removes all logged packets
+func (h *PacketLogHandler) Clear(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUser(r)
+
+	if err := h.packetLogService.Clear(); err != nil {
+		log.Printf("Failed to clear packet log: %v", err)
+		h.renderAlert(w, "error", "Failed to clear packet log: "+err.Error())
+		return
+	}
+
+	h.userService.LogAction(&user.ID, "packet_log_clear", "Group: "+strconv.Itoa(h.packetLogService.Group()), getClientIP(r))
+	h.renderAlert(w, "success", "Packet log cleared")
+}
+
+func (h *PacketLogHandler) renderAlert(w http.ResponseWriter, alertType, message string) {
+	if alertType == "success" {
+		w.Header().Set("HX-Trigger", "refresh")
+	}
+	data := map[string]interface{}{
+		"Type":    alertType,
+		"Message": message,
+	}
+	h.templates.ExecuteTemplate(w, "alert.html", data)
+}
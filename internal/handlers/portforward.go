@@ -0,0 +1,221 @@
+package handlers
+
+import (
+	"log"
+	"net/http"
+	"strings"
+
+	"linuxtorouter/internal/middleware"
+	"linuxtorouter/internal/models"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func (h *FirewallHandler) ListPortForwards(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUser(r)
+	family := models.ParseIPFamily(r.URL.Query().Get("family"))
+
+	var loadError string
+	forwards, err := h.portForwardService.List(family)
+	if err != nil {
+		log.Printf("Failed to list port forwards: %v", err)
+		loadError = err.Error()
+		forwards = []models.PortForward{}
+	}
+
+	data := map[string]interface{}{
+		"Title":      "Port Forwards",
+		"ActivePage": "firewall",
+		"User":       user,
+		"Forwards":   forwards,
+		"NewForward": models.PortForward{Family: family, Protocol: "tcp"},
+		"Family":     family,
+		"Families":   models.IPFamilies,
+		"Error":      loadError,
+		"Pending":    h.firewallService.PendingChange(),
+	}
+
+	if err := h.templates.ExecuteTemplate(w, "port_forwards.html", data); err != nil {
+		log.Printf("Template error: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	}
+}
+
+func (h *FirewallHandler) GetPortForwards(w http.ResponseWriter, r *http.Request) {
+	family := models.ParseIPFamily(r.URL.Query().Get("family"))
+
+	forwards, err := h.portForwardService.List(family)
+	if err != nil {
+		log.Printf("Failed to list port forwards: %v", err)
+		h.renderAlert(w, "error", "Failed to get port forwards: "+err.Error())
+		return
+	}
+
+	data := map[string]interface{}{
+		"Forwards": forwards,
+		"Family":   family,
+	}
+
+	if err := h.templates.ExecuteTemplate(w, "port_forward_table.html", data); err != nil {
+		log.Printf("Template error: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	}
+}
+
+// portForwardFromForm reads the port forward form shared by the add and
+// edit dialogs
+func portForwardFromForm(r *http.Request) models.PortForward {
+	return models.PortForward{
+		Family:        models.ParseIPFamily(r.FormValue("family")),
+		Description:   strings.TrimSpace(r.FormValue("description")),
+		Interface:     strings.TrimSpace(r.FormValue("interface")),
+		Protocol:      r.FormValue("protocol"),
+		ExternalPort:  strings.TrimSpace(r.FormValue("external_port")),
+		InternalHost:  strings.TrimSpace(r.FormValue("internal_host")),
+		InternalPort:  strings.TrimSpace(r.FormValue("internal_port")),
+		Source:        strings.TrimSpace(r.FormValue("source")),
+		Hairpin:       r.FormValue("hairpin") == "on",
+		PublicAddress: strings.TrimSpace(r.FormValue("public_address")),
+		LANNetwork:    strings.TrimSpace(r.FormValue("lan_network")),
+	}
+}
+
+// portForwardDetails describes a port forward for the audit log
+func portForwardDetails(pf models.PortForward) string {
+	to := pf.InternalHost
+	if pf.InternalPort != "" {
+		to += " port " + pf.InternalPort
+	}
+	details := "Family: " + string(pf.Family) + ", Interface: " + pf.Interface + ", " +
+		pf.Protocol + " " + pf.ExternalPort + " -> " + to
+	if pf.Source != "" {
+		details += ", Source: " + pf.Source
+	}
+	if pf.Hairpin {
+		details += ", Hairpin: " + pf.PublicAddress + " from " + pf.LANNetwork
+	}
+	return details
+}
+
+func (h *FirewallHandler) CreatePortForward(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUser(r)
+
+	if err := r.ParseForm(); err != nil {
+		h.renderAlert(w, "error", "Invalid form data")
+		return
+	}
+
+	pf := portForwardFromForm(r)
+	if pf.ExternalPort == "" || pf.InternalHost == "" {
+		h.renderAlert(w, "error", "External port and internal host are required")
+		return
+	}
+
+	details := portForwardDetails(pf)
+	change := "Add port forward (" + details + ")"
+	timeout, ok := h.armSafeApply(w, r, change)
+	if !ok {
+		return
+	}
+
+	id, err := h.portForwardService.Create(pf)
+	if err != nil {
+		log.Printf("Failed to add port forward: %v", err)
+		h.renderAlert(w, "error", "Failed to add port forward: "+err.Error()+h.disarmSafeApply(r, timeout, change))
+		return
+	}
+
+	h.userService.LogAction(&user.ID, "firewall_add_port_forward", "ID: "+id+", "+details, getClientIP(r))
+	h.renderAlert(w, "success", "Port forward added successfully"+safeApplySuffix(timeout))
+}
+
+// EditPortForwardForm renders the edit dialog of a port forward
+func (h *FirewallHandler) EditPortForwardForm(w http.ResponseWriter, r *http.Request) {
+	id := chi.URLParam(r, "id")
+	family := models.ParseIPFamily(r.URL.Query().Get("family"))
+
+	pf, err := h.portForwardService.Get(family, id)
+	if err != nil {
+		log.Printf("Failed to load port forward: %v", err)
+		h.renderAlert(w, "error", "Failed to load port forward: "+err.Error())
+		return
+	}
+
+	data := map[string]interface{}{
+		"Forward": pf,
+		"Family":  family,
+	}
+
+	if err := h.templates.ExecuteTemplate(w, "port_forward_form.html", data); err != nil {
+		log.Printf("Template error: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	}
+}
+
+func (h *FirewallHandler) UpdatePortForward(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUser(r)
+
+	if err := r.ParseForm(); err != nil {
+		h.renderAlert(w, "error", "Invalid form data")
+		return
+	}
+
+	pf := portForwardFromForm(r)
+	pf.ID = chi.URLParam(r, "id")
+	if pf.ExternalPort == "" || pf.InternalHost == "" {
+		h.renderAlert(w, "error", "External port and internal host are required")
+		return
+	}
+
+	old, err := h.portForwardService.Get(pf.Family, pf.ID)
+	if err != nil {
+		log.Printf("Failed to load port forward: %v", err)
+		h.renderAlert(w, "error", "Failed to update port forward: "+err.Error())
+		return
+	}
+
+	details := "ID: " + pf.ID + ", Before: " + portForwardDetails(*old) + ", After: " + portForwardDetails(pf)
+	change := "Edit port forward (" + details + ")"
+	timeout, ok := h.armSafeApply(w, r, change)
+	if !ok {
+		return
+	}
+
+	if err := h.portForwardService.Update(pf); err != nil {
+		log.Printf("Failed to update port forward: %v", err)
+		h.renderAlert(w, "error", "Failed to update port forward: "+err.Error()+h.disarmSafeApply(r, timeout, change))
+		return
+	}
+
+	h.userService.LogAction(&user.ID, "firewall_edit_port_forward", details, getClientIP(r))
+	h.renderAlert(w, "success", "Port forward updated successfully"+safeApplySuffix(timeout))
+}
+
+func (h *FirewallHandler) DeletePortForward(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUser(r)
+	id := chi.URLParam(r, "id")
+	family := models.ParseIPFamily(r.URL.Query().Get("family"))
+
+	pf, err := h.portForwardService.Get(family, id)
+	if err != nil {
+		log.Printf("Failed to load port forward: %v", err)
+		h.renderAlert(w, "error", "Failed to delete port forward: "+err.Error())
+		return
+	}
+
+	details := "ID: " + id + ", " + portForwardDetails(*pf)
+	change := "Delete port forward (" + details + ")"
+	timeout, ok := h.armSafeApply(w, r, change)
+	if !ok {
+		return
+	}
+
+	if err := h.portForwardService.Delete(family, id); err != nil {
+		log.Printf("Failed to delete port forward: %v", err)
+		h.renderAlert(w, "error", "Failed to delete port forward: "+err.Error()+h.disarmSafeApply(r, timeout, change))
+		return
+	}
+
+	h.userService.LogAction(&user.ID, "firewall_delete_port_forward", details, getClientIP(r))
+	h.renderAlert(w, "success", "Port forward deleted successfully"+safeApplySuffix(timeout))
+}
@@ -1,6 +1,7 @@
 package handlers
 
 import (
+	"fmt"
 	"log"
 	"net/http"
 	"strconv"
@@ -10,19 +11,23 @@ import (
 	"linuxtorouter/internal/middleware"
 	"linuxtorouter/internal/models"
 	"linuxtorouter/internal/services"
+
+	"github.com/go-chi/chi/v5"
 )
 
 type RoutesHandler struct {
 	templates      TemplateExecutor
 	routeService   *services.IPRouteService
+	ruleService    *services.IPRuleService
 	netlinkService *services.NetlinkService
 	userService    *auth.UserService
 }
 
-func NewRoutesHandler(templates TemplateExecutor, routeService *services.IPRouteService, netlinkService *services.NetlinkService, userService *auth.UserService) *RoutesHandler {
+func NewRoutesHandler(templates TemplateExecutor, routeService *services.IPRouteService, ruleService *services.IPRuleService, netlinkService *services.NetlinkService, userService *auth.UserService) *RoutesHandler {
 	return &RoutesHandler{
 		templates:      templates,
 		routeService:   routeService,
+		ruleService:    ruleService,
 		netlinkService: netlinkService,
 		userService:    userService,
 	}
@@ -30,12 +35,13 @@ func NewRoutesHandler(templates TemplateExecutor, routeService *services.IPRoute
 
 func (h *RoutesHandler) List(w http.ResponseWriter, r *http.Request) {
 	user := middleware.GetUser(r)
+	family := models.ParseIPFamily(r.URL.Query().Get("family"))
 	table := r.URL.Query().Get("table")
 	if table == "" {
 		table = "main"
 	}
 
-	routes, err := h.routeService.ListRoutes(table)
+	routes, err := h.routeService.ListRoutes(family, table)
 	if err != nil {
 		log.Printf("Failed to list routes: %v", err)
 		routes = []models.Route{}
@@ -43,6 +49,12 @@ func (h *RoutesHandler) List(w http.ResponseWriter, r *http.Request) {
 
 	tables, _ := h.routeService.GetRoutingTables()
 
+	nexthops, err := h.routeService.ListNexthops()
+	if err != nil {
+		log.Printf("Failed to list nexthops: %v", err)
+		nexthops = []models.Nexthop{}
+	}
+
 	interfaces, _ := h.netlinkService.ListInterfaces()
 	var ifaceNames []string
 	for _, iface := range interfaces {
@@ -54,9 +66,12 @@ func (h *RoutesHandler) List(w http.ResponseWriter, r *http.Request) {
 		"ActivePage":   "routes",
 		"User":         user,
 		"Routes":       routes,
+		"Family":       family,
+		"Families":     models.IPFamilies,
 		"CurrentTable": table,
 		"Tables":       tables,
 		"Interfaces":   ifaceNames,
+		"Nexthops":     nexthops,
 	}
 
 	if err := h.templates.ExecuteTemplate(w, "routes.html", data); err != nil {
@@ -66,12 +81,13 @@ func (h *RoutesHandler) List(w http.ResponseWriter, r *http.Request) {
 }
 
 func (h *RoutesHandler) GetRoutes(w http.ResponseWriter, r *http.Request) {
+	family := models.ParseIPFamily(r.URL.Query().Get("family"))
 	table := r.URL.Query().Get("table")
 	if table == "" {
 		table = "main"
 	}
 
-	routes, err := h.routeService.ListRoutes(table)
+	routes, err := h.routeService.ListRoutes(family, table)
 	if err != nil {
 		log.Printf("Failed to list routes: %v", err)
 		routes = []models.Route{}
@@ -79,6 +95,7 @@ func (h *RoutesHandler) GetRoutes(w http.ResponseWriter, r *http.Request) {
 
 	data := map[string]interface{}{
 		"Routes":       routes,
+		"Family":       family,
 		"CurrentTable": table,
 	}
 
@@ -97,13 +114,54 @@ func (h *RoutesHandler) AddRoute(w http.ResponseWriter, r *http.Request) {
 	}
 
 	metric, _ := strconv.Atoi(r.FormValue("metric"))
+	nhid, _ := strconv.Atoi(r.FormValue("nhid"))
+	mtu, _ := strconv.Atoi(r.FormValue("mtu"))
+	advmss, _ := strconv.Atoi(r.FormValue("advmss"))
+	initcwnd, _ := strconv.Atoi(r.FormValue("initcwnd"))
 
 	input := models.RouteInput{
+		Family:      models.ParseIPFamily(r.FormValue("family")),
+		Type:        r.FormValue("type"),
 		Destination: strings.TrimSpace(r.FormValue("destination")),
 		Gateway:     strings.TrimSpace(r.FormValue("gateway")),
 		Interface:   strings.TrimSpace(r.FormValue("interface")),
+		Onlink:      r.FormValue("onlink") == "on",
+		NexthopID:   nhid,
 		Metric:      metric,
 		Table:       r.FormValue("table"),
+		Source:      strings.TrimSpace(r.FormValue("source")),
+		Scope:       r.FormValue("scope"),
+		Protocol:    strings.TrimSpace(r.FormValue("protocol")),
+		MTU:         mtu,
+		AdvMSS:      advmss,
+		InitCwnd:    initcwnd,
+	}
+	if input.Type == "unicast" {
+		input.Type = ""
+	}
+
+	// Next hop rows of a multipath route, skipping the empty ones
+	gateways := r.Form["nexthop_gateway"]
+	for i, gateway := range gateways {
+		nh := models.RouteNexthop{Gateway: strings.TrimSpace(gateway), Weight: 1}
+		if i < len(r.Form["nexthop_interface"]) {
+			nh.Interface = strings.TrimSpace(r.Form["nexthop_interface"][i])
+		}
+		if nh.Gateway == "" && nh.Interface == "" {
+			continue
+		}
+		if i < len(r.Form["nexthop_weight"]) && r.Form["nexthop_weight"][i] != "" {
+			weight, err := strconv.Atoi(r.Form["nexthop_weight"][i])
+			if err != nil || weight < 1 || weight > 256 {
+				h.renderAlert(w, "error", "Next hop weight must be between 1 and 256")
+				return
+			}
+			nh.Weight = weight
+		}
+		if i < len(r.Form["nexthop_onlink"]) && r.Form["nexthop_onlink"][i] == "on" {
+			nh.Flags = "onlink"
+		}
+		input.Nexthops = append(input.Nexthops, nh)
 	}
 
 	if input.Destination == "" {
@@ -111,9 +169,27 @@ func (h *RoutesHandler) AddRoute(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if input.Gateway == "" && input.Interface == "" {
-		h.renderAlert(w, "error", "Gateway or interface is required")
-		return
+	paths := 0
+	if input.Gateway != "" || input.Interface != "" {
+		paths++
+	}
+	if len(input.Nexthops) > 0 {
+		paths++
+	}
+	if input.NexthopID > 0 {
+		paths++
+	}
+	switch input.Type {
+	case "blackhole", "unreachable", "prohibit", "throw":
+		if paths != 0 {
+			h.renderAlert(w, "error", "A "+input.Type+" route has no gateway, interface or next hops")
+			return
+		}
+	default:
+		if paths != 1 {
+			h.renderAlert(w, "error", "Use either a gateway or interface, next hops, or a nexthop object")
+			return
+		}
 	}
 
 	if err := h.routeService.AddRoute(input); err != nil {
@@ -122,15 +198,58 @@ func (h *RoutesHandler) AddRoute(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	h.userService.LogAction(&user.ID, "route_add",
-		"Dest: "+input.Destination+", Gateway: "+input.Gateway+", Dev: "+input.Interface, getClientIP(r))
+	h.userService.LogAction(&user.ID, "route_add", routeDetails(input), getClientIP(r))
 	h.renderAlert(w, "success", "Route added successfully")
 }
 
+// routeDetails describes an added route for the audit log
+func routeDetails(input models.RouteInput) string {
+	details := "Family: " + string(input.Family) + ", Dest: " + input.Destination
+	if input.Type != "" {
+		details += ", Type: " + input.Type
+	}
+	switch {
+	case input.NexthopID > 0:
+		details += fmt.Sprintf(", Nexthop ID: %d", input.NexthopID)
+	case len(input.Nexthops) > 0:
+		for _, nh := range input.Nexthops {
+			details += fmt.Sprintf(", Nexthop: %s dev %s weight %d", nh.Gateway, nh.Interface, nh.Weight)
+			if nh.Flags != "" {
+				details += " " + nh.Flags
+			}
+		}
+	case input.Gateway != "" || input.Interface != "":
+		details += ", Gateway: " + input.Gateway + ", Dev: " + input.Interface
+		if input.Onlink {
+			details += " onlink"
+		}
+	}
+	if input.Source != "" {
+		details += ", Src: " + input.Source
+	}
+	if input.Scope != "" {
+		details += ", Scope: " + input.Scope
+	}
+	if input.Protocol != "" {
+		details += ", Proto: " + input.Protocol
+	}
+	if input.MTU > 0 {
+		details += fmt.Sprintf(", MTU: %d", input.MTU)
+	}
+	if input.AdvMSS > 0 {
+		details += fmt.Sprintf(", AdvMSS: %d", input.AdvMSS)
+	}
+	if input.InitCwnd > 0 {
+		details += fmt.Sprintf(", InitCwnd: %d", input.InitCwnd)
+	}
+	return details
+}
+
 func (h *RoutesHandler) DeleteRoute(w http.ResponseWriter, r *http.Request) {
 	user := middleware.GetUser(r)
 
 	// Use query parameters for DELETE requests
+	family := models.ParseIPFamily(r.URL.Query().Get("family"))
 	destination := r.URL.Query().Get("destination")
 	gateway := r.URL.Query().Get("gateway")
 	iface := r.URL.Query().Get("interface")
@@ -141,14 +260,14 @@ func (h *RoutesHandler) DeleteRoute(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if err := h.routeService.DeleteRoute(destination, gateway, iface, table); err != nil {
+	if err := h.routeService.DeleteRoute(family, destination, gateway, iface, table); err != nil {
 		log.Printf("Failed to delete route: %v", err)
 		h.renderAlert(w, "error", "Failed to delete route: "+err.Error())
 		return
 	}
 
 	h.userService.LogAction(&user.ID, "route_delete",
-		"Dest: "+destination+", Table: "+table, getClientIP(r))
+		"Family: "+string(family)+", Dest: "+destination+", Table: "+table, getClientIP(r))
 	h.renderAlert(w, "success", "Route deleted successfully")
 }
 
@@ -165,6 +284,194 @@ func (h *RoutesHandler) SaveRoutes(w http.ResponseWriter, r *http.Request) {
 	h.renderAlert(w, "success", "Routes saved successfully")
 }
 
+func (h *RoutesHandler) GetNexthops(w http.ResponseWriter, r *http.Request) {
+	nexthops, err := h.routeService.ListNexthops()
+	if err != nil {
+		log.Printf("Failed to list nexthops: %v", err)
+		nexthops = []models.Nexthop{}
+	}
+
+	data := map[string]interface{}{
+		"Nexthops": nexthops,
+	}
+
+	if err := h.templates.ExecuteTemplate(w, "nexthop_table.html", data); err != nil {
+		log.Printf("Template error: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	}
+}
+
+// AddNexthop creates a nexthop object: a gateway and interface, a
+// blackhole or a group of other nexthops
+func (h *RoutesHandler) AddNexthop(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUser(r)
+
+	if err := r.ParseForm(); err != nil {
+		h.renderAlert(w, "error", "Invalid form data")
+		return
+	}
+
+	var nh models.Nexthop
+	if id := strings.TrimSpace(r.FormValue("id")); id != "" {
+		var err error
+		if nh.ID, err = strconv.Atoi(id); err != nil || nh.ID <= 0 {
+			h.renderAlert(w, "error", "Invalid nexthop ID")
+			return
+		}
+	}
+
+	switch r.FormValue("kind") {
+	case "group":
+		group, err := services.ParseNexthopGroup(r.FormValue("group"))
+		if err != nil {
+			h.renderAlert(w, "error", err.Error())
+			return
+		}
+		nh.Group = group
+	case "blackhole":
+		nh.Blackhole = true
+		nh.Family = models.ParseIPFamily(r.FormValue("family"))
+	default:
+		nh.Gateway = strings.TrimSpace(r.FormValue("gateway"))
+		nh.Interface = strings.TrimSpace(r.FormValue("interface"))
+		nh.Family = models.ParseIPFamily(r.FormValue("family"))
+		if r.FormValue("onlink") == "on" {
+			nh.Flags = "onlink"
+		}
+	}
+
+	if err := h.routeService.AddNexthop(nh); err != nil {
+		log.Printf("Failed to add nexthop: %v", err)
+		h.renderAlert(w, "error", "Failed to add nexthop: "+err.Error())
+		return
+	}
+
+	details := "ID: " + strconv.Itoa(nh.ID)
+	switch {
+	case len(nh.Group) > 0:
+		details += ", Group: " + services.FormatNexthopGroup(nh.Group)
+	case nh.Blackhole:
+		details += ", Blackhole"
+	default:
+		details += ", Gateway: " + nh.Gateway + ", Dev: " + nh.Interface
+	}
+	h.userService.LogAction(&user.ID, "nexthop_add", details, getClientIP(r))
+	h.renderAlert(w, "success", "Nexthop added successfully")
+}
+
+func (h *RoutesHandler) DeleteNexthop(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUser(r)
+
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		h.renderAlert(w, "error", "Invalid nexthop ID")
+		return
+	}
+
+	if err := h.routeService.DeleteNexthop(id); err != nil {
+		log.Printf("Failed to delete nexthop: %v", err)
+		h.renderAlert(w, "error", "Failed to delete nexthop: "+err.Error())
+		return
+	}
+
+	h.userService.LogAction(&user.ID, "nexthop_delete", "ID: "+strconv.Itoa(id), getClientIP(r))
+	h.renderAlert(w, "success", "Nexthop deleted successfully")
+}
+
+func (h *RoutesHandler) GetTables(w http.ResponseWriter, r *http.Request) {
+	tables, err := h.routeService.GetRoutingTables()
+	if err != nil {
+		log.Printf("Failed to list routing tables: %v", err)
+		tables = []models.RoutingTable{}
+	}
+
+	data := map[string]interface{}{
+		"Tables":       tables,
+		"CurrentTable": r.URL.Query().Get("table"),
+	}
+
+	if err := h.templates.ExecuteTemplate(w, "routing_tables.html", data); err != nil {
+		log.Printf("Template error: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	}
+}
+
+// CreateTable names a new routing table. Without an ID the first free one
+// from 100 is used.
+func (h *RoutesHandler) CreateTable(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUser(r)
+
+	if err := r.ParseForm(); err != nil {
+		h.renderAlert(w, "error", "Invalid form data")
+		return
+	}
+
+	var id int
+	if idStr := strings.TrimSpace(r.FormValue("id")); idStr != "" {
+		n, err := strconv.ParseUint(idStr, 0, 32)
+		if err != nil || n == 0 {
+			h.renderAlert(w, "error", "Invalid table ID")
+			return
+		}
+		id = int(n)
+	}
+	name := strings.TrimSpace(r.FormValue("name"))
+
+	table, err := h.routeService.CreateTable(id, name)
+	if err != nil {
+		log.Printf("Failed to create routing table: %v", err)
+		h.renderAlert(w, "error", "Failed to create routing table: "+err.Error())
+		return
+	}
+
+	h.userService.LogAction(&user.ID, "route_table_create",
+		fmt.Sprintf("Table: %s, ID: %d", table.Name, table.ID), getClientIP(r))
+	h.renderAlert(w, "success", fmt.Sprintf("Routing table %s created with ID %d", table.Name, table.ID))
+}
+
+// RenameTable renames a routing table along with its saved routes and the
+// saved rules that look it up
+func (h *RoutesHandler) RenameTable(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUser(r)
+
+	if err := r.ParseForm(); err != nil {
+		h.renderAlert(w, "error", "Invalid form data")
+		return
+	}
+
+	name := r.FormValue("name")
+	newName := strings.TrimSpace(r.FormValue("new_name"))
+
+	if err := h.routeService.RenameTable(name, newName); err != nil {
+		log.Printf("Failed to rename routing table: %v", err)
+		h.renderAlert(w, "error", "Failed to rename routing table: "+err.Error())
+		return
+	}
+	if err := h.ruleService.RenameTable(name, newName); err != nil {
+		log.Printf("Failed to update saved rules: %v", err)
+		h.renderAlert(w, "error", "Routing table renamed, but the saved rules were not updated: "+err.Error())
+		return
+	}
+
+	h.userService.LogAction(&user.ID, "route_table_rename", "Table: "+name+" -> "+newName, getClientIP(r))
+	h.renderAlert(w, "success", "Routing table renamed to "+newName)
+}
+
+func (h *RoutesHandler) DeleteTable(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUser(r)
+
+	name := chi.URLParam(r, "name")
+
+	if err := h.routeService.DeleteTable(name); err != nil {
+		log.Printf("Failed to delete routing table: %v", err)
+		h.renderAlert(w, "error", "Failed to delete routing table: "+err.Error())
+		return
+	}
+
+	h.userService.LogAction(&user.ID, "route_table_delete", "Table: "+name, getClientIP(r))
+	h.renderAlert(w, "success", "Routing table "+name+" deleted")
+}
+
 func (h *RoutesHandler) renderAlert(w http.ResponseWriter, alertType, message string) {
 	if alertType == "success" {
 		w.Header().Set("HX-Trigger", "refresh")
@@ -0,0 +1,171 @@
+package handlers
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"linuxtorouter/internal/middleware"
+	"linuxtorouter/internal/models"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func (h *FirewallHandler) ListSchedules(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUser(r)
+
+	data := h.schedulesData()
+	data["Title"] = "Rule Schedules"
+	data["ActivePage"] = "firewall"
+	data["User"] = user
+	data["Families"] = models.IPFamilies
+	data["Tables"] = []string{"filter", "nat", "mangle", "raw"}
+	data["NewSchedule"] = models.RuleSchedule{Family: models.FamilyIPv4, Table: "filter", Enabled: true}
+
+	if err := h.templates.ExecuteTemplate(w, "firewall_schedules.html", data); err != nil {
+		log.Printf("Template error: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	}
+}
+
+func (h *FirewallHandler) GetSchedules(w http.ResponseWriter, r *http.Request) {
+	if err := h.templates.ExecuteTemplate(w, "firewall_schedule_table.html", h.schedulesData()); err != nil {
+		log.Printf("Template error: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	}
+}
+
+// schedulesData loads the schedules shown on the schedules page
+func (h *FirewallHandler) schedulesData() map[string]interface{} {
+	var loadError string
+	schedules, err := h.scheduleService.List()
+	if err != nil {
+		log.Printf("Failed to list schedules: %v", err)
+		loadError = err.Error()
+	}
+
+	return map[string]interface{}{
+		"Schedules": schedules,
+		"Error":     loadError,
+	}
+}
+
+// scheduleFromForm reads the schedule form shared by the add and edit dialogs
+func scheduleFromForm(r *http.Request) models.RuleSchedule {
+	return models.RuleSchedule{
+		Name:        strings.TrimSpace(r.FormValue("name")),
+		Description: strings.TrimSpace(r.FormValue("description")),
+		Family:      models.ParseIPFamily(r.FormValue("family")),
+		Table:       r.FormValue("table"),
+		Start:       strings.TrimSpace(r.FormValue("start")),
+		Stop:        strings.TrimSpace(r.FormValue("stop")),
+		Rules:       strings.ReplaceAll(r.FormValue("rules"), "\r\n", "\n"),
+		Enabled:     r.FormValue("enabled") == "on",
+	}
+}
+
+// scheduleDetails describes a schedule for the audit log
+func scheduleDetails(sched models.RuleSchedule) string {
+	details := "Schedule: " + sched.Name + ", Start: " + sched.Start + ", Stop: " + sched.Stop +
+		", Table: " + string(sched.Family) + " " + sched.Table
+	if !sched.Enabled {
+		details += ", Disabled"
+	}
+	return details
+}
+
+func (h *FirewallHandler) CreateSchedule(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUser(r)
+
+	if err := r.ParseForm(); err != nil {
+		h.renderAlert(w, "error", "Invalid form data")
+		return
+	}
+
+	sched := scheduleFromForm(r)
+	if _, err := h.scheduleService.Create(sched); err != nil {
+		log.Printf("Failed to create schedule: %v", err)
+		h.renderAlert(w, "error", "Failed to create schedule: "+err.Error())
+		return
+	}
+
+	h.userService.LogAction(&user.ID, "firewall_create_schedule", scheduleDetails(sched), getClientIP(r))
+	h.renderAlert(w, "success", "Schedule "+sched.Name+" created")
+}
+
+// EditScheduleForm renders the edit dialog of a schedule
+func (h *FirewallHandler) EditScheduleForm(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		h.renderAlert(w, "error", "Invalid schedule ID")
+		return
+	}
+
+	sched, err := h.scheduleService.Get(id)
+	if err != nil {
+		log.Printf("Failed to load schedule: %v", err)
+		h.renderAlert(w, "error", "Failed to load schedule: "+err.Error())
+		return
+	}
+
+	data := map[string]interface{}{
+		"Schedule": sched,
+		"Families": models.IPFamilies,
+		"Tables":   []string{"filter", "nat", "mangle", "raw"},
+	}
+
+	if err := h.templates.ExecuteTemplate(w, "firewall_schedule_form.html", data); err != nil {
+		log.Printf("Template error: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	}
+}
+
+func (h *FirewallHandler) UpdateSchedule(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUser(r)
+
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		h.renderAlert(w, "error", "Invalid schedule ID")
+		return
+	}
+	if err := r.ParseForm(); err != nil {
+		h.renderAlert(w, "error", "Invalid form data")
+		return
+	}
+
+	sched := scheduleFromForm(r)
+	sched.ID = id
+	if err := h.scheduleService.Update(sched); err != nil {
+		log.Printf("Failed to update schedule: %v", err)
+		h.renderAlert(w, "error", "Failed to update schedule: "+err.Error())
+		return
+	}
+
+	h.userService.LogAction(&user.ID, "firewall_edit_schedule", scheduleDetails(sched), getClientIP(r))
+	h.renderAlert(w, "success", "Schedule "+sched.Name+" updated")
+}
+
+func (h *FirewallHandler) DeleteSchedule(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUser(r)
+
+	id, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		h.renderAlert(w, "error", "Invalid schedule ID")
+		return
+	}
+
+	sched, err := h.scheduleService.Get(id)
+	if err != nil {
+		h.renderAlert(w, "error", "Failed to delete schedule: "+err.Error())
+		return
+	}
+	if err := h.scheduleService.Delete(id); err != nil {
+		log.Printf("Failed to delete schedule: %v", err)
+		h.renderAlert(w, "error", "Failed to delete schedule: "+err.Error())
+		return
+	}
+
+	h.userService.LogAction(&user.ID, "firewall_delete_schedule", "Schedule: "+sched.Name, getClientIP(r))
+	h.renderAlert(w, "success", "Schedule "+sched.Name+" deleted")
+}
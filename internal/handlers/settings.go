@@ -8,6 +8,7 @@ import (
 
 	"linuxtorouter/internal/auth"
 	"linuxtorouter/internal/middleware"
+	"linuxtorouter/internal/models"
 	"linuxtorouter/internal/services"
 
 	"github.com/go-chi/chi/v5"
@@ -17,7 +18,8 @@ type SettingsHandler struct {
 	templates       TemplateExecutor
 	userService     *auth.UserService
 	persistService  *services.PersistService
-	iptablesService *services.IPTablesService
+	ipsetService    *services.IPSetService
+	firewallService services.FirewallBackend
 	routeService    *services.IPRouteService
 	ruleService     *services.IPRuleService
 }
@@ -26,7 +28,8 @@ func NewSettingsHandler(
 	templates TemplateExecutor,
 	userService *auth.UserService,
 	persistService *services.PersistService,
-	iptablesService *services.IPTablesService,
+	ipsetService *services.IPSetService,
+	firewallService services.FirewallBackend,
 	routeService *services.IPRouteService,
 	ruleService *services.IPRuleService,
 ) *SettingsHandler {
@@ -34,7 +37,8 @@ func NewSettingsHandler(
 		templates:       templates,
 		userService:     userService,
 		persistService:  persistService,
-		iptablesService: iptablesService,
+		ipsetService:    ipsetService,
+		firewallService: firewallService,
 		routeService:    routeService,
 		ruleService:     ruleService,
 	}
@@ -264,8 +268,14 @@ func (h *SettingsHandler) SaveAll(w http.ResponseWriter, r *http.Request) {
 
 	var errors []string
 
-	if err := h.iptablesService.SaveRules(); err != nil {
-		errors = append(errors, "iptables: "+err.Error())
+	if err := h.ipsetService.SaveSets(); err != nil {
+		errors = append(errors, "ipsets: "+err.Error())
+	}
+
+	for _, family := range models.IPFamilies {
+		if err := h.firewallService.SaveRules(family); err != nil {
+			errors = append(errors, string(family)+" firewall: "+err.Error())
+		}
 	}
 
 	if err := h.routeService.SaveRoutes(); err != nil {
@@ -0,0 +1,65 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"net/http"
+
+	"linuxtorouter/internal/middleware"
+	"linuxtorouter/internal/models"
+	"linuxtorouter/internal/services"
+)
+
+func (h *FirewallHandler) TracePage(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUser(r)
+
+	data := map[string]interface{}{
+		"Title":      "Packet Trace",
+		"ActivePage": "firewall",
+		"User":       user,
+		"Packet":     models.TracePacket{Protocol: "tcp", State: "NEW"},
+		"Protocols":  models.TraceProtocols,
+		"States":     models.TraceStates,
+		"Backend":    h.firewallService.Name(),
+	}
+
+	if err := h.templates.ExecuteTemplate(w, "firewall_trace.html", data); err != nil {
+		log.Printf("Template error: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	}
+}
+
+// RunTrace walks the packet described by the form through the ruleset
+func (h *FirewallHandler) RunTrace(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		h.renderAlert(w, "error", "Invalid form data")
+		return
+	}
+
+	packet := models.TracePacket{
+		InInterface:  r.FormValue("in_interface"),
+		OutInterface: r.FormValue("out_interface"),
+		Source:       r.FormValue("source"),
+		Destination:  r.FormValue("destination"),
+		Protocol:     r.FormValue("protocol"),
+		SPort:        r.FormValue("sport"),
+		DPort:        r.FormValue("dport"),
+		State:        r.FormValue("state"),
+	}
+
+	trace, err := h.traceService.Trace(packet)
+	if err != nil {
+		if errors.Is(err, services.ErrNotSupported) {
+			h.renderAlert(w, "error", "Packet tracing is only available with the iptables backend")
+			return
+		}
+		log.Printf("Failed to trace packet: %v", err)
+		h.renderAlert(w, "error", "Failed to trace packet: "+err.Error())
+		return
+	}
+
+	if err := h.templates.ExecuteTemplate(w, "firewall_trace_result.html", trace); err != nil {
+		log.Printf("Template error: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	}
+}
@@ -0,0 +1,246 @@
+package handlers
+
+import (
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"linuxtorouter/internal/middleware"
+	"linuxtorouter/internal/models"
+
+	"github.com/go-chi/chi/v5"
+)
+
+func (h *FirewallHandler) ListZones(w http.ResponseWriter, r *http.Request) {
+	user := middleware.GetUser(r)
+
+	data := h.zonesData()
+	data["Title"] = "Firewall Zones"
+	data["ActivePage"] = "firewall"
+	data["User"] = user
+	data["Actions"] = models.ZoneActions
+	data["NewZone"] = models.Zone{}
+	data["Pending"] = h.firewallService.PendingChange()
+
+	if err := h.templates.ExecuteTemplate(w, "firewall_zones.html", data); err != nil {
+		log.Printf("Template error: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	}
+}
+
+func (h *FirewallHandler) GetZones(w http.ResponseWriter, r *http.Request) {
+	data := h.zonesData()
+	data["Actions"] = models.ZoneActions
+
+	if err := h.templates.ExecuteTemplate(w, "firewall_zone_table.html", data); err != nil {
+		log.Printf("Template error: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	}
+}
+
+// zonesData loads the zones and policies shown on the zones page
+func (h *FirewallHandler) zonesData() map[string]interface{} {
+	var loadError string
+	zones, err := h.zoneService.ListZones()
+	if err != nil {
+		log.Printf("Failed to list zones: %v", err)
+		loadError = err.Error()
+	}
+	policies, err := h.zoneService.ListPolicies()
+	if err != nil {
+		log.Printf("Failed to list zone policies: %v", err)
+		loadError = err.Error()
+	}
+
+	return map[string]interface{}{
+		"Zones":    zones,
+		"Policies": policies,
+		"Error":    loadError,
+	}
+}
+
+// zoneFromForm reads the zone form shared by the add and edit dialogs
+func zoneFromForm(r *http.Request) models.Zone {
+	return models.Zone{
+		Name:        strings.TrimSpace(r.FormValue("name")),
+		Description: strings.TrimSpace(r.FormValue("description")),
+		Interfaces:  []string{r.FormValue("interfaces")},
+		InputAction: r.FormValue("input_action"),
+		Masquerade:  r.FormValue("masquerade") == "on",
+	}
+}
+
+// zoneDetails describes a zone for the audit log
+func zoneDetails(zone models.Zone) string {
+	details := "Zone: " + zone.Name + ", Interfaces: " + strings.Join(zone.Interfaces, " ")
+	if zone.InputAction != "" {
+		details += ", Input: " + zone.InputAction
+	}
+	if zone.Masquerade {
+		details += ", Masquerade"
+	}
+	return details
+}
+
+// applyZones recompiles the managed chains after a zone change has been
+// stored and renders the result
+func (h *FirewallHandler) applyZones(w http.ResponseWriter, r *http.Request, action, details, message, change string, timeout int) {
+	user := middleware.GetUser(r)
+
+	if err := h.zoneService.Compile(); err != nil {
+		log.Printf("Failed to compile zones: %v", err)
+		h.userService.LogAction(&user.ID, action, details+", Compile failed: "+err.Error(), getClientIP(r))
+		h.renderAlert(w, "error", "Saved, but applying the zone rules failed: "+err.Error()+h.disarmSafeApply(r, timeout, change))
+		return
+	}
+
+	h.userService.LogAction(&user.ID, action, details, getClientIP(r))
+	h.renderAlert(w, "success", message+safeApplySuffix(timeout))
+}
+
+func (h *FirewallHandler) CreateZone(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		h.renderAlert(w, "error", "Invalid form data")
+		return
+	}
+
+	zone := zoneFromForm(r)
+	details := zoneDetails(zone)
+	change := "Add zone " + zone.Name
+	timeout, ok := h.armSafeApply(w, r, change)
+	if !ok {
+		return
+	}
+
+	if err := h.zoneService.CreateZone(zone); err != nil {
+		log.Printf("Failed to create zone: %v", err)
+		h.renderAlert(w, "error", "Failed to create zone: "+err.Error()+h.disarmSafeApply(r, timeout, change))
+		return
+	}
+
+	h.applyZones(w, r, "firewall_create_zone", details, "Zone "+zone.Name+" created", change, timeout)
+}
+
+// EditZoneForm renders the edit dialog of a zone
+func (h *FirewallHandler) EditZoneForm(w http.ResponseWriter, r *http.Request) {
+	zone, err := h.zoneService.GetZone(chi.URLParam(r, "name"))
+	if err != nil {
+		log.Printf("Failed to load zone: %v", err)
+		h.renderAlert(w, "error", "Failed to load zone: "+err.Error())
+		return
+	}
+
+	data := map[string]interface{}{
+		"Zone":    zone,
+		"Actions": models.ZoneActions,
+	}
+
+	if err := h.templates.ExecuteTemplate(w, "firewall_zone_form.html", data); err != nil {
+		log.Printf("Template error: %v", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	}
+}
+
+func (h *FirewallHandler) UpdateZone(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		h.renderAlert(w, "error", "Invalid form data")
+		return
+	}
+
+	zone := zoneFromForm(r)
+	zone.Name = chi.URLParam(r, "name")
+	details := zoneDetails(zone)
+	change := "Edit zone " + zone.Name
+	timeout, ok := h.armSafeApply(w, r, change)
+	if !ok {
+		return
+	}
+
+	if err := h.zoneService.UpdateZone(zone); err != nil {
+		log.Printf("Failed to update zone: %v", err)
+		h.renderAlert(w, "error", "Failed to update zone: "+err.Error()+h.disarmSafeApply(r, timeout, change))
+		return
+	}
+
+	h.applyZones(w, r, "firewall_edit_zone", details, "Zone "+zone.Name+" updated", change, timeout)
+}
+
+func (h *FirewallHandler) DeleteZone(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+	change := "Delete zone " + name
+	timeout, ok := h.armSafeApply(w, r, change)
+	if !ok {
+		return
+	}
+
+	if err := h.zoneService.DeleteZone(name); err != nil {
+		log.Printf("Failed to delete zone: %v", err)
+		h.renderAlert(w, "error", "Failed to delete zone: "+err.Error()+h.disarmSafeApply(r, timeout, change))
+		return
+	}
+
+	h.applyZones(w, r, "firewall_delete_zone", "Zone: "+name, "Zone "+name+" deleted", change, timeout)
+}
+
+func (h *FirewallHandler) SetZonePolicy(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		h.renderAlert(w, "error", "Invalid form data")
+		return
+	}
+
+	policy := models.ZonePolicy{
+		FromZone: r.FormValue("from_zone"),
+		ToZone:   r.FormValue("to_zone"),
+		Action:   r.FormValue("action"),
+	}
+	details := "From: " + policy.FromZone + ", To: " + policy.ToZone + ", Action: " + policy.Action
+	change := "Set zone policy (" + details + ")"
+	timeout, ok := h.armSafeApply(w, r, change)
+	if !ok {
+		return
+	}
+
+	if err := h.zoneService.SetPolicy(policy); err != nil {
+		log.Printf("Failed to set zone policy: %v", err)
+		h.renderAlert(w, "error", "Failed to set zone policy: "+err.Error()+h.disarmSafeApply(r, timeout, change))
+		return
+	}
+
+	h.applyZones(w, r, "firewall_set_zone_policy", details,
+		"Policy "+policy.FromZone+" to "+policy.ToZone+" set to "+policy.Action, change, timeout)
+}
+
+func (h *FirewallHandler) DeleteZonePolicy(w http.ResponseWriter, r *http.Request) {
+	idStr := chi.URLParam(r, "id")
+	id, err := strconv.ParseInt(idStr, 10, 64)
+	if err != nil {
+		h.renderAlert(w, "error", "Invalid policy ID")
+		return
+	}
+
+	change := "Delete zone policy " + idStr
+	timeout, ok := h.armSafeApply(w, r, change)
+	if !ok {
+		return
+	}
+
+	if err := h.zoneService.DeletePolicy(id); err != nil {
+		log.Printf("Failed to delete zone policy: %v", err)
+		h.renderAlert(w, "error", "Failed to delete zone policy: "+err.Error()+h.disarmSafeApply(r, timeout, change))
+		return
+	}
+
+	h.applyZones(w, r, "firewall_delete_zone_policy", "Policy: "+idStr, "Zone policy deleted", change, timeout)
+}
+
+// CompileZones regenerates the managed chains without changing anything
+func (h *FirewallHandler) CompileZones(w http.ResponseWriter, r *http.Request) {
+	change := "Recompile zones"
+	timeout, ok := h.armSafeApply(w, r, change)
+	if !ok {
+		return
+	}
+
+	h.applyZones(w, r, "firewall_compile_zones", "", "Zone rules regenerated", change, timeout)
+}
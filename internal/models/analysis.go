@@ -0,0 +1,19 @@
+package models
+
+// Kinds of rule analysis warnings
+const (
+	WarningShadowed         = "shadowed"
+	WarningDuplicate        = "duplicate"
+	WarningMissingInterface = "missing_interface"
+	WarningEmptyChain       = "empty_chain"
+	WarningUnusedChain      = "unused_chain"
+)
+
+// RuleWarning is a problem found in a chain. RuleNum is 0 for warnings
+// about a chain as a whole.
+type RuleWarning struct {
+	Kind    string `json:"kind"`
+	Chain   string `json:"chain"`
+	RuleNum int    `json:"rule_num,omitempty"`
+	Message string `json:"message"`
+}
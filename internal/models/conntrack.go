@@ -0,0 +1,43 @@
+package models
+
+// ConntrackTuple is one direction of a tracked connection
+type ConntrackTuple struct {
+	Source      string `json:"source"`
+	Destination string `json:"destination"`
+	SPort       uint16 `json:"sport,omitempty"`
+	DPort       uint16 `json:"dport,omitempty"`
+	Packets     uint64 `json:"packets"`
+	Bytes       uint64 `json:"bytes"`
+}
+
+// ConntrackEntry is an entry of the kernel connection tracking table.
+// State is empty when the table was read over ctnetlink, which does not
+// report it in the library version used here.
+type ConntrackEntry struct {
+	Family      IPFamily       `json:"family"`
+	Protocol    string         `json:"protocol"`
+	ProtocolNum uint8          `json:"protocol_num"`
+	State       string         `json:"state,omitempty"`
+	Timeout     int            `json:"timeout,omitempty"`
+	Original    ConntrackTuple `json:"original"`
+	Reply       ConntrackTuple `json:"reply"`
+	NAT         string         `json:"nat,omitempty"`
+	Mark        uint32         `json:"mark"`
+	Flags       []string       `json:"flags,omitempty"`
+}
+
+// ConntrackFilter selects conntrack entries; empty fields match anything.
+// Address and Port match either end of either direction.
+type ConntrackFilter struct {
+	Family   IPFamily `json:"family,omitempty"`
+	Protocol string   `json:"protocol,omitempty"`
+	State    string   `json:"state,omitempty"`
+	Address  string   `json:"address,omitempty"`
+	Port     string   `json:"port,omitempty"`
+	Mark     string   `json:"mark,omitempty"`
+}
+
+// IsEmpty reports whether the filter matches every entry
+func (f ConntrackFilter) IsEmpty() bool {
+	return f == ConntrackFilter{}
+}
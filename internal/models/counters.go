@@ -0,0 +1,35 @@
+package models
+
+import "time"
+
+// CounterRanges are the time ranges the traffic graphs can show
+var CounterRanges = []string{"1h", "6h", "24h", "7d", "30d"}
+
+// CounterSample is the traffic counted during one interval
+type CounterSample struct {
+	Time    time.Time `json:"time"`
+	Packets uint64    `json:"packets"`
+	Bytes   uint64    `json:"bytes"`
+}
+
+// CounterSeries is the traffic history of a rule, or of all rules of a
+// chain, over a time range in equal steps. Key identifies the rule across
+// reloads: its comment when that is unique in the chain, otherwise a hash
+// of the rule. Num is the rule's current position, 0 when it no longer
+// exists or the series covers a chain.
+type CounterSeries struct {
+	Key     string          `json:"key"`
+	Family  IPFamily        `json:"family"`
+	Table   string          `json:"table"`
+	Chain   string          `json:"chain"`
+	Label   string          `json:"label"`
+	Num     int             `json:"num,omitempty"`
+	Step    time.Duration   `json:"step"`
+	Samples []CounterSample `json:"samples"`
+	Packets uint64          `json:"packets"`
+	Bytes   uint64          `json:"bytes"`
+	// PeakRate is the highest rate of a step in bytes per second
+	PeakRate uint64 `json:"peak_rate"`
+	// Gone reports a rule or chain that no longer exists
+	Gone bool `json:"gone,omitempty"`
+}
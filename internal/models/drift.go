@@ -0,0 +1,45 @@
+package models
+
+// Kinds of differences between the running and the saved rules
+const (
+	DriftAdded   = "added"
+	DriftRemoved = "removed"
+	DriftChanged = "changed"
+	DriftPolicy  = "policy"
+)
+
+// DriftChange is a difference between a running chain and its saved copy.
+// Num is the rule's position in the running chain, or in the saved chain
+// for removed rules.
+type DriftChange struct {
+	Kind    string `json:"kind"`
+	Num     int    `json:"num,omitempty"`
+	Running string `json:"running,omitempty"`
+	Saved   string `json:"saved,omitempty"`
+}
+
+// ChainDrift lists the differences of one chain. Status is DriftAdded for
+// a chain that only exists in the running rules and DriftRemoved for one
+// that only exists in the saved rules.
+type ChainDrift struct {
+	Table   string        `json:"table"`
+	Chain   string        `json:"chain"`
+	Status  string        `json:"status,omitempty"`
+	Changes []DriftChange `json:"changes"`
+}
+
+// RulesetDrift compares the running rules of a family with the rules file
+// restored at boot. Saved is false when the rules were never saved.
+type RulesetDrift struct {
+	Family  IPFamily     `json:"family"`
+	Saved   bool         `json:"saved"`
+	Chains  []ChainDrift `json:"chains"`
+	Added   int          `json:"added"`
+	Removed int          `json:"removed"`
+	Changed int          `json:"changed"`
+}
+
+// Differs reports whether the running rules differ from the saved ones
+func (d *RulesetDrift) Differs() bool {
+	return len(d.Chains) > 0
+}
@@ -1,8 +1,27 @@
 package models
 
+import "time"
+
+type IPFamily string
 type FirewallTable string
 type FirewallChain string
 
+const (
+	FamilyIPv4 IPFamily = "ipv4"
+	FamilyIPv6 IPFamily = "ipv6"
+)
+
+// IPFamilies lists the supported address families
+var IPFamilies = []IPFamily{FamilyIPv4, FamilyIPv6}
+
+// ParseIPFamily converts a form or query value to an IPFamily, defaulting to IPv4
+func ParseIPFamily(value string) IPFamily {
+	if value == string(FamilyIPv6) {
+		return FamilyIPv6
+	}
+	return FamilyIPv4
+}
+
 const (
 	TableFilter FirewallTable = "filter"
 	TableNAT    FirewallTable = "nat"
@@ -31,6 +50,94 @@ type FirewallRule struct {
 	Comment     string `json:"comment"`
 	Packets     uint64 `json:"packets"`
 	Bytes       uint64 `json:"bytes"`
+	// Handle is the nftables rule handle (nftables backend only)
+	Handle uint64 `json:"handle,omitempty"`
+	// Spec is the parsed rule specification (iptables backend only)
+	Spec *RuleSpec `json:"spec,omitempty"`
+}
+
+// RuleSpec is an iptables rule as written by iptables-save and iptables -S.
+// The Not* fields record a "!" in front of the corresponding option.
+type RuleSpec struct {
+	Chain           string        `json:"chain"`
+	Source          string        `json:"source,omitempty"`
+	NotSource       bool          `json:"not_source,omitempty"`
+	Destination     string        `json:"destination,omitempty"`
+	NotDestination  bool          `json:"not_destination,omitempty"`
+	InInterface     string        `json:"in_interface,omitempty"`
+	NotInInterface  bool          `json:"not_in_interface,omitempty"`
+	OutInterface    string        `json:"out_interface,omitempty"`
+	NotOutInterface bool          `json:"not_out_interface,omitempty"`
+	Protocol        string        `json:"protocol,omitempty"`
+	NotProtocol     bool          `json:"not_protocol,omitempty"`
+	Fragment        bool          `json:"fragment,omitempty"`
+	NotFragment     bool          `json:"not_fragment,omitempty"`
+	Matches         []RuleMatch   `json:"matches,omitempty"`
+	Target          string        `json:"target,omitempty"`
+	Goto            bool          `json:"goto,omitempty"`
+	TargetOptions   []RuleOption  `json:"target_options,omitempty"`
+	Counters        *RuleCounters `json:"counters,omitempty"`
+}
+
+// RuleMatch is a match module ("-m conntrack ...") with its options.
+// Implicit matches were loaded by "-p" without an explicit "-m".
+type RuleMatch struct {
+	Module   string       `json:"module"`
+	Implicit bool         `json:"implicit,omitempty"`
+	Options  []RuleOption `json:"options,omitempty"`
+}
+
+// RuleOption is a match or target option such as "--dport 22". Name has no
+// leading dashes; Quoted records that the value was quoted in the source.
+type RuleOption struct {
+	Name    string   `json:"name"`
+	Negated bool     `json:"negated,omitempty"`
+	Values  []string `json:"values,omitempty"`
+	Quoted  bool     `json:"quoted,omitempty"`
+}
+
+// RuleCounters are the packet and byte counters saved with a rule
+type RuleCounters struct {
+	Packets uint64 `json:"packets"`
+	Bytes   uint64 `json:"bytes"`
+}
+
+// Match returns the first match using the given module, or nil
+func (s *RuleSpec) Match(module string) *RuleMatch {
+	for i := range s.Matches {
+		if s.Matches[i].Module == module {
+			return &s.Matches[i]
+		}
+	}
+	return nil
+}
+
+// TargetOption returns the named target option, or nil
+func (s *RuleSpec) TargetOption(name string) *RuleOption {
+	for i := range s.TargetOptions {
+		if s.TargetOptions[i].Name == name {
+			return &s.TargetOptions[i]
+		}
+	}
+	return nil
+}
+
+// Option returns the named option of the match, or nil
+func (m *RuleMatch) Option(name string) *RuleOption {
+	for i := range m.Options {
+		if m.Options[i].Name == name {
+			return &m.Options[i]
+		}
+	}
+	return nil
+}
+
+// Value returns the first value of the option, or "" for flags
+func (o *RuleOption) Value() string {
+	if len(o.Values) == 0 {
+		return ""
+	}
+	return o.Values[0]
 }
 
 type ChainInfo struct {
@@ -42,19 +149,149 @@ type ChainInfo struct {
 }
 
 type FirewallRuleInput struct {
-	Table       string `json:"table"`
-	Chain       string `json:"chain"`
-	Position    int    `json:"position,omitempty"`
-	Protocol    string `json:"protocol,omitempty"`
-	Source      string `json:"source,omitempty"`
-	Destination string `json:"destination,omitempty"`
-	InInterface string `json:"in_interface,omitempty"`
-	OutInterface string `json:"out_interface,omitempty"`
-	DPort       string `json:"dport,omitempty"`
-	SPort       string `json:"sport,omitempty"`
-	Target      string `json:"target"`
-	ToDestination string `json:"to_destination,omitempty"`
-	ToSource    string `json:"to_source,omitempty"`
-	State       string `json:"state,omitempty"`
-	Comment     string `json:"comment,omitempty"`
+	Family        IPFamily `json:"family,omitempty"`
+	Table         string   `json:"table"`
+	Chain         string   `json:"chain"`
+	Position      int      `json:"position,omitempty"`
+	Protocol      string   `json:"protocol,omitempty"`
+	Source        string   `json:"source,omitempty"`
+	Destination   string   `json:"destination,omitempty"`
+	InInterface   string   `json:"in_interface,omitempty"`
+	OutInterface  string   `json:"out_interface,omitempty"`
+	DPort         string   `json:"dport,omitempty"`
+	SPort         string   `json:"sport,omitempty"`
+	Target        string   `json:"target"`
+	ToDestination string   `json:"to_destination,omitempty"`
+	ToSource      string   `json:"to_source,omitempty"`
+	State         string   `json:"state,omitempty"`
+	Comment       string   `json:"comment,omitempty"`
+	// MatchSet names an ipset the packet must be in; MatchSetDir lists
+	// the src/dst flags, one per dimension of the set (e.g. "src" or
+	// "dst,dst" for hash:ip,port)
+	MatchSet    string `json:"match_set,omitempty"`
+	MatchSetDir string `json:"match_set_dir,omitempty"`
+	// SourceObject, DestinationObject and ServiceObject name firewall
+	// objects used instead of Source, Destination and Protocol/DPort
+	SourceObject      string `json:"source_object,omitempty"`
+	DestinationObject string `json:"destination_object,omitempty"`
+	ServiceObject     string `json:"service_object,omitempty"`
+	// LogPrefix and LogLevel configure LOG and NFLOG targets; LogLevel
+	// only applies to LOG and NFLogGroup only to NFLOG
+	LogPrefix  string `json:"log_prefix,omitempty"`
+	LogLevel   string `json:"log_level,omitempty"`
+	NFLogGroup string `json:"nflog_group,omitempty"`
+	// Limit matches packets up to a rate such as "5/minute", allowing
+	// LimitBurst packets at once
+	Limit      string `json:"limit,omitempty"`
+	LimitBurst string `json:"limit_burst,omitempty"`
+	// HashLimit applies a rate to each source or destination separately,
+	// keyed by HashLimitMode (e.g. "srcip" or "srcip,dstport") and tracked
+	// in the HashLimitName table. It matches packets up to the rate, or
+	// over it with HashLimitAbove.
+	HashLimit      string `json:"hashlimit,omitempty"`
+	HashLimitBurst string `json:"hashlimit_burst,omitempty"`
+	HashLimitMode  string `json:"hashlimit_mode,omitempty"`
+	HashLimitName  string `json:"hashlimit_name,omitempty"`
+	HashLimitAbove bool   `json:"hashlimit_above,omitempty"`
+	// ConnLimit matches when a source address, or its network with a
+	// ConnLimitMask prefix length, has more than ConnLimit connections
+	ConnLimit     string `json:"connlimit,omitempty"`
+	ConnLimitMask string `json:"connlimit_mask,omitempty"`
+	// RecentName is a list of recently seen source addresses. RecentAction
+	// adds the source to it (set), checks it (rcheck), checks and refreshes
+	// it (update) or removes it (remove); RecentSeconds and RecentHitCount
+	// narrow rcheck and update to sources seen that often that recently.
+	RecentName     string `json:"recent_name,omitempty"`
+	RecentAction   string `json:"recent_action,omitempty"`
+	RecentSeconds  string `json:"recent_seconds,omitempty"`
+	RecentHitCount string `json:"recent_hitcount,omitempty"`
+	// TimeStart and TimeStop limit the rule to a time of day ("22:00");
+	// a stop before the start spans midnight. Weekdays lists days such as
+	// "Mon,Tue" and DateStart/DateStop bound the dates ("2024-06-01" or
+	// "2024-06-01T08:00"). Times are UTC unless KernelTZ is set.
+	TimeStart string `json:"time_start,omitempty"`
+	TimeStop  string `json:"time_stop,omitempty"`
+	Weekdays  string `json:"weekdays,omitempty"`
+	DateStart string `json:"date_start,omitempty"`
+	DateStop  string `json:"date_stop,omitempty"`
+	KernelTZ  bool   `json:"kernel_tz,omitempty"`
+}
+
+// LogLevels lists the syslog levels of the LOG target, most severe first
+var LogLevels = []string{"emerg", "alert", "crit", "err", "warning", "notice", "info", "debug"}
+
+// HashLimitModes lists common keys of a per-address rate limit
+var HashLimitModes = []string{"srcip", "dstip", "srcip,dstport", "srcip,dstip"}
+
+// RecentActions lists what a recent match does with the source address
+var RecentActions = []string{"set", "rcheck", "update", "remove"}
+
+// Weekdays lists the day names of the time match, Monday first
+var Weekdays = []string{"Mon", "Tue", "Wed", "Thu", "Fri", "Sat", "Sun"}
+
+// UsesObjects reports whether the rule references any firewall object
+func (i FirewallRuleInput) UsesObjects() bool {
+	return i.SourceObject != "" || i.DestinationObject != "" || i.ServiceObject != ""
+}
+
+// NftTable is an nftables table with its chains and sets
+type NftTable struct {
+	Family string     `json:"family"`
+	Name   string     `json:"name"`
+	Chains []NftChain `json:"chains"`
+	Sets   []NftSet   `json:"sets"`
+}
+
+// NftChain describes an nftables chain; Hook is empty for regular chains
+type NftChain struct {
+	Name     string `json:"name"`
+	Type     string `json:"type,omitempty"`
+	Hook     string `json:"hook,omitempty"`
+	Priority int    `json:"priority"`
+	Policy   string `json:"policy,omitempty"`
+	Rules    int    `json:"rules"`
+}
+
+// NftSet describes a named nftables set and its elements
+type NftSet struct {
+	Name     string   `json:"name"`
+	KeyType  string   `json:"key_type"`
+	Flags    []string `json:"flags,omitempty"`
+	Elements []string `json:"elements"`
+}
+
+// PendingFirewallChange is a firewall change that will be rolled back
+// unless it is confirmed before Deadline
+type PendingFirewallChange struct {
+	StartedAt time.Time `json:"started_at"`
+	Deadline  time.Time `json:"deadline"`
+	Changes   []string  `json:"changes"`
+}
+
+// SecondsLeft returns the number of seconds until the change is rolled back
+func (p PendingFirewallChange) SecondsLeft() int {
+	left := int(time.Until(p.Deadline).Seconds())
+	if left < 0 {
+		return 0
+	}
+	return left
+}
+
+// PortForward forwards a port on an external interface to an internal host.
+// It is made of a DNAT rule in nat PREROUTING and an ACCEPT rule in filter
+// FORWARD, plus a second DNAT rule and a MASQUERADE rule in nat POSTROUTING
+// when hairpin NAT is enabled. All of them carry the ID in their comment.
+type PortForward struct {
+	ID            string   `json:"id"`
+	Family        IPFamily `json:"family"`
+	Description   string   `json:"description,omitempty"`
+	Interface     string   `json:"interface"`
+	Protocol      string   `json:"protocol"`
+	ExternalPort  string   `json:"external_port"`
+	InternalHost  string   `json:"internal_host"`
+	InternalPort  string   `json:"internal_port,omitempty"`
+	Source        string   `json:"source,omitempty"`
+	Hairpin       bool     `json:"hairpin,omitempty"`
+	PublicAddress string   `json:"public_address,omitempty"`
+	LANNetwork    string   `json:"lan_network,omitempty"`
 }
@@ -0,0 +1,66 @@
+package models
+
+// Rule import formats
+const (
+	ImportIPTablesSave = "iptables-save"
+	ImportUFW          = "ufw"
+	ImportFirewalld    = "firewalld"
+)
+
+// ImportFormats lists the files the rule importer reads
+var ImportFormats = []string{ImportIPTablesSave, ImportUFW, ImportFirewalld}
+
+// Rule import modes: replace swaps the imported tables for the running
+// ones, append adds the imported rules after the running rules
+const (
+	ImportReplace = "replace"
+	ImportAppend  = "append"
+)
+
+// ImportRequest is an uploaded ruleset to convert
+type ImportRequest struct {
+	Format  string   `json:"format"`
+	Family  IPFamily `json:"family"`
+	Mode    string   `json:"mode"`
+	Content string   `json:"content"`
+	// Running identifies the running rules a preview was made against;
+	// an apply is refused when they have changed since
+	Running string `json:"running,omitempty"`
+}
+
+// ImportedRule is a converted rule. Rule is its iptables-save line and
+// Origin the line or element of the uploaded file it came from.
+type ImportedRule struct {
+	Table  string    `json:"table"`
+	Spec   *RuleSpec `json:"spec"`
+	Rule   string    `json:"rule"`
+	Origin string    `json:"origin,omitempty"`
+}
+
+// ImportSkipped is a part of the uploaded file that was not converted and
+// needs manual review
+type ImportSkipped struct {
+	Origin string `json:"origin"`
+	Reason string `json:"reason"`
+}
+
+// ImportDiffLine is a line of the iptables-save diff between the running
+// ruleset and the result of an import. Op is "+", "-" or " ".
+type ImportDiffLine struct {
+	Op   string `json:"op"`
+	Text string `json:"text"`
+}
+
+// ImportPreview is the result of converting an uploaded ruleset
+type ImportPreview struct {
+	Request ImportRequest    `json:"request"`
+	Rules   []ImportedRule   `json:"rules"`
+	Skipped []ImportSkipped  `json:"skipped"`
+	Notes   []string         `json:"notes,omitempty"`
+	Tables  []string         `json:"tables"`
+	Diff    []ImportDiffLine `json:"diff"`
+	Added   int              `json:"added"`
+	Removed int              `json:"removed"`
+	// Ruleset is the iptables-restore input applying the import
+	Ruleset string `json:"ruleset"`
+}
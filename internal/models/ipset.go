@@ -0,0 +1,15 @@
+package models
+
+// IPSetTypes lists the ipset types that can be created
+var IPSetTypes = []string{"hash:ip", "hash:net", "hash:ip,port"}
+
+// IPSet is a kernel ipset; Entries is only filled when a single set is
+// listed
+type IPSet struct {
+	Name       string   `json:"name"`
+	Type       string   `json:"type"`
+	Family     IPFamily `json:"family"`
+	References int      `json:"references"`
+	Count      int      `json:"count"`
+	Entries    []string `json:"entries,omitempty"`
+}
@@ -0,0 +1,48 @@
+package models
+
+import "time"
+
+// Firewall object types
+const (
+	ObjectTypeAddress = "address"
+	ObjectTypeGroup   = "group"
+	ObjectTypeService = "service"
+)
+
+// FirewallObjectTypes lists the object types that can be created
+var FirewallObjectTypes = []string{ObjectTypeAddress, ObjectTypeGroup, ObjectTypeService}
+
+// FirewallObject is a named, reusable rule operand. Depending on Type,
+// Values holds addresses and networks, the names of member address
+// objects and groups, or service entries such as "tcp/80,443".
+type FirewallObject struct {
+	ID          int64     `json:"id"`
+	Name        string    `json:"name"`
+	Type        string    `json:"type"`
+	Description string    `json:"description,omitempty"`
+	Values      []string  `json:"values"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+	// UsedBy describes the rules and groups referencing the object
+	UsedBy []string `json:"used_by,omitempty"`
+}
+
+// ObjectRule is a firewall rule that references objects. It is rendered
+// into one kernel rule per combination of addresses and protocols, each
+// carrying the ID in its comment, and re-rendered when an object changes.
+type ObjectRule struct {
+	ID        int64             `json:"id"`
+	Input     FirewallRuleInput `json:"input"`
+	CreatedAt time.Time         `json:"created_at"`
+	// State is empty while the running firewall matches the stored rule
+	State string `json:"state,omitempty"`
+}
+
+// Object rule states. A missing rule has none of its rendered rules in the
+// running firewall, e.g. after a chain flush or a reboot without saving. A
+// deleted rule has rendered rules back in the firewall, e.g. after a
+// rollback.
+const (
+	ObjectRuleMissing = "missing"
+	ObjectRuleDeleted = "deleted"
+)
@@ -0,0 +1,29 @@
+package models
+
+import "time"
+
+// PacketLogEntry is a packet received from an NFLOG rule. Ports are 0 for
+// protocols without ports.
+type PacketLogEntry struct {
+	ID           int64     `json:"id"`
+	Time         time.Time `json:"time"`
+	Group        int       `json:"group"`
+	Prefix       string    `json:"prefix,omitempty"`
+	Family       IPFamily  `json:"family"`
+	InInterface  string    `json:"in_interface,omitempty"`
+	OutInterface string    `json:"out_interface,omitempty"`
+	Protocol     string    `json:"protocol"`
+	Source       string    `json:"source"`
+	Destination  string    `json:"destination"`
+	SPort        uint16    `json:"sport,omitempty"`
+	DPort        uint16    `json:"dport,omitempty"`
+	Length       int       `json:"length"`
+}
+
+// PacketLogFilter selects logged packets; empty fields match anything.
+// Prefix matches part of the rule prefix, Address and Port either end.
+type PacketLogFilter struct {
+	Prefix  string `json:"prefix,omitempty"`
+	Address string `json:"address,omitempty"`
+	Port    string `json:"port,omitempty"`
+}
@@ -1,27 +1,96 @@
 package models
 
+import "net"
+
+// Route is a kernel route. Names follow iproute2: the unicast type, the
+// boot protocol and the global scope are left empty, as `ip route` omits
+// them. Nexthops is set instead of Gateway and Interface for multipath
+// routes. NexthopID is the nexthop object a route refers to; the kernel
+// still reports that object's gateway and interface.
 type Route struct {
-	Destination string `json:"destination"`
-	Gateway     string `json:"gateway"`
-	Interface   string `json:"interface"`
-	Metric      int    `json:"metric"`
-	Scope       string `json:"scope"`
-	Protocol    string `json:"protocol"`
-	Type        string `json:"type"`
-	Table       string `json:"table"`
-	Source      string `json:"source"`
-	Flags       string `json:"flags"`
+	Family      IPFamily       `json:"family"`
+	Destination string         `json:"destination"`
+	Gateway     string         `json:"gateway"`
+	Interface   string         `json:"interface"`
+	Nexthops    []RouteNexthop `json:"nexthops,omitempty"`
+	NexthopID   int            `json:"nhid,omitempty"`
+	Metric      int            `json:"metric"`
+	Scope       string         `json:"scope"`
+	Protocol    string         `json:"protocol"`
+	Type        string         `json:"type"`
+	Table       string         `json:"table"`
+	Source      string         `json:"source"`
+	Flags       string         `json:"flags"`
+	TOS         int            `json:"tos,omitempty"`
+	MTU         int            `json:"mtu,omitempty"`
+	AdvMSS      int            `json:"advmss,omitempty"`
+	Hoplimit    int            `json:"hoplimit,omitempty"`
+	InitCwnd    int            `json:"initcwnd,omitempty"`
+}
+
+// LinkLocalGateway reports whether the gateway is a link-local address,
+// which only means something together with the route's interface
+func (r Route) LinkLocalGateway() bool {
+	ip := net.ParseIP(r.Gateway)
+	return ip != nil && ip.IsLinkLocalUnicast()
+}
+
+// RouteNexthop is one path of a multipath route
+type RouteNexthop struct {
+	Gateway   string `json:"gateway"`
+	Interface string `json:"interface"`
+	Weight    int    `json:"weight"`
+	Flags     string `json:"flags,omitempty"`
 }
 
+// RouteInput adds a route through a gateway or interface, through
+// several weighted Nexthops, or through a nexthop object. Blackhole,
+// unreachable, prohibit and throw routes have none of these. Empty
+// attributes take the defaults of `ip route add`.
 type RouteInput struct {
-	Destination string `json:"destination"`
-	Gateway     string `json:"gateway"`
-	Interface   string `json:"interface"`
-	Metric      int    `json:"metric"`
-	Table       string `json:"table"`
+	Family      IPFamily       `json:"family"`
+	Type        string         `json:"type"`
+	Destination string         `json:"destination"`
+	Gateway     string         `json:"gateway"`
+	Interface   string         `json:"interface"`
+	Onlink      bool           `json:"onlink"`
+	Nexthops    []RouteNexthop `json:"nexthops,omitempty"`
+	NexthopID   int            `json:"nhid,omitempty"`
+	Metric      int            `json:"metric"`
+	Table       string         `json:"table"`
+	Source      string         `json:"source"`
+	Scope       string         `json:"scope"`
+	Protocol    string         `json:"protocol"`
+	MTU         int            `json:"mtu,omitempty"`
+	AdvMSS      int            `json:"advmss,omitempty"`
+	InitCwnd    int            `json:"initcwnd,omitempty"`
+}
+
+// Nexthop is a kernel nexthop object (`ip nexthop`) that routes refer to
+// by ID. It is a gateway and interface, a blackhole, or a group of other
+// nexthops sharing traffic by weight.
+type Nexthop struct {
+	ID        int                  `json:"id"`
+	Family    IPFamily             `json:"family,omitempty"`
+	Gateway   string               `json:"gateway,omitempty"`
+	Interface string               `json:"interface,omitempty"`
+	Flags     string               `json:"flags,omitempty"`
+	Blackhole bool                 `json:"blackhole,omitempty"`
+	Group     []NexthopGroupMember `json:"group,omitempty"`
+	Protocol  string               `json:"protocol,omitempty"`
+}
+
+// NexthopGroupMember is a nexthop of a group and its weight
+type NexthopGroupMember struct {
+	ID     int `json:"id"`
+	Weight int `json:"weight"`
 }
 
 type RoutingTable struct {
 	ID   int    `json:"id"`
 	Name string `json:"name"`
+	// File is the rt_tables file naming the table
+	File string `json:"file"`
+	// Editable is set for the tables that can be renamed or deleted
+	Editable bool `json:"editable"`
 }
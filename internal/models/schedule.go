@@ -0,0 +1,28 @@
+package models
+
+import "time"
+
+// RuleSchedule is a group of firewall rules added when the Start cron
+// expression fires and removed when the Stop one does. Rules holds one rule
+// per line in iptables syntax ("-A FORWARD -i guest0 -j DROP"); they are
+// inserted at the top of their chains in Table, tagged with the schedule ID
+// in their comment. Cron expressions use the server's local time.
+type RuleSchedule struct {
+	ID          int64     `json:"id"`
+	Name        string    `json:"name"`
+	Description string    `json:"description,omitempty"`
+	Family      IPFamily  `json:"family"`
+	Table       string    `json:"table"`
+	Start       string    `json:"start"`
+	Stop        string    `json:"stop"`
+	Rules       string    `json:"rules"`
+	Enabled     bool      `json:"enabled"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+	// Active reports whether the rules are currently in the firewall;
+	// NextStart and NextStop are zero when the expression does not fire
+	// within the scheduler's lookahead
+	Active    bool      `json:"active"`
+	NextStart time.Time `json:"next_start,omitempty"`
+	NextStop  time.Time `json:"next_stop,omitempty"`
+}
@@ -0,0 +1,46 @@
+package models
+
+// TracePacket is a hypothetical packet walked through the ruleset. The
+// interfaces decide its path: only InInterface for traffic to the router,
+// both for forwarded traffic and only OutInterface for traffic the router
+// sends itself.
+type TracePacket struct {
+	Family       IPFamily `json:"family"`
+	InInterface  string   `json:"in_interface,omitempty"`
+	OutInterface string   `json:"out_interface,omitempty"`
+	Source       string   `json:"source"`
+	Destination  string   `json:"destination"`
+	Protocol     string   `json:"protocol"`
+	SPort        string   `json:"sport,omitempty"`
+	DPort        string   `json:"dport,omitempty"`
+	State        string   `json:"state"`
+}
+
+// TraceStep is a rule that matched the packet, or the end of a chain when
+// none did. RuleNum is 0 for chain ends and policies. Unevaluated lists
+// the match modules of the rule that were assumed to match.
+type TraceStep struct {
+	Table       string   `json:"table"`
+	Chain       string   `json:"chain"`
+	Depth       int      `json:"depth"`
+	RuleNum     int      `json:"rule_num,omitempty"`
+	Rule        string   `json:"rule,omitempty"`
+	Action      string   `json:"action"`
+	Unevaluated []string `json:"unevaluated,omitempty"`
+}
+
+// PacketTrace is the result of walking a packet through the ruleset
+type PacketTrace struct {
+	Packet      TracePacket `json:"packet"`
+	Hooks       []string    `json:"hooks"`
+	Steps       []TraceStep `json:"steps"`
+	Verdict     string      `json:"verdict"`
+	Unevaluated []string    `json:"unevaluated,omitempty"`
+	Notes       []string    `json:"notes,omitempty"`
+}
+
+// TraceProtocols lists the protocols a trace packet can use
+var TraceProtocols = []string{"tcp", "udp", "icmp", "icmpv6", "sctp", "gre", "esp", "ah"}
+
+// TraceStates lists the conntrack states a trace packet can be in
+var TraceStates = []string{"NEW", "ESTABLISHED", "RELATED", "INVALID", "UNTRACKED"}
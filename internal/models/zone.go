@@ -0,0 +1,30 @@
+package models
+
+import "time"
+
+// ZoneActions lists the verdicts a zone or zone policy can apply
+var ZoneActions = []string{"ACCEPT", "DROP", "REJECT"}
+
+// Zone groups interfaces that share a trust level. InputAction decides
+// traffic from the zone to the router itself and is left to the rest of
+// the INPUT chain when empty. Masquerade rewrites the source address of
+// traffic leaving through the zone's interfaces.
+type Zone struct {
+	ID          int64     `json:"id"`
+	Name        string    `json:"name"`
+	Description string    `json:"description,omitempty"`
+	Interfaces  []string  `json:"interfaces"`
+	InputAction string    `json:"input_action,omitempty"`
+	Masquerade  bool      `json:"masquerade"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// ZonePolicy decides new connections forwarded from one zone to another.
+// Zone pairs without a policy fall through to the rest of FORWARD.
+type ZonePolicy struct {
+	ID       int64  `json:"id"`
+	FromZone string `json:"from_zone"`
+	ToZone   string `json:"to_zone"`
+	Action   string `json:"action"`
+}
@@ -0,0 +1,433 @@
+package services
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"linuxtorouter/internal/models"
+)
+
+// analysisTerminating lists targets after which a packet never reaches the
+// next rule of the chain
+var analysisTerminating = map[string]bool{
+	"ACCEPT": true, "DROP": true, "REJECT": true, "RETURN": true, "QUEUE": true,
+	"NFQUEUE": true, "DNAT": true, "SNAT": true, "MASQUERADE": true,
+	"REDIRECT": true, "NETMAP": true,
+}
+
+// RuleAnalysisService looks for rules that can never match, duplicates,
+// references to missing interfaces and unused or empty chains
+type RuleAnalysisService struct {
+	firewall FirewallBackend
+	netlink  *NetlinkService
+}
+
+func NewRuleAnalysisService(firewall FirewallBackend, netlink *NetlinkService) *RuleAnalysisService {
+	return &RuleAnalysisService{firewall: firewall, netlink: netlink}
+}
+
+// Analyze checks the chains of a table. Shadowed and duplicate rules are
+// only detected for backends that provide parsed rules (iptables).
+func (s *RuleAnalysisService) Analyze(family models.IPFamily, table string) ([]models.RuleWarning, error) {
+	chains, err := s.firewall.ListChains(family, table)
+	if err != nil {
+		return nil, err
+	}
+
+	// Interfaces are only checked when the list could be read
+	var interfaces map[string]bool
+	if links, err := s.netlink.ListInterfaces(); err == nil {
+		interfaces = make(map[string]bool, len(links))
+		for _, link := range links {
+			interfaces[link.Name] = true
+		}
+	}
+
+	userChains := make(map[string]*models.ChainInfo)
+	referenced := make(map[string]bool)
+	for i := range chains {
+		if chains[i].Policy == "-" {
+			userChains[chains[i].Name] = &chains[i]
+		}
+		for _, rule := range chains[i].Rules {
+			referenced[rule.Target] = true
+		}
+	}
+
+	var warnings []models.RuleWarning
+	for _, chain := range chains {
+		warnings = append(warnings, analyzeChainRules(chain)...)
+
+		for _, rule := range chain.Rules {
+			if interfaces != nil {
+				for _, iface := range ruleInterfaces(rule) {
+					if !interfaceExists(iface, interfaces) {
+						warnings = append(warnings, models.RuleWarning{
+							Kind:    models.WarningMissingInterface,
+							Chain:   chain.Name,
+							RuleNum: rule.Num,
+							Message: fmt.Sprintf("Rule %d uses interface %s, which does not exist", rule.Num, iface),
+						})
+					}
+				}
+			}
+
+			if target, ok := userChains[rule.Target]; ok && len(target.Rules) == 0 {
+				warnings = append(warnings, models.RuleWarning{
+					Kind:    models.WarningEmptyChain,
+					Chain:   chain.Name,
+					RuleNum: rule.Num,
+					Message: fmt.Sprintf("Rule %d jumps to chain %s, which has no rules", rule.Num, rule.Target),
+				})
+			}
+		}
+
+		if _, ok := userChains[chain.Name]; ok && !referenced[chain.Name] {
+			warnings = append(warnings, models.RuleWarning{
+				Kind:    models.WarningUnusedChain,
+				Chain:   chain.Name,
+				Message: fmt.Sprintf("Chain %s is not referenced by any rule", chain.Name),
+			})
+		}
+	}
+
+	return warnings, nil
+}
+
+// analyzeChainRules finds duplicates and rules shadowed by an earlier rule
+// that matches all of their traffic and ends the chain for it
+func analyzeChainRules(chain models.ChainInfo) []models.RuleWarning {
+	var warnings []models.RuleWarning
+	seen := make(map[string]int)
+	scopes := make([]*ruleScope, len(chain.Rules))
+
+	for j, rule := range chain.Rules {
+		if rule.Spec == nil {
+			continue
+		}
+		scopes[j] = scopeFromSpec(rule.Spec)
+
+		// Implicit and explicit protocol matches compare equal
+		spec := *rule.Spec
+		spec.Counters = nil
+		spec.Matches = append([]models.RuleMatch(nil), spec.Matches...)
+		for k := range spec.Matches {
+			spec.Matches[k].Implicit = false
+		}
+		key := FormatRuleSpec(&spec)
+		if first, ok := seen[key]; ok {
+			warnings = append(warnings, models.RuleWarning{
+				Kind:    models.WarningDuplicate,
+				Chain:   chain.Name,
+				RuleNum: rule.Num,
+				Message: fmt.Sprintf("Rule %d duplicates rule %d", rule.Num, first),
+			})
+			continue
+		}
+		seen[key] = rule.Num
+
+		for i := 0; i < j; i++ {
+			earlier := chain.Rules[i]
+			if scopes[i] == nil || !(analysisTerminating[earlier.Spec.Target] || earlier.Spec.Goto) {
+				continue
+			}
+			if scopes[i].covers(scopes[j]) {
+				target := earlier.Spec.Target
+				if earlier.Spec.Goto {
+					target = "goto " + target
+				}
+				warnings = append(warnings, models.RuleWarning{
+					Kind:    models.WarningShadowed,
+					Chain:   chain.Name,
+					RuleNum: rule.Num,
+					Message: fmt.Sprintf("Rule %d can never match: rule %d (%s) already matches all of its traffic",
+						rule.Num, earlier.Num, target),
+				})
+				break
+			}
+		}
+	}
+
+	return warnings
+}
+
+// ruleInterfaces returns the interfaces a rule matches on, without
+// negations
+func ruleInterfaces(rule models.FirewallRule) []string {
+	var names []string
+	if rule.Spec != nil {
+		names = []string{rule.Spec.InInterface, rule.Spec.OutInterface}
+	} else {
+		names = []string{strings.TrimPrefix(rule.In, "!"), strings.TrimPrefix(rule.Out, "!")}
+	}
+
+	var result []string
+	for _, name := range names {
+		if name != "" && name != "*" && name != "+" {
+			result = append(result, name)
+		}
+	}
+	return result
+}
+
+// interfaceExists checks a name, where a trailing "+" matches any suffix
+func interfaceExists(name string, interfaces map[string]bool) bool {
+	if !strings.HasSuffix(name, "+") {
+		return interfaces[name]
+	}
+	prefix := strings.TrimSuffix(name, "+")
+	for iface := range interfaces {
+		if strings.HasPrefix(iface, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// portRange is an inclusive range of ports
+type portRange struct{ lo, hi int }
+
+// ruleScope is the traffic a rule matches, split into the criteria the
+// analysis can compare. Matches it cannot compare are kept in canonical
+// form in other and only cover identical matches.
+type ruleScope struct {
+	spec   *models.RuleSpec
+	dports []portRange
+	sports []portRange
+	states map[string]bool
+	other  map[string]bool
+}
+
+func scopeFromSpec(spec *models.RuleSpec) *ruleScope {
+	s := &ruleScope{spec: spec, other: make(map[string]bool)}
+
+	for _, m := range spec.Matches {
+		if m.Module == "comment" {
+			continue
+		}
+		for _, opt := range m.Options {
+			if !opt.Negated && s.addOption(m.Module, opt) {
+				continue
+			}
+			s.other[FormatRuleSpec(&models.RuleSpec{Matches: []models.RuleMatch{{Module: m.Module, Options: []models.RuleOption{opt}}}})] = true
+		}
+		if len(m.Options) == 0 {
+			s.other[m.Module] = true
+		}
+	}
+
+	return s
+}
+
+// addOption records a port or state option, returning false for options
+// the analysis cannot compare or that restrict an already set criterion
+func (s *ruleScope) addOption(module string, opt models.RuleOption) bool {
+	var target *[]portRange
+	switch {
+	case (module == "tcp" || module == "udp" || module == "sctp") && (opt.Name == "dport" || opt.Name == "destination-port"):
+		target = &s.dports
+	case (module == "tcp" || module == "udp" || module == "sctp") && (opt.Name == "sport" || opt.Name == "source-port"):
+		target = &s.sports
+	case module == "multiport" && (opt.Name == "dports" || opt.Name == "destination-ports"):
+		target = &s.dports
+	case module == "multiport" && (opt.Name == "sports" || opt.Name == "source-ports"):
+		target = &s.sports
+	case (module == "conntrack" && opt.Name == "ctstate") || (module == "state" && opt.Name == "state"):
+		if s.states != nil {
+			return false
+		}
+		s.states = make(map[string]bool)
+		for _, state := range strings.Split(opt.Value(), ",") {
+			s.states[strings.ToUpper(state)] = true
+		}
+		return true
+	default:
+		return false
+	}
+
+	if *target != nil {
+		return false
+	}
+	ranges, ok := parsePortRanges(opt.Value())
+	if !ok {
+		return false
+	}
+	*target = ranges
+	return true
+}
+
+// covers reports whether every packet matched by o is also matched by s
+func (s *ruleScope) covers(o *ruleScope) bool {
+	a, b := s.spec, o.spec
+
+	if !addressCovers(a.Source, a.NotSource, b.Source, b.NotSource) ||
+		!addressCovers(a.Destination, a.NotDestination, b.Destination, b.NotDestination) ||
+		!interfaceCovers(a.InInterface, a.NotInInterface, b.InInterface, b.NotInInterface) ||
+		!interfaceCovers(a.OutInterface, a.NotOutInterface, b.OutInterface, b.NotOutInterface) {
+		return false
+	}
+
+	if a.Protocol != "" && a.Protocol != "all" {
+		if a.NotProtocol != b.NotProtocol || !strings.EqualFold(a.Protocol, b.Protocol) {
+			return false
+		}
+	}
+	if a.Fragment && (a.Fragment != b.Fragment || a.NotFragment != b.NotFragment) {
+		return false
+	}
+
+	if s.dports != nil && (o.dports == nil || !portRangesCover(s.dports, o.dports)) {
+		return false
+	}
+	if s.sports != nil && (o.sports == nil || !portRangesCover(s.sports, o.sports)) {
+		return false
+	}
+	if s.states != nil {
+		if o.states == nil {
+			return false
+		}
+		for state := range o.states {
+			if !s.states[state] {
+				return false
+			}
+		}
+	}
+	for key := range s.other {
+		if !o.other[key] {
+			return false
+		}
+	}
+
+	return true
+}
+
+// addressCovers compares two address criteria; negated ones only cover
+// the same negation
+func addressCovers(a string, notA bool, b string, notB bool) bool {
+	if a == "" {
+		return true
+	}
+	if notA || notB {
+		return notA == notB && a == b
+	}
+	if b == "" {
+		return false
+	}
+
+	netA, okA := parseAnalysisPrefix(a)
+	netB, okB := parseAnalysisPrefix(b)
+	if !okA || !okB {
+		return a == b
+	}
+	onesA, bitsA := netA.Mask.Size()
+	onesB, bitsB := netB.Mask.Size()
+	return bitsA == bitsB && onesA <= onesB && netA.Contains(netB.IP)
+}
+
+// parseAnalysisPrefix parses "addr", "addr/len" and "addr/dotted-mask"
+func parseAnalysisPrefix(value string) (*net.IPNet, bool) {
+	if !strings.Contains(value, "/") {
+		ip := net.ParseIP(value)
+		if ip == nil {
+			return nil, false
+		}
+		if ip.To4() != nil {
+			return &net.IPNet{IP: ip.To4(), Mask: net.CIDRMask(32, 32)}, true
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, true
+	}
+	if _, network, err := net.ParseCIDR(value); err == nil {
+		return network, true
+	}
+
+	base, mask, _ := strings.Cut(value, "/")
+	baseIP, maskIP := net.ParseIP(base).To4(), net.ParseIP(mask).To4()
+	if baseIP == nil || maskIP == nil {
+		return nil, false
+	}
+	m := net.IPMask(maskIP)
+	if ones, bits := m.Size(); ones == 0 && bits == 0 {
+		return nil, false
+	}
+	return &net.IPNet{IP: baseIP.Mask(m), Mask: m}, true
+}
+
+// interfaceCovers compares two interface criteria, where a trailing "+"
+// matches any suffix
+func interfaceCovers(a string, notA bool, b string, notB bool) bool {
+	if a == "" || (a == "+" && !notA) {
+		return true
+	}
+	if notA || notB {
+		return notA == notB && a == b
+	}
+	if b == "" {
+		return false
+	}
+	if !strings.HasSuffix(a, "+") {
+		return a == b
+	}
+	return strings.HasPrefix(strings.TrimSuffix(b, "+"), strings.TrimSuffix(a, "+"))
+}
+
+// parsePortRanges parses a comma separated list of ports and "first:last"
+// ranges into sorted, merged ranges
+func parsePortRanges(value string) ([]portRange, bool) {
+	var ranges []portRange
+	for _, item := range strings.Split(value, ",") {
+		first, last, isRange := strings.Cut(item, ":")
+		if !isRange {
+			last = first
+		}
+		if first == "" {
+			first = "0"
+		}
+		if last == "" {
+			last = "65535"
+		}
+		lo, err := strconv.Atoi(first)
+		if err != nil {
+			return nil, false
+		}
+		hi, err := strconv.Atoi(last)
+		if err != nil || hi < lo {
+			return nil, false
+		}
+		ranges = append(ranges, portRange{lo, hi})
+	}
+
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i].lo < ranges[j].lo })
+	merged := ranges[:1]
+	for _, r := range ranges[1:] {
+		last := &merged[len(merged)-1]
+		if r.lo <= last.hi+1 {
+			if r.hi > last.hi {
+				last.hi = r.hi
+			}
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return merged, true
+}
+
+// portRangesCover reports whether the merged ranges a contain every port
+// of b
+func portRangesCover(a, b []portRange) bool {
+	for _, rb := range b {
+		covered := false
+		for _, ra := range a {
+			if ra.lo <= rb.lo && rb.hi <= ra.hi {
+				covered = true
+				break
+			}
+		}
+		if !covered {
+			return false
+		}
+	}
+	return true
+}
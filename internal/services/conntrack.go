@@ -0,0 +1,384 @@
+package services
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"linuxtorouter/internal/models"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+)
+
+// conntrackProcFile lists the conntrack table with connection states when
+// the kernel has CONFIG_NF_CONNTRACK_PROCFS
+const conntrackProcFile = "/proc/net/nf_conntrack"
+
+// conntrackProtocols names the protocol numbers ctnetlink reports
+var conntrackProtocols = map[uint8]string{
+	1:   "icmp",
+	6:   "tcp",
+	17:  "udp",
+	33:  "dccp",
+	47:  "gre",
+	58:  "icmpv6",
+	132: "sctp",
+	136: "udplite",
+}
+
+// ConntrackService reads and deletes connection tracking entries. The table
+// is read from /proc/net/nf_conntrack when available, since it includes the
+// connection state, and over ctnetlink otherwise. Deletes always go through
+// ctnetlink.
+type ConntrackService struct{}
+
+func NewConntrackService() *ConntrackService {
+	return &ConntrackService{}
+}
+
+// List returns the entries matching the filter
+func (s *ConntrackService) List(filter models.ConntrackFilter) ([]models.ConntrackEntry, error) {
+	match, err := conntrackMatcher(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	entries, err := s.readProc()
+	if os.IsNotExist(err) {
+		// ctnetlink entries are read without their state, so a state
+		// filter would hide every entry
+		if filter.State != "" {
+			return nil, fmt.Errorf("filtering by state needs %s, which this kernel does not provide", conntrackProcFile)
+		}
+		entries, err = s.readNetlink()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var result []models.ConntrackEntry
+	for _, e := range entries {
+		if match(e) {
+			result = append(result, e)
+		}
+	}
+	return result, nil
+}
+
+// Delete removes the entry with the given family, protocol and original
+// tuple and returns the number of entries removed
+func (s *ConntrackService) Delete(entry models.ConntrackEntry) (uint, error) {
+	return s.deleteKeys(map[string]bool{conntrackEntryKey(entry): true})
+}
+
+// Flush removes all entries matching the filter and returns their number
+func (s *ConntrackService) Flush(filter models.ConntrackFilter) (uint, error) {
+	entries, err := s.List(filter)
+	if err != nil {
+		return 0, err
+	}
+
+	keys := make(map[string]bool, len(entries))
+	for _, e := range entries {
+		keys[conntrackEntryKey(e)] = true
+	}
+	return s.deleteKeys(keys)
+}
+
+// deleteKeys removes the entries whose key is in keys from both families
+func (s *ConntrackService) deleteKeys(keys map[string]bool) (uint, error) {
+	if len(keys) == 0 {
+		return 0, nil
+	}
+
+	var total uint
+	for _, family := range []netlink.InetFamily{unix.AF_INET, unix.AF_INET6} {
+		n, err := netlink.ConntrackDeleteFilter(netlink.ConntrackTable, family, conntrackKeyFilter(keys))
+		total += n
+		if err != nil {
+			return total, fmt.Errorf("failed to delete conntrack entries: %w", err)
+		}
+	}
+	return total, nil
+}
+
+// conntrackKeyFilter matches flows by conntrackFlowKey
+type conntrackKeyFilter map[string]bool
+
+func (f conntrackKeyFilter) MatchConntrackFlow(flow *netlink.ConntrackFlow) bool {
+	return f[conntrackFlowKey(flow)]
+}
+
+// conntrackEntryKey identifies an entry by its original direction. Ports
+// are only included for protocols that have them.
+func conntrackEntryKey(e models.ConntrackEntry) string {
+	key := fmt.Sprintf("%d %s %s", e.ProtocolNum, normalizeIP(e.Original.Source), normalizeIP(e.Original.Destination))
+	if conntrackHasPorts(e.ProtocolNum) {
+		key += fmt.Sprintf(" %d %d", e.Original.SPort, e.Original.DPort)
+	}
+	return key
+}
+
+// conntrackFlowKey is conntrackEntryKey for a ctnetlink flow
+func conntrackFlowKey(flow *netlink.ConntrackFlow) string {
+	return conntrackEntryKey(models.ConntrackEntry{
+		ProtocolNum: flow.Forward.Protocol,
+		Original: models.ConntrackTuple{
+			Source:      flow.Forward.SrcIP.String(),
+			Destination: flow.Forward.DstIP.String(),
+			SPort:       flow.Forward.SrcPort,
+			DPort:       flow.Forward.DstPort,
+		},
+	})
+}
+
+func conntrackHasPorts(proto uint8) bool {
+	switch proto {
+	case 6, 17, 33, 132, 136:
+		return true
+	}
+	return false
+}
+
+// normalizeIP formats an address the way net.IP does so that keys built
+// from /proc and ctnetlink compare equal
+func normalizeIP(addr string) string {
+	if ip := net.ParseIP(addr); ip != nil {
+		return ip.String()
+	}
+	return addr
+}
+
+// readProc parses /proc/net/nf_conntrack, e.g.
+//
+//	ipv4 2 tcp 6 431999 ESTABLISHED src=10.0.0.2 dst=1.1.1.1 sport=5555 dport=443 packets=10 bytes=1000 src=1.1.1.1 dst=203.0.113.5 sport=443 dport=5555 packets=8 bytes=2000 [ASSURED] mark=0 zone=0 use=2
+func (s *ConntrackService) readProc() ([]models.ConntrackEntry, error) {
+	file, err := os.Open(conntrackProcFile)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var entries []models.ConntrackEntry
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if entry, ok := parseConntrackLine(scanner.Text()); ok {
+			entries = append(entries, entry)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", conntrackProcFile, err)
+	}
+
+	return entries, nil
+}
+
+// parseConntrackLine parses one line of /proc/net/nf_conntrack
+func parseConntrackLine(line string) (models.ConntrackEntry, bool) {
+	fields := strings.Fields(line)
+	if len(fields) < 5 {
+		return models.ConntrackEntry{}, false
+	}
+
+	entry := models.ConntrackEntry{
+		Family:   models.ParseIPFamily(fields[0]),
+		Protocol: fields[2],
+	}
+	if n, err := strconv.ParseUint(fields[3], 10, 8); err == nil {
+		entry.ProtocolNum = uint8(n)
+	}
+	entry.Timeout, _ = strconv.Atoi(fields[4])
+
+	// The original tuple comes first; a second src= starts the reply tuple
+	tuple := &entry.Original
+	sources := 0
+	for _, field := range fields[5:] {
+		if strings.HasPrefix(field, "[") {
+			entry.Flags = append(entry.Flags, strings.Trim(field, "[]"))
+			continue
+		}
+
+		key, value, ok := strings.Cut(field, "=")
+		if !ok {
+			entry.State = field
+			continue
+		}
+
+		switch key {
+		case "src":
+			sources++
+			if sources == 2 {
+				tuple = &entry.Reply
+			}
+			tuple.Source = value
+		case "dst":
+			tuple.Destination = value
+		case "sport":
+			tuple.SPort = parsePort(value)
+		case "dport":
+			tuple.DPort = parsePort(value)
+		case "packets":
+			tuple.Packets, _ = strconv.ParseUint(value, 10, 64)
+		case "bytes":
+			tuple.Bytes, _ = strconv.ParseUint(value, 10, 64)
+		case "mark":
+			if n, err := strconv.ParseUint(value, 10, 32); err == nil {
+				entry.Mark = uint32(n)
+			}
+		}
+	}
+
+	entry.NAT = conntrackNAT(entry)
+	return entry, true
+}
+
+func parsePort(value string) uint16 {
+	n, _ := strconv.ParseUint(value, 10, 16)
+	return uint16(n)
+}
+
+// readNetlink dumps the table of both families over ctnetlink
+func (s *ConntrackService) readNetlink() ([]models.ConntrackEntry, error) {
+	var entries []models.ConntrackEntry
+	for _, family := range models.IPFamilies {
+		inet := netlink.InetFamily(unix.AF_INET)
+		if family == models.FamilyIPv6 {
+			inet = unix.AF_INET6
+		}
+
+		flows, err := netlink.ConntrackTableList(netlink.ConntrackTable, inet)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list conntrack table: %w", err)
+		}
+
+		for _, flow := range flows {
+			entry := models.ConntrackEntry{
+				Family:      family,
+				Protocol:    conntrackProtocolName(flow.Forward.Protocol),
+				ProtocolNum: flow.Forward.Protocol,
+				Original:    conntrackTuple(flow.Forward.SrcIP, flow.Forward.DstIP, flow.Forward.SrcPort, flow.Forward.DstPort, flow.Forward.Packets, flow.Forward.Bytes),
+				Reply:       conntrackTuple(flow.Reverse.SrcIP, flow.Reverse.DstIP, flow.Reverse.SrcPort, flow.Reverse.DstPort, flow.Reverse.Packets, flow.Reverse.Bytes),
+				Mark:        flow.Mark,
+			}
+			if !conntrackHasPorts(entry.ProtocolNum) {
+				entry.Original.SPort, entry.Original.DPort = 0, 0
+				entry.Reply.SPort, entry.Reply.DPort = 0, 0
+			}
+			entry.NAT = conntrackNAT(entry)
+			entries = append(entries, entry)
+		}
+	}
+
+	return entries, nil
+}
+
+func conntrackTuple(src, dst net.IP, sport, dport uint16, packets, bytes uint64) models.ConntrackTuple {
+	return models.ConntrackTuple{
+		Source:      src.String(),
+		Destination: dst.String(),
+		SPort:       sport,
+		DPort:       dport,
+		Packets:     packets,
+		Bytes:       bytes,
+	}
+}
+
+func conntrackProtocolName(proto uint8) string {
+	if name, ok := conntrackProtocols[proto]; ok {
+		return name
+	}
+	return strconv.Itoa(int(proto))
+}
+
+// conntrackNAT describes the address translation of an entry. Without NAT
+// the reply tuple is the original one reversed.
+func conntrackNAT(e models.ConntrackEntry) string {
+	var parts []string
+	if e.Reply.Source != e.Original.Destination || e.Reply.SPort != e.Original.DPort {
+		parts = append(parts, "DNAT to "+ConntrackEndpoint(e.Reply.Source, e.Reply.SPort))
+	}
+	if e.Reply.Destination != e.Original.Source || e.Reply.DPort != e.Original.SPort {
+		parts = append(parts, "SNAT to "+ConntrackEndpoint(e.Reply.Destination, e.Reply.DPort))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// ConntrackEndpoint formats an address and optional port, with IPv6
+// addresses in brackets when there is a port
+func ConntrackEndpoint(addr string, port uint16) string {
+	if port == 0 {
+		return addr
+	}
+	return net.JoinHostPort(addr, strconv.Itoa(int(port)))
+}
+
+// conntrackMatcher compiles a filter into a match function
+func conntrackMatcher(filter models.ConntrackFilter) (func(models.ConntrackEntry) bool, error) {
+	var network *net.IPNet
+	if filter.Address != "" {
+		addr := filter.Address
+		if !strings.Contains(addr, "/") {
+			if ip := net.ParseIP(addr); ip != nil && ip.To4() == nil {
+				addr += "/128"
+			} else {
+				addr += "/32"
+			}
+		}
+		_, n, err := net.ParseCIDR(addr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid address: %s", filter.Address)
+		}
+		network = n
+	}
+
+	var port uint16
+	if filter.Port != "" {
+		n, err := strconv.ParseUint(filter.Port, 10, 16)
+		if err != nil || n == 0 {
+			return nil, fmt.Errorf("invalid port: %s", filter.Port)
+		}
+		port = uint16(n)
+	}
+
+	var mark uint32
+	if filter.Mark != "" {
+		n, err := strconv.ParseUint(filter.Mark, 0, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid mark: %s", filter.Mark)
+		}
+		mark = uint32(n)
+	}
+
+	inNetwork := func(addr string) bool {
+		ip := net.ParseIP(addr)
+		return ip != nil && network.Contains(ip)
+	}
+
+	return func(e models.ConntrackEntry) bool {
+		if filter.Family != "" && e.Family != filter.Family {
+			return false
+		}
+		if filter.Protocol != "" && !strings.EqualFold(e.Protocol, filter.Protocol) {
+			return false
+		}
+		if filter.State != "" && !strings.EqualFold(e.State, filter.State) {
+			return false
+		}
+		if network != nil && !inNetwork(e.Original.Source) && !inNetwork(e.Original.Destination) &&
+			!inNetwork(e.Reply.Source) && !inNetwork(e.Reply.Destination) {
+			return false
+		}
+		if port != 0 && e.Original.SPort != port && e.Original.DPort != port &&
+			e.Reply.SPort != port && e.Reply.DPort != port {
+			return false
+		}
+		if filter.Mark != "" && e.Mark != mark {
+			return false
+		}
+		return true
+	}, nil
+}
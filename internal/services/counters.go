@@ -0,0 +1,542 @@
+package services
+
+import (
+	"crypto/sha1"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"linuxtorouter/internal/database"
+	"linuxtorouter/internal/models"
+)
+
+const (
+	// counterSampleInterval is how often the rule counters are read
+	counterSampleInterval = time.Minute
+	// counterRawRetention is how long samples are kept at full resolution
+	// before they are summed into counterRollupStep buckets
+	counterRawRetention = 48 * time.Hour
+	// counterRollupStep is the resolution of older samples
+	counterRollupStep = time.Hour
+	// counterRetention is how long any sample is kept
+	counterRetention = 90 * 24 * time.Hour
+)
+
+// counterTables are the tables whose rules are sampled
+var counterTables = []string{"filter", "nat", "mangle", "raw"}
+
+// counterRangeSteps maps each graph range to the width of its steps, which
+// keeps every graph between 60 and 168 points
+var counterRangeSteps = map[string]struct{ span, step time.Duration }{
+	"1h":  {time.Hour, time.Minute},
+	"6h":  {6 * time.Hour, 5 * time.Minute},
+	"24h": {24 * time.Hour, 15 * time.Minute},
+	"7d":  {7 * 24 * time.Hour, time.Hour},
+	"30d": {30 * 24 * time.Hour, 6 * time.Hour},
+}
+
+// counterReading is the state of one rule at a sample
+type counterReading struct {
+	family         models.IPFamily
+	table, chain   string
+	label          string
+	packets, bytes uint64
+}
+
+// RuleCounterService records the packet and byte counters of every rule
+// and chain policy once a minute. Only the difference to the previous
+// reading is stored, so counters reset by a restore or a reload simply
+// start over. Samples older than counterRawRetention are summed into
+// hourly buckets, which are kept for counterRetention.
+type RuleCounterService struct {
+	db       *database.DB
+	firewall FirewallBackend
+
+	mu         sync.Mutex
+	last       map[string]counterReading
+	lastRollup time.Time
+}
+
+func NewRuleCounterService(db *database.DB, firewall FirewallBackend) *RuleCounterService {
+	return &RuleCounterService{db: db, firewall: firewall}
+}
+
+// Start samples the counters at the beginning of every minute. The first
+// reading only sets the baseline.
+func (s *RuleCounterService) Start() {
+	go func() {
+		for {
+			if err := s.sample(time.Now()); err != nil {
+				log.Printf("Failed to record rule counters: %v", err)
+			}
+			now := time.Now()
+			time.Sleep(now.Truncate(counterSampleInterval).Add(counterSampleInterval).Sub(now))
+		}
+	}()
+}
+
+// read returns the current counters of all rules and policies by key
+func (s *RuleCounterService) read() map[string]counterReading {
+	readings := make(map[string]counterReading)
+	for _, family := range models.IPFamilies {
+		for _, table := range counterTables {
+			chains, err := s.firewall.ListChains(family, table)
+			if err != nil {
+				continue
+			}
+			for _, chain := range chains {
+				for key, reading := range chainReadings(family, table, chain) {
+					readings[key] = reading
+				}
+			}
+		}
+	}
+	return readings
+}
+
+// chainReadings returns the counters of the rules and the policy of a
+// chain by key
+func chainReadings(family models.IPFamily, table string, chain models.ChainInfo) map[string]counterReading {
+	readings := make(map[string]counterReading)
+	prefix := counterKeyPrefix(family, table, chain.Name)
+	if chain.Policy != "-" && chain.Policy != "" {
+		readings[prefix+"policy"] = counterReading{family, table, chain.Name, "Policy " + chain.Policy, chain.Packets, chain.Bytes}
+	}
+	for i, id := range ruleCounterIDs(chain.Rules) {
+		rule := chain.Rules[i]
+		readings[prefix+id] = counterReading{family, table, chain.Name, ruleCounterLabel(rule), rule.Packets, rule.Bytes}
+	}
+	return readings
+}
+
+// counterKeyPrefix is the part of a key naming the chain
+func counterKeyPrefix(family models.IPFamily, table, chain string) string {
+	return string(family) + "/" + table + "/" + chain + "/"
+}
+
+// ruleCounterIDs returns the identity of each rule within its chain: its
+// comment when no other rule of the chain has the same one, otherwise a
+// hash of the rule, numbered when identical rules repeat
+func ruleCounterIDs(rules []models.FirewallRule) []string {
+	comments := make(map[string]int)
+	for _, rule := range rules {
+		if c := ruleComment(rule.Comment); c != "" {
+			comments[c]++
+		}
+	}
+
+	ids := make([]string, len(rules))
+	seen := make(map[string]int)
+	for i, rule := range rules {
+		if c := ruleComment(rule.Comment); c != "" && comments[c] == 1 {
+			ids[i] = "comment:" + c
+			continue
+		}
+		sum := sha1.Sum([]byte(ruleCounterLabel(rule) + "\x00" + rule.Comment))
+		id := "rule:" + hex.EncodeToString(sum[:8])
+		seen[id]++
+		if seen[id] > 1 {
+			id += fmt.Sprintf("#%d", seen[id])
+		}
+		ids[i] = id
+	}
+	return ids
+}
+
+// ruleCounterLabel describes a rule without its counters
+func ruleCounterLabel(rule models.FirewallRule) string {
+	if rule.Spec != nil {
+		spec := *rule.Spec
+		spec.Counters = nil
+		return strings.TrimPrefix(FormatRuleSpec(&spec), "-A "+spec.Chain+" ")
+	}
+
+	var parts []string
+	for _, p := range []struct{ label, value string }{
+		{"-p ", rule.Protocol}, {"-i ", rule.In}, {"-o ", rule.Out},
+		{"-s ", rule.Source}, {"-d ", rule.Destination},
+	} {
+		if p.value != "" && p.value != "*" && p.value != "all" && p.value != "0.0.0.0/0" && p.value != "::/0" {
+			parts = append(parts, p.label+p.value)
+		}
+	}
+	if rule.Extra != "" {
+		parts = append(parts, rule.Extra)
+	}
+	if rule.Target != "" {
+		parts = append(parts, "-j "+rule.Target)
+	}
+	return strings.Join(parts, " ")
+}
+
+// sample stores the traffic of every rule since the previous reading
+func (s *RuleCounterService) sample(now time.Time) error {
+	readings := s.read()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.last == nil {
+		s.last = readings
+		return nil
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := s.record(tx, readings, now); err != nil {
+		return err
+	}
+	// Forget rules that are gone
+	s.last = readings
+
+	if now.Sub(s.lastRollup) >= counterRollupStep {
+		if err := rollupCounters(tx, now); err != nil {
+			return err
+		}
+		s.lastRollup = now
+	}
+
+	return tx.Commit()
+}
+
+// record stores the difference between readings and the previous reading
+// of the same rules and makes readings the new baseline
+func (s *RuleCounterService) record(tx *sql.Tx, readings map[string]counterReading, now time.Time) error {
+	for key, cur := range readings {
+		if _, err := tx.Exec(`INSERT INTO rule_counters (key, family, table_name, chain, label, last_seen)
+			VALUES (?, ?, ?, ?, ?, ?)
+			ON CONFLICT(key) DO UPDATE SET label = excluded.label, last_seen = excluded.last_seen`,
+			key, string(cur.family), cur.table, cur.chain, cur.label, now.Unix()); err != nil {
+			return err
+		}
+
+		prev, ok := s.last[key]
+		s.last[key] = cur
+		if !ok {
+			continue
+		}
+		packets, bytes := cur.packets-prev.packets, cur.bytes-prev.bytes
+		if cur.packets < prev.packets || cur.bytes < prev.bytes {
+			// The counters were reset outside of ZeroCounters, e.g. by a
+			// restore, since the last reading
+			packets, bytes = cur.packets, cur.bytes
+		}
+		if packets == 0 && bytes == 0 {
+			continue
+		}
+		if _, err := tx.Exec(`INSERT INTO rule_counter_samples (rule_key, resolution, sampled_at, packets, bytes)
+			VALUES (?, ?, ?, ?, ?)
+			ON CONFLICT(rule_key, resolution, sampled_at) DO UPDATE SET
+				packets = packets + excluded.packets, bytes = bytes + excluded.bytes`,
+			key, int64(counterSampleInterval.Seconds()), now.Unix(), packets, bytes); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ZeroCounters resets the counters of a table, a chain or a rule through
+// the firewall backend. The traffic counted since the last sample is stored
+// first and zero becomes the new baseline of the affected rules, so the
+// reset shows neither as a drop nor as a burst in the history.
+func (s *RuleCounterService) ZeroCounters(family models.IPFamily, table, chain string, ruleNum int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	before := make(map[string]counterReading)
+	var chains []models.ChainInfo
+	if chain == "" {
+		chains, _ = s.firewall.ListChains(family, table)
+	} else if info, err := s.firewall.GetChain(family, table, chain); err == nil {
+		chains = append(chains, *info)
+	}
+	for _, c := range chains {
+		readings := chainReadings(family, table, c)
+		if ruleNum > 0 {
+			// Only the rule itself; -Z with a rule number leaves the policy
+			ids := ruleCounterIDs(c.Rules)
+			if ruleNum > len(ids) {
+				readings = nil
+			} else {
+				key := counterKeyPrefix(family, table, c.Name) + ids[ruleNum-1]
+				readings = map[string]counterReading{key: readings[key]}
+			}
+		}
+		for key, reading := range readings {
+			before[key] = reading
+		}
+	}
+
+	if err := s.firewall.ZeroCounters(family, table, chain, ruleNum); err != nil {
+		return err
+	}
+
+	if s.last == nil {
+		return nil
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err := s.record(tx, before, time.Now()); err != nil {
+		return err
+	}
+	for key, reading := range before {
+		reading.packets, reading.bytes = 0, 0
+		s.last[key] = reading
+	}
+
+	return tx.Commit()
+}
+
+// rollupCounters sums the samples older than counterRawRetention into
+// hourly buckets and removes everything older than counterRetention
+func rollupCounters(tx *sql.Tx, now time.Time) error {
+	raw := int64(counterSampleInterval.Seconds())
+	step := int64(counterRollupStep.Seconds())
+	cutoff := now.Add(-counterRawRetention).Truncate(counterRollupStep).Unix()
+
+	if _, err := tx.Exec(`INSERT INTO rule_counter_samples (rule_key, resolution, sampled_at, packets, bytes)
+		SELECT rule_key, ?, sampled_at - sampled_at % ?, SUM(packets), SUM(bytes)
+		FROM rule_counter_samples WHERE resolution = ? AND sampled_at < ?
+		GROUP BY rule_key, sampled_at - sampled_at % ?
+		ON CONFLICT(rule_key, resolution, sampled_at) DO UPDATE SET
+			packets = packets + excluded.packets, bytes = bytes + excluded.bytes`,
+		step, step, raw, cutoff, step); err != nil {
+		return fmt.Errorf("failed to roll up counters: %w", err)
+	}
+	if _, err := tx.Exec(`DELETE FROM rule_counter_samples WHERE resolution = ? AND sampled_at < ?`, raw, cutoff); err != nil {
+		return err
+	}
+
+	expired := now.Add(-counterRetention).Unix()
+	if _, err := tx.Exec(`DELETE FROM rule_counter_samples WHERE sampled_at < ?`, expired); err != nil {
+		return err
+	}
+	_, err := tx.Exec(`DELETE FROM rule_counters WHERE last_seen < ?`, expired)
+	return err
+}
+
+// CounterRange returns the span and step of a graph range, defaulting to
+// the last 24 hours
+func CounterRange(name string) (string, time.Duration, time.Duration) {
+	r, ok := counterRangeSteps[name]
+	if !ok {
+		name = "24h"
+		r = counterRangeSteps[name]
+	}
+	return name, r.span, r.step
+}
+
+// ChainSeries returns the traffic of each chain of a table, summed over its
+// rules and policy
+func (s *RuleCounterService) ChainSeries(family models.IPFamily, table, rangeName string) ([]models.CounterSeries, error) {
+	rules, err := s.history(family, table, "", rangeName)
+	if err != nil {
+		return nil, err
+	}
+
+	byChain := make(map[string]*models.CounterSeries)
+	var names []string
+	chains, listErr := s.firewall.ListChains(family, table)
+	for _, chain := range chains {
+		names = append(names, chain.Name)
+	}
+	for _, rule := range rules {
+		chain, ok := byChain[rule.Chain]
+		if !ok {
+			chain = &models.CounterSeries{
+				Key: counterKeyPrefix(family, table, rule.Chain), Family: family, Table: table, Chain: rule.Chain,
+				Label: rule.Chain, Step: rule.Step, Samples: make([]models.CounterSample, len(rule.Samples)),
+			}
+			for i := range rule.Samples {
+				chain.Samples[i].Time = rule.Samples[i].Time
+			}
+			byChain[rule.Chain] = chain
+		}
+		for i, sample := range rule.Samples {
+			chain.Samples[i].Packets += sample.Packets
+			chain.Samples[i].Bytes += sample.Bytes
+		}
+	}
+
+	// Chains that no longer exist but still have history come last
+	present := make(map[string]bool)
+	for _, name := range names {
+		present[name] = true
+	}
+	var gone []string
+	for name := range byChain {
+		if !present[name] {
+			gone = append(gone, name)
+		}
+	}
+	sort.Strings(gone)
+
+	_, span, step := CounterRange(rangeName)
+	var series []models.CounterSeries
+	for _, name := range append(names, gone...) {
+		chain, ok := byChain[name]
+		if !ok {
+			chain = &models.CounterSeries{
+				Key: counterKeyPrefix(family, table, name), Family: family, Table: table, Chain: name, Label: name,
+				Step: step, Samples: emptyCounterSamples(time.Now(), span, step),
+			}
+		}
+		chain.Gone = listErr == nil && !present[name]
+		summarizeCounterSeries(chain)
+		series = append(series, *chain)
+	}
+	return series, nil
+}
+
+// RuleSeries returns the traffic of each rule of a chain, in chain order,
+// followed by the policy and by rules that no longer exist
+func (s *RuleCounterService) RuleSeries(family models.IPFamily, table, chain, rangeName string) ([]models.CounterSeries, error) {
+	series, err := s.history(family, table, chain, rangeName)
+	if err != nil {
+		return nil, err
+	}
+
+	if info, err := s.firewall.GetChain(family, table, chain); err == nil {
+		prefix := counterKeyPrefix(family, table, chain)
+		nums := make(map[string]int)
+		for i, id := range ruleCounterIDs(info.Rules) {
+			nums[prefix+id] = info.Rules[i].Num
+		}
+		for i := range series {
+			series[i].Num = nums[series[i].Key]
+			series[i].Gone = series[i].Num == 0 && !strings.HasSuffix(series[i].Key, "/policy")
+		}
+	}
+
+	order := func(rs models.CounterSeries) int {
+		switch {
+		case rs.Num > 0:
+			return rs.Num
+		case strings.HasSuffix(rs.Key, "/policy"):
+			return 1 << 30
+		default:
+			return 1<<30 + 1
+		}
+	}
+	sort.SliceStable(series, func(i, j int) bool {
+		if order(series[i]) != order(series[j]) {
+			return order(series[i]) < order(series[j])
+		}
+		return series[i].Label < series[j].Label
+	})
+	return series, nil
+}
+
+// history returns the series of every rule of a table, or of one chain,
+// seen during the range
+func (s *RuleCounterService) history(family models.IPFamily, table, chain, rangeName string) ([]models.CounterSeries, error) {
+	_, span, step := CounterRange(rangeName)
+	now := time.Now()
+	template := emptyCounterSamples(now, span, step)
+	from := template[0].Time
+
+	query := `SELECT key, chain, label FROM rule_counters WHERE family = ? AND table_name = ? AND last_seen >= ?`
+	args := []any{string(family), table, from.Unix()}
+	if chain != "" {
+		query += ` AND chain = ?`
+		args = append(args, chain)
+	}
+	rows, err := s.db.Query(query+` ORDER BY key`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list rule counters: %w", err)
+	}
+	var series []models.CounterSeries
+	index := make(map[string]int)
+	for rows.Next() {
+		rs := models.CounterSeries{Family: family, Table: table, Step: step}
+		if err := rows.Scan(&rs.Key, &rs.Chain, &rs.Label); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		rs.Samples = make([]models.CounterSample, len(template))
+		copy(rs.Samples, template)
+		index[rs.Key] = len(series)
+		series = append(series, rs)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	query = `SELECT s.rule_key, s.sampled_at, s.packets, s.bytes FROM rule_counter_samples s
+		JOIN rule_counters c ON c.key = s.rule_key
+		WHERE c.family = ? AND c.table_name = ? AND s.sampled_at >= ?`
+	if chain != "" {
+		query += ` AND c.chain = ?`
+	}
+	rows, err = s.db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read rule counters: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var key string
+		var at int64
+		var packets, bytes uint64
+		if err := rows.Scan(&key, &at, &packets, &bytes); err != nil {
+			return nil, err
+		}
+		i, ok := index[key]
+		if !ok {
+			continue
+		}
+		bucket := int(time.Unix(at, 0).Sub(from) / step)
+		if bucket < 0 || bucket >= len(template) {
+			continue
+		}
+		series[i].Samples[bucket].Packets += packets
+		series[i].Samples[bucket].Bytes += bytes
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i := range series {
+		summarizeCounterSeries(&series[i])
+	}
+	return series, nil
+}
+
+// emptyCounterSamples returns the steps of a range ending with the step
+// that contains now
+func emptyCounterSamples(now time.Time, span, step time.Duration) []models.CounterSample {
+	end := now.Truncate(step).Add(step)
+	samples := make([]models.CounterSample, span/step)
+	for i := range samples {
+		samples[i].Time = end.Add(-span + time.Duration(i)*step)
+	}
+	return samples
+}
+
+// summarizeCounterSeries fills the totals and the peak rate of a series
+func summarizeCounterSeries(series *models.CounterSeries) {
+	series.Packets, series.Bytes, series.PeakRate = 0, 0, 0
+	seconds := uint64(series.Step.Seconds())
+	for _, sample := range series.Samples {
+		series.Packets += sample.Packets
+		series.Bytes += sample.Bytes
+		if rate := sample.Bytes / seconds; rate > series.PeakRate {
+			series.PeakRate = rate
+		}
+	}
+}
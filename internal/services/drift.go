@@ -0,0 +1,235 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"linuxtorouter/internal/models"
+)
+
+// RuleDriftService compares the running iptables rules with the rules
+// files SaveRules writes and RestoreRules loads at boot. It requires the
+// iptables backend.
+type RuleDriftService struct {
+	firewall FirewallBackend
+}
+
+func NewRuleDriftService(firewall FirewallBackend) *RuleDriftService {
+	return &RuleDriftService{firewall: firewall}
+}
+
+// Drift returns the added, removed and changed rules of every chain
+// between the saved rules of a family and the running ones
+func (s *RuleDriftService) Drift(family models.IPFamily) (*models.RulesetDrift, error) {
+	if s.firewall.Name() != "iptables" {
+		return nil, ErrNotSupported
+	}
+
+	drift := &models.RulesetDrift{Family: family, Saved: true}
+
+	output, err := s.firewall.GetRawRules(family)
+	if err != nil {
+		return nil, err
+	}
+	running, err := parseRulesetTables(output)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse running rules: %w", err)
+	}
+
+	output, err = s.firewall.GetSavedRules(family)
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+		drift.Saved = false
+	}
+	saved, err := parseRulesetTables(output)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse saved rules: %w", err)
+	}
+
+	for _, name := range driftTableNames(running, saved) {
+		rt, st := running[name], saved[name]
+		if rt == nil {
+			rt = newRulesetTable(name)
+		}
+		if st == nil {
+			st = newRulesetTable(name)
+		}
+
+		// Running chains in order, then the chains only in the saved rules
+		var chains []string
+		for _, c := range rt.chains {
+			chains = append(chains, c.name)
+		}
+		for _, c := range st.chains {
+			if _, ok := rt.index[c.name]; !ok {
+				chains = append(chains, c.name)
+			}
+		}
+
+		for _, chain := range chains {
+			cd := compareChains(name, chain, rt.index[chain], st.index[chain])
+			if cd.Status == "" && len(cd.Changes) == 0 {
+				continue
+			}
+			for _, change := range cd.Changes {
+				switch change.Kind {
+				case models.DriftAdded:
+					drift.Added++
+				case models.DriftRemoved:
+					drift.Removed++
+				default:
+					drift.Changed++
+				}
+			}
+			drift.Chains = append(drift.Chains, cd)
+		}
+	}
+
+	return drift, nil
+}
+
+// driftTableNames returns the tables of both rulesets, the common ones in
+// their usual order first
+func driftTableNames(running, saved map[string]*rulesetTable) []string {
+	var names, others []string
+	seen := make(map[string]bool)
+	for _, name := range importTableOrder {
+		seen[name] = true
+		if running[name] != nil || saved[name] != nil {
+			names = append(names, name)
+		}
+	}
+	for _, tables := range []map[string]*rulesetTable{running, saved} {
+		for name := range tables {
+			if !seen[name] {
+				seen[name] = true
+				others = append(others, name)
+			}
+		}
+	}
+	sort.Strings(others)
+	return append(names, others...)
+}
+
+// compareChains diffs the rules of a chain. A built-in chain missing on
+// one side counts as empty with an ACCEPT policy, which is how the kernel
+// creates it; a missing user chain makes the whole chain added or removed.
+func compareChains(table, name string, running, saved *rulesetChain) models.ChainDrift {
+	cd := models.ChainDrift{Table: table, Chain: name}
+	builtin := isBuiltinChain(table, name) || (running != nil && running.policy != "-") ||
+		(saved != nil && saved.policy != "-")
+
+	switch {
+	case running == nil && !builtin:
+		cd.Status = models.DriftRemoved
+		running = &rulesetChain{name: name, policy: "-"}
+	case saved == nil && !builtin:
+		cd.Status = models.DriftAdded
+		saved = &rulesetChain{name: name, policy: "-"}
+	case running == nil:
+		running = &rulesetChain{name: name, policy: "ACCEPT"}
+	case saved == nil:
+		saved = &rulesetChain{name: name, policy: "ACCEPT"}
+	}
+
+	if running.policy != saved.policy && builtin {
+		cd.Changes = append(cd.Changes, models.DriftChange{
+			Kind: models.DriftPolicy, Running: running.policy, Saved: saved.policy,
+		})
+	}
+
+	ruleLines := func(c *rulesetChain) []string {
+		lines := make([]string, len(c.rules))
+		for i, spec := range c.rules {
+			lines[i] = FormatRuleSpec(spec)
+		}
+		return lines
+	}
+
+	// Pair each run of removed lines with the added lines that follow it,
+	// so a rule edited in place shows as changed
+	diff := diffLines(ruleLines(saved), ruleLines(running))
+	savedNum, runningNum := 0, 0
+	for k := 0; k < len(diff); {
+		if diff[k].Op == " " {
+			savedNum++
+			runningNum++
+			k++
+			continue
+		}
+
+		var removed, added []string
+		for k < len(diff) && diff[k].Op == "-" {
+			removed = append(removed, diff[k].Text)
+			k++
+		}
+		for k < len(diff) && diff[k].Op == "+" {
+			added = append(added, diff[k].Text)
+			k++
+		}
+
+		for n := 0; n < max(len(removed), len(added)); n++ {
+			switch {
+			case n < len(removed) && n < len(added):
+				cd.Changes = append(cd.Changes, models.DriftChange{
+					Kind: models.DriftChanged, Num: runningNum + n + 1, Running: added[n], Saved: removed[n],
+				})
+			case n < len(removed):
+				cd.Changes = append(cd.Changes, models.DriftChange{
+					Kind: models.DriftRemoved, Num: savedNum + n + 1, Saved: removed[n],
+				})
+			default:
+				cd.Changes = append(cd.Changes, models.DriftChange{
+					Kind: models.DriftAdded, Num: runningNum + n + 1, Running: added[n],
+				})
+			}
+		}
+		savedNum += len(removed)
+		runningNum += len(added)
+	}
+
+	return cd
+}
+
+// parseRulesetTables reads iptables-save output into its tables, without
+// counters
+func parseRulesetTables(output string) (map[string]*rulesetTable, error) {
+	tables := make(map[string]*rulesetTable)
+	var table *rulesetTable
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "" || strings.HasPrefix(line, "#"):
+		case strings.HasPrefix(line, "*"):
+			name := line[1:]
+			if table = tables[name]; table == nil {
+				table = newRulesetTable(name)
+				tables[name] = table
+			}
+		case line == "COMMIT":
+			table = nil
+		case table == nil:
+			return nil, fmt.Errorf("line outside of a table: %s", line)
+		case strings.HasPrefix(line, ":"):
+			fields := strings.Fields(line[1:])
+			if len(fields) < 2 {
+				return nil, fmt.Errorf("invalid chain line: %s", line)
+			}
+			table.chain(fields[0], fields[1]).policy = fields[1]
+		default:
+			spec, err := ParseRuleSpec(line)
+			if err != nil {
+				return nil, err
+			}
+			spec.Counters = nil
+			c := table.chain(spec.Chain, "-")
+			c.rules = append(c.rules, spec)
+		}
+	}
+	return tables, nil
+}
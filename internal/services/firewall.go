@@ -0,0 +1,70 @@
+package services
+
+import (
+	"errors"
+	"time"
+
+	"linuxtorouter/internal/models"
+)
+
+// ErrNotSupported is returned by a firewall backend for operations it
+// cannot perform
+var ErrNotSupported = errors.New("operation not supported by this firewall backend")
+
+// ManagedChain is a chain whose rules are generated as a whole, such as the
+// ZONE_* chains, together with the built-in chain that jumps to it
+type ManagedChain struct {
+	Table  string
+	Chain  string
+	Parent string
+	Rules  []models.FirewallRuleInput
+}
+
+// FirewallBackend is the packet filter managed by the firewall pages.
+// Tables and chains use the iptables names (filter, nat, mangle, raw and
+// INPUT, FORWARD, ...) regardless of the backend.
+type FirewallBackend interface {
+	// Name identifies the backend in the UI ("iptables" or "nftables")
+	Name() string
+
+	ListChains(family models.IPFamily, table string) ([]models.ChainInfo, error)
+	GetChain(family models.IPFamily, table, chain string) (*models.ChainInfo, error)
+	AddRule(input models.FirewallRuleInput) error
+	DeleteRule(family models.IPFamily, table, chain string, ruleNum int) error
+	// RuleInput returns the rule form values of an existing rule and the
+	// parts of it the form cannot represent
+	RuleInput(family models.IPFamily, table, chain string, ruleNum int) (*models.FirewallRuleInput, []string, error)
+	ReplaceRule(ruleNum int, input models.FirewallRuleInput) error
+	MoveRule(family models.IPFamily, table, chain string, fromPos, toPos int) error
+	SetPolicy(family models.IPFamily, table, chain, policy string) error
+	CreateChain(family models.IPFamily, table, chain string) error
+	DeleteChain(family models.IPFamily, table, chain string) error
+	FlushChain(family models.IPFamily, table, chain string) error
+	// ReplaceChains creates each chain if it is missing, replaces its rules
+	// and leaves exactly one jump to it at the top of its parent, all in one
+	// transaction so no packet sees a chain half filled
+	ReplaceChains(family models.IPFamily, chains []ManagedChain) error
+	// ZeroCounters resets the packet and byte counters of every chain of a
+	// table when chain is empty, of one chain when ruleNum is 0, or of the
+	// rule at ruleNum
+	ZeroCounters(family models.IPFamily, table, chain string, ruleNum int) error
+
+	SaveRules(family models.IPFamily) error
+	RestoreRules(family models.IPFamily) error
+	GetRawRules(family models.IPFamily) (string, error)
+	// GetSavedRules returns the rules file written by SaveRules, or an
+	// error wrapping os.ErrNotExist if the rules were never saved
+	GetSavedRules(family models.IPFamily) (string, error)
+	// ApplyRuleset loads an iptables-restore input with counters, replacing
+	// the tables it contains in a single transaction
+	ApplyRuleset(family models.IPFamily, ruleset string) error
+
+	BeginSafeApply(timeout time.Duration, description string, onRollback func(models.PendingFirewallChange, error)) error
+	// CancelSafeApply withdraws a BeginSafeApply whose change failed if
+	// the ruleset is unchanged, and reports false when the rollback stays
+	// pending because the failed change left something behind
+	CancelSafeApply(description string) (bool, error)
+	ConfirmChanges() (*models.PendingFirewallChange, error)
+	RollbackChanges() (*models.PendingFirewallChange, error)
+	PendingChange() *models.PendingFirewallChange
+}
@@ -0,0 +1,968 @@
+package services
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"linuxtorouter/internal/models"
+)
+
+// maxImportSize is the largest ruleset file accepted
+const maxImportSize = 1 << 20
+
+// importBuiltinChains lists the built-in chains of each table, which every
+// iptables-restore table section declares
+var importBuiltinChains = map[string][]string{
+	"filter": {"INPUT", "FORWARD", "OUTPUT"},
+	"nat":    {"PREROUTING", "INPUT", "OUTPUT", "POSTROUTING"},
+	"mangle": {"PREROUTING", "INPUT", "FORWARD", "OUTPUT", "POSTROUTING"},
+	"raw":    {"PREROUTING", "OUTPUT"},
+}
+
+// importTableOrder is the order of tables in the ruleset and the diff
+var importTableOrder = []string{"raw", "mangle", "nat", "filter"}
+
+// rulesetChain is a chain of a ruleset being imported or built
+type rulesetChain struct {
+	name           string
+	policy         string
+	declared       bool
+	packets, bytes uint64
+	rules          []*models.RuleSpec
+}
+
+// rulesetTable is a table of a ruleset, keeping its chains in order
+type rulesetTable struct {
+	name   string
+	chains []*rulesetChain
+	index  map[string]*rulesetChain
+}
+
+func newRulesetTable(name string) *rulesetTable {
+	return &rulesetTable{name: name, index: make(map[string]*rulesetChain)}
+}
+
+// chain returns a chain of the table, adding it with policy if missing
+func (t *rulesetTable) chain(name, policy string) *rulesetChain {
+	if c, ok := t.index[name]; ok {
+		return c
+	}
+	c := &rulesetChain{name: name, policy: policy}
+	t.chains = append(t.chains, c)
+	t.index[name] = c
+	return c
+}
+
+// lines renders the table in iptables-save syntax, with or without the
+// counters
+func (t *rulesetTable) lines(counters bool) []string {
+	lines := []string{"*" + t.name}
+	for _, c := range t.chains {
+		line := ":" + c.name + " " + c.policy
+		if counters {
+			line += fmt.Sprintf(" [%d:%d]", c.packets, c.bytes)
+		}
+		lines = append(lines, line)
+	}
+	for _, c := range t.chains {
+		for _, spec := range c.rules {
+			rule := *spec
+			if !counters {
+				rule.Counters = nil
+			}
+			lines = append(lines, FormatRuleSpec(&rule))
+		}
+	}
+	return append(lines, "COMMIT")
+}
+
+// importResult collects what a parser converted
+type importResult struct {
+	family  models.IPFamily
+	tables  map[string]*rulesetTable
+	rules   []models.ImportedRule
+	skipped []models.ImportSkipped
+	notes   []string
+}
+
+func newImportResult(family models.IPFamily) *importResult {
+	return &importResult{family: family, tables: make(map[string]*rulesetTable)}
+}
+
+func (res *importResult) table(name string) *rulesetTable {
+	t, ok := res.tables[name]
+	if !ok {
+		t = newRulesetTable(name)
+		for _, chain := range importBuiltinChains[name] {
+			t.chain(chain, "ACCEPT")
+		}
+		res.tables[name] = t
+	}
+	return t
+}
+
+func (res *importResult) skip(origin, reason string, args ...any) {
+	res.skipped = append(res.skipped, models.ImportSkipped{Origin: origin, Reason: fmt.Sprintf(reason, args...)})
+}
+
+// add appends a converted rule to its chain, creating user chains as
+// needed. Rules with addresses of the other family are skipped.
+func (res *importResult) add(table string, spec *models.RuleSpec, origin string) {
+	for _, addr := range []string{spec.Source, spec.Destination} {
+		if addr == "" {
+			continue
+		}
+		if err := validateAddressFamily(res.family, addr); err != nil {
+			res.skip(origin, "%v", err)
+			return
+		}
+	}
+
+	t := res.table(table)
+	policy := "-"
+	if isBuiltinChain(table, spec.Chain) {
+		policy = "ACCEPT"
+	}
+	c := t.chain(spec.Chain, policy)
+	c.rules = append(c.rules, spec)
+	res.rules = append(res.rules, models.ImportedRule{Table: table, Spec: spec, Rule: FormatRuleSpec(spec), Origin: origin})
+}
+
+func isBuiltinChain(table, chain string) bool {
+	for _, name := range importBuiltinChains[table] {
+		if name == chain {
+			return true
+		}
+	}
+	return false
+}
+
+// RuleImportService converts iptables-save dumps, ufw user rules and
+// firewalld zones into iptables rules, previews the change against the
+// running ruleset and applies it in a single iptables-restore transaction.
+// It requires the iptables backend.
+type RuleImportService struct {
+	firewall FirewallBackend
+}
+
+func NewRuleImportService(firewall FirewallBackend) *RuleImportService {
+	return &RuleImportService{firewall: firewall}
+}
+
+// Preview converts an uploaded ruleset and compares the result with the
+// running rules
+func (s *RuleImportService) Preview(req models.ImportRequest) (*models.ImportPreview, error) {
+	if s.firewall.Name() != "iptables" {
+		return nil, ErrNotSupported
+	}
+	if len(req.Content) > maxImportSize {
+		return nil, fmt.Errorf("file too large (max %d KB)", maxImportSize/1024)
+	}
+	if strings.TrimSpace(req.Content) == "" {
+		return nil, fmt.Errorf("the file is empty")
+	}
+	if req.Mode != models.ImportAppend {
+		req.Mode = models.ImportReplace
+	}
+
+	res := newImportResult(req.Family)
+	switch req.Format {
+	case models.ImportIPTablesSave:
+		parseIPTablesSaveImport(req.Content, res)
+	case models.ImportUFW:
+		parseUFWImport(req.Content, res)
+	case models.ImportFirewalld:
+		if err := parseFirewalldImport(req.Content, res); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unknown format: %s", req.Format)
+	}
+
+	preview := &models.ImportPreview{
+		Request: req,
+		Rules:   res.rules,
+		Skipped: res.skipped,
+		Notes:   res.notes,
+	}
+
+	var ruleset strings.Builder
+	running := sha256.New()
+	for _, name := range importTableOrder {
+		imported, ok := res.tables[name]
+		if !ok {
+			continue
+		}
+		table, err := s.runningTable(req.Family, name)
+		if err != nil {
+			return nil, err
+		}
+		for _, line := range table.lines(false) {
+			running.Write([]byte(line + "\n"))
+		}
+
+		result := mergeImportTable(table, imported, req.Mode)
+		preview.Tables = append(preview.Tables, name)
+		for _, line := range diffLines(table.lines(false), result.lines(false)) {
+			switch line.Op {
+			case "+":
+				preview.Added++
+			case "-":
+				preview.Removed++
+			}
+			preview.Diff = append(preview.Diff, line)
+		}
+		ruleset.WriteString(strings.Join(result.lines(true), "\n") + "\n")
+	}
+	preview.Ruleset = ruleset.String()
+	preview.Request.Running = hex.EncodeToString(running.Sum(nil))
+
+	return preview, nil
+}
+
+// Apply converts an uploaded ruleset again and loads the result. The
+// conversion only depends on the upload and the running rules, so it is
+// refused unless the running rules are still those of the preview.
+func (s *RuleImportService) Apply(req models.ImportRequest) (*models.ImportPreview, error) {
+	previewed := req.Running
+	preview, err := s.Preview(req)
+	if err != nil {
+		return nil, err
+	}
+	if previewed == "" || previewed != preview.Request.Running {
+		return nil, fmt.Errorf("the running rules changed since the preview; preview the import again")
+	}
+	if len(preview.Tables) == 0 {
+		return nil, fmt.Errorf("no rules could be converted")
+	}
+	if err := s.firewall.ApplyRuleset(req.Family, preview.Ruleset); err != nil {
+		return nil, err
+	}
+	return preview, nil
+}
+
+// runningTable reads a running table with its counters
+func (s *RuleImportService) runningTable(family models.IPFamily, name string) (*rulesetTable, error) {
+	chains, err := s.firewall.ListChains(family, name)
+	if err != nil {
+		return nil, err
+	}
+
+	t := newRulesetTable(name)
+	for _, info := range chains {
+		c := t.chain(info.Name, info.Policy)
+		c.packets, c.bytes = info.Packets, info.Bytes
+		for _, rule := range info.Rules {
+			if rule.Spec == nil {
+				return nil, ErrNotSupported
+			}
+			c.rules = append(c.rules, rule.Spec)
+		}
+	}
+	return t, nil
+}
+
+// mergeImportTable returns the table an import leaves behind. Replace
+// keeps only the imported chains and rules, taking the running policy of
+// built-in chains the import does not declare; append adds the imported
+// chains and rules after the running ones and keeps the running policies.
+func mergeImportTable(running, imported *rulesetTable, mode string) *rulesetTable {
+	result := newRulesetTable(running.name)
+
+	if mode == models.ImportReplace {
+		for _, c := range imported.chains {
+			policy := c.policy
+			if r, ok := running.index[c.name]; ok && isBuiltinChain(running.name, c.name) && !c.declared {
+				policy = r.policy
+			}
+			rc := result.chain(c.name, policy)
+			rc.rules = c.rules
+		}
+		return result
+	}
+
+	for _, c := range running.chains {
+		rc := result.chain(c.name, c.policy)
+		rc.packets, rc.bytes = c.packets, c.bytes
+		rc.rules = append(rc.rules, c.rules...)
+	}
+	for _, c := range imported.chains {
+		rc := result.chain(c.name, c.policy)
+		rc.rules = append(rc.rules, c.rules...)
+	}
+	return result
+}
+
+// parseIPTablesSaveImport reads an iptables-save dump
+func parseIPTablesSaveImport(content string, res *importResult) {
+	var table *rulesetTable
+	skipTable := false
+	for n, line := range strings.Split(content, "\n") {
+		line = strings.TrimSpace(line)
+		origin := "line " + strconv.Itoa(n+1) + ": " + line
+		switch {
+		case line == "" || strings.HasPrefix(line, "#"):
+		case strings.HasPrefix(line, "*"):
+			name := line[1:]
+			if _, ok := importBuiltinChains[name]; !ok {
+				res.skip(origin, "table %s is not supported", name)
+				table, skipTable = nil, true
+				continue
+			}
+			table, skipTable = res.table(name), false
+		case line == "COMMIT":
+			table, skipTable = nil, false
+		case skipTable:
+		case table == nil:
+			res.skip(origin, "outside of a table")
+		case strings.HasPrefix(line, ":"):
+			fields := strings.Fields(line[1:])
+			if len(fields) < 2 {
+				res.skip(origin, "invalid chain line")
+				continue
+			}
+			c := table.chain(fields[0], fields[1])
+			c.policy, c.declared = fields[1], true
+		default:
+			spec, err := ParseRuleSpec(line)
+			if err != nil {
+				res.skip(origin, "%v", err)
+				continue
+			}
+			if _, ok := table.index[spec.Chain]; !ok {
+				res.skip(origin, "chain %s is not declared", spec.Chain)
+				continue
+			}
+			spec.Counters = nil
+			res.add(table.name, spec, "line "+strconv.Itoa(n+1))
+		}
+	}
+}
+
+// ufwChains maps the ufw chains holding user rules to the chains they are
+// imported into
+var ufwChains = map[string]string{
+	"ufw-user-input":        "INPUT",
+	"ufw-user-output":       "OUTPUT",
+	"ufw-user-forward":      "FORWARD",
+	"ufw-user-limit":        "ufw-limit",
+	"ufw-user-limit-accept": "ufw-limit-accept",
+}
+
+// parseUFWImport reads a ufw user.rules or user6.rules file. Only the user
+// rules are converted; the chains of ufw's own framework are left out.
+func parseUFWImport(content string, res *importResult) {
+	tuple := ""
+	framework := 0
+	limited := false
+	for n, line := range strings.Split(content, "\n") {
+		line = strings.TrimSpace(line)
+		origin := "line " + strconv.Itoa(n+1) + ": " + line
+		switch {
+		case strings.HasPrefix(line, "### tuple ###"):
+			tuple = strings.TrimSpace(strings.TrimPrefix(line, "### tuple ###"))
+			continue
+		case line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "*") ||
+			strings.HasPrefix(line, ":") || line == "COMMIT":
+			continue
+		case !strings.HasPrefix(line, "-A "):
+			res.skip(origin, "only appended rules are converted")
+			continue
+		}
+
+		spec, err := ParseRuleSpec(line)
+		if err != nil {
+			res.skip(origin, "%v", err)
+			continue
+		}
+		chain, ok := ufwChains[spec.Chain]
+		if !ok {
+			framework++
+			continue
+		}
+		if chain == "ufw-limit" || chain == "ufw-limit-accept" {
+			// Rebuilt below with their default contents
+			continue
+		}
+		if strings.HasPrefix(spec.Target, "ufw-") {
+			target, ok := ufwChains[spec.Target]
+			if !ok {
+				res.skip(origin, "jumps to ufw chain %s", spec.Target)
+				continue
+			}
+			spec.Target = target
+			limited = true
+		}
+		spec.Chain = chain
+		spec.Counters = nil
+
+		if tuple != "" {
+			origin = "ufw " + tuple
+		}
+		res.add("filter", spec, origin)
+	}
+
+	if limited {
+		for _, line := range []string{
+			`-A ufw-limit -m limit --limit 3/min --limit-burst 10 -j LOG --log-prefix "[UFW LIMIT BLOCK] "`,
+			`-A ufw-limit -j REJECT`,
+			`-A ufw-limit-accept -j ACCEPT`,
+		} {
+			spec, _ := ParseRuleSpec(line)
+			res.add("filter", spec, "ufw rate limiting")
+		}
+	}
+	if framework > 0 {
+		res.notes = append(res.notes, fmt.Sprintf("%d rules of ufw's logging and framework chains were left out.", framework))
+	}
+	res.notes = append(res.notes, "ufw's default policies and before.rules (loopback, established connections, ICMP) "+
+		"are not part of user.rules. Check the chain policies and add those rules if the ruleset does not have them.")
+}
+
+// firewalldServices maps the common predefined firewalld services to
+// their protocol and port
+var firewalldServices = map[string][]string{
+	"ssh":             {"tcp/22"},
+	"http":            {"tcp/80"},
+	"https":           {"tcp/443"},
+	"http3":           {"udp/443"},
+	"dns":             {"tcp/53", "udp/53"},
+	"dhcp":            {"udp/67"},
+	"dhcpv6":          {"udp/547"},
+	"dhcpv6-client":   {"udp/546"},
+	"ntp":             {"udp/123"},
+	"smtp":            {"tcp/25"},
+	"smtps":           {"tcp/465"},
+	"smtp-submission": {"tcp/587"},
+	"imap":            {"tcp/143"},
+	"imaps":           {"tcp/993"},
+	"pop3":            {"tcp/110"},
+	"pop3s":           {"tcp/995"},
+	"ftp":             {"tcp/21"},
+	"mdns":            {"udp/5353"},
+	"samba":           {"udp/137", "udp/138", "tcp/139", "tcp/445"},
+	"samba-client":    {"udp/137", "udp/138"},
+	"nfs":             {"tcp/2049"},
+	"mysql":           {"tcp/3306"},
+	"postgresql":      {"tcp/5432"},
+	"redis":           {"tcp/6379"},
+	"openvpn":         {"udp/1194"},
+	"wireguard":       {"udp/51820"},
+	"ipsec":           {"udp/500", "udp/4500"},
+	"snmp":            {"udp/161"},
+	"syslog":          {"udp/514"},
+	"tftp":            {"udp/69"},
+	"vnc-server":      {"tcp/5900"},
+	"rdp":             {"tcp/3389"},
+	"cockpit":         {"tcp/9090"},
+	"kerberos":        {"tcp/88", "udp/88"},
+	"ldap":            {"tcp/389"},
+	"ldaps":           {"tcp/636"},
+	"bgp":             {"tcp/179"},
+}
+
+type firewalldName struct {
+	Name string `xml:"name,attr"`
+}
+
+type firewalldAddress struct {
+	Address string `xml:"address,attr"`
+	IPSet   string `xml:"ipset,attr"`
+	MAC     string `xml:"mac,attr"`
+	Invert  string `xml:"invert,attr"`
+}
+
+type firewalldPort struct {
+	Port     string `xml:"port,attr"`
+	Protocol string `xml:"protocol,attr"`
+}
+
+type firewalldForwardPort struct {
+	Port     string `xml:"port,attr"`
+	Protocol string `xml:"protocol,attr"`
+	ToPort   string `xml:"to-port,attr"`
+	ToAddr   string `xml:"to-addr,attr"`
+}
+
+type firewalldAction struct {
+	Type string `xml:"type,attr"`
+}
+
+type firewalldRule struct {
+	Family      string            `xml:"family,attr"`
+	Source      *firewalldAddress `xml:"source"`
+	Destination *firewalldAddress `xml:"destination"`
+	Service     *firewalldName    `xml:"service"`
+	Port        *firewalldPort    `xml:"port"`
+	SourcePort  *firewalldPort    `xml:"source-port"`
+	Protocol    *struct {
+		Value string `xml:"value,attr"`
+	} `xml:"protocol"`
+	ICMPBlock   *firewalldName        `xml:"icmp-block"`
+	ICMPType    *firewalldName        `xml:"icmp-type"`
+	ForwardPort *firewalldForwardPort `xml:"forward-port"`
+	Masquerade  *struct{}             `xml:"masquerade"`
+	Log         *struct{}             `xml:"log"`
+	NFLog       *struct{}             `xml:"nflog"`
+	Audit       *struct{}             `xml:"audit"`
+	Accept      *firewalldAction      `xml:"accept"`
+	Drop        *firewalldAction      `xml:"drop"`
+	Reject      *firewalldAction      `xml:"reject"`
+	Mark        *struct{}             `xml:"mark"`
+}
+
+type firewalldZone struct {
+	XMLName    xml.Name           `xml:"zone"`
+	Target     string             `xml:"target,attr"`
+	Short      string             `xml:"short"`
+	Interfaces []firewalldName    `xml:"interface"`
+	Sources    []firewalldAddress `xml:"source"`
+	Services   []firewalldName    `xml:"service"`
+	Ports      []firewalldPort    `xml:"port"`
+	Protocols  []struct {
+		Value string `xml:"value,attr"`
+	} `xml:"protocol"`
+	SourcePorts        []firewalldPort        `xml:"source-port"`
+	ICMPBlocks         []firewalldName        `xml:"icmp-block"`
+	ICMPBlockInversion *struct{}              `xml:"icmp-block-inversion"`
+	Masquerade         *struct{}              `xml:"masquerade"`
+	ForwardPorts       []firewalldForwardPort `xml:"forward-port"`
+	Rules              []firewalldRule        `xml:"rule"`
+}
+
+// firewalldScope is an interface or source address a zone applies to; an
+// empty scope matches all traffic
+type firewalldScope struct {
+	iface, source string
+	notSource     bool
+}
+
+// firewalldPortRange converts a firewalld port or range ("5000-5010") to
+// iptables syntax ("5000:5010")
+func firewalldPortRange(port string) string {
+	return strings.ReplaceAll(port, "-", ":")
+}
+
+// parseFirewalldImport reads a firewalld zone file into INPUT rules for the
+// zone's interfaces and sources, and nat rules for masquerading and port
+// forwarding
+func parseFirewalldImport(content string, res *importResult) error {
+	var zone firewalldZone
+	if err := xml.Unmarshal([]byte(content), &zone); err != nil {
+		return fmt.Errorf("invalid firewalld zone file: %w", err)
+	}
+
+	var scopes []firewalldScope
+	for _, iface := range zone.Interfaces {
+		scopes = append(scopes, firewalldScope{iface: iface.Name})
+	}
+	for _, src := range zone.Sources {
+		origin := `source address="` + src.Address + `"`
+		switch {
+		case src.Address == "":
+			res.skip(`source ipset="`+src.IPSet+`" mac="`+src.MAC+`"`, "only address sources are converted")
+		case validateAddressFamily(res.family, src.Address) != nil:
+			res.skip(origin, "address of the other family")
+		default:
+			scopes = append(scopes, firewalldScope{source: src.Address})
+		}
+	}
+	if len(scopes) == 0 {
+		scopes = []firewalldScope{{}}
+		res.notes = append(res.notes, "The zone has no interfaces or sources, so its rules apply to all traffic.")
+	}
+
+	// base returns the rule input of a scope
+	base := func(scope firewalldScope, chain, target string) models.FirewallRuleInput {
+		return models.FirewallRuleInput{
+			Family: res.family, Table: "filter", Chain: chain, Target: target,
+			InInterface: scope.iface, Source: scope.source,
+		}
+	}
+	// build converts a rule input, reporting errors as skipped
+	build := func(input models.FirewallRuleInput, origin string) *models.RuleSpec {
+		spec, err := ruleSpecFromInput(input)
+		if err != nil {
+			res.skip(origin, "%v", err)
+			return nil
+		}
+		return spec
+	}
+	icmpProtocol, icmpModule, icmpOption := "icmp", "icmp", "icmp-type"
+	if res.family == models.FamilyIPv6 {
+		icmpProtocol, icmpModule, icmpOption = "ipv6-icmp", "icmp6", "icmpv6-type"
+	}
+	icmpMatch := func(spec *models.RuleSpec, name string) {
+		spec.Protocol = icmpProtocol
+		spec.Matches = append([]models.RuleMatch{{
+			Module: icmpModule, Options: []models.RuleOption{{Name: icmpOption, Values: []string{name}}},
+		}}, spec.Matches...)
+	}
+
+	// firewalld accepts established and loopback traffic before any zone
+	for _, rule := range []models.FirewallRuleInput{
+		{Family: res.family, Table: "filter", Chain: "INPUT", State: "RELATED,ESTABLISHED", Target: "ACCEPT"},
+		{Family: res.family, Table: "filter", Chain: "INPUT", InInterface: "lo", Target: "ACCEPT"},
+	} {
+		if spec := build(rule, "firewalld built-in"); spec != nil {
+			res.add("filter", spec, "firewalld built-in")
+		}
+	}
+
+	for _, scope := range scopes {
+		for _, rule := range zone.Rules {
+			convertFirewalldRule(res, rule, scope, base, build, icmpMatch)
+		}
+
+		for _, svc := range zone.Services {
+			origin := `service name="` + svc.Name + `"`
+			ports, ok := firewalldServices[svc.Name]
+			if !ok {
+				res.skip(origin, "unknown service %s, add its ports by hand", svc.Name)
+				continue
+			}
+			for _, port := range ports {
+				proto, number, _ := strings.Cut(port, "/")
+				input := base(scope, "INPUT", "ACCEPT")
+				input.Protocol, input.DPort = proto, number
+				if spec := build(input, origin); spec != nil {
+					res.add("filter", spec, origin)
+				}
+			}
+		}
+
+		for _, port := range zone.Ports {
+			origin := `port port="` + port.Port + `" protocol="` + port.Protocol + `"`
+			input := base(scope, "INPUT", "ACCEPT")
+			input.Protocol, input.DPort = port.Protocol, firewalldPortRange(port.Port)
+			if spec := build(input, origin); spec != nil {
+				res.add("filter", spec, origin)
+			}
+		}
+
+		for _, port := range zone.SourcePorts {
+			origin := `source-port port="` + port.Port + `" protocol="` + port.Protocol + `"`
+			input := base(scope, "INPUT", "ACCEPT")
+			input.Protocol, input.SPort = port.Protocol, firewalldPortRange(port.Port)
+			if spec := build(input, origin); spec != nil {
+				res.add("filter", spec, origin)
+			}
+		}
+
+		for _, proto := range zone.Protocols {
+			origin := `protocol value="` + proto.Value + `"`
+			input := base(scope, "INPUT", "ACCEPT")
+			input.Protocol = proto.Value
+			if spec := build(input, origin); spec != nil {
+				res.add("filter", spec, origin)
+			}
+		}
+
+		for _, block := range zone.ICMPBlocks {
+			origin := `icmp-block name="` + block.Name + `"`
+			if zone.ICMPBlockInversion != nil {
+				res.skip(origin, "icmp-block-inversion is not converted")
+				continue
+			}
+			if spec := build(base(scope, "INPUT", "REJECT"), origin); spec != nil {
+				icmpMatch(spec, block.Name)
+				res.add("filter", spec, origin)
+			}
+		}
+
+		for _, fwd := range zone.ForwardPorts {
+			origin := `forward-port port="` + fwd.Port + `" protocol="` + fwd.Protocol + `"`
+			if scope.iface == "" && scope.source == "" {
+				res.skip(origin, "port forwarding in a zone without interfaces or sources")
+				continue
+			}
+			input := base(scope, "PREROUTING", "DNAT")
+			input.Table, input.Protocol, input.DPort = "nat", fwd.Protocol, firewalldPortRange(fwd.Port)
+			toPort := firewalldPortRange(fwd.ToPort)
+			switch {
+			case fwd.ToAddr == "":
+				input.Target = "REDIRECT"
+			case toPort != "":
+				input.ToDestination = fwd.ToAddr + ":" + strings.ReplaceAll(toPort, ":", "-")
+				if res.family == models.FamilyIPv6 {
+					input.ToDestination = "[" + fwd.ToAddr + "]:" + strings.ReplaceAll(toPort, ":", "-")
+				}
+			default:
+				input.ToDestination = fwd.ToAddr
+			}
+			spec := build(input, origin)
+			if spec == nil {
+				continue
+			}
+			if input.Target == "REDIRECT" && toPort != "" {
+				spec.TargetOptions = append(spec.TargetOptions, models.RuleOption{Name: "to-ports", Values: []string{strings.ReplaceAll(toPort, ":", "-")}})
+			}
+			res.add("nat", spec, origin)
+		}
+
+		if zone.Masquerade != nil {
+			if scope.iface == "" {
+				if scope.source == "" {
+					res.skip("masquerade", "masquerading in a zone without interfaces")
+				}
+				continue
+			}
+			input := models.FirewallRuleInput{
+				Family: res.family, Table: "nat", Chain: "POSTROUTING", OutInterface: scope.iface, Target: "MASQUERADE",
+			}
+			if spec := build(input, "masquerade"); spec != nil {
+				res.add("nat", spec, "masquerade")
+			}
+		}
+
+		// The zone target handles everything else the zone receives
+		target := strings.TrimSpace(zone.Target)
+		switch target {
+		case "ACCEPT", "DROP":
+		case "", "default", "%%REJECT%%":
+			target = "REJECT"
+		default:
+			res.skip(`zone target="`+zone.Target+`"`, "unknown zone target")
+			continue
+		}
+		if spec := build(base(scope, "INPUT", target), `zone target="`+zone.Target+`"`); spec != nil {
+			res.add("filter", spec, `zone target="`+zone.Target+`"`)
+		}
+	}
+
+	if len(zone.ForwardPorts) > 0 {
+		input := models.FirewallRuleInput{Family: res.family, Table: "filter", Chain: "FORWARD", Target: "ACCEPT"}
+		if spec := build(input, "forward-port"); spec != nil {
+			spec.Matches = append(spec.Matches, models.RuleMatch{
+				Module: "conntrack", Options: []models.RuleOption{{Name: "ctstate", Values: []string{"DNAT"}}},
+			})
+			res.add("filter", spec, "forward-port")
+		}
+	}
+
+	return nil
+}
+
+// convertFirewalldRule converts a rich rule for one scope of its zone
+func convertFirewalldRule(res *importResult, rule firewalldRule, scope firewalldScope,
+	base func(firewalldScope, string, string) models.FirewallRuleInput,
+	build func(models.FirewallRuleInput, string) *models.RuleSpec,
+	icmpMatch func(*models.RuleSpec, string)) {
+
+	origin := describeFirewalldRule(rule)
+	if rule.Family != "" && rule.Family != string(res.family) {
+		res.skip(origin, "%s rule, import the file again for that family", rule.Family)
+		return
+	}
+	if rule.Log != nil || rule.NFLog != nil || rule.Audit != nil || rule.Mark != nil ||
+		rule.ForwardPort != nil || rule.Masquerade != nil || rule.ICMPType != nil {
+		res.skip(origin, "log, audit, mark, icmp-type, forward-port and masquerade rich rules are not converted")
+		return
+	}
+
+	target := ""
+	var rejectWith string
+	switch {
+	case rule.Accept != nil:
+		target = "ACCEPT"
+	case rule.Drop != nil:
+		target = "DROP"
+	case rule.Reject != nil:
+		target, rejectWith = "REJECT", rule.Reject.Type
+	case rule.ICMPBlock != nil:
+		target = "REJECT"
+	default:
+		res.skip(origin, "rich rule without an action")
+		return
+	}
+
+	input := base(scope, "INPUT", target)
+	notSource, notDestination := false, false
+	for _, addr := range []struct {
+		a      *firewalldAddress
+		value  *string
+		negate *bool
+		dir    string
+	}{{rule.Source, &input.Source, &notSource, "src"}, {rule.Destination, &input.Destination, &notDestination, "dst"}} {
+		if addr.a == nil {
+			continue
+		}
+		switch {
+		case addr.a.Address != "":
+			if addr.dir == "src" && scope.source != "" {
+				res.skip(origin, "source address in a zone bound to sources")
+				return
+			}
+			*addr.value = addr.a.Address
+			*addr.negate = addr.a.Invert == "true" || addr.a.Invert == "yes"
+		case addr.a.IPSet != "":
+			input.MatchSet, input.MatchSetDir = addr.a.IPSet, addr.dir
+		default:
+			res.skip(origin, "MAC address matches are not converted")
+			return
+		}
+	}
+
+	var ports [][2]string
+	switch {
+	case rule.Service != nil:
+		svcPorts, ok := firewalldServices[rule.Service.Name]
+		if !ok {
+			res.skip(origin, "unknown service %s, add its ports by hand", rule.Service.Name)
+			return
+		}
+		for _, port := range svcPorts {
+			proto, number, _ := strings.Cut(port, "/")
+			ports = append(ports, [2]string{proto, number})
+		}
+	case rule.Port != nil:
+		ports = append(ports, [2]string{rule.Port.Protocol, firewalldPortRange(rule.Port.Port)})
+	case rule.Protocol != nil:
+		input.Protocol = rule.Protocol.Value
+	case rule.SourcePort != nil:
+		input.Protocol, input.SPort = rule.SourcePort.Protocol, firewalldPortRange(rule.SourcePort.Port)
+	}
+	if len(ports) == 0 {
+		ports = append(ports, [2]string{"", ""})
+	}
+
+	for _, port := range ports {
+		in := input
+		if port[0] != "" {
+			in.Protocol, in.DPort = port[0], port[1]
+		}
+		spec := build(in, origin)
+		if spec == nil {
+			return
+		}
+		spec.NotSource, spec.NotDestination = notSource && spec.Source != "", notDestination && spec.Destination != ""
+		if rule.ICMPBlock != nil {
+			icmpMatch(spec, rule.ICMPBlock.Name)
+		}
+		if rejectWith != "" {
+			spec.TargetOptions = append(spec.TargetOptions, models.RuleOption{Name: "reject-with", Values: []string{rejectWith}})
+		}
+		res.add("filter", spec, origin)
+	}
+}
+
+// describeFirewalldRule renders a rich rule in firewall-cmd syntax for the
+// preview
+func describeFirewalldRule(rule firewalldRule) string {
+	parts := []string{"rule"}
+	if rule.Family != "" {
+		parts = append(parts, `family="`+rule.Family+`"`)
+	}
+	addr := func(kind string, a *firewalldAddress) {
+		if a == nil {
+			return
+		}
+		if a.Invert == "true" || a.Invert == "yes" {
+			kind += " NOT"
+		}
+		switch {
+		case a.Address != "":
+			parts = append(parts, kind+` address="`+a.Address+`"`)
+		case a.IPSet != "":
+			parts = append(parts, kind+` ipset="`+a.IPSet+`"`)
+		case a.MAC != "":
+			parts = append(parts, kind+` mac="`+a.MAC+`"`)
+		}
+	}
+	addr("source", rule.Source)
+	addr("destination", rule.Destination)
+	switch {
+	case rule.Service != nil:
+		parts = append(parts, `service name="`+rule.Service.Name+`"`)
+	case rule.Port != nil:
+		parts = append(parts, `port port="`+rule.Port.Port+`" protocol="`+rule.Port.Protocol+`"`)
+	case rule.Protocol != nil:
+		parts = append(parts, `protocol value="`+rule.Protocol.Value+`"`)
+	case rule.ICMPBlock != nil:
+		parts = append(parts, `icmp-block name="`+rule.ICMPBlock.Name+`"`)
+	}
+	switch {
+	case rule.Accept != nil:
+		parts = append(parts, "accept")
+	case rule.Drop != nil:
+		parts = append(parts, "drop")
+	case rule.Reject != nil:
+		parts = append(parts, "reject")
+	}
+	return strings.Join(parts, " ")
+}
+
+// maxDiffCells bounds the size of the table used to compute a diff; larger
+// inputs only match their common start and end
+const maxDiffCells = 4 << 20
+
+// diffLines returns the line diff turning a into b, based on their
+// longest common subsequence
+func diffLines(a, b []string) []models.ImportDiffLine {
+	var diff []models.ImportDiffLine
+
+	// Common start and end
+	start := 0
+	for start < len(a) && start < len(b) && a[start] == b[start] {
+		start++
+	}
+	endA, endB := len(a), len(b)
+	for endA > start && endB > start && a[endA-1] == b[endB-1] {
+		endA--
+		endB--
+	}
+	for _, line := range a[:start] {
+		diff = append(diff, models.ImportDiffLine{Op: " ", Text: line})
+	}
+
+	midA, midB := a[start:endA], b[start:endB]
+	if len(midA)*len(midB) > maxDiffCells {
+		for _, line := range midA {
+			diff = append(diff, models.ImportDiffLine{Op: "-", Text: line})
+		}
+		for _, line := range midB {
+			diff = append(diff, models.ImportDiffLine{Op: "+", Text: line})
+		}
+	} else {
+		// lcs[i][j] is the length of the common subsequence of midA[i:]
+		// and midB[j:]
+		lcs := make([][]int, len(midA)+1)
+		for i := range lcs {
+			lcs[i] = make([]int, len(midB)+1)
+		}
+		for i := len(midA) - 1; i >= 0; i-- {
+			for j := len(midB) - 1; j >= 0; j-- {
+				if midA[i] == midB[j] {
+					lcs[i][j] = lcs[i+1][j+1] + 1
+				} else {
+					lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+				}
+			}
+		}
+
+		i, j := 0, 0
+		for i < len(midA) || j < len(midB) {
+			switch {
+			case i < len(midA) && j < len(midB) && midA[i] == midB[j]:
+				diff = append(diff, models.ImportDiffLine{Op: " ", Text: midA[i]})
+				i++
+				j++
+			case i < len(midA) && (j == len(midB) || lcs[i+1][j] >= lcs[i][j+1]):
+				diff = append(diff, models.ImportDiffLine{Op: "-", Text: midA[i]})
+				i++
+			default:
+				diff = append(diff, models.ImportDiffLine{Op: "+", Text: midB[j]})
+				j++
+			}
+		}
+	}
+
+	for _, line := range a[endA:] {
+		diff = append(diff, models.ImportDiffLine{Op: " ", Text: line})
+	}
+	return diff
+}
@@ -3,244 +3,733 @@ package services
 import (
 	"bufio"
 	"fmt"
+	"net"
 	"os"
-	"os/exec"
 	"path/filepath"
-	"regexp"
 	"strconv"
 	"strings"
 
 	"linuxtorouter/internal/models"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
 )
 
+// routeProtocols names the route protocols like iproute2's rt_protos
+var routeProtocols = map[int]string{
+	unix.RTPROT_UNSPEC:   "unspec",
+	unix.RTPROT_REDIRECT: "redirect",
+	unix.RTPROT_KERNEL:   "kernel",
+	unix.RTPROT_BOOT:     "boot",
+	unix.RTPROT_STATIC:   "static",
+	8:                    "gated",
+	9:                    "ra",
+	10:                   "mrt",
+	11:                   "zebra",
+	12:                   "bird",
+	13:                   "dnrouted",
+	14:                   "xorp",
+	15:                   "ntk",
+	16:                   "dhcp",
+	18:                   "keepalived",
+	42:                   "babel",
+	99:                   "openr",
+	186:                  "bgp",
+	187:                  "isis",
+	188:                  "ospf",
+	189:                  "rip",
+	192:                  "eigrp",
+}
+
+// routeTypes names the route types
+var routeTypes = map[int]string{
+	unix.RTN_UNICAST:     "unicast",
+	unix.RTN_LOCAL:       "local",
+	unix.RTN_BROADCAST:   "broadcast",
+	unix.RTN_ANYCAST:     "anycast",
+	unix.RTN_MULTICAST:   "multicast",
+	unix.RTN_BLACKHOLE:   "blackhole",
+	unix.RTN_UNREACHABLE: "unreachable",
+	unix.RTN_PROHIBIT:    "prohibit",
+	unix.RTN_THROW:       "throw",
+	unix.RTN_NAT:         "nat",
+}
+
+// routeScopes names the route scopes other than global
+var routeScopes = map[int]string{
+	int(netlink.SCOPE_SITE):    "site",
+	int(netlink.SCOPE_LINK):    "link",
+	int(netlink.SCOPE_HOST):    "host",
+	int(netlink.SCOPE_NOWHERE): "nowhere",
+}
+
+// routeFlags maps the route and nexthop flag names to their values
+var routeFlags = map[string]int{
+	"onlink":    int(netlink.FLAG_ONLINK),
+	"pervasive": int(netlink.FLAG_PERVASIVE),
+}
+
+// routeValue returns the number of a named protocol, type or scope, which
+// may also be given as a number
+func routeValue(names map[int]string, name string) (int, bool) {
+	if n, err := strconv.Atoi(name); err == nil {
+		return n, true
+	}
+	for value, n := range names {
+		if n == name {
+			return value, true
+		}
+	}
+	return 0, false
+}
+
 type IPRouteService struct {
-	configDir string
+	configDir    string
+	rtTablesPath string
 }
 
-func NewIPRouteService(configDir string) *IPRouteService {
-	return &IPRouteService{configDir: configDir}
+// NewIPRouteService creates the route service. rtTablesPath is the
+// iproute2 table names file, normally /etc/iproute2/rt_tables; tables
+// created here go in its .d directory.
+func NewIPRouteService(configDir, rtTablesPath string) *IPRouteService {
+	return &IPRouteService{configDir: configDir, rtTablesPath: rtTablesPath}
 }
 
-func (s *IPRouteService) ListRoutes(table string) ([]models.Route, error) {
-	args := []string{"route", "show"}
-	if table != "" && table != "main" {
-		args = append(args, "table", table)
+// routeFamily returns the netlink address family of a route family
+func routeFamily(family models.IPFamily) int {
+	if family == models.FamilyIPv6 {
+		return netlink.FAMILY_V6
 	}
+	return netlink.FAMILY_V4
+}
 
-	cmd := exec.Command("ip", args...)
-	output, err := cmd.Output()
+// ListRoutes returns the routes of a family in a table, like
+// `ip route show table`
+func (s *IPRouteService) ListRoutes(family models.IPFamily, table string) ([]models.Route, error) {
+	id, err := s.tableID(table)
 	if err != nil {
-		return nil, fmt.Errorf("failed to list routes: %w", err)
+		return nil, err
 	}
+	return s.listRoutes(family, id)
+}
 
-	return s.parseRouteOutput(string(output), table)
+// ListAllRoutes returns the routes of a family in every table
+func (s *IPRouteService) ListAllRoutes(family models.IPFamily) ([]models.Route, error) {
+	return s.listRoutes(family, unix.RT_TABLE_UNSPEC)
 }
 
-func (s *IPRouteService) ListAllRoutes() ([]models.Route, error) {
-	cmd := exec.Command("ip", "route", "show", "table", "all")
-	output, err := cmd.Output()
+func (s *IPRouteService) listRoutes(family models.IPFamily, table int) ([]models.Route, error) {
+	routes, err := netlink.RouteListFiltered(routeFamily(family), &netlink.Route{Table: table}, netlink.RT_FILTER_TABLE)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list routes: %w", err)
+	}
+
+	links := make(map[int]string)
+	if all, err := netlink.LinkList(); err == nil {
+		for _, link := range all {
+			links[link.Attrs().Index] = link.Attrs().Name
+		}
+	}
+	tables := s.tableNames()
+	extras, err := routeExtras(routeFamily(family))
 	if err != nil {
-		return nil, fmt.Errorf("failed to list all routes: %w", err)
+		return nil, fmt.Errorf("failed to list routes: %w", err)
 	}
 
-	return s.parseRouteOutput(string(output), "")
+	result := make([]models.Route, 0, len(routes))
+	for _, r := range routes {
+		route := routeFromNetlink(r, family, links, tables)
+		extra := extras[routeKey(r.Table, r.Dst, r.Tos, r.Priority)]
+		route.NexthopID = extra.nexthopID
+		route.InitCwnd = extra.initCwnd
+		result = append(result, route)
+	}
+	return result, nil
 }
 
-func (s *IPRouteService) parseRouteOutput(output, defaultTable string) ([]models.Route, error) {
-	var routes []models.Route
-	scanner := bufio.NewScanner(strings.NewReader(output))
+// routeFromNetlink converts a kernel route, naming its attributes the way
+// `ip route` prints them
+func routeFromNetlink(r netlink.Route, family models.IPFamily, links, tables map[int]string) models.Route {
+	route := models.Route{
+		Family:      family,
+		Destination: routeDestination(r.Dst),
+		Interface:   links[r.LinkIndex],
+		Metric:      r.Priority,
+		Scope:       routeScopes[int(r.Scope)],
+		Flags:       strings.Join(r.ListFlags(), " "),
+		TOS:         r.Tos,
+		MTU:         r.MTU,
+		AdvMSS:      r.AdvMSS,
+		Hoplimit:    r.Hoplimit,
+	}
+	if r.Gw != nil {
+		route.Gateway = r.Gw.String()
+	}
+	if r.Src != nil {
+		route.Source = r.Src.String()
+	}
 
-	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
-		if line == "" {
-			continue
+	if r.Protocol != unix.RTPROT_BOOT {
+		route.Protocol = routeProtocols[r.Protocol]
+		if route.Protocol == "" {
+			route.Protocol = strconv.Itoa(r.Protocol)
+		}
+	}
+	if r.Type != unix.RTN_UNICAST {
+		route.Type = routeTypes[r.Type]
+		if route.Type == "" {
+			route.Type = strconv.Itoa(r.Type)
 		}
+	}
+	switch r.Type {
+	case unix.RTN_BLACKHOLE, unix.RTN_UNREACHABLE, unix.RTN_PROHIBIT, unix.RTN_THROW:
+		// IPv6 puts these on the loopback device, which they cannot be
+		// added with
+		route.Interface = ""
+	}
+	route.Table = tables[r.Table]
+	if route.Table == "" {
+		route.Table = strconv.Itoa(r.Table)
+	}
 
-		route := s.parseRouteLine(line, defaultTable)
-		if route != nil {
-			routes = append(routes, *route)
+	for _, nh := range r.MultiPath {
+		nexthop := models.RouteNexthop{
+			Interface: links[nh.LinkIndex],
+			Weight:    nh.Hops + 1,
+			Flags:     strings.Join(nh.ListFlags(), " "),
+		}
+		if nh.Gw != nil {
+			nexthop.Gateway = nh.Gw.String()
 		}
+		route.Nexthops = append(route.Nexthops, nexthop)
 	}
 
-	return routes, nil
+	return route
 }
 
-func (s *IPRouteService) parseRouteLine(line, defaultTable string) *models.Route {
-	route := &models.Route{
-		Table: defaultTable,
+// routeDestination prints a route destination: "default" for the default
+// route and a bare address for host routes
+func routeDestination(dst *net.IPNet) string {
+	if dst == nil {
+		return "default"
+	}
+	ones, bits := dst.Mask.Size()
+	switch ones {
+	case 0:
+		return "default"
+	case bits:
+		return dst.IP.String()
 	}
+	return dst.String()
+}
 
-	parts := strings.Fields(line)
-	if len(parts) < 1 {
-		return nil
+// parseRouteDestination parses "default", an address or a CIDR prefix
+func parseRouteDestination(dst string, ipv6 bool) (*net.IPNet, error) {
+	if dst == "default" {
+		dst = "0.0.0.0/0"
+		if ipv6 {
+			dst = "::/0"
+		}
+	}
+	if !strings.Contains(dst, "/") {
+		ip := net.ParseIP(dst)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid destination: %s", dst)
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
 	}
 
-	// First element is usually destination or "default"
-	route.Destination = parts[0]
+	_, prefix, err := net.ParseCIDR(dst)
+	if err != nil {
+		return nil, fmt.Errorf("invalid destination: %s", dst)
+	}
+	return prefix, nil
+}
 
-	// Parse key-value pairs
-	for i := 1; i < len(parts); i++ {
-		switch parts[i] {
-		case "via":
-			if i+1 < len(parts) {
-				route.Gateway = parts[i+1]
-				i++
-			}
-		case "dev":
-			if i+1 < len(parts) {
-				route.Interface = parts[i+1]
-				i++
-			}
-		case "proto":
-			if i+1 < len(parts) {
-				route.Protocol = parts[i+1]
-				i++
-			}
-		case "scope":
-			if i+1 < len(parts) {
-				route.Scope = parts[i+1]
-				i++
-			}
-		case "src":
-			if i+1 < len(parts) {
-				route.Source = parts[i+1]
-				i++
+// routeFamilyName names the family of a route in messages
+func routeFamilyName(ipv6 bool) string {
+	if ipv6 {
+		return "IPv6"
+	}
+	return "IPv4"
+}
+
+// routeGateway parses a gateway of a route, which must be in the family
+// of the destination. A link-local gateway is only reachable through the
+// interface it is on, so it needs one.
+func routeGateway(gateway, iface string, ipv6 bool) (net.IP, error) {
+	gw := net.ParseIP(gateway)
+	if gw == nil {
+		return nil, fmt.Errorf("invalid gateway: %s", gateway)
+	}
+	if (gw.To4() == nil) != ipv6 {
+		return nil, fmt.Errorf("gateway %s is not an %s address like the destination", gateway, routeFamilyName(ipv6))
+	}
+	if gw.IsLinkLocalUnicast() && iface == "" {
+		return nil, fmt.Errorf("link-local gateway %s requires an interface", gateway)
+	}
+	return gw, nil
+}
+
+// netlinkRoute converts a route to its netlink form. Unset attributes take
+// the defaults of `ip route add`: the boot protocol, the unicast type and
+// link scope for routes without a gateway. The nexthop object of a route
+// is left to the caller.
+func (s *IPRouteService) netlinkRoute(route models.Route) (*netlink.Route, error) {
+	if route.Destination == "" {
+		return nil, fmt.Errorf("destination is required")
+	}
+	if route.NexthopID > 0 && (route.Gateway != "" || route.Interface != "" || len(route.Nexthops) > 0) {
+		return nil, fmt.Errorf("a route through a nexthop object cannot have a gateway, interface or nexthops")
+	}
+	if len(route.Nexthops) > 0 && (route.Gateway != "" || route.Interface != "") {
+		return nil, fmt.Errorf("a multipath route cannot also have a gateway or interface")
+	}
+
+	nr := &netlink.Route{
+		Priority: route.Metric,
+		Tos:      route.TOS,
+		MTU:      route.MTU,
+		AdvMSS:   route.AdvMSS,
+		Hoplimit: route.Hoplimit,
+	}
+
+	table, err := s.tableID(route.Table)
+	if err != nil {
+		return nil, err
+	}
+	nr.Table = table
+
+	// The family of a route without one follows its destination
+	ipv6 := route.Family == models.FamilyIPv6
+	if route.Family == "" {
+		ipv6 = strings.Contains(route.Destination, ":")
+	}
+	if nr.Dst, err = parseRouteDestination(route.Destination, ipv6); err != nil {
+		return nil, err
+	}
+	if (nr.Dst.IP.To4() == nil) != ipv6 {
+		return nil, fmt.Errorf("destination %s is not an %s address", route.Destination, routeFamilyName(ipv6))
+	}
+
+	if route.Gateway != "" {
+		if nr.Gw, err = routeGateway(route.Gateway, route.Interface, ipv6); err != nil {
+			return nil, err
+		}
+	}
+	if route.Source != "" {
+		if nr.Src = net.ParseIP(route.Source); nr.Src == nil {
+			return nil, fmt.Errorf("invalid source address: %s", route.Source)
+		}
+		if (nr.Src.To4() == nil) != ipv6 {
+			return nil, fmt.Errorf("source address %s is not an %s address", route.Source, routeFamilyName(ipv6))
+		}
+	}
+	if route.Interface != "" {
+		link, err := netlink.LinkByName(route.Interface)
+		if err != nil {
+			return nil, fmt.Errorf("interface %s not found: %w", route.Interface, err)
+		}
+		nr.LinkIndex = link.Attrs().Index
+	}
+
+	for _, nh := range route.Nexthops {
+		info := &netlink.NexthopInfo{}
+		if nh.Weight > 1 {
+			info.Hops = nh.Weight - 1
+		}
+		if nh.Gateway != "" {
+			if info.Gw, err = routeGateway(nh.Gateway, nh.Interface, ipv6); err != nil {
+				return nil, err
 			}
-		case "metric":
-			if i+1 < len(parts) {
-				route.Metric, _ = strconv.Atoi(parts[i+1])
-				i++
+		}
+		if nh.Interface != "" {
+			link, err := netlink.LinkByName(nh.Interface)
+			if err != nil {
+				return nil, fmt.Errorf("interface %s not found: %w", nh.Interface, err)
 			}
-		case "table":
-			if i+1 < len(parts) {
-				route.Table = parts[i+1]
-				i++
+			info.LinkIndex = link.Attrs().Index
+		}
+		for _, flag := range strings.Fields(nh.Flags) {
+			value, ok := routeFlags[flag]
+			if !ok {
+				return nil, fmt.Errorf("unknown nexthop flag: %s", flag)
 			}
+			info.Flags |= value
 		}
+		nr.MultiPath = append(nr.MultiPath, info)
 	}
 
-	// Handle route type
-	if strings.HasPrefix(route.Destination, "broadcast") ||
-		strings.HasPrefix(route.Destination, "local") ||
-		strings.HasPrefix(route.Destination, "unreachable") {
-		typeParts := strings.SplitN(route.Destination, " ", 2)
-		route.Type = typeParts[0]
-		if len(typeParts) > 1 {
-			route.Destination = typeParts[1]
+	for _, flag := range strings.Fields(route.Flags) {
+		value, ok := routeFlags[flag]
+		if !ok {
+			return nil, fmt.Errorf("unknown route flag: %s", flag)
 		}
+		nr.Flags |= value
 	}
 
-	return route
+	nr.Protocol = unix.RTPROT_BOOT
+	if route.Protocol != "" {
+		value, ok := routeValue(routeProtocols, route.Protocol)
+		if !ok {
+			return nil, fmt.Errorf("unknown route protocol: %s", route.Protocol)
+		}
+		nr.Protocol = value
+	}
+
+	nr.Type = unix.RTN_UNICAST
+	if route.Type != "" {
+		value, ok := routeValue(routeTypes, route.Type)
+		if !ok {
+			return nil, fmt.Errorf("unknown route type: %s", route.Type)
+		}
+		nr.Type = value
+	}
+
+	// Routes that drop or reject packets have nowhere to send them
+	switch nr.Type {
+	case unix.RTN_BLACKHOLE, unix.RTN_UNREACHABLE, unix.RTN_PROHIBIT, unix.RTN_THROW:
+		if nr.Gw != nil || nr.LinkIndex > 0 || len(nr.MultiPath) > 0 || route.NexthopID > 0 {
+			return nil, fmt.Errorf("%s routes cannot have a gateway, interface or nexthops", routeTypes[nr.Type])
+		}
+	}
+
+	switch {
+	case route.Scope == "global" || route.Scope == "universe":
+		nr.Scope = netlink.SCOPE_UNIVERSE
+	case route.Scope != "":
+		value, ok := routeValue(routeScopes, route.Scope)
+		if !ok {
+			return nil, fmt.Errorf("unknown route scope: %s", route.Scope)
+		}
+		nr.Scope = netlink.Scope(value)
+	case ipv6:
+		// IPv6 routes are always global, as `ip -6 route add` makes them
+	case nr.Type == unix.RTN_LOCAL || nr.Type == unix.RTN_NAT:
+		nr.Scope = netlink.SCOPE_HOST
+	case nr.Type == unix.RTN_BROADCAST || nr.Type == unix.RTN_MULTICAST || nr.Type == unix.RTN_ANYCAST:
+		nr.Scope = netlink.SCOPE_LINK
+	case nr.Type == unix.RTN_UNICAST && nr.Gw == nil && len(nr.MultiPath) == 0 && route.NexthopID == 0:
+		nr.Scope = netlink.SCOPE_LINK
+	}
+
+	return nr, nil
 }
 
 func (s *IPRouteService) AddRoute(input models.RouteInput) error {
-	args := []string{"route", "add"}
+	route := models.Route{
+		Family:      input.Family,
+		Type:        input.Type,
+		Destination: input.Destination,
+		Gateway:     input.Gateway,
+		Interface:   input.Interface,
+		Nexthops:    input.Nexthops,
+		NexthopID:   input.NexthopID,
+		Metric:      input.Metric,
+		Table:       input.Table,
+		Source:      input.Source,
+		Scope:       input.Scope,
+		Protocol:    input.Protocol,
+		MTU:         input.MTU,
+		AdvMSS:      input.AdvMSS,
+		InitCwnd:    input.InitCwnd,
+	}
+	if input.Onlink {
+		route.Flags = "onlink"
+	}
 
-	if input.Destination == "" {
-		return fmt.Errorf("destination is required")
+	nr, err := s.netlinkRoute(route)
+	if err != nil {
+		return err
 	}
-	args = append(args, input.Destination)
 
-	if input.Gateway != "" {
-		args = append(args, "via", input.Gateway)
+	if extra := (routeExtra{route.NexthopID, route.InitCwnd}); extra != (routeExtra{}) {
+		err = changeRoute(nr, extra, unix.NLM_F_CREATE|unix.NLM_F_EXCL)
+	} else {
+		err = netlink.RouteAdd(nr)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to add route: %w", err)
 	}
 
-	if input.Interface != "" {
-		args = append(args, "dev", input.Interface)
+	return nil
+}
+
+// ReplaceRoute adds a route or replaces the route with the same
+// destination, metric and table
+func (s *IPRouteService) ReplaceRoute(route models.Route) error {
+	nr, err := s.netlinkRoute(route)
+	if err != nil {
+		return err
 	}
 
-	if input.Metric > 0 {
-		args = append(args, "metric", strconv.Itoa(input.Metric))
+	if extra := (routeExtra{route.NexthopID, route.InitCwnd}); extra != (routeExtra{}) {
+		err = changeRoute(nr, extra, unix.NLM_F_CREATE|unix.NLM_F_REPLACE)
+	} else {
+		err = netlink.RouteReplace(nr)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to replace route: %w", err)
 	}
 
-	if input.Table != "" && input.Table != "main" {
-		args = append(args, "table", input.Table)
+	return nil
+}
+
+func (s *IPRouteService) DeleteRoute(family models.IPFamily, destination, gateway, iface, table string) error {
+	nr, err := s.netlinkRoute(models.Route{
+		Family:      family,
+		Destination: destination,
+		Gateway:     gateway,
+		Interface:   iface,
+		Table:       table,
+	})
+	if err != nil {
+		return err
 	}
 
-	cmd := exec.Command("ip", args...)
-	if output, err := cmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("failed to add route: %s", string(output))
+	// Match the route whatever its protocol, type and scope
+	nr.Protocol, nr.Type, nr.Scope = 0, 0, netlink.SCOPE_NOWHERE
+	if err := netlink.RouteDel(nr); err != nil {
+		return fmt.Errorf("failed to delete route: %w", err)
 	}
 
 	return nil
 }
 
-func (s *IPRouteService) DeleteRoute(destination, gateway, iface, table string) error {
-	args := []string{"route", "del", destination}
-
-	if gateway != "" {
-		args = append(args, "via", gateway)
+// tableNames maps table IDs to the names in rt_tables
+func (s *IPRouteService) tableNames() map[int]string {
+	names := map[int]string{
+		unix.RT_TABLE_LOCAL:   "local",
+		unix.RT_TABLE_MAIN:    "main",
+		unix.RT_TABLE_DEFAULT: "default",
+	}
+	tables, _ := s.GetRoutingTables()
+	for _, t := range tables {
+		names[t.ID] = t.Name
 	}
+	return names
+}
 
-	if iface != "" {
-		args = append(args, "dev", iface)
+// tableID resolves a table name or number; the empty name is main
+func (s *IPRouteService) tableID(table string) (int, error) {
+	if table == "" {
+		return unix.RT_TABLE_MAIN, nil
+	}
+	if id, err := strconv.Atoi(table); err == nil {
+		return id, nil
+	}
+	for id, name := range s.tableNames() {
+		if name == table {
+			return id, nil
+		}
 	}
+	return 0, fmt.Errorf("unknown routing table: %s", table)
+}
 
-	if table != "" && table != "main" {
-		args = append(args, "table", table)
+func (s *IPRouteService) FlushTable(family models.IPFamily, table string) error {
+	id, err := s.tableID(table)
+	if err != nil {
+		return err
 	}
 
-	cmd := exec.Command("ip", args...)
-	if output, err := cmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("failed to delete route: %s", string(output))
+	routes, err := netlink.RouteListFiltered(routeFamily(family), &netlink.Route{Table: id}, netlink.RT_FILTER_TABLE)
+	if err != nil {
+		return fmt.Errorf("failed to flush routes: %w", err)
+	}
+	extras, err := routeExtras(routeFamily(family))
+	if err != nil {
+		return fmt.Errorf("failed to flush routes: %w", err)
+	}
+	for i := range routes {
+		// The kernel only matches a route through a nexthop object when
+		// no gateway or interface is given
+		r := &routes[i]
+		if extras[routeKey(r.Table, r.Dst, r.Tos, r.Priority)].nexthopID > 0 {
+			r.Gw, r.LinkIndex, r.MultiPath = nil, 0, nil
+		}
+		if err := netlink.RouteDel(r); err != nil {
+			return fmt.Errorf("failed to flush routes: %w", err)
+		}
 	}
 
 	return nil
 }
 
-func (s *IPRouteService) GetRoutingTables() ([]models.RoutingTable, error) {
-	// Read /etc/iproute2/rt_tables
-	file, err := os.Open("/etc/iproute2/rt_tables")
-	if err != nil {
-		// Return default tables if file doesn't exist
-		return []models.RoutingTable{
-			{ID: 255, Name: "local"},
-			{ID: 254, Name: "main"},
-			{ID: 253, Name: "default"},
-		}, nil
-	}
-	defer file.Close()
-
-	var tables []models.RoutingTable
-	scanner := bufio.NewScanner(file)
-	re := regexp.MustCompile(`^\s*(\d+)\s+(\S+)`)
-
-	for scanner.Scan() {
-		line := scanner.Text()
-		if strings.HasPrefix(strings.TrimSpace(line), "#") || strings.TrimSpace(line) == "" {
-			continue
+// formatRouteConfig writes a route in the `ip route add` syntax of the
+// saved route files
+func formatRouteConfig(route models.Route) string {
+	var parts []string
+	if route.Type != "" {
+		parts = append(parts, route.Type)
+	}
+	parts = append(parts, route.Destination)
+	if route.NexthopID > 0 {
+		// The gateway and interface belong to the nexthop object
+		parts = append(parts, "nhid", strconv.Itoa(route.NexthopID))
+	} else {
+		if route.Gateway != "" {
+			parts = append(parts, "via", route.Gateway)
 		}
-
-		matches := re.FindStringSubmatch(line)
-		if matches != nil {
-			id, _ := strconv.Atoi(matches[1])
-			tables = append(tables, models.RoutingTable{
-				ID:   id,
-				Name: matches[2],
-			})
+		if route.Interface != "" {
+			parts = append(parts, "dev", route.Interface)
 		}
 	}
-
-	return tables, nil
+	if route.Metric > 0 {
+		parts = append(parts, "metric", strconv.Itoa(route.Metric))
+	}
+	if route.Source != "" {
+		parts = append(parts, "src", route.Source)
+	}
+	switch {
+	case route.Scope != "":
+		parts = append(parts, "scope", route.Scope)
+	case route.Family != models.FamilyIPv6 && route.Type == "" && route.Gateway == "" &&
+		len(route.Nexthops) == 0 && route.NexthopID == 0:
+		// Without a gateway the scope would default to link on restore
+		parts = append(parts, "scope", "global")
+	}
+	if route.Protocol != "" {
+		parts = append(parts, "proto", route.Protocol)
+	}
+	if route.TOS > 0 {
+		parts = append(parts, "tos", strconv.Itoa(route.TOS))
+	}
+	if route.MTU > 0 {
+		parts = append(parts, "mtu", strconv.Itoa(route.MTU))
+	}
+	if route.AdvMSS > 0 {
+		parts = append(parts, "advmss", strconv.Itoa(route.AdvMSS))
+	}
+	if route.Hoplimit > 0 {
+		parts = append(parts, "hoplimit", strconv.Itoa(route.Hoplimit))
+	}
+	if route.InitCwnd > 0 {
+		parts = append(parts, "initcwnd", strconv.Itoa(route.InitCwnd))
+	}
+	parts = append(parts, strings.Fields(route.Flags)...)
+	if route.NexthopID > 0 {
+		return strings.Join(parts, " ")
+	}
+	for _, nh := range route.Nexthops {
+		parts = append(parts, "nexthop")
+		if nh.Gateway != "" {
+			parts = append(parts, "via", nh.Gateway)
+		}
+		if nh.Interface != "" {
+			parts = append(parts, "dev", nh.Interface)
+		}
+		parts = append(parts, "weight", strconv.Itoa(nh.Weight))
+		parts = append(parts, strings.Fields(nh.Flags)...)
+	}
+	return strings.Join(parts, " ")
 }
 
-func (s *IPRouteService) FlushTable(table string) error {
-	args := []string{"route", "flush"}
-	if table != "" {
-		args = append(args, "table", table)
+// parseRouteConfig reads a line of a saved route file
+func parseRouteConfig(line string) (models.Route, error) {
+	var route models.Route
+	fields := strings.Fields(line)
+	if len(fields) > 0 && fields[0] != "unicast" {
+		if _, ok := routeValue(routeTypes, fields[0]); ok {
+			if _, err := strconv.Atoi(fields[0]); err != nil {
+				route.Type = fields[0]
+				fields = fields[1:]
+			}
+		}
 	}
+	if len(fields) == 0 {
+		return route, fmt.Errorf("missing destination")
+	}
+	route.Destination = fields[0]
+
+	var nexthop *models.RouteNexthop
+	for i := 1; i < len(fields); i++ {
+		key := fields[i]
+		if _, ok := routeFlags[key]; ok {
+			if nexthop != nil {
+				nexthop.Flags = strings.TrimSpace(nexthop.Flags + " " + key)
+			} else {
+				route.Flags = strings.TrimSpace(route.Flags + " " + key)
+			}
+			continue
+		}
+		if key == "nexthop" {
+			route.Nexthops = append(route.Nexthops, models.RouteNexthop{Weight: 1})
+			nexthop = &route.Nexthops[len(route.Nexthops)-1]
+			continue
+		}
 
-	cmd := exec.Command("ip", args...)
-	if output, err := cmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("failed to flush routes: %s", string(output))
+		if i+1 >= len(fields) {
+			return route, fmt.Errorf("missing value for %s", key)
+		}
+		value := fields[i+1]
+		i++
+
+		var err error
+		switch key {
+		case "via":
+			if nexthop != nil {
+				nexthop.Gateway = value
+			} else {
+				route.Gateway = value
+			}
+		case "dev":
+			if nexthop != nil {
+				nexthop.Interface = value
+			} else {
+				route.Interface = value
+			}
+		case "weight":
+			if nexthop == nil {
+				return route, fmt.Errorf("weight outside of a nexthop")
+			}
+			nexthop.Weight, err = strconv.Atoi(value)
+		case "nhid":
+			route.NexthopID, err = strconv.Atoi(value)
+		case "metric":
+			route.Metric, err = strconv.Atoi(value)
+		case "src":
+			route.Source = value
+		case "proto":
+			route.Protocol = value
+		case "scope":
+			route.Scope = value
+		case "tos":
+			route.TOS, err = strconv.Atoi(value)
+		case "mtu":
+			route.MTU, err = strconv.Atoi(value)
+		case "advmss":
+			route.AdvMSS, err = strconv.Atoi(value)
+		case "hoplimit":
+			route.Hoplimit, err = strconv.Atoi(value)
+		case "initcwnd":
+			route.InitCwnd, err = strconv.Atoi(value)
+		default:
+			return route, fmt.Errorf("unknown route option: %s", key)
+		}
+		if err != nil {
+			return route, fmt.Errorf("invalid %s: %s", key, value)
+		}
 	}
 
-	return nil
+	return route, nil
 }
 
+// SaveRoutes writes the routes of each table, the IPv4 routes to
+// <table>.conf and the IPv6 routes to <table>.v6.conf
 func (s *IPRouteService) SaveRoutes() error {
-	// Get all routes
-	routes, err := s.ListAllRoutes()
+	for _, family := range models.IPFamilies {
+		if err := s.saveRoutes(family); err != nil {
+			return err
+		}
+	}
+	return s.saveNexthops()
+}
+
+func (s *IPRouteService) saveRoutes(family models.IPFamily) error {
+	routes, err := s.ListAllRoutes(family)
 	if err != nil {
 		return err
 	}
@@ -252,7 +741,13 @@ func (s *IPRouteService) SaveRoutes() error {
 		if route.Protocol == "kernel" && (route.Scope == "link" || route.Scope == "host") {
 			continue
 		}
-		if route.Type == "local" || route.Type == "broadcast" {
+		switch route.Type {
+		case "local", "broadcast", "multicast", "anycast":
+			continue
+		}
+		// IPv6 prefix routes are global; they and the routes learned from
+		// router advertisements come back on their own
+		if family == models.FamilyIPv6 && (route.Protocol == "kernel" || route.Protocol == "ra") {
 			continue
 		}
 
@@ -261,33 +756,54 @@ func (s *IPRouteService) SaveRoutes() error {
 			table = "main"
 		}
 
-		// Build route command
-		cmd := route.Destination
-		if route.Gateway != "" {
-			cmd += " via " + route.Gateway
-		}
-		if route.Interface != "" {
-			cmd += " dev " + route.Interface
-		}
-		if route.Metric > 0 {
-			cmd += " metric " + strconv.Itoa(route.Metric)
-		}
-
-		tableRoutes[table] = append(tableRoutes[table], cmd)
+		tableRoutes[table] = append(tableRoutes[table], formatRouteConfig(route))
 	}
 
 	// Save to files
 	for table, cmds := range tableRoutes {
-		savePath := filepath.Join(s.configDir, "routes", table+".conf")
+		savePath := filepath.Join(s.configDir, "routes", routeFileName(family, table))
 		content := strings.Join(cmds, "\n")
 		if err := os.WriteFile(savePath, []byte(content), 0644); err != nil {
-			return fmt.Errorf("failed to save routes for table %s: %w", table, err)
+			return fmt.Errorf("failed to save %s routes for table %s: %w", family, table, err)
 		}
 	}
 
 	return nil
 }
 
+// routeFileName names the saved routes file of a family and table
+func routeFileName(family models.IPFamily, table string) string {
+	if family == models.FamilyIPv6 {
+		return table + ".v6.conf"
+	}
+	return table + ".conf"
+}
+
+// saveNexthops writes the nexthop objects the saved routes may refer to,
+// groups after the nexthops they contain
+func (s *IPRouteService) saveNexthops() error {
+	nexthops, err := s.ListNexthops()
+	if err != nil {
+		return err
+	}
+
+	var lines, groups []string
+	for _, nh := range nexthops {
+		if len(nh.Group) > 0 {
+			groups = append(groups, formatNexthopConfig(nh))
+		} else {
+			lines = append(lines, formatNexthopConfig(nh))
+		}
+	}
+	lines = append(lines, groups...)
+
+	savePath := filepath.Join(s.configDir, "routes", "nexthops")
+	if err := os.WriteFile(savePath, []byte(strings.Join(lines, "\n")), 0644); err != nil {
+		return fmt.Errorf("failed to save nexthops: %w", err)
+	}
+	return nil
+}
+
 func (s *IPRouteService) RestoreRoutes() error {
 	routesDir := filepath.Join(s.configDir, "routes")
 	files, err := os.ReadDir(routesDir)
@@ -298,12 +814,35 @@ func (s *IPRouteService) RestoreRoutes() error {
 		return err
 	}
 
+	// Nexthop objects first, as routes may refer to them
+	var errors []string
+	if data, err := os.ReadFile(filepath.Join(routesDir, "nexthops")); err == nil {
+		scanner := bufio.NewScanner(strings.NewReader(string(data)))
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+
+			nh, err := parseNexthopConfig(line)
+			if err == nil {
+				err = s.ReplaceNexthop(nh)
+			}
+			if err != nil {
+				errors = append(errors, "nexthops: "+line+": "+err.Error())
+			}
+		}
+	}
+
 	for _, file := range files {
 		if file.IsDir() || !strings.HasSuffix(file.Name(), ".conf") {
 			continue
 		}
 
-		table := strings.TrimSuffix(file.Name(), ".conf")
+		family, table := models.FamilyIPv4, strings.TrimSuffix(file.Name(), ".conf")
+		if strings.HasSuffix(table, ".v6") {
+			family, table = models.FamilyIPv6, strings.TrimSuffix(table, ".v6")
+		}
 		data, err := os.ReadFile(filepath.Join(routesDir, file.Name()))
 		if err != nil {
 			continue
@@ -316,15 +855,21 @@ func (s *IPRouteService) RestoreRoutes() error {
 				continue
 			}
 
-			args := []string{"route", "add"}
-			args = append(args, strings.Fields(line)...)
-			if table != "main" {
-				args = append(args, "table", table)
+			route, err := parseRouteConfig(line)
+			if err == nil {
+				route.Family = family
+				route.Table = table
+				err = s.ReplaceRoute(route)
+			}
+			if err != nil {
+				errors = append(errors, file.Name()+": "+line+": "+err.Error())
 			}
-
-			exec.Command("ip", args...).Run()
 		}
 	}
 
+	if len(errors) > 0 {
+		return fmt.Errorf("%s", strings.Join(errors, "; "))
+	}
+
 	return nil
 }
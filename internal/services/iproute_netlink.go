@@ -0,0 +1,175 @@
+package services
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+)
+
+// The netlink package does not know the nexthop object of a route or its
+// initial congestion window, so routes with those are built and read here
+
+// rtaNexthopID is the RTA_NH_ID route attribute
+const rtaNexthopID = 30
+
+// routeExtra holds the route attributes the netlink package leaves out
+type routeExtra struct {
+	nexthopID int
+	initCwnd  int
+}
+
+// routeKey identifies a route across its netlink forms
+func routeKey(table int, dst *net.IPNet, tos, priority int) string {
+	return fmt.Sprintf("%d %s %d %d", table, routeDestination(dst), tos, priority)
+}
+
+// routeExtras returns the extra attributes of the routes of a family that
+// have any, keyed by routeKey
+func routeExtras(family int) (map[string]routeExtra, error) {
+	req := nl.NewNetlinkRequest(unix.RTM_GETROUTE, unix.NLM_F_DUMP)
+	msg := nl.NewRtMsg()
+	msg.Family = uint8(family)
+	req.AddData(msg)
+	msgs, err := req.Execute(unix.NETLINK_ROUTE, unix.RTM_NEWROUTE)
+	if err != nil {
+		return nil, err
+	}
+
+	native := nl.NativeEndian()
+	extras := make(map[string]routeExtra)
+	for _, m := range msgs {
+		if len(m) < unix.SizeofRtMsg {
+			continue
+		}
+		rt := nl.DeserializeRtMsg(m)
+		attrs, err := nl.ParseRouteAttr(m[unix.SizeofRtMsg:])
+		if err != nil {
+			return nil, err
+		}
+
+		table, priority := int(rt.Table), 0
+		dst := &net.IPNet{IP: net.IPv4zero, Mask: net.CIDRMask(int(rt.Dst_len), 32)}
+		if rt.Family == unix.AF_INET6 {
+			dst = &net.IPNet{IP: net.IPv6zero, Mask: net.CIDRMask(int(rt.Dst_len), 128)}
+		}
+		var extra routeExtra
+		for _, attr := range attrs {
+			switch attr.Attr.Type {
+			case unix.RTA_DST:
+				dst.IP = net.IP(attr.Value)
+			case unix.RTA_TABLE:
+				table = int(native.Uint32(attr.Value))
+			case unix.RTA_PRIORITY:
+				priority = int(native.Uint32(attr.Value))
+			case rtaNexthopID:
+				extra.nexthopID = int(native.Uint32(attr.Value))
+			case unix.RTA_METRICS:
+				metrics, err := nl.ParseRouteAttr(attr.Value)
+				if err != nil {
+					return nil, err
+				}
+				for _, metric := range metrics {
+					if metric.Attr.Type == unix.RTAX_INITCWND {
+						extra.initCwnd = int(native.Uint32(metric.Value))
+					}
+				}
+			}
+		}
+		if extra != (routeExtra{}) {
+			extras[routeKey(table, dst, int(rt.Tos), priority)] = extra
+		}
+	}
+	return extras, nil
+}
+
+// changeRoute adds or replaces a route with its extra attributes, the way
+// netlink.RouteAdd and netlink.RouteReplace would
+func changeRoute(nr *netlink.Route, extra routeExtra, flags int) error {
+	req := nl.NewNetlinkRequest(unix.RTM_NEWROUTE, flags|unix.NLM_F_ACK)
+	msg := nl.NewRtMsg()
+	msg.Family = uint8(nl.GetIPFamily(nr.Dst.IP))
+	ones, _ := nr.Dst.Mask.Size()
+	msg.Dst_len = uint8(ones)
+	msg.Tos = uint8(nr.Tos)
+	msg.Protocol = uint8(nr.Protocol)
+	msg.Type = uint8(nr.Type)
+	msg.Scope = uint8(nr.Scope)
+	msg.Flags = uint32(nr.Flags)
+
+	// Addresses in their 4-byte form for IPv4
+	addr := func(ip net.IP) []byte {
+		if ip4 := ip.To4(); ip4 != nil {
+			return ip4
+		}
+		return ip.To16()
+	}
+
+	attrs := []nl.NetlinkRequestData{nl.NewRtAttr(unix.RTA_DST, addr(nr.Dst.IP))}
+	if nr.Table >= 256 {
+		msg.Table = unix.RT_TABLE_UNSPEC
+		attrs = append(attrs, nl.NewRtAttr(unix.RTA_TABLE, nl.Uint32Attr(uint32(nr.Table))))
+	} else {
+		msg.Table = uint8(nr.Table)
+	}
+	if nr.Priority > 0 {
+		attrs = append(attrs, nl.NewRtAttr(unix.RTA_PRIORITY, nl.Uint32Attr(uint32(nr.Priority))))
+	}
+	if nr.Src != nil {
+		attrs = append(attrs, nl.NewRtAttr(unix.RTA_PREFSRC, addr(nr.Src)))
+	}
+	if nr.Gw != nil {
+		attrs = append(attrs, nl.NewRtAttr(unix.RTA_GATEWAY, addr(nr.Gw)))
+	}
+	if nr.LinkIndex > 0 {
+		attrs = append(attrs, nl.NewRtAttr(unix.RTA_OIF, nl.Uint32Attr(uint32(nr.LinkIndex))))
+	}
+
+	if len(nr.MultiPath) > 0 {
+		var buf []byte
+		for _, nh := range nr.MultiPath {
+			rtnh := &nl.RtNexthop{
+				RtNexthop: unix.RtNexthop{
+					Hops:    uint8(nh.Hops),
+					Ifindex: int32(nh.LinkIndex),
+					Flags:   uint8(nh.Flags),
+				},
+			}
+			if nh.Gw != nil {
+				rtnh.Children = []nl.NetlinkRequestData{nl.NewRtAttr(unix.RTA_GATEWAY, addr(nh.Gw))}
+			}
+			buf = append(buf, rtnh.Serialize()...)
+		}
+		attrs = append(attrs, nl.NewRtAttr(unix.RTA_MULTIPATH, buf))
+	}
+
+	metrics := nl.NewRtAttr(unix.RTA_METRICS, nil)
+	hasMetrics := false
+	for _, m := range []struct{ attr, value int }{
+		{unix.RTAX_MTU, nr.MTU},
+		{unix.RTAX_ADVMSS, nr.AdvMSS},
+		{unix.RTAX_HOPLIMIT, nr.Hoplimit},
+		{unix.RTAX_INITCWND, extra.initCwnd},
+	} {
+		if m.value > 0 {
+			metrics.AddRtAttr(m.attr, nl.Uint32Attr(uint32(m.value)))
+			hasMetrics = true
+		}
+	}
+	if hasMetrics {
+		attrs = append(attrs, metrics)
+	}
+
+	if extra.nexthopID > 0 {
+		attrs = append(attrs, nl.NewRtAttr(rtaNexthopID, nl.Uint32Attr(uint32(extra.nexthopID))))
+	}
+
+	req.AddData(msg)
+	for _, attr := range attrs {
+		req.AddData(attr)
+	}
+	_, err := req.Execute(unix.NETLINK_ROUTE, 0)
+	return err
+}
@@ -275,3 +275,32 @@ func (s *IPRuleService) RestoreRules() error {
 
 	return nil
 }
+
+// RenameTable points the saved rules that look up a table by its old name
+// at the new one. The running rules keep the table ID and need no change.
+func (s *IPRuleService) RenameTable(oldName, newName string) error {
+	savePath := filepath.Join(s.configDir, "rules", "ip-rules.conf")
+	data, err := os.ReadFile(savePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+
+	lines := strings.Split(string(data), "\n")
+	for i, line := range lines {
+		fields := strings.Fields(line)
+		for j := 0; j+1 < len(fields); j++ {
+			if (fields[j] == "lookup" || fields[j] == "table") && fields[j+1] == oldName {
+				fields[j+1] = newName
+				lines[i] = strings.Join(fields, " ")
+			}
+		}
+	}
+
+	if err := os.WriteFile(savePath, []byte(strings.Join(lines, "\n")), 0644); err != nil {
+		return fmt.Errorf("failed to save rules: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,282 @@
+package services
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"linuxtorouter/internal/models"
+)
+
+// ipsetNamePattern matches the set names accepted here; ipset allows up to
+// 31 characters
+var ipsetNamePattern = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,31}$`)
+
+// IPSetService manages ipsets through the ipset command. Sets are saved to
+// configs/ipset/ipsets.conf and must be restored before the iptables rules
+// that reference them.
+type IPSetService struct {
+	configDir string
+}
+
+func NewIPSetService(configDir string) *IPSetService {
+	return &IPSetService{configDir: configDir}
+}
+
+// ListSets returns all sets without their entries
+func (s *IPSetService) ListSets() ([]models.IPSet, error) {
+	output, err := exec.Command("ipset", "list", "-t").CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list ipsets: %s", strings.TrimSpace(string(output)))
+	}
+
+	return parseIPSetList(string(output)), nil
+}
+
+// GetSet returns a set with its entries
+func (s *IPSetService) GetSet(name string) (*models.IPSet, error) {
+	if err := validateIPSetName(name); err != nil {
+		return nil, err
+	}
+
+	output, err := exec.Command("ipset", "list", name).CombinedOutput()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list ipset: %s", strings.TrimSpace(string(output)))
+	}
+
+	sets := parseIPSetList(string(output))
+	if len(sets) != 1 {
+		return nil, fmt.Errorf("ipset %s not found", name)
+	}
+	return &sets[0], nil
+}
+
+// parseIPSetList parses the output of "ipset list", e.g.
+//
+//	Name: blocklist
+//	Type: hash:net
+//	Revision: 7
+//	Header: family inet hashsize 1024 maxelem 65536
+//	Size in memory: 504
+//	References: 1
+//	Number of entries: 1
+//	Members:
+//	198.51.100.0/24
+func parseIPSetList(output string) []models.IPSet {
+	var sets []models.IPSet
+	var current *models.IPSet
+	inMembers := false
+
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			inMembers = false
+			continue
+		}
+
+		if inMembers {
+			current.Entries = append(current.Entries, line)
+			current.Count = len(current.Entries)
+			continue
+		}
+
+		key, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		value = strings.TrimSpace(value)
+
+		switch key {
+		case "Name":
+			sets = append(sets, models.IPSet{Name: value, Family: models.FamilyIPv4})
+			current = &sets[len(sets)-1]
+		case "Type":
+			current.Type = value
+		case "Header":
+			if strings.Contains(" "+value+" ", " family inet6 ") {
+				current.Family = models.FamilyIPv6
+			}
+		case "References":
+			current.References, _ = strconv.Atoi(value)
+		case "Number of entries":
+			current.Count, _ = strconv.Atoi(value)
+		case "Members":
+			inMembers = current != nil
+		}
+	}
+
+	return sets
+}
+
+// CreateSet creates a set of one of models.IPSetTypes
+func (s *IPSetService) CreateSet(name, setType string, family models.IPFamily) error {
+	if err := validateIPSetName(name); err != nil {
+		return err
+	}
+
+	valid := false
+	for _, t := range models.IPSetTypes {
+		if setType == t {
+			valid = true
+		}
+	}
+	if !valid {
+		return fmt.Errorf("unsupported ipset type: %s", setType)
+	}
+
+	inet := "inet"
+	if family == models.FamilyIPv6 {
+		inet = "inet6"
+	}
+
+	if output, err := exec.Command("ipset", "create", name, setType, "family", inet).CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to create ipset: %s", strings.TrimSpace(string(output)))
+	}
+
+	return nil
+}
+
+// DestroySet removes a set; the kernel refuses while rules reference it
+func (s *IPSetService) DestroySet(name string) error {
+	if err := validateIPSetName(name); err != nil {
+		return err
+	}
+
+	if output, err := exec.Command("ipset", "destroy", name).CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to destroy ipset: %s", strings.TrimSpace(string(output)))
+	}
+
+	return nil
+}
+
+// AddEntry adds an address, network or address,port entry to a set
+func (s *IPSetService) AddEntry(name, entry string) error {
+	if err := validateIPSetName(name); err != nil {
+		return err
+	}
+	if err := validateIPSetEntry(entry); err != nil {
+		return err
+	}
+
+	if output, err := exec.Command("ipset", "add", name, entry, "-exist").CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to add entry: %s", strings.TrimSpace(string(output)))
+	}
+
+	return nil
+}
+
+// DeleteEntry removes an entry from a set
+func (s *IPSetService) DeleteEntry(name, entry string) error {
+	if err := validateIPSetName(name); err != nil {
+		return err
+	}
+	if err := validateIPSetEntry(entry); err != nil {
+		return err
+	}
+
+	if output, err := exec.Command("ipset", "del", name, entry).CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to delete entry: %s", strings.TrimSpace(string(output)))
+	}
+
+	return nil
+}
+
+// ImportEntries adds one entry per line (blank lines and "#" comments are
+// skipped) in a single "ipset restore" run and returns the number of
+// entries submitted. Entries already in the set are ignored.
+func (s *IPSetService) ImportEntries(name, entries string) (int, error) {
+	if err := validateIPSetName(name); err != nil {
+		return 0, err
+	}
+
+	var script strings.Builder
+	count := 0
+	scanner := bufio.NewScanner(strings.NewReader(entries))
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = strings.TrimSpace(line[:i])
+		}
+		if line == "" {
+			continue
+		}
+		if err := validateIPSetEntry(line); err != nil {
+			return 0, fmt.Errorf("line %d: %w", lineNum, err)
+		}
+		fmt.Fprintf(&script, "add %s %s\n", name, line)
+		count++
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, fmt.Errorf("failed to read entries: %w", err)
+	}
+
+	if count == 0 {
+		return 0, nil
+	}
+
+	cmd := exec.Command("ipset", "restore", "-exist")
+	cmd.Stdin = strings.NewReader(script.String())
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return 0, fmt.Errorf("failed to import entries: %s", strings.TrimSpace(string(output)))
+	}
+
+	return count, nil
+}
+
+func (s *IPSetService) SaveSets() error {
+	output, err := exec.Command("ipset", "save").Output()
+	if err != nil {
+		return fmt.Errorf("failed to save ipsets: %w", err)
+	}
+
+	savePath := filepath.Join(s.configDir, "ipset", "ipsets.conf")
+	if err := os.WriteFile(savePath, output, 0644); err != nil {
+		return fmt.Errorf("failed to write ipset file: %w", err)
+	}
+
+	return nil
+}
+
+// RestoreSets loads the saved sets. It has to run before the firewall
+// rules are restored, since iptables-restore fails on unknown sets.
+func (s *IPSetService) RestoreSets() error {
+	savePath := filepath.Join(s.configDir, "ipset", "ipsets.conf")
+	data, err := os.ReadFile(savePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil // No saved sets
+		}
+		return fmt.Errorf("failed to read ipset file: %w", err)
+	}
+
+	cmd := exec.Command("ipset", "restore", "-exist")
+	cmd.Stdin = bytes.NewReader(data)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to restore ipsets: %s", strings.TrimSpace(string(output)))
+	}
+
+	return nil
+}
+
+func validateIPSetName(name string) error {
+	if !ipsetNamePattern.MatchString(name) {
+		return fmt.Errorf("invalid ipset name: %q", name)
+	}
+	return nil
+}
+
+// validateIPSetEntry rejects entries that would break out of an ipset
+// restore line; the kernel validates the entry itself
+func validateIPSetEntry(entry string) error {
+	if entry == "" || strings.ContainsAny(entry, " \t\r\n") {
+		return fmt.Errorf("invalid ipset entry: %q", entry)
+	}
+	return nil
+}
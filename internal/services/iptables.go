@@ -4,10 +4,12 @@ import (
 	"bufio"
 	"bytes"
 	"fmt"
+	"net"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 
@@ -16,261 +18,221 @@ import (
 
 type IPTablesService struct {
 	configDir string
+
+	*safeApplier
 }
 
 func NewIPTablesService(configDir string) *IPTablesService {
-	return &IPTablesService{configDir: configDir}
+	s := &IPTablesService{configDir: configDir}
+	s.safeApplier = newSafeApplier(s.snapshotRules, s.restoreSnapshots)
+	return s
 }
 
-func (s *IPTablesService) ListChains(table string) ([]models.ChainInfo, error) {
-	if table == "" {
-		table = "filter"
-	}
+// Name identifies the backend in the UI
+func (s *IPTablesService) Name() string {
+	return "iptables"
+}
 
-	cmd := exec.Command("iptables", "-t", table, "-L", "-n", "-v", "--line-numbers")
-	output, err := cmd.Output()
-	if err != nil {
-		return nil, fmt.Errorf("failed to list chains: %w", err)
+// iptablesCommand returns the iptables binary for an address family
+func iptablesCommand(family models.IPFamily) string {
+	if family == models.FamilyIPv6 {
+		return "ip6tables"
 	}
+	return "iptables"
+}
 
-	return s.parseChainOutput(string(output))
+// rulesFile returns the name of the persisted ruleset for an address family
+func rulesFile(family models.IPFamily) string {
+	if family == models.FamilyIPv6 {
+		return "rules.v6"
+	}
+	return "rules.v4"
 }
 
-func (s *IPTablesService) GetChain(table, chain string) (*models.ChainInfo, error) {
+func (s *IPTablesService) ListChains(family models.IPFamily, table string) ([]models.ChainInfo, error) {
 	if table == "" {
 		table = "filter"
 	}
 
-	cmd := exec.Command("iptables", "-t", table, "-L", chain, "-n", "-v", "--line-numbers")
+	cmd := exec.Command(iptablesCommand(family)+"-save", "-c", "-t", table)
 	output, err := cmd.Output()
 	if err != nil {
-		return nil, fmt.Errorf("failed to get chain: %w", err)
+		return nil, fmt.Errorf("failed to list chains: %w", err)
 	}
 
-	chains, err := s.parseChainOutput(string(output))
+	return parseSaveTable(string(output), family)
+}
+
+func (s *IPTablesService) GetChain(family models.IPFamily, table, chain string) (*models.ChainInfo, error) {
+	chains, err := s.ListChains(family, table)
 	if err != nil {
-		return nil, err
+		return nil, fmt.Errorf("failed to get chain: %w", err)
 	}
 
-	if len(chains) == 0 {
-		return nil, fmt.Errorf("chain not found")
+	for i := range chains {
+		if chains[i].Name == chain {
+			return &chains[i], nil
+		}
 	}
 
-	return &chains[0], nil
+	return nil, fmt.Errorf("chain not found")
 }
 
-func (s *IPTablesService) parseChainOutput(output string) ([]models.ChainInfo, error) {
-	var chains []models.ChainInfo
-	var currentChain *models.ChainInfo
-
-	scanner := bufio.NewScanner(strings.NewReader(output))
-	// Updated regex to handle K/M/G suffixes for both packets and bytes (e.g., "253K packets, 33M bytes")
-	chainHeaderRe := regexp.MustCompile(`^Chain (\S+) \(policy (\S+) (\d+[KMG]?) packets, (\d+[KMG]?) bytes\)`)
-	chainHeaderNoPolicy := regexp.MustCompile(`^Chain (\S+) \((\d+) references\)`)
-
-	for scanner.Scan() {
-		line := scanner.Text()
-
-		// Check for chain header with policy
-		if matches := chainHeaderRe.FindStringSubmatch(line); matches != nil {
-			if currentChain != nil {
-				chains = append(chains, *currentChain)
-			}
-			packets := parseSuffixedNumber(matches[3])
-			bytesVal := parseSuffixedNumber(matches[4])
-			currentChain = &models.ChainInfo{
-				Name:    matches[1],
-				Policy:  matches[2],
-				Packets: packets,
-				Bytes:   bytesVal,
-			}
-			continue
-		}
-
-		// Check for chain header without policy (user-defined chains)
-		if matches := chainHeaderNoPolicy.FindStringSubmatch(line); matches != nil {
-			if currentChain != nil {
-				chains = append(chains, *currentChain)
-			}
-			currentChain = &models.ChainInfo{
-				Name:   matches[1],
-				Policy: "-",
-			}
-			continue
-		}
-
-		// Skip header line
-		if strings.HasPrefix(line, "num") || strings.TrimSpace(line) == "" {
-			continue
-		}
+func (s *IPTablesService) AddRule(input models.FirewallRuleInput) error {
+	spec, err := ruleSpecFromInput(input)
+	if err != nil {
+		return err
+	}
+	args := RuleSpecArgs(spec)
 
-		// Parse rule line
-		if currentChain != nil && strings.TrimSpace(line) != "" {
-			rule := s.parseRuleLine(line)
-			if rule != nil {
-				currentChain.Rules = append(currentChain.Rules, *rule)
-			}
-		}
+	if input.Position > 0 {
+		args = append([]string{"-t", input.Table, "-I", input.Chain, strconv.Itoa(input.Position)}, args...)
+	} else {
+		args = append([]string{"-t", input.Table, "-A", input.Chain}, args...)
 	}
 
-	if currentChain != nil {
-		chains = append(chains, *currentChain)
+	cmd := exec.Command(iptablesCommand(input.Family), args...)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to add rule: %s", string(output))
 	}
 
-	return chains, nil
+	return nil
 }
 
-// parseSuffixedNumber parses numbers with K/M/G suffixes (e.g., "6477K", "49M", "253K")
-func parseSuffixedNumber(s string) uint64 {
-	if s == "" {
-		return 0
+func (s *IPTablesService) DeleteRule(family models.IPFamily, table, chain string, ruleNum int) error {
+	if table == "" {
+		table = "filter"
 	}
 
-	multiplier := uint64(1)
-	numStr := s
-
-	// Check for suffix
-	lastChar := s[len(s)-1]
-	switch lastChar {
-	case 'K':
-		multiplier = 1024
-		numStr = s[:len(s)-1]
-	case 'M':
-		multiplier = 1024 * 1024
-		numStr = s[:len(s)-1]
-	case 'G':
-		multiplier = 1024 * 1024 * 1024
-		numStr = s[:len(s)-1]
+	cmd := exec.Command(iptablesCommand(family), "-t", table, "-D", chain, strconv.Itoa(ruleNum))
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to delete rule: %s", string(output))
 	}
 
-	val, _ := strconv.ParseUint(numStr, 10, 64)
-	return val * multiplier
+	return nil
 }
 
-func (s *IPTablesService) parseRuleLine(line string) *models.FirewallRule {
-	fields := strings.Fields(line)
-	// iptables -L -n -v --line-numbers output format:
-	// num pkts bytes target prot opt in out source destination [extra...]
-	// 0   1    2     3      4    5   6  7   8      9           10+
-	if len(fields) < 10 {
-		return nil
+// RuleInput returns the rule form values of a rule and the parts of its
+// specification the form cannot represent
+func (s *IPTablesService) RuleInput(family models.IPFamily, table, chain string, ruleNum int) (*models.FirewallRuleInput, []string, error) {
+	rule, err := s.getRule(family, table, chain, ruleNum)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	num, _ := strconv.Atoi(fields[0])
-	packets := parseSuffixedNumber(fields[1])
-	bytesVal := parseSuffixedNumber(fields[2])
-
-	rule := &models.FirewallRule{
-		Num:         num,
-		Packets:     packets,
-		Bytes:       bytesVal,
-		Target:      fields[3],
-		Protocol:    fields[4],
-		Opt:         fields[5],
-		In:          fields[6],
-		Out:         fields[7],
-		Source:      fields[8],
-		Destination: fields[9],
+	input, unsupported := RuleInputFromSpec(rule.Spec, family)
+	input.Table = table
+	if input.Table == "" {
+		input.Table = "filter"
 	}
+	return input, unsupported, nil
+}
 
-	if len(fields) > 10 {
-		extra := strings.Join(fields[10:], " ")
-		// Extract comment (content between /* and */)
-		rule.Extra, rule.Comment = extractComment(extra)
+// ReplaceRule replaces the rule at ruleNum with "iptables -R", keeping its
+// position and packet and byte counters
+func (s *IPTablesService) ReplaceRule(ruleNum int, input models.FirewallRuleInput) error {
+	if input.Table == "" {
+		input.Table = "filter"
 	}
 
-	return rule
-}
-
-// extractComment separates comment from extra options
-// Returns (options without comment, comment text including /* and */)
-func extractComment(extra string) (string, string) {
-	startIdx := strings.Index(extra, "/*")
-	if startIdx == -1 {
-		return extra, ""
+	rule, err := s.getRule(input.Family, input.Table, input.Chain, ruleNum)
+	if err != nil {
+		return err
 	}
 
-	endIdx := strings.LastIndex(extra, "*/")
-	if endIdx == -1 || endIdx < startIdx {
-		return extra, ""
+	spec, err := ruleSpecFromInput(input)
+	if err != nil {
+		return err
 	}
 
-	// Extract comment text (including /* and */)
-	comment := strings.TrimSpace(extra[startIdx : endIdx+2])
+	args := []string{"-t", input.Table, "-R", input.Chain, strconv.Itoa(ruleNum),
+		"-c", strconv.FormatUint(rule.Packets, 10), strconv.FormatUint(rule.Bytes, 10)}
+	args = append(args, RuleSpecArgs(spec)...)
 
-	// Build options without comment
-	options := strings.TrimSpace(extra[:startIdx])
-	if endIdx+2 < len(extra) {
-		remaining := strings.TrimSpace(extra[endIdx+2:])
-		if remaining != "" {
-			if options != "" {
-				options = options + " " + remaining
-			} else {
-				options = remaining
-			}
-		}
+	cmd := exec.Command(iptablesCommand(input.Family), args...)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to replace rule: %s", string(output))
 	}
 
-	return options, comment
+	return nil
 }
 
-func (s *IPTablesService) AddRule(input models.FirewallRuleInput) error {
-	args := s.buildRuleArgs(input)
-
-	if input.Position > 0 {
-		args = append([]string{"-t", input.Table, "-I", input.Chain, strconv.Itoa(input.Position)}, args...)
-	} else {
-		args = append([]string{"-t", input.Table, "-A", input.Chain}, args...)
+// getRule returns the rule at ruleNum of a chain
+func (s *IPTablesService) getRule(family models.IPFamily, table, chain string, ruleNum int) (*models.FirewallRule, error) {
+	info, err := s.GetChain(family, table, chain)
+	if err != nil {
+		return nil, err
 	}
 
-	cmd := exec.Command("iptables", args...)
-	if output, err := cmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("failed to add rule: %s", string(output))
+	if ruleNum < 1 || ruleNum > len(info.Rules) {
+		return nil, fmt.Errorf("rule %d not found", ruleNum)
 	}
 
-	return nil
+	return &info.Rules[ruleNum-1], nil
 }
 
-func (s *IPTablesService) DeleteRule(table, chain string, ruleNum int) error {
+// MoveRule moves the rule at fromPos so that it ends up at toPos. The rule
+// specification is taken from "iptables -S" and the delete and re-insert are
+// applied in a single iptables-restore transaction, so a failure leaves the
+// chain untouched.
+func (s *IPTablesService) MoveRule(family models.IPFamily, table, chain string, fromPos, toPos int) error {
 	if table == "" {
 		table = "filter"
 	}
 
-	cmd := exec.Command("iptables", "-t", table, "-D", chain, strconv.Itoa(ruleNum))
-	if output, err := cmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("failed to delete rule: %s", string(output))
-	}
-
-	return nil
-}
-
-func (s *IPTablesService) MoveRule(table, chain string, fromPos, toPos int) error {
-	// Get the rule specification first
-	chainInfo, err := s.GetChain(table, chain)
+	specs, err := s.chainRuleSpecs(family, table, chain)
 	if err != nil {
 		return err
 	}
 
-	if fromPos < 1 || fromPos > len(chainInfo.Rules) {
+	if fromPos < 1 || fromPos > len(specs) {
 		return fmt.Errorf("invalid source position")
 	}
-
-	// Delete the rule from original position
-	if err := s.DeleteRule(table, chain, fromPos); err != nil {
-		return err
+	if toPos < 1 || toPos > len(specs) {
+		return fmt.Errorf("invalid target position")
 	}
+	if fromPos == toPos {
+		return nil
+	}
+
+	var payload bytes.Buffer
+	fmt.Fprintf(&payload, "*%s\n", table)
+	fmt.Fprintf(&payload, "-D %s %d\n", chain, fromPos)
+	fmt.Fprintf(&payload, "-I %s %d %s\n", chain, toPos, specs[fromPos-1])
+	payload.WriteString("COMMIT\n")
 
-	// Adjust target position if needed
-	if toPos > fromPos {
-		toPos--
+	cmd := exec.Command(iptablesCommand(family)+"-restore", "--noflush")
+	cmd.Stdin = &payload
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to move rule: %s", string(output))
 	}
 
-	// Get updated rule spec and re-insert at new position
-	// This is a simplified approach - in production you'd need to preserve the full rule spec
 	return nil
 }
 
-func (s *IPTablesService) SetPolicy(table, chain, policy string) error {
+// chainRuleSpecs returns the rule specifications of a chain as printed by
+// "iptables -S", without the leading "-A <chain>", in rule order
+func (s *IPTablesService) chainRuleSpecs(family models.IPFamily, table, chain string) ([]string, error) {
+	cmd := exec.Command(iptablesCommand(family), "-t", table, "-S", chain)
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get rule specs: %w", err)
+	}
+
+	prefix := "-A " + chain + " "
+	var specs []string
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, prefix) {
+			specs = append(specs, strings.TrimPrefix(line, prefix))
+		}
+	}
+
+	return specs, nil
+}
+
+func (s *IPTablesService) SetPolicy(family models.IPFamily, table, chain, policy string) error {
 	if table == "" {
 		table = "filter"
 	}
@@ -280,7 +242,7 @@ func (s *IPTablesService) SetPolicy(table, chain, policy string) error {
 		return fmt.Errorf("invalid policy: %s", policy)
 	}
 
-	cmd := exec.Command("iptables", "-t", table, "-P", chain, policy)
+	cmd := exec.Command(iptablesCommand(family), "-t", table, "-P", chain, policy)
 	if output, err := cmd.CombinedOutput(); err != nil {
 		return fmt.Errorf("failed to set policy: %s", string(output))
 	}
@@ -288,12 +250,12 @@ func (s *IPTablesService) SetPolicy(table, chain, policy string) error {
 	return nil
 }
 
-func (s *IPTablesService) CreateChain(table, chain string) error {
+func (s *IPTablesService) CreateChain(family models.IPFamily, table, chain string) error {
 	if table == "" {
 		table = "filter"
 	}
 
-	cmd := exec.Command("iptables", "-t", table, "-N", chain)
+	cmd := exec.Command(iptablesCommand(family), "-t", table, "-N", chain)
 	if output, err := cmd.CombinedOutput(); err != nil {
 		return fmt.Errorf("failed to create chain: %s", string(output))
 	}
@@ -301,17 +263,17 @@ func (s *IPTablesService) CreateChain(table, chain string) error {
 	return nil
 }
 
-func (s *IPTablesService) DeleteChain(table, chain string) error {
+func (s *IPTablesService) DeleteChain(family models.IPFamily, table, chain string) error {
 	if table == "" {
 		table = "filter"
 	}
 
 	// First flush the chain
-	flushCmd := exec.Command("iptables", "-t", table, "-F", chain)
+	flushCmd := exec.Command(iptablesCommand(family), "-t", table, "-F", chain)
 	flushCmd.Run()
 
 	// Then delete it
-	cmd := exec.Command("iptables", "-t", table, "-X", chain)
+	cmd := exec.Command(iptablesCommand(family), "-t", table, "-X", chain)
 	if output, err := cmd.CombinedOutput(); err != nil {
 		return fmt.Errorf("failed to delete chain: %s", string(output))
 	}
@@ -319,7 +281,7 @@ func (s *IPTablesService) DeleteChain(table, chain string) error {
 	return nil
 }
 
-func (s *IPTablesService) FlushChain(table, chain string) error {
+func (s *IPTablesService) FlushChain(family models.IPFamily, table, chain string) error {
 	if table == "" {
 		table = "filter"
 	}
@@ -329,7 +291,7 @@ func (s *IPTablesService) FlushChain(table, chain string) error {
 		args = append(args, chain)
 	}
 
-	cmd := exec.Command("iptables", args...)
+	cmd := exec.Command(iptablesCommand(family), args...)
 	if output, err := cmd.CombinedOutput(); err != nil {
 		return fmt.Errorf("failed to flush chain: %s", string(output))
 	}
@@ -337,66 +299,283 @@ func (s *IPTablesService) FlushChain(table, chain string) error {
 	return nil
 }
 
-func (s *IPTablesService) buildRuleArgs(input models.FirewallRuleInput) []string {
-	var args []string
+// ReplaceChains rewrites managed chains in one iptables-restore --noflush
+// run. Declaring a chain creates it or flushes it, its rules follow, and
+// every jump from the parent is deleted by the numbers read before the run,
+// bottom first so they do not shift, and inserted again at the top.
+func (s *IPTablesService) ReplaceChains(family models.IPFamily, chains []ManagedChain) error {
+	var tables []string
+	byTable := make(map[string][]ManagedChain)
+	for _, mc := range chains {
+		if _, ok := byTable[mc.Table]; !ok {
+			tables = append(tables, mc.Table)
+		}
+		byTable[mc.Table] = append(byTable[mc.Table], mc)
+	}
 
-	if input.Protocol != "" && input.Protocol != "all" {
-		args = append(args, "-p", input.Protocol)
+	var payload bytes.Buffer
+	for _, table := range tables {
+		fmt.Fprintf(&payload, "*%s\n", table)
+		for _, mc := range byTable[table] {
+			fmt.Fprintf(&payload, ":%s - [0:0]\n", mc.Chain)
+		}
+
+		deletes := make(map[string][]int)
+		var parents, inserts []string
+		for _, mc := range byTable[table] {
+			for _, input := range mc.Rules {
+				input.Chain = mc.Chain
+				spec, err := ruleSpecFromInput(input)
+				if err != nil {
+					return fmt.Errorf("%s: %w", mc.Chain, err)
+				}
+				payload.WriteString(FormatRuleSpec(spec) + "\n")
+			}
+
+			parent, err := s.GetChain(family, table, mc.Parent)
+			if err != nil {
+				return fmt.Errorf("failed to read %s %s: %w", table, mc.Parent, err)
+			}
+			var jumps []int
+			for _, rule := range parent.Rules {
+				if rule.Target == mc.Chain {
+					jumps = append(jumps, rule.Num)
+				}
+			}
+			if _, ok := deletes[mc.Parent]; !ok {
+				parents = append(parents, mc.Parent)
+			}
+			deletes[mc.Parent] = append(deletes[mc.Parent], jumps...)
+			inserts = append(inserts, fmt.Sprintf("-I %s 1 -j %s", mc.Parent, mc.Chain))
+		}
+
+		for _, parent := range parents {
+			nums := deletes[parent]
+			sort.Sort(sort.Reverse(sort.IntSlice(nums)))
+			for _, num := range nums {
+				fmt.Fprintf(&payload, "-D %s %d\n", parent, num)
+			}
+		}
+		for _, insert := range inserts {
+			payload.WriteString(insert + "\n")
+		}
+		payload.WriteString("COMMIT\n")
 	}
 
-	if input.Source != "" && input.Source != "0.0.0.0/0" {
-		args = append(args, "-s", input.Source)
+	cmd := exec.Command(iptablesCommand(family)+"-restore", "--noflush")
+	cmd.Stdin = &payload
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to replace chains: %s", string(output))
 	}
 
-	if input.Destination != "" && input.Destination != "0.0.0.0/0" {
-		args = append(args, "-d", input.Destination)
+	return nil
+}
+
+func (s *IPTablesService) ZeroCounters(family models.IPFamily, table, chain string, ruleNum int) error {
+	if table == "" {
+		table = "filter"
 	}
 
-	if input.InInterface != "" {
-		args = append(args, "-i", input.InInterface)
+	args := []string{"-t", table, "-Z"}
+	if chain != "" {
+		args = append(args, chain)
+		if ruleNum > 0 {
+			args = append(args, strconv.Itoa(ruleNum))
+		}
+	} else if ruleNum > 0 {
+		return fmt.Errorf("a rule number requires a chain")
 	}
 
-	if input.OutInterface != "" {
-		args = append(args, "-o", input.OutInterface)
+	cmd := exec.Command(iptablesCommand(family), args...)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to zero counters: %s", string(output))
 	}
 
-	if input.DPort != "" {
-		args = append(args, "--dport", input.DPort)
+	return nil
+}
+
+func (s *IPTablesService) ApplyRuleset(family models.IPFamily, ruleset string) error {
+	cmd := exec.Command(iptablesCommand(family)+"-restore", "-c")
+	cmd.Stdin = strings.NewReader(ruleset)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to apply ruleset: %s", string(output))
+	}
+
+	return nil
+}
+
+// matchSetDirPattern matches the direction flags of --match-set, one per
+// set dimension
+var matchSetDirPattern = regexp.MustCompile(`^(src|dst)(,(src|dst)){0,2}$`)
+
+// ruleSpecFromInput builds a rule specification from the add rule form
+func ruleSpecFromInput(input models.FirewallRuleInput) (*models.RuleSpec, error) {
+	spec := &models.RuleSpec{Chain: input.Chain, Target: input.Target}
+
+	if err := validateLogOptions(input); err != nil {
+		return nil, err
+	}
+	if err := validateRateOptions(input); err != nil {
+		return nil, err
 	}
+	if err := validateTimeOptions(input); err != nil {
+		return nil, err
+	}
+
+	if input.Protocol != "" && input.Protocol != "all" {
+		spec.Protocol = input.Protocol
+	}
+
+	if input.Source != "" && input.Source != anyAddress(input.Family) {
+		if err := validateAddressFamily(input.Family, input.Source); err != nil {
+			return nil, fmt.Errorf("invalid source: %w", err)
+		}
+		spec.Source = input.Source
+	}
+
+	if input.Destination != "" && input.Destination != anyAddress(input.Family) {
+		if err := validateAddressFamily(input.Family, input.Destination); err != nil {
+			return nil, fmt.Errorf("invalid destination: %w", err)
+		}
+		spec.Destination = input.Destination
+	}
+
+	spec.InInterface = input.InInterface
+	spec.OutInterface = input.OutInterface
 
-	if input.SPort != "" {
-		args = append(args, "--sport", input.SPort)
+	// Single ports and ranges use the protocol match, lists need multiport
+	protoMatch := models.RuleMatch{Module: spec.Protocol}
+	multiport := models.RuleMatch{Module: "multiport"}
+	for _, port := range []struct{ name, value string }{{"sport", input.SPort}, {"dport", input.DPort}} {
+		if port.value == "" {
+			continue
+		}
+		switch spec.Protocol {
+		case "tcp", "udp", "udplite", "sctp", "dccp":
+		default:
+			return nil, fmt.Errorf("ports require protocol tcp, udp or sctp")
+		}
+		if strings.Contains(port.value, ",") {
+			multiport.Options = append(multiport.Options, models.RuleOption{Name: port.name + "s", Values: []string{port.value}})
+		} else {
+			protoMatch.Options = append(protoMatch.Options, models.RuleOption{Name: port.name, Values: []string{port.value}})
+		}
+	}
+	if len(protoMatch.Options) > 0 {
+		spec.Matches = append(spec.Matches, protoMatch)
+	}
+	if len(multiport.Options) > 0 {
+		spec.Matches = append(spec.Matches, multiport)
 	}
 
 	if input.State != "" {
-		args = append(args, "-m", "state", "--state", input.State)
+		spec.Matches = append(spec.Matches, models.RuleMatch{
+			Module:  "state",
+			Options: []models.RuleOption{{Name: "state", Values: []string{input.State}}},
+		})
 	}
 
-	if input.Comment != "" {
-		args = append(args, "-m", "comment", "--comment", input.Comment)
+	if input.MatchSet != "" {
+		if err := validateIPSetName(input.MatchSet); err != nil {
+			return nil, err
+		}
+		dir := input.MatchSetDir
+		if dir == "" {
+			dir = "src"
+		}
+		if !matchSetDirPattern.MatchString(dir) {
+			return nil, fmt.Errorf("invalid match set direction: %s", dir)
+		}
+		spec.Matches = append(spec.Matches, models.RuleMatch{
+			Module:  "set",
+			Options: []models.RuleOption{{Name: "match-set", Values: []string{input.MatchSet, dir}}},
+		})
 	}
 
-	args = append(args, "-j", input.Target)
+	spec.Matches = append(spec.Matches, rateMatches(input)...)
+	if m := timeMatch(input); m != nil {
+		spec.Matches = append(spec.Matches, *m)
+	}
+
+	if input.Comment != "" {
+		spec.Matches = append(spec.Matches, models.RuleMatch{
+			Module:  "comment",
+			Options: []models.RuleOption{{Name: "comment", Values: []string{input.Comment}}},
+		})
+	}
 
 	if input.ToDestination != "" {
-		args = append(args, "--to-destination", input.ToDestination)
+		spec.TargetOptions = append(spec.TargetOptions, models.RuleOption{Name: "to-destination", Values: []string{input.ToDestination}})
 	}
 
 	if input.ToSource != "" {
-		args = append(args, "--to-source", input.ToSource)
+		spec.TargetOptions = append(spec.TargetOptions, models.RuleOption{Name: "to-source", Values: []string{input.ToSource}})
+	}
+
+	switch input.Target {
+	case "LOG":
+		if input.LogPrefix != "" {
+			spec.TargetOptions = append(spec.TargetOptions, models.RuleOption{Name: "log-prefix", Values: []string{input.LogPrefix}})
+		}
+		if input.LogLevel != "" {
+			spec.TargetOptions = append(spec.TargetOptions, models.RuleOption{Name: "log-level", Values: []string{input.LogLevel}})
+		}
+	case "NFLOG":
+		if input.NFLogGroup != "" {
+			spec.TargetOptions = append(spec.TargetOptions, models.RuleOption{Name: "nflog-group", Values: []string{input.NFLogGroup}})
+		}
+		if input.LogPrefix != "" {
+			spec.TargetOptions = append(spec.TargetOptions, models.RuleOption{Name: "nflog-prefix", Values: []string{input.LogPrefix}})
+		}
 	}
 
-	return args
+	return spec, nil
 }
 
-func (s *IPTablesService) SaveRules() error {
-	cmd := exec.Command("iptables-save")
+// anyAddress returns the match-all network of an address family
+func anyAddress(family models.IPFamily) string {
+	if family == models.FamilyIPv6 {
+		return "::/0"
+	}
+	return "0.0.0.0/0"
+}
+
+// validateAddressFamily rejects IP addresses and CIDRs (optionally comma
+// separated) that do not belong to the given family. Host names are left
+// for iptables to resolve.
+func validateAddressFamily(family models.IPFamily, addrs string) error {
+	for _, addr := range strings.Split(addrs, ",") {
+		addr = strings.TrimSpace(addr)
+		host := addr
+		if i := strings.IndexByte(addr, '/'); i >= 0 {
+			host = addr[:i]
+		}
+
+		ip := net.ParseIP(host)
+		if ip == nil {
+			continue
+		}
+
+		isIPv4 := ip.To4() != nil
+		if family == models.FamilyIPv6 && isIPv4 {
+			return fmt.Errorf("%s is an IPv4 address, expected IPv6", addr)
+		}
+		if family != models.FamilyIPv6 && !isIPv4 {
+			return fmt.Errorf("%s is an IPv6 address, expected IPv4", addr)
+		}
+	}
+
+	return nil
+}
+
+func (s *IPTablesService) SaveRules(family models.IPFamily) error {
+	cmd := exec.Command(iptablesCommand(family) + "-save")
 	output, err := cmd.Output()
 	if err != nil {
 		return fmt.Errorf("failed to save rules: %w", err)
 	}
 
-	savePath := filepath.Join(s.configDir, "iptables", "rules.v4")
+	savePath := filepath.Join(s.configDir, "iptables", rulesFile(family))
 	if err := os.WriteFile(savePath, output, 0644); err != nil {
 		return fmt.Errorf("failed to write rules file: %w", err)
 	}
@@ -404,8 +583,8 @@ func (s *IPTablesService) SaveRules() error {
 	return nil
 }
 
-func (s *IPTablesService) RestoreRules() error {
-	savePath := filepath.Join(s.configDir, "iptables", "rules.v4")
+func (s *IPTablesService) RestoreRules(family models.IPFamily) error {
+	savePath := filepath.Join(s.configDir, "iptables", rulesFile(family))
 	data, err := os.ReadFile(savePath)
 	if err != nil {
 		if os.IsNotExist(err) {
@@ -414,7 +593,7 @@ func (s *IPTablesService) RestoreRules() error {
 		return fmt.Errorf("failed to read rules file: %w", err)
 	}
 
-	cmd := exec.Command("iptables-restore")
+	cmd := exec.Command(iptablesCommand(family) + "-restore")
 	cmd.Stdin = bytes.NewReader(data)
 	if output, err := cmd.CombinedOutput(); err != nil {
 		return fmt.Errorf("failed to restore rules: %s", string(output))
@@ -423,11 +602,49 @@ func (s *IPTablesService) RestoreRules() error {
 	return nil
 }
 
-func (s *IPTablesService) GetRawRules() (string, error) {
-	cmd := exec.Command("iptables-save")
+func (s *IPTablesService) GetRawRules(family models.IPFamily) (string, error) {
+	cmd := exec.Command(iptablesCommand(family) + "-save")
 	output, err := cmd.Output()
 	if err != nil {
 		return "", fmt.Errorf("failed to get rules: %w", err)
 	}
 	return string(output), nil
 }
+
+func (s *IPTablesService) GetSavedRules(family models.IPFamily) (string, error) {
+	data, err := os.ReadFile(filepath.Join(s.configDir, "iptables", rulesFile(family)))
+	if err != nil {
+		return "", fmt.Errorf("failed to read rules file: %w", err)
+	}
+	return string(data), nil
+}
+
+// snapshotRules captures the running IPv4 and IPv6 rulesets for safe apply
+func (s *IPTablesService) snapshotRules() (map[string][]byte, error) {
+	snapshots := make(map[string][]byte)
+	for _, family := range models.IPFamilies {
+		snapshot, err := exec.Command(iptablesCommand(family) + "-save").Output()
+		if err != nil {
+			return nil, fmt.Errorf("failed to snapshot %s rules: %w", family, err)
+		}
+		snapshots[string(family)] = snapshot
+	}
+	return snapshots, nil
+}
+
+func (s *IPTablesService) restoreSnapshots(snapshots map[string][]byte) error {
+	var errors []string
+	for family, snapshot := range snapshots {
+		cmd := exec.Command(iptablesCommand(models.IPFamily(family)) + "-restore")
+		cmd.Stdin = bytes.NewReader(snapshot)
+		if output, err := cmd.CombinedOutput(); err != nil {
+			errors = append(errors, family+": "+strings.TrimSpace(string(output)))
+		}
+	}
+
+	if len(errors) > 0 {
+		return fmt.Errorf("failed to roll back rules: %s", strings.Join(errors, "; "))
+	}
+
+	return nil
+}
@@ -0,0 +1,622 @@
+package services
+
+import (
+	"bufio"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"linuxtorouter/internal/models"
+)
+
+// ruleToken is a word of a rule specification; quoted tokens are never
+// treated as options or negations
+type ruleToken struct {
+	text   string
+	quoted bool
+}
+
+// tokenizeRule splits a rule line into words the way iptables-restore
+// does: whitespace separated, with double or single quoted strings and
+// backslash escapes inside double quotes
+func tokenizeRule(line string) ([]ruleToken, error) {
+	var tokens []ruleToken
+	var current strings.Builder
+	inToken, quoted := false, false
+
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case c == ' ' || c == '\t':
+			if inToken {
+				tokens = append(tokens, ruleToken{current.String(), quoted})
+				current.Reset()
+				inToken, quoted = false, false
+			}
+		case c == '"' || c == '\'':
+			inToken, quoted = true, true
+			end := i + 1
+			for ; end < len(line) && line[end] != c; end++ {
+				if c == '"' && line[end] == '\\' && end+1 < len(line) {
+					end++
+				}
+				current.WriteByte(line[end])
+			}
+			if end >= len(line) {
+				return nil, fmt.Errorf("unterminated quote in rule: %s", line)
+			}
+			i = end
+		default:
+			inToken = true
+			current.WriteByte(c)
+		}
+	}
+	if inToken {
+		tokens = append(tokens, ruleToken{current.String(), quoted})
+	}
+
+	return tokens, nil
+}
+
+// isOptionToken reports whether a token starts a new option ("-s",
+// "--dport") rather than being an option value. Negative numbers are values.
+func isOptionToken(t ruleToken) bool {
+	if t.quoted || len(t.text) < 2 || t.text[0] != '-' {
+		return false
+	}
+	_, err := strconv.ParseFloat(t.text, 64)
+	return err != nil
+}
+
+// ParseRuleSpec parses a rule line in iptables-save or iptables -S syntax,
+// e.g. `[12:720] -A INPUT -p tcp -m tcp --dport 22 -j ACCEPT`
+func ParseRuleSpec(line string) (*models.RuleSpec, error) {
+	tokens, err := tokenizeRule(strings.TrimSpace(line))
+	if err != nil {
+		return nil, err
+	}
+
+	spec := &models.RuleSpec{}
+	i := 0
+
+	// iptables-save -c prefixes rules with [packets:bytes]
+	if len(tokens) > 0 && !tokens[0].quoted && strings.HasPrefix(tokens[0].text, "[") {
+		counters, err := parseCounters(tokens[0].text)
+		if err != nil {
+			return nil, err
+		}
+		spec.Counters = counters
+		i++
+	}
+
+	if i+1 >= len(tokens) || (tokens[i].text != "-A" && tokens[i].text != "--append") {
+		return nil, fmt.Errorf("not a rule: %s", line)
+	}
+	spec.Chain = tokens[i+1].text
+	i += 2
+
+	var match *models.RuleMatch
+	inTarget := false
+
+	// next returns the value of an option that takes exactly one argument
+	next := func(option string) (string, error) {
+		if i+1 >= len(tokens) {
+			return "", fmt.Errorf("option %s requires a value", option)
+		}
+		i++
+		return tokens[i].text, nil
+	}
+
+	for ; i < len(tokens); i++ {
+		negated := false
+		if tokens[i].text == "!" && !tokens[i].quoted {
+			negated = true
+			i++
+			if i >= len(tokens) {
+				return nil, fmt.Errorf("dangling \"!\" in rule: %s", line)
+			}
+		}
+
+		option := tokens[i].text
+		if !isOptionToken(tokens[i]) {
+			return nil, fmt.Errorf("unexpected %q in rule: %s", option, line)
+		}
+
+		var value string
+		switch option {
+		case "-s", "--source", "-d", "--destination", "-i", "--in-interface",
+			"-o", "--out-interface", "-p", "--protocol", "-m", "--match",
+			"-j", "--jump", "-g", "--goto":
+			if value, err = next(option); err != nil {
+				return nil, err
+			}
+		}
+
+		switch option {
+		case "-s", "--source":
+			spec.Source, spec.NotSource = value, negated
+		case "-d", "--destination":
+			spec.Destination, spec.NotDestination = value, negated
+		case "-i", "--in-interface":
+			spec.InInterface, spec.NotInInterface = value, negated
+		case "-o", "--out-interface":
+			spec.OutInterface, spec.NotOutInterface = value, negated
+		case "-p", "--protocol":
+			spec.Protocol, spec.NotProtocol = value, negated
+		case "-f", "--fragment":
+			spec.Fragment, spec.NotFragment = true, negated
+		case "-m", "--match":
+			spec.Matches = append(spec.Matches, models.RuleMatch{Module: value})
+			match = &spec.Matches[len(spec.Matches)-1]
+		case "-j", "--jump", "-g", "--goto":
+			spec.Target = value
+			spec.Goto = option == "-g" || option == "--goto"
+			inTarget = true
+		case "-c", "--set-counters":
+			if i+2 >= len(tokens) {
+				return nil, fmt.Errorf("option %s requires packets and bytes", option)
+			}
+			packets, perr := strconv.ParseUint(tokens[i+1].text, 10, 64)
+			bytesVal, berr := strconv.ParseUint(tokens[i+2].text, 10, 64)
+			if perr != nil || berr != nil {
+				return nil, fmt.Errorf("invalid counters in rule: %s", line)
+			}
+			spec.Counters = &models.RuleCounters{Packets: packets, Bytes: bytesVal}
+			i += 2
+		default:
+			opt := models.RuleOption{Name: strings.TrimLeft(option, "-"), Negated: negated}
+			for i+1 < len(tokens) {
+				t := tokens[i+1]
+				if t.text == "!" && !t.quoted {
+					// "! --opt" negates the next option; "--opt ! value"
+					// is the legacy form negating this one
+					if i+2 < len(tokens) && isOptionToken(tokens[i+2]) {
+						break
+					}
+					opt.Negated = true
+					i++
+					continue
+				}
+				if isOptionToken(t) {
+					break
+				}
+				opt.Values = append(opt.Values, t.text)
+				opt.Quoted = opt.Quoted || t.quoted
+				i++
+			}
+
+			switch {
+			case inTarget:
+				spec.TargetOptions = append(spec.TargetOptions, opt)
+			case match != nil:
+				match.Options = append(match.Options, opt)
+			case spec.Protocol != "":
+				// "-p tcp --dport 22" loads the protocol match implicitly
+				spec.Matches = append(spec.Matches, models.RuleMatch{Module: spec.Protocol, Implicit: true})
+				match = &spec.Matches[len(spec.Matches)-1]
+				match.Options = append(match.Options, opt)
+			default:
+				return nil, fmt.Errorf("option %s outside of a match in rule: %s", option, line)
+			}
+		}
+	}
+
+	return spec, nil
+}
+
+// parseCounters parses an iptables-save "[packets:bytes]" counter pair
+func parseCounters(s string) (*models.RuleCounters, error) {
+	inner := strings.TrimSuffix(strings.TrimPrefix(s, "["), "]")
+	packetsStr, bytesStr, ok := strings.Cut(inner, ":")
+	if !ok {
+		return nil, fmt.Errorf("invalid counters: %s", s)
+	}
+	packets, err := strconv.ParseUint(packetsStr, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid counters: %s", s)
+	}
+	bytesVal, err := strconv.ParseUint(bytesStr, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid counters: %s", s)
+	}
+	return &models.RuleCounters{Packets: packets, Bytes: bytesVal}, nil
+}
+
+// ruleSpecTokens serializes a rule in iptables-save order, without the
+// leading "-A <chain>" and without counters
+func ruleSpecTokens(spec *models.RuleSpec) []ruleToken {
+	var tokens []ruleToken
+	add := func(negated bool, words ...string) {
+		if negated {
+			tokens = append(tokens, ruleToken{text: "!"})
+		}
+		for _, w := range words {
+			tokens = append(tokens, ruleToken{text: w})
+		}
+	}
+
+	if spec.Source != "" {
+		add(spec.NotSource, "-s", spec.Source)
+	}
+	if spec.Destination != "" {
+		add(spec.NotDestination, "-d", spec.Destination)
+	}
+	if spec.InInterface != "" {
+		add(spec.NotInInterface, "-i", spec.InInterface)
+	}
+	if spec.OutInterface != "" {
+		add(spec.NotOutInterface, "-o", spec.OutInterface)
+	}
+	if spec.Protocol != "" {
+		add(spec.NotProtocol, "-p", spec.Protocol)
+	}
+	if spec.Fragment {
+		add(spec.NotFragment, "-f")
+	}
+
+	addOption := func(opt models.RuleOption) {
+		add(opt.Negated, "--"+opt.Name)
+		for _, v := range opt.Values {
+			tokens = append(tokens, ruleToken{text: v, quoted: opt.Quoted || needsQuoting(v)})
+		}
+	}
+
+	for _, m := range spec.Matches {
+		if !m.Implicit {
+			add(false, "-m", m.Module)
+		}
+		for _, opt := range m.Options {
+			addOption(opt)
+		}
+	}
+
+	if spec.Target != "" {
+		if spec.Goto {
+			add(false, "-g", spec.Target)
+		} else {
+			add(false, "-j", spec.Target)
+		}
+		for _, opt := range spec.TargetOptions {
+			addOption(opt)
+		}
+	}
+
+	return tokens
+}
+
+// RuleSpecArgs returns the iptables arguments for a rule, i.e. everything
+// after "-A <chain>", ready to pass to exec.Command
+func RuleSpecArgs(spec *models.RuleSpec) []string {
+	var args []string
+	for _, t := range ruleSpecTokens(spec) {
+		args = append(args, t.text)
+	}
+	return args
+}
+
+// FormatRuleSpec renders a rule as an iptables-save line, including the
+// "[packets:bytes]" prefix when the spec has counters. Parsing the result
+// with ParseRuleSpec yields the same spec.
+func FormatRuleSpec(spec *models.RuleSpec) string {
+	var b strings.Builder
+	if spec.Counters != nil {
+		fmt.Fprintf(&b, "[%d:%d] ", spec.Counters.Packets, spec.Counters.Bytes)
+	}
+	b.WriteString("-A " + spec.Chain)
+	for _, t := range ruleSpecTokens(spec) {
+		b.WriteByte(' ')
+		b.WriteString(quoteRuleWord(t))
+	}
+	return b.String()
+}
+
+// quoteRuleWord renders a word, quoting it with iptables-save escaping
+// when it was quoted in the source or needs quotes to survive tokenizing
+func quoteRuleWord(t ruleToken) string {
+	if !t.quoted {
+		return t.text
+	}
+
+	var b strings.Builder
+	b.WriteByte('"')
+	for _, c := range t.text {
+		if c == '"' || c == '\\' {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(c)
+	}
+	b.WriteByte('"')
+	return b.String()
+}
+
+// needsQuoting reports whether an option value would be split or taken for
+// an option or negation if written without quotes
+func needsQuoting(value string) bool {
+	return value == "" || value == "!" || strings.ContainsAny(value, " \t\"'\\") ||
+		isOptionToken(ruleToken{text: value})
+}
+
+// parseSaveTable parses the output of "iptables-save -c -t <table>" into
+// chains with their policies, counters and rules
+func parseSaveTable(output string, family models.IPFamily) ([]models.ChainInfo, error) {
+	var chains []models.ChainInfo
+	index := make(map[string]int)
+
+	scanner := bufio.NewScanner(strings.NewReader(output))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		switch {
+		case line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "*") || line == "COMMIT":
+			continue
+		case strings.HasPrefix(line, ":"):
+			// :INPUT ACCEPT [123:4567]
+			fields := strings.Fields(line[1:])
+			if len(fields) < 2 {
+				return nil, fmt.Errorf("invalid chain line: %s", line)
+			}
+			chain := models.ChainInfo{Name: fields[0], Policy: fields[1]}
+			if len(fields) > 2 {
+				if counters, err := parseCounters(fields[2]); err == nil {
+					chain.Packets, chain.Bytes = counters.Packets, counters.Bytes
+				}
+			}
+			index[chain.Name] = len(chains)
+			chains = append(chains, chain)
+		default:
+			spec, err := ParseRuleSpec(line)
+			if err != nil {
+				return nil, err
+			}
+			pos, ok := index[spec.Chain]
+			if !ok {
+				return nil, fmt.Errorf("rule for unknown chain %s", spec.Chain)
+			}
+			rule := ruleFromSpec(spec, family)
+			rule.Num = len(chains[pos].Rules) + 1
+			chains[pos].Rules = append(chains[pos].Rules, rule)
+		}
+	}
+
+	return chains, scanner.Err()
+}
+
+// ruleFromSpec fills the display columns of the firewall table from a
+// parsed rule, using the same placeholders as iptables -L
+func ruleFromSpec(spec *models.RuleSpec, family models.IPFamily) models.FirewallRule {
+	negate := func(value string, negated bool) string {
+		if negated {
+			return "!" + value
+		}
+		return value
+	}
+
+	rule := models.FirewallRule{
+		Target:      spec.Target,
+		Protocol:    "all",
+		Opt:         "--",
+		In:          "*",
+		Out:         "*",
+		Source:      anyAddress(family),
+		Destination: anyAddress(family),
+		Spec:        spec,
+	}
+
+	if spec.Protocol != "" {
+		rule.Protocol = negate(spec.Protocol, spec.NotProtocol)
+	}
+	if spec.Fragment {
+		rule.Opt = negate("-f", spec.NotFragment)
+	}
+	if spec.InInterface != "" {
+		rule.In = negate(spec.InInterface, spec.NotInInterface)
+	}
+	if spec.OutInterface != "" {
+		rule.Out = negate(spec.OutInterface, spec.NotOutInterface)
+	}
+	if spec.Source != "" {
+		rule.Source = negate(spec.Source, spec.NotSource)
+	}
+	if spec.Destination != "" {
+		rule.Destination = negate(spec.Destination, spec.NotDestination)
+	}
+	if spec.Counters != nil {
+		rule.Packets, rule.Bytes = spec.Counters.Packets, spec.Counters.Bytes
+	}
+	if m := spec.Match("comment"); m != nil {
+		if opt := m.Option("comment"); opt != nil {
+			rule.Comment = "/* " + opt.Value() + " */"
+		}
+	}
+
+	rule.Extra = describeRuleSpec(spec, family)
+	return rule
+}
+
+// describeRuleSpec summarizes the match modules and target options of a
+// rule for the Options column, e.g. "dport 22 conntrack ctstate NEW"
+func describeRuleSpec(spec *models.RuleSpec, family models.IPFamily) string {
+	var parts []string
+	describe := func(opts []models.RuleOption) {
+		for _, opt := range opts {
+			part := opt.Name
+			for _, v := range opt.Values {
+				part += " " + quoteRuleWord(ruleToken{text: v, quoted: needsQuoting(v)})
+			}
+			if opt.Negated {
+				part = "! " + part
+			}
+			parts = append(parts, part)
+		}
+	}
+
+	for _, m := range spec.Matches {
+		if m.Module == "comment" {
+			continue
+		}
+		if text, ok := describeRateMatch(m, family); ok {
+			parts = append(parts, text)
+			continue
+		}
+		if text, ok := describeTimeMatch(m); ok {
+			parts = append(parts, text)
+			continue
+		}
+		// The protocol's own match (-p tcp -m tcp) needs no label
+		if m.Module != spec.Protocol {
+			parts = append(parts, m.Module)
+		}
+		describe(m.Options)
+	}
+	describe(spec.TargetOptions)
+
+	return strings.Join(parts, " ")
+}
+
+// RuleInputFromSpec converts a parsed rule back into rule form values. The
+// returned list holds the parts of the rule the form cannot represent, in
+// iptables syntax; they are dropped when the form is submitted.
+func RuleInputFromSpec(spec *models.RuleSpec, family models.IPFamily) (*models.FirewallRuleInput, []string) {
+	input := &models.FirewallRuleInput{
+		Family:       family,
+		Chain:        spec.Chain,
+		Protocol:     spec.Protocol,
+		Source:       spec.Source,
+		Destination:  spec.Destination,
+		InInterface:  spec.InInterface,
+		OutInterface: spec.OutInterface,
+		Target:       spec.Target,
+	}
+	if input.Protocol == "" {
+		input.Protocol = "all"
+	}
+
+	var unsupported []string
+	format := func(partial *models.RuleSpec) {
+		line := FormatRuleSpec(partial)
+		unsupported = append(unsupported, strings.TrimPrefix(line, "-A "+partial.Chain+" "))
+	}
+
+	if spec.NotSource || spec.NotDestination || spec.NotInInterface || spec.NotOutInterface || spec.NotProtocol || spec.Fragment {
+		format(&models.RuleSpec{
+			Chain:           spec.Chain,
+			Source:          negatedOnly(spec.Source, spec.NotSource),
+			NotSource:       spec.NotSource,
+			Destination:     negatedOnly(spec.Destination, spec.NotDestination),
+			NotDestination:  spec.NotDestination,
+			InInterface:     negatedOnly(spec.InInterface, spec.NotInInterface),
+			NotInInterface:  spec.NotInInterface,
+			OutInterface:    negatedOnly(spec.OutInterface, spec.NotOutInterface),
+			NotOutInterface: spec.NotOutInterface,
+			Protocol:        negatedOnly(spec.Protocol, spec.NotProtocol),
+			NotProtocol:     spec.NotProtocol,
+			Fragment:        spec.Fragment,
+			NotFragment:     spec.NotFragment,
+		})
+		if spec.NotSource {
+			input.Source = ""
+		}
+		if spec.NotDestination {
+			input.Destination = ""
+		}
+		if spec.NotInInterface {
+			input.InInterface = ""
+		}
+		if spec.NotOutInterface {
+			input.OutInterface = ""
+		}
+		if spec.NotProtocol {
+			input.Protocol = "all"
+		}
+	}
+
+	for _, m := range spec.Matches {
+		var rest []models.RuleOption
+		for _, opt := range m.Options {
+			value := opt.Value()
+			if rateInputFromOption(input, m.Module, opt) || timeInputFromOption(input, m.Module, opt) {
+				continue
+			}
+			handled := !opt.Negated && len(opt.Values) == 1
+			if m.Module == "set" && opt.Name == "match-set" && !opt.Negated && len(opt.Values) == 2 && input.MatchSet == "" {
+				input.MatchSet, input.MatchSetDir = opt.Values[0], opt.Values[1]
+				continue
+			}
+			if handled {
+				switch {
+				case m.Module == spec.Protocol && (opt.Name == "dport" || opt.Name == "destination-port"):
+					input.DPort = value
+				case m.Module == spec.Protocol && (opt.Name == "sport" || opt.Name == "source-port"):
+					input.SPort = value
+				case m.Module == "multiport" && (opt.Name == "dports" || opt.Name == "destination-ports"):
+					input.DPort = value
+				case m.Module == "multiport" && (opt.Name == "sports" || opt.Name == "source-ports"):
+					input.SPort = value
+				case m.Module == "state" && opt.Name == "state", m.Module == "conntrack" && opt.Name == "ctstate":
+					input.State = value
+				case m.Module == "comment" && opt.Name == "comment":
+					input.Comment = value
+				default:
+					handled = false
+				}
+			}
+			if !handled {
+				rest = append(rest, opt)
+			}
+		}
+		if len(rest) > 0 {
+			format(&models.RuleSpec{
+				Chain:   spec.Chain,
+				Matches: []models.RuleMatch{{Module: m.Module, Implicit: m.Implicit, Options: rest}},
+			})
+		}
+	}
+
+	if spec.Goto {
+		unsupported = append(unsupported, "-g "+spec.Target)
+	}
+
+	var rest []models.RuleOption
+	for _, opt := range spec.TargetOptions {
+		switch {
+		case spec.Target == "DNAT" && opt.Name == "to-destination" && len(opt.Values) == 1:
+			input.ToDestination = opt.Value()
+		case spec.Target == "SNAT" && opt.Name == "to-source" && len(opt.Values) == 1:
+			input.ToSource = opt.Value()
+		case spec.Target == "LOG" && opt.Name == "log-prefix" && len(opt.Values) == 1,
+			spec.Target == "NFLOG" && opt.Name == "nflog-prefix" && len(opt.Values) == 1:
+			input.LogPrefix = opt.Value()
+		case spec.Target == "LOG" && opt.Name == "log-level" && len(opt.Values) == 1:
+			input.LogLevel = logLevelName(opt.Value())
+		case spec.Target == "NFLOG" && opt.Name == "nflog-group" && len(opt.Values) == 1:
+			input.NFLogGroup = opt.Value()
+		default:
+			rest = append(rest, opt)
+		}
+	}
+	if len(rest) > 0 {
+		line := FormatRuleSpec(&models.RuleSpec{Chain: spec.Chain, Target: spec.Target, TargetOptions: rest})
+		unsupported = append(unsupported, strings.TrimPrefix(line, "-A "+spec.Chain+" "))
+	}
+
+	return input, unsupported
+}
+
+// negatedOnly returns value if it is negated, for listing negated base
+// matches separately
+func negatedOnly(value string, negated bool) string {
+	if negated {
+		return value
+	}
+	return ""
+}
+
+// FormatRuleInput renders rule form values in iptables syntax without the
+// chain, e.g. "-p tcp -m tcp --dport 22 -j ACCEPT", for the audit log
+func FormatRuleInput(input models.FirewallRuleInput) string {
+	spec, err := ruleSpecFromInput(input)
+	if err != nil {
+		return "invalid rule: " + err.Error()
+	}
+	return strings.TrimPrefix(FormatRuleSpec(spec), "-A "+spec.Chain+" ")
+}
@@ -0,0 +1,261 @@
+package services
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"linuxtorouter/internal/models"
+)
+
+// The testdata/*.rules files are iptables-save -c and ip6tables-save -c
+// output; names ending in 6 hold IPv6 rules
+
+type goldenFile struct {
+	name   string
+	family models.IPFamily
+	data   string
+	rules  []string
+	chains []string
+}
+
+func loadGoldenFiles(t *testing.T) []goldenFile {
+	t.Helper()
+	paths, err := filepath.Glob(filepath.Join("testdata", "*.rules"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(paths) == 0 {
+		t.Fatal("no golden files in testdata")
+	}
+
+	var files []goldenFile
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		g := goldenFile{name: filepath.Base(path), family: models.FamilyIPv4, data: string(data)}
+		if strings.HasSuffix(strings.TrimSuffix(g.name, ".rules"), "6") {
+			g.family = models.FamilyIPv6
+		}
+		for _, line := range strings.Split(g.data, "\n") {
+			switch {
+			case strings.HasPrefix(line, ":"):
+				g.chains = append(g.chains, line)
+			case strings.HasPrefix(line, "["):
+				g.rules = append(g.rules, line)
+			}
+		}
+		files = append(files, g)
+	}
+	return files
+}
+
+func TestRuleSpecRoundTrip(t *testing.T) {
+	for _, g := range loadGoldenFiles(t) {
+		for _, line := range g.rules {
+			spec, err := ParseRuleSpec(line)
+			if err != nil {
+				t.Errorf("%s: ParseRuleSpec(%q): %v", g.name, line, err)
+				continue
+			}
+			formatted := FormatRuleSpec(spec)
+			if formatted != line {
+				t.Errorf("%s: round trip changed the rule\n got: %s\nwant: %s", g.name, formatted, line)
+				continue
+			}
+			again, err := ParseRuleSpec(formatted)
+			if err != nil {
+				t.Errorf("%s: reparsing %q: %v", g.name, formatted, err)
+				continue
+			}
+			if !reflect.DeepEqual(spec, again) {
+				t.Errorf("%s: reparsed spec differs for %q\n got: %+v\nwant: %+v", g.name, line, again, spec)
+			}
+		}
+	}
+}
+
+func TestParseSaveTable(t *testing.T) {
+	for _, g := range loadGoldenFiles(t) {
+		chains, err := parseSaveTable(g.data, g.family)
+		if err != nil {
+			t.Errorf("%s: %v", g.name, err)
+			continue
+		}
+		if len(chains) != len(g.chains) {
+			t.Errorf("%s: got %d chains, want %d", g.name, len(chains), len(g.chains))
+			continue
+		}
+
+		var rules []string
+		for i, chain := range chains {
+			want := g.chains[i]
+			got := fmt.Sprintf(":%s %s [%d:%d]", chain.Name, chain.Policy, chain.Packets, chain.Bytes)
+			if got != want {
+				t.Errorf("%s: chain line\n got: %s\nwant: %s", g.name, got, want)
+			}
+			for j, rule := range chain.Rules {
+				if rule.Num != j+1 {
+					t.Errorf("%s: rule %d of %s numbered %d", g.name, j+1, chain.Name, rule.Num)
+				}
+				if rule.Spec == nil {
+					t.Errorf("%s: rule %d of %s has no spec", g.name, j+1, chain.Name)
+					continue
+				}
+				if rule.Packets != rule.Spec.Counters.Packets || rule.Bytes != rule.Spec.Counters.Bytes {
+					t.Errorf("%s: rule %d of %s lost its counters", g.name, j+1, chain.Name)
+				}
+				rules = append(rules, FormatRuleSpec(rule.Spec))
+			}
+		}
+
+		// iptables-save groups the rules by chain in chain order
+		if !reflect.DeepEqual(rules, g.rules) {
+			t.Errorf("%s: rules differ\n got: %q\nwant: %q", g.name, rules, g.rules)
+		}
+	}
+}
+
+func TestRuleInputRoundTrip(t *testing.T) {
+	for _, g := range loadGoldenFiles(t) {
+		for _, line := range g.rules {
+			spec, err := ParseRuleSpec(line)
+			if err != nil {
+				t.Fatalf("%s: ParseRuleSpec(%q): %v", g.name, line, err)
+			}
+
+			input, unsupported := RuleInputFromSpec(spec, g.family)
+			formatted := FormatRuleInput(*input)
+			if strings.HasPrefix(formatted, "invalid rule") {
+				t.Errorf("%s: %q: %s", g.name, line, formatted)
+				continue
+			}
+			edited, err := ParseRuleSpec("-A " + spec.Chain + " " + formatted)
+			if err != nil {
+				t.Errorf("%s: parsing form output %q: %v", g.name, formatted, err)
+				continue
+			}
+
+			// Everything in the rule must come back from the form or be
+			// listed as unsupported, and the form must add nothing
+			got := ruleFacts(edited, g.family)
+			for _, part := range unsupported {
+				partial, err := ParseRuleSpec("-A " + spec.Chain + " " + part)
+				if err != nil {
+					t.Errorf("%s: parsing unsupported part %q: %v", g.name, part, err)
+					continue
+				}
+				got = append(got, ruleFacts(partial, g.family)...)
+			}
+			// The form has no goto: it jumps instead and reports "-g"
+			if spec.Goto {
+				for i, fact := range got {
+					if fact == "-j "+spec.Target {
+						got = append(got[:i], got[i+1:]...)
+						break
+					}
+				}
+			}
+			want := ruleFacts(spec, g.family)
+			sort.Strings(got)
+			sort.Strings(want)
+			if !reflect.DeepEqual(dedupe(got), want) {
+				t.Errorf("%s: lossy round trip of %q\nform: %s\nunsupported: %q\n got: %q\nwant: %q",
+					g.name, line, formatted, unsupported, got, want)
+			}
+		}
+	}
+}
+
+// ruleFacts lists the parts of a rule that decide what it matches and
+// does, one string each, with the options iptables-save writes with their
+// default values left out and equivalent forms written the same way
+func ruleFacts(spec *models.RuleSpec, family models.IPFamily) []string {
+	var facts []string
+	base := func(name, value string, negated bool) {
+		if value == "" {
+			return
+		}
+		if negated {
+			name = "! " + name
+		}
+		facts = append(facts, name+" "+value)
+	}
+	base("-s", spec.Source, spec.NotSource)
+	base("-d", spec.Destination, spec.NotDestination)
+	base("-i", spec.InInterface, spec.NotInInterface)
+	base("-o", spec.OutInterface, spec.NotOutInterface)
+	base("-p", spec.Protocol, spec.NotProtocol)
+	if spec.Fragment {
+		base("-f", "fragment", spec.NotFragment)
+	}
+	if spec.Target != "" {
+		base("-j", spec.Target, false)
+		if spec.Goto {
+			facts[len(facts)-1] = "-g " + spec.Target
+		}
+	}
+
+	fullMask, fullPrefix := "255.255.255.255", "32"
+	if family == models.FamilyIPv6 {
+		fullMask, fullPrefix = "ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff", "128"
+	}
+	defaults := map[string]bool{
+		"limit --limit-burst 5":                    true,
+		"hashlimit --hashlimit-burst 5":            true,
+		"connlimit --connlimit-mask " + fullPrefix: true,
+		"connlimit --connlimit-saddr":              true,
+		"recent --mask " + fullMask:                true,
+		"recent --rsource":                         true,
+		"time --utc":                               true,
+	}
+
+	option := func(module string, opt models.RuleOption) {
+		name, values := opt.Name, opt.Values
+		// The state match is the older name of conntrack --ctstate
+		if module == "state" && name == "state" {
+			module, name = "conntrack", "ctstate"
+		}
+		if module == "target" && name == "log-level" && len(values) == 1 {
+			values = []string{logLevelName(values[0])}
+		}
+		fact := module + " --" + name
+		if len(values) > 0 {
+			fact += " " + strings.Join(values, " ")
+		}
+		if defaults[fact] {
+			return
+		}
+		if opt.Negated {
+			fact = "! " + fact
+		}
+		facts = append(facts, fact)
+	}
+	for _, m := range spec.Matches {
+		for _, opt := range m.Options {
+			option(m.Module, opt)
+		}
+	}
+	for _, opt := range spec.TargetOptions {
+		option("target", opt)
+	}
+
+	sort.Strings(facts)
+	return facts
+}
+
+func dedupe(sorted []string) []string {
+	var out []string
+	for i, s := range sorted {
+		if i == 0 || s != sorted[i-1] {
+			out = append(out, s)
+		}
+	}
+	return out
+}
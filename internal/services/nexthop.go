@@ -0,0 +1,338 @@
+package services
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"linuxtorouter/internal/models"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+)
+
+// The netlink package predates nexthop objects, so nexthop messages are
+// built and parsed here
+
+// sizeofNhmsg is the size of struct nhmsg
+const sizeofNhmsg = 8
+
+// nhMsg is the header of nexthop messages
+type nhMsg struct {
+	unix.Nhmsg
+}
+
+func (m *nhMsg) Len() int {
+	return sizeofNhmsg
+}
+
+func (m *nhMsg) Serialize() []byte {
+	b := make([]byte, sizeofNhmsg)
+	b[0] = m.Family
+	b[1] = m.Scope
+	b[2] = m.Protocol
+	nl.NativeEndian().PutUint32(b[4:], m.Flags)
+	return b
+}
+
+// ListNexthops returns the nexthop objects of both families, like
+// `ip nexthop show`
+func (s *IPRouteService) ListNexthops() ([]models.Nexthop, error) {
+	req := nl.NewNetlinkRequest(unix.RTM_GETNEXTHOP, unix.NLM_F_DUMP)
+	req.AddData(&nhMsg{})
+	msgs, err := req.Execute(unix.NETLINK_ROUTE, unix.RTM_NEWNEXTHOP)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list nexthops: %w", err)
+	}
+
+	links := make(map[int]string)
+	if all, err := netlink.LinkList(); err == nil {
+		for _, link := range all {
+			links[link.Attrs().Index] = link.Attrs().Name
+		}
+	}
+
+	native := nl.NativeEndian()
+	nexthops := make([]models.Nexthop, 0, len(msgs))
+	for _, m := range msgs {
+		if len(m) < sizeofNhmsg {
+			continue
+		}
+		attrs, err := nl.ParseRouteAttr(m[sizeofNhmsg:])
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse nexthop: %w", err)
+		}
+
+		var nh models.Nexthop
+		switch m[0] {
+		case unix.AF_INET:
+			nh.Family = models.FamilyIPv4
+		case unix.AF_INET6:
+			nh.Family = models.FamilyIPv6
+		}
+		if protocol := int(m[2]); protocol != unix.RTPROT_UNSPEC {
+			nh.Protocol = routeProtocols[protocol]
+			if nh.Protocol == "" {
+				nh.Protocol = strconv.Itoa(protocol)
+			}
+		}
+		if native.Uint32(m[4:8])&unix.RTNH_F_ONLINK != 0 {
+			nh.Flags = "onlink"
+		}
+
+		for _, attr := range attrs {
+			switch attr.Attr.Type {
+			case unix.NHA_ID:
+				nh.ID = int(native.Uint32(attr.Value))
+			case unix.NHA_BLACKHOLE:
+				nh.Blackhole = true
+			case unix.NHA_OIF:
+				nh.Interface = links[int(native.Uint32(attr.Value))]
+			case unix.NHA_GATEWAY:
+				nh.Gateway = net.IP(attr.Value).String()
+			case unix.NHA_GROUP:
+				// struct nexthop_grp: the ID, then the weight minus one
+				for b := attr.Value; len(b) >= 8; b = b[8:] {
+					nh.Group = append(nh.Group, models.NexthopGroupMember{
+						ID:     int(native.Uint32(b)),
+						Weight: int(b[4]) + 1,
+					})
+				}
+			}
+		}
+		nexthops = append(nexthops, nh)
+	}
+
+	sort.Slice(nexthops, func(i, j int) bool { return nexthops[i].ID < nexthops[j].ID })
+	return nexthops, nil
+}
+
+// AddNexthop creates a nexthop object. Without an ID the kernel picks one.
+func (s *IPRouteService) AddNexthop(nh models.Nexthop) error {
+	if err := s.changeNexthop(nh, unix.NLM_F_CREATE|unix.NLM_F_EXCL); err != nil {
+		return fmt.Errorf("failed to add nexthop: %w", err)
+	}
+	return nil
+}
+
+// ReplaceNexthop creates a nexthop object or replaces the one with its ID
+func (s *IPRouteService) ReplaceNexthop(nh models.Nexthop) error {
+	if err := s.changeNexthop(nh, unix.NLM_F_CREATE|unix.NLM_F_REPLACE); err != nil {
+		return fmt.Errorf("failed to replace nexthop: %w", err)
+	}
+	return nil
+}
+
+func (s *IPRouteService) changeNexthop(nh models.Nexthop, flags int) error {
+	req := nl.NewNetlinkRequest(unix.RTM_NEWNEXTHOP, flags|unix.NLM_F_ACK)
+	msg := &nhMsg{}
+
+	var attrs []*nl.RtAttr
+	if nh.ID > 0 {
+		attrs = append(attrs, nl.NewRtAttr(unix.NHA_ID, nl.Uint32Attr(uint32(nh.ID))))
+	}
+
+	switch {
+	case len(nh.Group) > 0:
+		if nh.Gateway != "" || nh.Interface != "" || nh.Blackhole {
+			return fmt.Errorf("a nexthop group cannot have a gateway, interface or blackhole")
+		}
+		group := make([]byte, 0, 8*len(nh.Group))
+		for _, member := range nh.Group {
+			if member.Weight < 1 || member.Weight > 256 {
+				return fmt.Errorf("invalid weight %d for nexthop %d", member.Weight, member.ID)
+			}
+			entry := make([]byte, 8)
+			nl.NativeEndian().PutUint32(entry, uint32(member.ID))
+			entry[4] = uint8(member.Weight - 1)
+			group = append(group, entry...)
+		}
+		attrs = append(attrs, nl.NewRtAttr(unix.NHA_GROUP, group))
+
+	case nh.Blackhole:
+		if nh.Gateway != "" || nh.Interface != "" {
+			return fmt.Errorf("a blackhole nexthop cannot have a gateway or interface")
+		}
+		msg.Family = unix.AF_INET
+		if nh.Family == models.FamilyIPv6 {
+			msg.Family = unix.AF_INET6
+		}
+		attrs = append(attrs, nl.NewRtAttr(unix.NHA_BLACKHOLE, nil))
+
+	default:
+		if nh.Interface == "" {
+			return fmt.Errorf("interface is required")
+		}
+		link, err := netlink.LinkByName(nh.Interface)
+		if err != nil {
+			return fmt.Errorf("interface %s not found: %w", nh.Interface, err)
+		}
+		attrs = append(attrs, nl.NewRtAttr(unix.NHA_OIF, nl.Uint32Attr(uint32(link.Attrs().Index))))
+
+		msg.Family = unix.AF_INET
+		if nh.Family == models.FamilyIPv6 {
+			msg.Family = unix.AF_INET6
+		}
+		if nh.Gateway != "" {
+			gw := net.ParseIP(nh.Gateway)
+			if gw == nil {
+				return fmt.Errorf("invalid gateway: %s", nh.Gateway)
+			}
+			if gw4 := gw.To4(); gw4 != nil {
+				msg.Family = unix.AF_INET
+				gw = gw4
+			} else {
+				msg.Family = unix.AF_INET6
+			}
+			attrs = append(attrs, nl.NewRtAttr(unix.NHA_GATEWAY, gw))
+		}
+
+		for _, flag := range strings.Fields(nh.Flags) {
+			if flag != "onlink" {
+				return fmt.Errorf("unknown nexthop flag: %s", flag)
+			}
+			msg.Flags |= unix.RTNH_F_ONLINK
+		}
+	}
+
+	if nh.Protocol != "" {
+		value, ok := routeValue(routeProtocols, nh.Protocol)
+		if !ok {
+			return fmt.Errorf("unknown nexthop protocol: %s", nh.Protocol)
+		}
+		msg.Protocol = uint8(value)
+	}
+
+	req.AddData(msg)
+	for _, attr := range attrs {
+		req.AddData(attr)
+	}
+	_, err := req.Execute(unix.NETLINK_ROUTE, 0)
+	return err
+}
+
+// DeleteNexthop removes a nexthop object. The kernel also removes the
+// routes using it and drops it from the groups it belongs to.
+func (s *IPRouteService) DeleteNexthop(id int) error {
+	req := nl.NewNetlinkRequest(unix.RTM_DELNEXTHOP, unix.NLM_F_ACK)
+	req.AddData(&nhMsg{})
+	req.AddData(nl.NewRtAttr(unix.NHA_ID, nl.Uint32Attr(uint32(id))))
+	if _, err := req.Execute(unix.NETLINK_ROUTE, 0); err != nil {
+		return fmt.Errorf("failed to delete nexthop %d: %w", id, err)
+	}
+	return nil
+}
+
+// formatNexthopConfig writes a nexthop object in the `ip nexthop add`
+// syntax of the saved nexthops file
+func formatNexthopConfig(nh models.Nexthop) string {
+	parts := []string{"id", strconv.Itoa(nh.ID)}
+	switch {
+	case len(nh.Group) > 0:
+		parts = append(parts, "group", FormatNexthopGroup(nh.Group))
+	case nh.Blackhole:
+		parts = append(parts, "blackhole")
+		if nh.Family == models.FamilyIPv6 {
+			parts = append(parts, "family", "inet6")
+		}
+	default:
+		if nh.Gateway != "" {
+			parts = append(parts, "via", nh.Gateway)
+		}
+		if nh.Interface != "" {
+			parts = append(parts, "dev", nh.Interface)
+		}
+		parts = append(parts, strings.Fields(nh.Flags)...)
+	}
+	if nh.Protocol != "" {
+		parts = append(parts, "proto", nh.Protocol)
+	}
+	return strings.Join(parts, " ")
+}
+
+// parseNexthopConfig reads a line of the saved nexthops file
+func parseNexthopConfig(line string) (models.Nexthop, error) {
+	var nh models.Nexthop
+	fields := strings.Fields(line)
+	for i := 0; i < len(fields); i++ {
+		key := fields[i]
+		switch key {
+		case "blackhole":
+			nh.Blackhole = true
+			continue
+		case "onlink":
+			nh.Flags = "onlink"
+			continue
+		}
+
+		if i+1 >= len(fields) {
+			return nh, fmt.Errorf("missing value for %s", key)
+		}
+		value := fields[i+1]
+		i++
+
+		var err error
+		switch key {
+		case "id":
+			nh.ID, err = strconv.Atoi(value)
+		case "via":
+			nh.Gateway = value
+		case "dev":
+			nh.Interface = value
+		case "group":
+			nh.Group, err = ParseNexthopGroup(value)
+		case "proto":
+			nh.Protocol = value
+		case "family":
+			if value == "inet6" {
+				nh.Family = models.FamilyIPv6
+			}
+		default:
+			return nh, fmt.Errorf("unknown nexthop option: %s", key)
+		}
+		if err != nil {
+			return nh, fmt.Errorf("invalid %s: %s", key, value)
+		}
+	}
+	if nh.ID == 0 {
+		return nh, fmt.Errorf("missing nexthop id")
+	}
+	return nh, nil
+}
+
+// ParseNexthopGroup parses the iproute2 group syntax "id[,weight][/...]",
+// where the weight defaults to 1
+func ParseNexthopGroup(group string) ([]models.NexthopGroupMember, error) {
+	var members []models.NexthopGroupMember
+	for _, part := range strings.Split(group, "/") {
+		idStr, weightStr, hasWeight := strings.Cut(strings.TrimSpace(part), ",")
+		id, err := strconv.Atoi(idStr)
+		if err != nil || id <= 0 {
+			return nil, fmt.Errorf("invalid nexthop id in group: %s", part)
+		}
+		member := models.NexthopGroupMember{ID: id, Weight: 1}
+		if hasWeight {
+			member.Weight, err = strconv.Atoi(weightStr)
+			if err != nil || member.Weight < 1 || member.Weight > 256 {
+				return nil, fmt.Errorf("invalid weight in group: %s", part)
+			}
+		}
+		members = append(members, member)
+	}
+	return members, nil
+}
+
+// FormatNexthopGroup writes group members in the iproute2 group syntax
+func FormatNexthopGroup(members []models.NexthopGroupMember) string {
+	parts := make([]string, len(members))
+	for i, member := range members {
+		parts[i] = strconv.Itoa(member.ID)
+		if member.Weight > 1 {
+			parts[i] += "," + strconv.Itoa(member.Weight)
+		}
+	}
+	return strings.Join(parts, "/")
+}
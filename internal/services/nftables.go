@@ -0,0 +1,1740 @@
+package services
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"linuxtorouter/internal/models"
+
+	"github.com/google/nftables"
+	"github.com/google/nftables/binaryutil"
+	"github.com/google/nftables/expr"
+	"github.com/google/nftables/userdata"
+	"golang.org/x/sys/unix"
+)
+
+// NftablesService manages the firewall through nftables over netlink.
+// Tables keep their iptables names (filter, nat, mangle, raw) in the ip and
+// ip6 families, so the firewall pages work the same against either backend.
+type NftablesService struct {
+	configDir string
+
+	*safeApplier
+}
+
+func NewNftablesService(configDir string) *NftablesService {
+	s := &NftablesService{configDir: configDir}
+	s.safeApplier = newSafeApplier(s.snapshotRules, s.restoreSnapshots)
+	return s
+}
+
+// Name identifies the backend in the UI
+func (s *NftablesService) Name() string {
+	return "nftables"
+}
+
+// nftBaseChain is a built-in chain of an iptables compatible table
+type nftBaseChain struct {
+	name      string
+	hook      *nftables.ChainHook
+	priority  nftables.ChainPriority
+	chainType nftables.ChainType
+}
+
+// nftBuiltinChains mirrors the tables and hooks iptables-nft creates
+var nftBuiltinChains = map[string][]nftBaseChain{
+	"filter": {
+		{"INPUT", nftables.ChainHookInput, 0, nftables.ChainTypeFilter},
+		{"FORWARD", nftables.ChainHookForward, 0, nftables.ChainTypeFilter},
+		{"OUTPUT", nftables.ChainHookOutput, 0, nftables.ChainTypeFilter},
+	},
+	"nat": {
+		{"PREROUTING", nftables.ChainHookPrerouting, -100, nftables.ChainTypeNAT},
+		{"INPUT", nftables.ChainHookInput, 100, nftables.ChainTypeNAT},
+		{"OUTPUT", nftables.ChainHookOutput, -100, nftables.ChainTypeNAT},
+		{"POSTROUTING", nftables.ChainHookPostrouting, 100, nftables.ChainTypeNAT},
+	},
+	"mangle": {
+		{"PREROUTING", nftables.ChainHookPrerouting, -150, nftables.ChainTypeFilter},
+		{"INPUT", nftables.ChainHookInput, -150, nftables.ChainTypeFilter},
+		{"FORWARD", nftables.ChainHookForward, -150, nftables.ChainTypeFilter},
+		{"OUTPUT", nftables.ChainHookOutput, -150, nftables.ChainTypeRoute},
+		{"POSTROUTING", nftables.ChainHookPostrouting, -150, nftables.ChainTypeFilter},
+	},
+	"raw": {
+		{"PREROUTING", nftables.ChainHookPrerouting, -300, nftables.ChainTypeFilter},
+		{"OUTPUT", nftables.ChainHookOutput, -300, nftables.ChainTypeFilter},
+	},
+}
+
+// nftFamily maps an address family to its nftables table family
+func nftFamily(family models.IPFamily) nftables.TableFamily {
+	if family == models.FamilyIPv6 {
+		return nftables.TableFamilyIPv6
+	}
+	return nftables.TableFamilyIPv4
+}
+
+// nftFamilyName returns the family keyword used by the nft command
+func nftFamilyName(family models.IPFamily) string {
+	if family == models.FamilyIPv6 {
+		return "ip6"
+	}
+	return "ip"
+}
+
+// rulesetFile returns the name of the persisted nftables ruleset for an address family
+func rulesetFile(family models.IPFamily) string {
+	return "ruleset-" + nftFamilyName(family) + ".nft"
+}
+
+// lookupTable returns the table, or nil if it is one of the iptables
+// compatible tables and has not been created yet
+func (s *NftablesService) lookupTable(conn *nftables.Conn, family models.IPFamily, table string) (*nftables.Table, error) {
+	tables, err := conn.ListTablesOfFamily(nftFamily(family))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list tables: %w", err)
+	}
+	for _, t := range tables {
+		if t.Name == table {
+			return t, nil
+		}
+	}
+
+	if _, ok := nftBuiltinChains[table]; !ok {
+		return nil, fmt.Errorf("table %s not found", table)
+	}
+	return nil, nil
+}
+
+// ensureTable returns the table, creating it with its built-in chains if
+// it does not exist yet (like iptables-nft does on first change). Only
+// changes create tables; reads use lookupTable.
+func (s *NftablesService) ensureTable(conn *nftables.Conn, family models.IPFamily, table string) (*nftables.Table, error) {
+	t, err := s.lookupTable(conn, family, table)
+	if err != nil || t != nil {
+		return t, err
+	}
+
+	t = conn.AddTable(&nftables.Table{Name: table, Family: nftFamily(family)})
+	for _, bc := range nftBuiltinChains[table] {
+		policy := nftables.ChainPolicyAccept
+		conn.AddChain(&nftables.Chain{
+			Name:     bc.name,
+			Table:    t,
+			Hooknum:  bc.hook,
+			Priority: nftables.ChainPriorityRef(bc.priority),
+			Type:     bc.chainType,
+			Policy:   &policy,
+		})
+	}
+	if err := conn.Flush(); err != nil {
+		return nil, fmt.Errorf("failed to create table %s: %w", table, err)
+	}
+
+	return t, nil
+}
+
+// findChain looks up a chain of a table by name
+func (s *NftablesService) findChain(conn *nftables.Conn, t *nftables.Table, chain string) (*nftables.Chain, error) {
+	chains, err := conn.ListChainsOfTableFamily(t.Family)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list chains: %w", err)
+	}
+	for _, c := range chains {
+		if c.Table.Name == t.Name && c.Name == chain {
+			c.Table = t
+			return c, nil
+		}
+	}
+	return nil, fmt.Errorf("chain %s not found", chain)
+}
+
+// open connects to nftables and resolves a table for a change, defaulting
+// to filter
+func (s *NftablesService) open(family models.IPFamily, table string) (*nftables.Conn, *nftables.Table, error) {
+	if table == "" {
+		table = "filter"
+	}
+
+	conn, err := nftables.New()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to connect to nftables: %w", err)
+	}
+
+	t, err := s.ensureTable(conn, family, table)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return conn, t, nil
+}
+
+// openExisting is open for reads: the table is nil when it does not exist
+// yet, and nothing is created
+func (s *NftablesService) openExisting(family models.IPFamily, table string) (*nftables.Conn, *nftables.Table, error) {
+	if table == "" {
+		table = "filter"
+	}
+
+	conn, err := nftables.New()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to connect to nftables: %w", err)
+	}
+
+	t, err := s.lookupTable(conn, family, table)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return conn, t, nil
+}
+
+func (s *NftablesService) ListChains(family models.IPFamily, table string) ([]models.ChainInfo, error) {
+	conn, t, err := s.openExisting(family, table)
+	if err != nil || t == nil {
+		return nil, err
+	}
+
+	chains, err := conn.ListChainsOfTableFamily(t.Family)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list chains: %w", err)
+	}
+
+	var result []models.ChainInfo
+	for _, c := range chains {
+		if c.Table.Name != t.Name {
+			continue
+		}
+		c.Table = t
+		info, err := s.chainInfo(conn, t, c)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, *info)
+	}
+
+	return result, nil
+}
+
+func (s *NftablesService) GetChain(family models.IPFamily, table, chain string) (*models.ChainInfo, error) {
+	conn, t, err := s.openExisting(family, table)
+	if err != nil {
+		return nil, err
+	}
+	if t == nil {
+		return nil, fmt.Errorf("chain %s not found", chain)
+	}
+
+	c, err := s.findChain(conn, t, chain)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.chainInfo(conn, t, c)
+}
+
+func (s *NftablesService) chainInfo(conn *nftables.Conn, t *nftables.Table, c *nftables.Chain) (*models.ChainInfo, error) {
+	info := &models.ChainInfo{
+		Name:   c.Name,
+		Policy: "-",
+	}
+	if c.Hooknum != nil {
+		info.Policy = "ACCEPT"
+		if c.Policy != nil && *c.Policy == nftables.ChainPolicyDrop {
+			info.Policy = "DROP"
+		}
+	}
+
+	rules, err := conn.GetRules(t, c)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get rules: %w", err)
+	}
+
+	for i, r := range rules {
+		rule, _, _ := s.decodeRule(conn, t, r)
+		rule.Num = i + 1
+		rule.Handle = r.Handle
+		info.Rules = append(info.Rules, rule)
+	}
+
+	return info, nil
+}
+
+// chainRules returns the chain and its rules in evaluation order
+func (s *NftablesService) chainRules(conn *nftables.Conn, t *nftables.Table, chain string) (*nftables.Chain, []*nftables.Rule, error) {
+	c, err := s.findChain(conn, t, chain)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	rules, err := conn.GetRules(t, c)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get rules: %w", err)
+	}
+
+	return c, rules, nil
+}
+
+func (s *NftablesService) AddRule(input models.FirewallRuleInput) error {
+	conn, t, err := s.open(input.Family, input.Table)
+	if err != nil {
+		return err
+	}
+
+	c, rules, err := s.chainRules(conn, t, input.Chain)
+	if err != nil {
+		return err
+	}
+
+	exprs, sets, err := s.buildRuleExprs(t, input)
+	if err != nil {
+		return err
+	}
+
+	if err := addAnonymousSets(conn, sets); err != nil {
+		return fmt.Errorf("failed to add rule: %w", err)
+	}
+
+	rule := &nftables.Rule{Table: t, Chain: c, Exprs: exprs}
+	if input.Comment != "" {
+		rule.UserData = userdata.AppendString(nil, userdata.TypeComment, input.Comment)
+	}
+
+	switch {
+	case input.Position > len(rules)+1:
+		return fmt.Errorf("invalid position %d", input.Position)
+	case input.Position > 0 && input.Position <= len(rules):
+		rule.Position = rules[input.Position-1].Handle
+		conn.InsertRule(rule)
+	default:
+		conn.AddRule(rule)
+	}
+
+	if err := conn.Flush(); err != nil {
+		return fmt.Errorf("failed to add rule: %w", err)
+	}
+
+	return nil
+}
+
+func (s *NftablesService) DeleteRule(family models.IPFamily, table, chain string, ruleNum int) error {
+	conn, t, err := s.open(family, table)
+	if err != nil {
+		return err
+	}
+
+	c, rules, err := s.chainRules(conn, t, chain)
+	if err != nil {
+		return err
+	}
+
+	if ruleNum < 1 || ruleNum > len(rules) {
+		return fmt.Errorf("rule %d not found", ruleNum)
+	}
+
+	if err := conn.DelRule(&nftables.Rule{Table: t, Chain: c, Handle: rules[ruleNum-1].Handle}); err != nil {
+		return fmt.Errorf("failed to delete rule: %w", err)
+	}
+	if err := conn.Flush(); err != nil {
+		return fmt.Errorf("failed to delete rule: %w", err)
+	}
+
+	return nil
+}
+
+// RuleInput returns the rule form values of a rule and the expressions the
+// form cannot represent
+func (s *NftablesService) RuleInput(family models.IPFamily, table, chain string, ruleNum int) (*models.FirewallRuleInput, []string, error) {
+	conn, t, err := s.openExisting(family, table)
+	if err != nil {
+		return nil, nil, err
+	}
+	if t == nil {
+		return nil, nil, fmt.Errorf("chain %s not found", chain)
+	}
+
+	_, rules, err := s.chainRules(conn, t, chain)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if ruleNum < 1 || ruleNum > len(rules) {
+		return nil, nil, fmt.Errorf("rule %d not found", ruleNum)
+	}
+
+	_, input, unsupported := s.decodeRule(conn, t, rules[ruleNum-1])
+	input.Chain = chain
+	return &input, unsupported, nil
+}
+
+// ReplaceRule replaces the rule at ruleNum in place, keeping its handle
+// position and counters
+func (s *NftablesService) ReplaceRule(ruleNum int, input models.FirewallRuleInput) error {
+	conn, t, err := s.open(input.Family, input.Table)
+	if err != nil {
+		return err
+	}
+
+	c, rules, err := s.chainRules(conn, t, input.Chain)
+	if err != nil {
+		return err
+	}
+
+	if ruleNum < 1 || ruleNum > len(rules) {
+		return fmt.Errorf("rule %d not found", ruleNum)
+	}
+	old := rules[ruleNum-1]
+
+	exprs, sets, err := s.buildRuleExprs(t, input)
+	if err != nil {
+		return err
+	}
+
+	// Carry the old counter values over to the new counter statement
+	for _, e := range old.Exprs {
+		if oldCounter, ok := e.(*expr.Counter); ok {
+			for _, n := range exprs {
+				if counter, ok := n.(*expr.Counter); ok {
+					counter.Packets, counter.Bytes = oldCounter.Packets, oldCounter.Bytes
+				}
+			}
+		}
+	}
+
+	if err := addAnonymousSets(conn, sets); err != nil {
+		return fmt.Errorf("failed to replace rule: %w", err)
+	}
+
+	rule := &nftables.Rule{Table: t, Chain: c, Handle: old.Handle, Exprs: exprs}
+	if input.Comment != "" {
+		rule.UserData = userdata.AppendString(nil, userdata.TypeComment, input.Comment)
+	}
+	conn.ReplaceRule(rule)
+
+	if err := conn.Flush(); err != nil {
+		return fmt.Errorf("failed to replace rule: %w", err)
+	}
+
+	return nil
+}
+
+// MoveRule moves the rule at fromPos so that it ends up at toPos. The
+// delete and re-insert are sent in one netlink batch, which nftables
+// commits atomically; the rule keeps its expressions, counters and comment.
+func (s *NftablesService) MoveRule(family models.IPFamily, table, chain string, fromPos, toPos int) error {
+	conn, t, err := s.open(family, table)
+	if err != nil {
+		return err
+	}
+
+	c, rules, err := s.chainRules(conn, t, chain)
+	if err != nil {
+		return err
+	}
+
+	if fromPos < 1 || fromPos > len(rules) {
+		return fmt.Errorf("rule %d not found", fromPos)
+	}
+	if toPos < 1 || toPos > len(rules) {
+		return fmt.Errorf("invalid position %d", toPos)
+	}
+	if fromPos == toPos {
+		return nil
+	}
+
+	moved := rules[fromPos-1]
+	remaining := append(append([]*nftables.Rule{}, rules[:fromPos-1]...), rules[fromPos:]...)
+
+	exprs, sets, err := s.cloneAnonymousSets(conn, t, moved.Exprs)
+	if err != nil {
+		return err
+	}
+
+	if err := conn.DelRule(&nftables.Rule{Table: t, Chain: c, Handle: moved.Handle}); err != nil {
+		return fmt.Errorf("failed to move rule: %w", err)
+	}
+	if err := addAnonymousSets(conn, sets); err != nil {
+		return fmt.Errorf("failed to move rule: %w", err)
+	}
+
+	rule := &nftables.Rule{Table: t, Chain: c, Exprs: exprs, UserData: moved.UserData}
+	if toPos <= len(remaining) {
+		rule.Position = remaining[toPos-1].Handle
+		conn.InsertRule(rule)
+	} else {
+		rule.Position = remaining[len(remaining)-1].Handle
+		conn.AddRule(rule)
+	}
+
+	if err := conn.Flush(); err != nil {
+		return fmt.Errorf("failed to move rule: %w", err)
+	}
+
+	return nil
+}
+
+// cloneAnonymousSets copies the anonymous sets a rule looks up, since they
+// are bound to the rule and go away when it is deleted
+func (s *NftablesService) cloneAnonymousSets(conn *nftables.Conn, t *nftables.Table, exprs []expr.Any) ([]expr.Any, []nftAnonSet, error) {
+	var sets []nftAnonSet
+	cloned := make([]expr.Any, len(exprs))
+	for i, e := range exprs {
+		cloned[i] = e
+		lookup, ok := e.(*expr.Lookup)
+		if !ok || !strings.HasPrefix(lookup.SetName, "__set") {
+			continue
+		}
+
+		set, err := conn.GetSetByName(t, lookup.SetName)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to get set %s: %w", lookup.SetName, err)
+		}
+		elements, err := conn.GetSetElements(set)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to get set %s: %w", lookup.SetName, err)
+		}
+
+		copySet := &nftables.Set{
+			Table:     t,
+			Anonymous: true,
+			Constant:  true,
+			Interval:  set.Interval,
+			KeyType:   set.KeyType,
+		}
+		copyLookup := *lookup
+		cloned[i] = &copyLookup
+		sets = append(sets, nftAnonSet{set: copySet, elements: elements, lookup: &copyLookup})
+	}
+
+	return cloned, sets, nil
+}
+
+func (s *NftablesService) SetPolicy(family models.IPFamily, table, chain, policy string) error {
+	policy = strings.ToUpper(policy)
+	var chainPolicy nftables.ChainPolicy
+	switch policy {
+	case "ACCEPT":
+		chainPolicy = nftables.ChainPolicyAccept
+	case "DROP":
+		chainPolicy = nftables.ChainPolicyDrop
+	case "REJECT":
+		return fmt.Errorf("REJECT policy: %w", ErrNotSupported)
+	default:
+		return fmt.Errorf("invalid policy: %s", policy)
+	}
+
+	conn, t, err := s.open(family, table)
+	if err != nil {
+		return err
+	}
+
+	c, err := s.findChain(conn, t, chain)
+	if err != nil {
+		return err
+	}
+	if c.Hooknum == nil {
+		return fmt.Errorf("chain %s is not a built-in chain", chain)
+	}
+
+	c.Policy = &chainPolicy
+	conn.AddChain(c)
+	if err := conn.Flush(); err != nil {
+		return fmt.Errorf("failed to set policy: %w", err)
+	}
+
+	return nil
+}
+
+func (s *NftablesService) CreateChain(family models.IPFamily, table, chain string) error {
+	conn, t, err := s.open(family, table)
+	if err != nil {
+		return err
+	}
+
+	if _, err := s.findChain(conn, t, chain); err == nil {
+		return fmt.Errorf("failed to create chain: chain %s already exists", chain)
+	}
+
+	conn.AddChain(&nftables.Chain{Name: chain, Table: t})
+	if err := conn.Flush(); err != nil {
+		return fmt.Errorf("failed to create chain: %w", err)
+	}
+
+	return nil
+}
+
+func (s *NftablesService) DeleteChain(family models.IPFamily, table, chain string) error {
+	conn, t, err := s.open(family, table)
+	if err != nil {
+		return err
+	}
+
+	c, err := s.findChain(conn, t, chain)
+	if err != nil {
+		return err
+	}
+	if c.Hooknum != nil {
+		return fmt.Errorf("failed to delete chain: %s is a built-in chain", chain)
+	}
+
+	conn.FlushChain(c)
+	conn.DelChain(c)
+	if err := conn.Flush(); err != nil {
+		return fmt.Errorf("failed to delete chain: %w", err)
+	}
+
+	return nil
+}
+
+func (s *NftablesService) FlushChain(family models.IPFamily, table, chain string) error {
+	conn, t, err := s.open(family, table)
+	if err != nil {
+		return err
+	}
+
+	if chain == "" {
+		conn.FlushTable(t)
+	} else {
+		c, err := s.findChain(conn, t, chain)
+		if err != nil {
+			return err
+		}
+		conn.FlushChain(c)
+	}
+
+	if err := conn.Flush(); err != nil {
+		return fmt.Errorf("failed to flush chain: %w", err)
+	}
+
+	return nil
+}
+
+// ReplaceChains rewrites managed chains in one netlink batch. Everything is
+// read first and the flushes, rules and jump fixes are queued behind it, so
+// nftables commits the new contents atomically.
+func (s *NftablesService) ReplaceChains(family models.IPFamily, chains []ManagedChain) error {
+	conn, err := nftables.New()
+	if err != nil {
+		return fmt.Errorf("failed to connect to nftables: %w", err)
+	}
+
+	type jumpFix struct {
+		parent *nftables.Chain
+		jumps  []uint64
+		input  models.FirewallRuleInput
+	}
+	type plannedChain struct {
+		chain  *nftables.Chain
+		exists bool
+		rules  []*nftables.Rule
+		sets   []nftAnonSet
+		jump   jumpFix
+	}
+
+	var planned []plannedChain
+	for _, mc := range chains {
+		t, err := s.ensureTable(conn, family, mc.Table)
+		if err != nil {
+			return err
+		}
+
+		cr := plannedChain{chain: &nftables.Chain{Name: mc.Chain, Table: t}}
+		if c, err := s.findChain(conn, t, mc.Chain); err == nil {
+			cr.chain, cr.exists = c, true
+		}
+
+		for _, input := range mc.Rules {
+			input.Chain = mc.Chain
+			exprs, sets, err := s.buildRuleExprs(t, input)
+			if err != nil {
+				return fmt.Errorf("%s: %w", mc.Chain, err)
+			}
+			rule := &nftables.Rule{Table: t, Chain: cr.chain, Exprs: exprs}
+			if input.Comment != "" {
+				rule.UserData = userdata.AppendString(nil, userdata.TypeComment, input.Comment)
+			}
+			cr.rules = append(cr.rules, rule)
+			cr.sets = append(cr.sets, sets...)
+		}
+
+		parent, err := s.findChain(conn, t, mc.Parent)
+		if err != nil {
+			return err
+		}
+		info, err := s.chainInfo(conn, t, parent)
+		if err != nil {
+			return err
+		}
+		cr.jump = jumpFix{parent: parent, input: models.FirewallRuleInput{
+			Family: family, Table: mc.Table, Chain: mc.Parent, Target: mc.Chain,
+		}}
+		for _, rule := range info.Rules {
+			if rule.Target == mc.Chain {
+				cr.jump.jumps = append(cr.jump.jumps, rule.Handle)
+			}
+		}
+		planned = append(planned, cr)
+	}
+
+	for _, cr := range planned {
+		if cr.exists {
+			conn.FlushChain(cr.chain)
+		} else {
+			cr.chain = conn.AddChain(cr.chain)
+		}
+		if err := addAnonymousSets(conn, cr.sets); err != nil {
+			return fmt.Errorf("failed to replace chains: %w", err)
+		}
+		for _, rule := range cr.rules {
+			rule.Chain = cr.chain
+			conn.AddRule(rule)
+		}
+
+		// Every old jump goes and one new jump is inserted at the top, so
+		// the chain is reached first however the parent was edited
+		for _, handle := range cr.jump.jumps {
+			if err := conn.DelRule(&nftables.Rule{Table: cr.jump.parent.Table, Chain: cr.jump.parent, Handle: handle}); err != nil {
+				return fmt.Errorf("failed to replace chains: %w", err)
+			}
+		}
+		exprs, _, err := s.buildRuleExprs(cr.jump.parent.Table, cr.jump.input)
+		if err != nil {
+			return err
+		}
+		conn.InsertRule(&nftables.Rule{Table: cr.jump.parent.Table, Chain: cr.jump.parent, Exprs: exprs})
+	}
+
+	if err := conn.Flush(); err != nil {
+		return fmt.Errorf("failed to replace chains: %w", err)
+	}
+
+	return nil
+}
+
+// ZeroCounters replaces the rules with a counter statement in place with
+// copies whose counters start at zero, in one batch. Base chains have no
+// policy counters in nftables.
+func (s *NftablesService) ZeroCounters(family models.IPFamily, table, chain string, ruleNum int) error {
+	conn, t, err := s.open(family, table)
+	if err != nil {
+		return err
+	}
+
+	var chains []*nftables.Chain
+	if chain == "" {
+		if ruleNum > 0 {
+			return fmt.Errorf("a rule number requires a chain")
+		}
+		all, err := conn.ListChainsOfTableFamily(t.Family)
+		if err != nil {
+			return fmt.Errorf("failed to list chains: %w", err)
+		}
+		for _, c := range all {
+			if c.Table.Name == t.Name {
+				c.Table = t
+				chains = append(chains, c)
+			}
+		}
+	} else {
+		c, err := s.findChain(conn, t, chain)
+		if err != nil {
+			return err
+		}
+		chains = append(chains, c)
+	}
+
+	for _, c := range chains {
+		rules, err := conn.GetRules(t, c)
+		if err != nil {
+			return fmt.Errorf("failed to get rules: %w", err)
+		}
+		if ruleNum > 0 {
+			if ruleNum > len(rules) {
+				return fmt.Errorf("rule %d not found", ruleNum)
+			}
+			rules = rules[ruleNum-1 : ruleNum]
+		}
+
+		for _, r := range rules {
+			counted := false
+			for _, e := range r.Exprs {
+				if counter, ok := e.(*expr.Counter); ok {
+					counter.Packets, counter.Bytes = 0, 0
+					counted = true
+				}
+			}
+			if !counted {
+				continue
+			}
+
+			exprs, sets, err := s.cloneAnonymousSets(conn, t, r.Exprs)
+			if err != nil {
+				return err
+			}
+			if err := addAnonymousSets(conn, sets); err != nil {
+				return fmt.Errorf("failed to zero counters: %w", err)
+			}
+			conn.ReplaceRule(&nftables.Rule{Table: t, Chain: c, Handle: r.Handle, Exprs: exprs, UserData: r.UserData})
+		}
+	}
+
+	if err := conn.Flush(); err != nil {
+		return fmt.Errorf("failed to zero counters: %w", err)
+	}
+
+	return nil
+}
+
+// nftAnonSet is an anonymous set created together with the rule using it
+type nftAnonSet struct {
+	set      *nftables.Set
+	elements []nftables.SetElement
+	lookup   *expr.Lookup
+}
+
+// addAnonymousSets queues the sets and points their lookups at them
+func addAnonymousSets(conn *nftables.Conn, sets []nftAnonSet) error {
+	for _, set := range sets {
+		if err := conn.AddSet(set.set, set.elements); err != nil {
+			return err
+		}
+		set.lookup.SetName = set.set.Name
+		set.lookup.SetID = set.set.ID
+	}
+	return nil
+}
+
+// nftProtocols maps protocol names accepted by the rule form to IP protocol numbers
+var nftProtocols = map[string]byte{
+	"icmp":      unix.IPPROTO_ICMP,
+	"tcp":       unix.IPPROTO_TCP,
+	"udp":       unix.IPPROTO_UDP,
+	"gre":       unix.IPPROTO_GRE,
+	"esp":       unix.IPPROTO_ESP,
+	"ah":        unix.IPPROTO_AH,
+	"ipv6-icmp": unix.IPPROTO_ICMPV6,
+	"sctp":      unix.IPPROTO_SCTP,
+}
+
+// nftCtStates maps conntrack state names to their ct state bits
+var nftCtStates = []struct {
+	name string
+	bit  uint32
+}{
+	{"INVALID", expr.CtStateBitINVALID},
+	{"NEW", expr.CtStateBitNEW},
+	{"RELATED", expr.CtStateBitRELATED},
+	{"ESTABLISHED", expr.CtStateBitESTABLISHED},
+	{"UNTRACKED", expr.CtStateBitUNTRACKED},
+}
+
+// addressOffsets returns the network header offsets of the source and
+// destination address and the address length for a table family
+func addressOffsets(family nftables.TableFamily) (src, dst, length uint32) {
+	if family == nftables.TableFamilyIPv6 {
+		return 8, 24, 16
+	}
+	return 12, 16, 4
+}
+
+// buildRuleExprs translates the rule form into nftables expressions
+func (s *NftablesService) buildRuleExprs(t *nftables.Table, input models.FirewallRuleInput) ([]expr.Any, []nftAnonSet, error) {
+	var exprs []expr.Any
+	var sets []nftAnonSet
+
+	if err := validateLogOptions(input); err != nil {
+		return nil, nil, err
+	}
+	if err := validateRateOptions(input); err != nil {
+		return nil, nil, err
+	}
+	// Per-address limits need dynamic sets (meters) in nftables, and the
+	// meta time keys are not translated
+	switch {
+	case input.HashLimit != "":
+		return nil, nil, fmt.Errorf("hashlimit matches: %w", ErrNotSupported)
+	case input.ConnLimit != "":
+		return nil, nil, fmt.Errorf("connlimit matches: %w", ErrNotSupported)
+	case input.RecentName != "":
+		return nil, nil, fmt.Errorf("recent matches: %w", ErrNotSupported)
+	case usesTimeMatch(input):
+		return nil, nil, fmt.Errorf("time matches: %w", ErrNotSupported)
+	}
+
+	// ipsets live outside nftables; named nftables sets are the equivalent
+	if input.MatchSet != "" {
+		return nil, nil, fmt.Errorf("ipset matches: %w", ErrNotSupported)
+	}
+
+	protocol := strings.ToLower(input.Protocol)
+	if protocol != "" && protocol != "all" {
+		num, ok := nftProtocols[protocol]
+		if !ok {
+			n, err := strconv.ParseUint(protocol, 10, 8)
+			if err != nil {
+				return nil, nil, fmt.Errorf("unknown protocol: %s", input.Protocol)
+			}
+			num = byte(n)
+		}
+		exprs = append(exprs,
+			&expr.Meta{Key: expr.MetaKeyL4PROTO, Register: 1},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: []byte{num}},
+		)
+	}
+
+	srcOffset, dstOffset, addrLen := addressOffsets(t.Family)
+	if input.Source != "" && input.Source != anyAddress(input.Family) {
+		match, err := addressMatch(input.Family, input.Source, srcOffset, addrLen)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid source: %w", err)
+		}
+		exprs = append(exprs, match...)
+	}
+	if input.Destination != "" && input.Destination != anyAddress(input.Family) {
+		match, err := addressMatch(input.Family, input.Destination, dstOffset, addrLen)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid destination: %w", err)
+		}
+		exprs = append(exprs, match...)
+	}
+
+	if input.InInterface != "" {
+		exprs = append(exprs,
+			&expr.Meta{Key: expr.MetaKeyIIFNAME, Register: 1},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: ifnameData(input.InInterface)},
+		)
+	}
+	if input.OutInterface != "" {
+		exprs = append(exprs,
+			&expr.Meta{Key: expr.MetaKeyOIFNAME, Register: 1},
+			&expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: ifnameData(input.OutInterface)},
+		)
+	}
+
+	for _, port := range []struct {
+		value  string
+		offset uint32
+	}{{input.SPort, 0}, {input.DPort, 2}} {
+		if port.value == "" {
+			continue
+		}
+		if protocol != "tcp" && protocol != "udp" && protocol != "sctp" {
+			return nil, nil, fmt.Errorf("ports require protocol tcp, udp or sctp")
+		}
+		match, set, err := portMatch(t, port.value, port.offset)
+		if err != nil {
+			return nil, nil, err
+		}
+		if set != nil {
+			sets = append(sets, *set)
+		}
+		exprs = append(exprs, match...)
+	}
+
+	if input.State != "" {
+		var mask uint32
+		for _, name := range strings.Split(strings.ToUpper(input.State), ",") {
+			found := false
+			for _, state := range nftCtStates {
+				if state.name == strings.TrimSpace(name) {
+					mask |= state.bit
+					found = true
+				}
+			}
+			if !found {
+				return nil, nil, fmt.Errorf("unknown state: %s", name)
+			}
+		}
+		exprs = append(exprs,
+			&expr.Ct{Register: 1, Key: expr.CtKeySTATE},
+			&expr.Bitwise{
+				SourceRegister: 1,
+				DestRegister:   1,
+				Len:            4,
+				Mask:           binaryutil.NativeEndian.PutUint32(mask),
+				Xor:            binaryutil.NativeEndian.PutUint32(0),
+			},
+			&expr.Cmp{Op: expr.CmpOpNeq, Register: 1, Data: []byte{0, 0, 0, 0}},
+		)
+	}
+
+	if input.Limit != "" {
+		rate, unit, _ := parseRate(input.Limit)
+		burst := uint64(nftDefaultBurst)
+		if input.LimitBurst != "" {
+			burst, _ = strconv.ParseUint(input.LimitBurst, 10, 32)
+		}
+		exprs = append(exprs, &expr.Limit{
+			Type:  expr.LimitTypePkts,
+			Rate:  rate,
+			Unit:  nftLimitUnits[unit],
+			Burst: uint32(burst),
+		})
+	}
+
+	exprs = append(exprs, &expr.Counter{})
+
+	target, err := s.targetExprs(input)
+	if err != nil {
+		return nil, nil, err
+	}
+	exprs = append(exprs, target...)
+
+	return exprs, sets, nil
+}
+
+// targetExprs translates an iptables style target into nftables statements
+func (s *NftablesService) targetExprs(input models.FirewallRuleInput) ([]expr.Any, error) {
+	switch input.Target {
+	case "ACCEPT":
+		return []expr.Any{&expr.Verdict{Kind: expr.VerdictAccept}}, nil
+	case "DROP":
+		return []expr.Any{&expr.Verdict{Kind: expr.VerdictDrop}}, nil
+	case "RETURN":
+		return []expr.Any{&expr.Verdict{Kind: expr.VerdictReturn}}, nil
+	case "REJECT":
+		code := uint8(3) // ICMP port unreachable
+		if input.Family == models.FamilyIPv6 {
+			code = 4 // ICMPv6 port unreachable
+		}
+		return []expr.Any{&expr.Reject{Type: unix.NFT_REJECT_ICMP_UNREACH, Code: code}}, nil
+	case "LOG", "NFLOG":
+		return []expr.Any{logExpr(input)}, nil
+	case "MASQUERADE":
+		return []expr.Any{&expr.Masq{}}, nil
+	case "SNAT", "DNAT":
+		to := input.ToSource
+		natType := expr.NATTypeSourceNAT
+		if input.Target == "DNAT" {
+			to = input.ToDestination
+			natType = expr.NATTypeDestNAT
+		}
+		if to == "" {
+			return nil, fmt.Errorf("%s requires a target address", input.Target)
+		}
+		return natExprs(input.Family, natType, to)
+	case "":
+		return nil, fmt.Errorf("target is required")
+	default:
+		if nftUnsupportedTargets[input.Target] {
+			return nil, fmt.Errorf("target %s: %w", input.Target, ErrNotSupported)
+		}
+		return []expr.Any{&expr.Verdict{Kind: expr.VerdictJump, Chain: input.Target}}, nil
+	}
+}
+
+// nftUnsupportedTargets are iptables extension targets that have no
+// translation here; any other unknown target is treated as a chain to jump to
+var nftUnsupportedTargets = map[string]bool{
+	"MARK": true, "CONNMARK": true, "TCPMSS": true, "NFQUEUE": true,
+	"CT": true, "NOTRACK": true, "REDIRECT": true, "TPROXY": true, "TOS": true,
+	"DSCP": true, "TTL": true, "HL": true, "CLASSIFY": true, "SET": true,
+	"TRACE": true, "AUDIT": true, "CHECKSUM": true,
+}
+
+// nftDefaultBurst is the burst of the iptables limit match when none is set
+const nftDefaultBurst = 5
+
+// nftLimitUnits maps the units of a rate limit to nftables limit units
+var nftLimitUnits = map[string]expr.LimitTime{
+	"second": expr.LimitTimeSecond,
+	"minute": expr.LimitTimeMinute,
+	"hour":   expr.LimitTimeHour,
+	"day":    expr.LimitTimeDay,
+}
+
+// logExpr builds the log statement of a LOG or NFLOG rule. NFLOG sends
+// the packet to a netlink group instead of the kernel log.
+func logExpr(input models.FirewallRuleInput) *expr.Log {
+	log := &expr.Log{}
+	if input.LogPrefix != "" {
+		log.Key |= 1 << unix.NFTA_LOG_PREFIX
+		log.Data = []byte(input.LogPrefix)
+	}
+	if input.Target == "NFLOG" {
+		group, _ := strconv.ParseUint(input.NFLogGroup, 10, 16)
+		log.Key |= 1 << unix.NFTA_LOG_GROUP
+		log.Group = uint16(group)
+	} else if input.LogLevel != "" {
+		log.Key |= 1 << unix.NFTA_LOG_LEVEL
+		log.Level = expr.LogLevel(logLevelIndex(input.LogLevel))
+	}
+	return log
+}
+
+// natExprs loads the NAT address (and optional port) into registers 1 and 2
+func natExprs(family models.IPFamily, natType expr.NATType, to string) ([]expr.Any, error) {
+	host, port := to, ""
+	if strings.HasPrefix(to, "[") {
+		end := strings.Index(to, "]")
+		if end < 0 {
+			return nil, fmt.Errorf("invalid address: %s", to)
+		}
+		host = to[1:end]
+		port = strings.TrimPrefix(to[end+1:], ":")
+	} else if strings.Count(to, ":") == 1 {
+		host, port, _ = strings.Cut(to, ":")
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid address: %s", to)
+	}
+	if err := validateAddressFamily(family, host); err != nil {
+		return nil, err
+	}
+
+	natFamily := uint32(unix.NFPROTO_IPV4)
+	addr := ip.To4()
+	if family == models.FamilyIPv6 {
+		natFamily = unix.NFPROTO_IPV6
+		addr = ip.To16()
+	}
+
+	exprs := []expr.Any{&expr.Immediate{Register: 1, Data: addr}}
+	nat := &expr.NAT{Type: natType, Family: natFamily, RegAddrMin: 1}
+	if port != "" {
+		p, err := strconv.ParseUint(port, 10, 16)
+		if err != nil || p == 0 {
+			return nil, fmt.Errorf("invalid port: %s", port)
+		}
+		exprs = append(exprs, &expr.Immediate{Register: 2, Data: binaryutil.BigEndian.PutUint16(uint16(p))})
+		nat.RegProtoMin = 2
+	}
+
+	return append(exprs, nat), nil
+}
+
+// addressMatch matches a network header address against an IP or CIDR
+func addressMatch(family models.IPFamily, addr string, offset, length uint32) ([]expr.Any, error) {
+	if strings.Contains(addr, ",") {
+		return nil, fmt.Errorf("address lists: %w", ErrNotSupported)
+	}
+	if err := validateAddressFamily(family, addr); err != nil {
+		return nil, err
+	}
+
+	var ip net.IP
+	var mask net.IPMask
+	if strings.Contains(addr, "/") {
+		_, ipNet, err := net.ParseCIDR(addr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid address: %s", addr)
+		}
+		ip, mask = ipNet.IP, ipNet.Mask
+	} else {
+		ip = net.ParseIP(addr)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid address: %s", addr)
+		}
+	}
+
+	data := ip.To16()
+	if length == 4 {
+		data = ip.To4()
+	}
+
+	exprs := []expr.Any{&expr.Payload{
+		DestRegister: 1,
+		Base:         expr.PayloadBaseNetworkHeader,
+		Offset:       offset,
+		Len:          length,
+	}}
+	if ones, bits := mask.Size(); mask != nil && ones < bits {
+		exprs = append(exprs, &expr.Bitwise{
+			SourceRegister: 1,
+			DestRegister:   1,
+			Len:            length,
+			Mask:           mask,
+			Xor:            make([]byte, length),
+		})
+	}
+
+	return append(exprs, &expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: data}), nil
+}
+
+// portMatch matches a transport header port against a single port, a
+// range ("1000:2000") or a list ("80,443", via an anonymous set)
+func portMatch(t *nftables.Table, ports string, offset uint32) ([]expr.Any, *nftAnonSet, error) {
+	load := &expr.Payload{
+		DestRegister: 1,
+		Base:         expr.PayloadBaseTransportHeader,
+		Offset:       offset,
+		Len:          2,
+	}
+
+	parsePort := func(value string) ([]byte, error) {
+		p, err := strconv.ParseUint(strings.TrimSpace(value), 10, 16)
+		if err != nil || p == 0 {
+			return nil, fmt.Errorf("invalid port: %s", value)
+		}
+		return binaryutil.BigEndian.PutUint16(uint16(p)), nil
+	}
+
+	if strings.Contains(ports, ",") {
+		set := &nftAnonSet{
+			set: &nftables.Set{
+				Table:     t,
+				Anonymous: true,
+				Constant:  true,
+				KeyType:   nftables.TypeInetService,
+			},
+			lookup: &expr.Lookup{SourceRegister: 1},
+		}
+		for _, value := range strings.Split(ports, ",") {
+			key, err := parsePort(value)
+			if err != nil {
+				return nil, nil, err
+			}
+			set.elements = append(set.elements, nftables.SetElement{Key: key})
+		}
+		return []expr.Any{load, set.lookup}, set, nil
+	}
+
+	if from, to, ok := strings.Cut(ports, ":"); ok {
+		fromData, err := parsePort(from)
+		if err != nil {
+			return nil, nil, err
+		}
+		toData, err := parsePort(to)
+		if err != nil {
+			return nil, nil, err
+		}
+		return []expr.Any{load, &expr.Range{Op: expr.CmpOpEq, Register: 1, FromData: fromData, ToData: toData}}, nil, nil
+	}
+
+	data, err := parsePort(ports)
+	if err != nil {
+		return nil, nil, err
+	}
+	return []expr.Any{load, &expr.Cmp{Op: expr.CmpOpEq, Register: 1, Data: data}}, nil, nil
+}
+
+// ifnameData encodes an interface name for comparison with meta iifname
+// and oifname; a trailing "+" matches any name with that prefix
+func ifnameData(name string) []byte {
+	if prefix, ok := strings.CutSuffix(name, "+"); ok {
+		return []byte(prefix)
+	}
+	data := make([]byte, unix.IFNAMSIZ)
+	copy(data, name)
+	return data
+}
+
+// decodeRule renders a rule's expressions in the columns iptables -L uses
+// and as rule form values. Expressions the form cannot produce are
+// summarized in Extra and returned as unsupported.
+func (s *NftablesService) decodeRule(conn *nftables.Conn, t *nftables.Table, r *nftables.Rule) (models.FirewallRule, models.FirewallRuleInput, []string) {
+	family := models.FamilyIPv4
+	if t.Family == nftables.TableFamilyIPv6 {
+		family = models.FamilyIPv6
+	}
+
+	rule := models.FirewallRule{
+		Protocol:    "all",
+		Opt:         "--",
+		In:          "*",
+		Out:         "*",
+		Source:      anyAddress(family),
+		Destination: anyAddress(family),
+	}
+	input := models.FirewallRuleInput{
+		Family:   family,
+		Table:    t.Name,
+		Chain:    r.Chain.Name,
+		Protocol: "all",
+	}
+
+	if comment, ok := userdata.GetString(r.UserData, userdata.TypeComment); ok {
+		rule.Comment = "/* " + comment + " */"
+		input.Comment = comment
+	}
+
+	srcOffset, dstOffset, _ := addressOffsets(t.Family)
+	var extra, unsupported []string
+	var load expr.Any
+	var mask []byte
+	immediates := make(map[uint32][]byte)
+	logged := ""
+
+	// other records an expression only shown in the Options column
+	other := func(text string) {
+		extra = append(extra, text)
+		unsupported = append(unsupported, text)
+	}
+	// setPort fills the sport or dport form field
+	setPort := func(offset uint32, value string) {
+		if offset == 0 {
+			input.SPort = value
+		} else {
+			input.DPort = value
+		}
+	}
+
+	for _, e := range r.Exprs {
+		switch e := e.(type) {
+		case *expr.Meta, *expr.Payload, *expr.Ct:
+			load, mask = e, nil
+		case *expr.Bitwise:
+			mask = e.Mask
+		case *expr.Cmp:
+			negate := ""
+			if e.Op == expr.CmpOpNeq {
+				negate = "!"
+			}
+			switch l := load.(type) {
+			case *expr.Meta:
+				switch l.Key {
+				case expr.MetaKeyL4PROTO:
+					rule.Protocol = negate + protocolName(e.Data)
+					input.Protocol = rule.Protocol
+				case expr.MetaKeyIIFNAME:
+					rule.In = negate + ifnameString(e.Data)
+					input.InInterface = rule.In
+				case expr.MetaKeyOIFNAME:
+					rule.Out = negate + ifnameString(e.Data)
+					input.OutInterface = rule.Out
+				default:
+					other(fmt.Sprintf("meta %d %s0x%s", l.Key, negate, hex.EncodeToString(e.Data)))
+				}
+			case *expr.Payload:
+				switch {
+				case l.Base == expr.PayloadBaseNetworkHeader && l.Offset == srcOffset:
+					rule.Source = negate + cidrString(e.Data, mask)
+					input.Source = rule.Source
+				case l.Base == expr.PayloadBaseNetworkHeader && l.Offset == dstOffset:
+					rule.Destination = negate + cidrString(e.Data, mask)
+					input.Destination = rule.Destination
+				case l.Base == expr.PayloadBaseTransportHeader && l.Len == 2 && l.Offset <= 2:
+					port := binary.BigEndian.Uint16(e.Data)
+					extra = append(extra, fmt.Sprintf("%s%s:%d", portPrefix(l.Offset), negate, port))
+					setPort(l.Offset, negate+strconv.Itoa(int(port)))
+				default:
+					other(fmt.Sprintf("payload @%d,%d %s0x%s", l.Offset, l.Len, negate, hex.EncodeToString(e.Data)))
+				}
+			case *expr.Ct:
+				// A state match is "ct state & mask != 0", so the not equal
+				// belongs to the match and does not negate it
+				if l.Key == expr.CtKeySTATE && mask != nil && e.Op == expr.CmpOpNeq && isZero(e.Data) {
+					negate = ""
+					states := ctStateNames(binaryutil.NativeEndian.Uint32(mask))
+					extra = append(extra, "state "+states)
+					input.State = states
+				} else {
+					other(fmt.Sprintf("ct %d %s0x%s", l.Key, negate, hex.EncodeToString(e.Data)))
+				}
+			}
+			if negate != "" {
+				unsupported = append(unsupported, "negated match")
+			}
+		case *expr.Range:
+			if l, ok := load.(*expr.Payload); ok && l.Base == expr.PayloadBaseTransportHeader && l.Len == 2 {
+				ports := fmt.Sprintf("%d:%d", binary.BigEndian.Uint16(e.FromData), binary.BigEndian.Uint16(e.ToData))
+				extra = append(extra, portPrefix(l.Offset)+"s:"+ports)
+				setPort(l.Offset, ports)
+			} else {
+				other("range")
+			}
+		case *expr.Lookup:
+			negate := ""
+			if e.Invert {
+				negate = "!"
+			}
+			values := "@" + e.SetName
+			if strings.HasPrefix(e.SetName, "__set") {
+				values = s.setElementsString(conn, t, e.SetName)
+			}
+			if l, ok := load.(*expr.Payload); ok && l.Base == expr.PayloadBaseTransportHeader && l.Len == 2 && negate == "" && !strings.HasPrefix(values, "@") {
+				extra = append(extra, fmt.Sprintf("multiport %ss %s", portPrefix(l.Offset), values))
+				setPort(l.Offset, values)
+			} else {
+				other(fmt.Sprintf("lookup %s%s", negate, values))
+			}
+		case *expr.Counter:
+			rule.Packets = e.Packets
+			rule.Bytes = e.Bytes
+		case *expr.Immediate:
+			immediates[e.Register] = e.Data
+		case *expr.Verdict:
+			switch e.Kind {
+			case expr.VerdictAccept:
+				rule.Target = "ACCEPT"
+			case expr.VerdictDrop:
+				rule.Target = "DROP"
+			case expr.VerdictReturn:
+				rule.Target = "RETURN"
+			case expr.VerdictJump:
+				rule.Target = e.Chain
+			case expr.VerdictGoto:
+				rule.Target = e.Chain
+				other("[goto]")
+			case expr.VerdictQueue:
+				rule.Target = "QUEUE"
+			default:
+				rule.Target = fmt.Sprintf("verdict %d", e.Kind)
+			}
+		case *expr.Reject:
+			rule.Target = "REJECT"
+		case *expr.Masq:
+			rule.Target = "MASQUERADE"
+		case *expr.NAT:
+			rule.Target = "SNAT"
+			if e.Type == expr.NATTypeDestNAT {
+				rule.Target = "DNAT"
+			}
+			to := ""
+			if addr, ok := immediates[e.RegAddrMin]; ok && e.RegAddrMin != 0 {
+				to = net.IP(addr).String()
+				if len(addr) == 16 {
+					to = "[" + to + "]"
+				}
+			}
+			if port, ok := immediates[e.RegProtoMin]; ok && e.RegProtoMin != 0 && len(port) == 2 {
+				to += fmt.Sprintf(":%d", binary.BigEndian.Uint16(port))
+			}
+			if to != "" {
+				extra = append(extra, "to:"+to)
+			}
+			if e.Type == expr.NATTypeDestNAT {
+				input.ToDestination = to
+			} else {
+				input.ToSource = to
+			}
+		case *expr.Log:
+			logged = "LOG"
+			if e.Key&(1<<unix.NFTA_LOG_GROUP) != 0 {
+				logged = "NFLOG"
+				input.NFLogGroup = strconv.Itoa(int(e.Group))
+				extra = append(extra, fmt.Sprintf("group %d", e.Group))
+			}
+			if e.Key&(1<<unix.NFTA_LOG_LEVEL) != 0 && int(e.Level) < len(models.LogLevels) {
+				input.LogLevel = models.LogLevels[e.Level]
+				extra = append(extra, "level "+input.LogLevel)
+			}
+			if len(e.Data) > 0 {
+				input.LogPrefix = string(e.Data)
+				extra = append(extra, fmt.Sprintf("prefix %q", input.LogPrefix))
+			}
+		case *expr.Limit:
+			unit := ""
+			for name, u := range nftLimitUnits {
+				if u == e.Unit {
+					unit = name
+				}
+			}
+			if e.Type != expr.LimitTypePkts || e.Over || unit == "" {
+				other("limit")
+				break
+			}
+			input.Limit = fmt.Sprintf("%d/%s", e.Rate, unit)
+			text := "limit: up to " + input.Limit
+			if e.Burst != 0 && e.Burst != nftDefaultBurst {
+				input.LimitBurst = strconv.Itoa(int(e.Burst))
+				text += ", burst " + input.LimitBurst
+			}
+			extra = append(extra, text)
+		default:
+			other(strings.ToLower(strings.TrimPrefix(fmt.Sprintf("%T", e), "*expr.")))
+		}
+	}
+
+	if rule.Target == "" && logged != "" {
+		rule.Target = logged
+	}
+	rule.Extra = strings.Join(extra, " ")
+	input.Target = rule.Target
+
+	return rule, input, unsupported
+}
+
+// setElementsString formats the elements of an anonymous port set
+func (s *NftablesService) setElementsString(conn *nftables.Conn, t *nftables.Table, name string) string {
+	set, err := conn.GetSetByName(t, name)
+	if err != nil {
+		return "@" + name
+	}
+	elements, err := conn.GetSetElements(set)
+	if err != nil {
+		return "@" + name
+	}
+
+	var values []string
+	for _, element := range elements {
+		if element.IntervalEnd {
+			continue
+		}
+		values = append(values, formatSetKey(set.KeyType, element.Key))
+	}
+	return strings.Join(values, ",")
+}
+
+func portPrefix(offset uint32) string {
+	if offset == 0 {
+		return "spt"
+	}
+	return "dpt"
+}
+
+func protocolName(data []byte) string {
+	if len(data) != 1 {
+		return hex.EncodeToString(data)
+	}
+	for name, num := range nftProtocols {
+		if num == data[0] {
+			return name
+		}
+	}
+	return strconv.Itoa(int(data[0]))
+}
+
+// isZero reports whether all bytes of data are zero
+func isZero(data []byte) bool {
+	for _, b := range data {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func ifnameString(data []byte) string {
+	if i := bytes.IndexByte(data, 0); i >= 0 {
+		return string(data[:i])
+	}
+	return string(data) + "+"
+}
+
+func cidrString(data, mask []byte) string {
+	ip := net.IP(data)
+	if mask == nil || len(mask) != len(data) {
+		return ip.String()
+	}
+	ones, _ := net.IPMask(mask).Size()
+	return fmt.Sprintf("%s/%d", ip, ones)
+}
+
+func ctStateNames(mask uint32) string {
+	var names []string
+	for _, state := range nftCtStates {
+		if mask&state.bit != 0 {
+			names = append(names, state.name)
+		}
+	}
+	return strings.Join(names, ",")
+}
+
+// formatSetKey renders a set element key according to the set's key type
+func formatSetKey(keyType nftables.SetDatatype, key []byte) string {
+	switch keyType.Name {
+	case nftables.TypeIPAddr.Name, nftables.TypeIP6Addr.Name:
+		return net.IP(key).String()
+	case nftables.TypeInetService.Name:
+		if len(key) == 2 {
+			return strconv.Itoa(int(binary.BigEndian.Uint16(key)))
+		}
+	case nftables.TypeInetProto.Name:
+		return protocolName(key)
+	case nftables.TypeIFName.Name:
+		return ifnameString(key)
+	}
+	return "0x" + hex.EncodeToString(key)
+}
+
+// nftTableFamilyNames maps table families to the names nft uses
+var nftTableFamilyNames = map[nftables.TableFamily]string{
+	nftables.TableFamilyINet:   "inet",
+	nftables.TableFamilyIPv4:   "ip",
+	nftables.TableFamilyIPv6:   "ip6",
+	nftables.TableFamilyARP:    "arp",
+	nftables.TableFamilyNetdev: "netdev",
+	nftables.TableFamilyBridge: "bridge",
+}
+
+// nftHookNames maps netfilter hook numbers to the names nft uses
+var nftHookNames = map[nftables.ChainHook]string{
+	unix.NF_INET_PRE_ROUTING:  "prerouting",
+	unix.NF_INET_LOCAL_IN:     "input",
+	unix.NF_INET_FORWARD:      "forward",
+	unix.NF_INET_LOCAL_OUT:    "output",
+	unix.NF_INET_POST_ROUTING: "postrouting",
+}
+
+// ListTables returns every nftables table with its chains and named sets,
+// including tables this application does not manage
+func (s *NftablesService) ListTables() ([]models.NftTable, error) {
+	conn, err := nftables.New()
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to nftables: %w", err)
+	}
+
+	tables, err := conn.ListTables()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list tables: %w", err)
+	}
+	chains, err := conn.ListChains()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list chains: %w", err)
+	}
+
+	var result []models.NftTable
+	for _, t := range tables {
+		table := models.NftTable{
+			Family: nftTableFamilyNames[t.Family],
+			Name:   t.Name,
+		}
+
+		for _, c := range chains {
+			if c.Table.Name != t.Name || c.Table.Family != t.Family {
+				continue
+			}
+			c.Table = t
+			chain := models.NftChain{Name: c.Name, Type: string(c.Type)}
+			if c.Hooknum != nil {
+				chain.Hook = nftHookNames[*c.Hooknum]
+				if t.Family == nftables.TableFamilyNetdev {
+					chain.Hook = "ingress"
+				}
+				chain.Policy = "accept"
+				if c.Policy != nil && *c.Policy == nftables.ChainPolicyDrop {
+					chain.Policy = "drop"
+				}
+			}
+			if c.Priority != nil {
+				chain.Priority = int(*c.Priority)
+			}
+			if rules, err := conn.GetRules(t, c); err == nil {
+				chain.Rules = len(rules)
+			}
+			table.Chains = append(table.Chains, chain)
+		}
+
+		sets, err := conn.GetSets(t)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list sets: %w", err)
+		}
+		for _, set := range sets {
+			if set.Anonymous {
+				continue
+			}
+			nftSet := models.NftSet{Name: set.Name, KeyType: set.KeyType.Name}
+			for flag, on := range map[string]bool{
+				"constant": set.Constant,
+				"interval": set.Interval,
+				"timeout":  set.HasTimeout,
+				"dynamic":  set.Dynamic,
+				"map":      set.IsMap,
+			} {
+				if on {
+					nftSet.Flags = append(nftSet.Flags, flag)
+				}
+			}
+			if elements, err := conn.GetSetElements(set); err == nil {
+				for _, element := range elements {
+					if !element.IntervalEnd {
+						nftSet.Elements = append(nftSet.Elements, formatSetKey(set.KeyType, element.Key))
+					}
+				}
+			}
+			table.Sets = append(table.Sets, nftSet)
+		}
+
+		result = append(result, table)
+	}
+
+	return result, nil
+}
+
+func (s *NftablesService) SaveRules(family models.IPFamily) error {
+	output, err := s.GetRawRules(family)
+	if err != nil {
+		return fmt.Errorf("failed to save rules: %w", err)
+	}
+
+	savePath := filepath.Join(s.configDir, "nftables", rulesetFile(family))
+	data := "flush ruleset " + nftFamilyName(family) + "\n" + output
+	if err := os.WriteFile(savePath, []byte(data), 0644); err != nil {
+		return fmt.Errorf("failed to write rules file: %w", err)
+	}
+
+	return nil
+}
+
+func (s *NftablesService) RestoreRules(family models.IPFamily) error {
+	savePath := filepath.Join(s.configDir, "nftables", rulesetFile(family))
+	if _, err := os.Stat(savePath); err != nil {
+		if os.IsNotExist(err) {
+			return nil // No saved rules
+		}
+		return fmt.Errorf("failed to read rules file: %w", err)
+	}
+
+	cmd := exec.Command("nft", "-f", savePath)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to restore rules: %s", string(output))
+	}
+
+	return nil
+}
+
+func (s *NftablesService) GetRawRules(family models.IPFamily) (string, error) {
+	cmd := exec.Command("nft", "list", "ruleset", nftFamilyName(family))
+	output, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("failed to get rules: %w", err)
+	}
+	return string(output), nil
+}
+
+func (s *NftablesService) GetSavedRules(family models.IPFamily) (string, error) {
+	data, err := os.ReadFile(filepath.Join(s.configDir, "nftables", rulesetFile(family)))
+	if err != nil {
+		return "", fmt.Errorf("failed to read rules file: %w", err)
+	}
+	return string(data), nil
+}
+
+// ApplyRuleset is not supported: the imported rulesets are in
+// iptables-restore syntax
+func (s *NftablesService) ApplyRuleset(family models.IPFamily, ruleset string) error {
+	return ErrNotSupported
+}
+
+// snapshotRules captures the ip and ip6 rulesets for safe apply
+func (s *NftablesService) snapshotRules() (map[string][]byte, error) {
+	snapshots := make(map[string][]byte)
+	for _, family := range models.IPFamilies {
+		output, err := s.GetRawRules(family)
+		if err != nil {
+			return nil, fmt.Errorf("failed to snapshot %s rules: %w", family, err)
+		}
+		snapshots[string(family)] = []byte(output)
+	}
+	return snapshots, nil
+}
+
+func (s *NftablesService) restoreSnapshots(snapshots map[string][]byte) error {
+	var errors []string
+	for family, snapshot := range snapshots {
+		script := "flush ruleset " + nftFamilyName(models.IPFamily(family)) + "\n" + string(snapshot)
+		cmd := exec.Command("nft", "-f", "-")
+		cmd.Stdin = strings.NewReader(script)
+		if output, err := cmd.CombinedOutput(); err != nil {
+			errors = append(errors, family+": "+strings.TrimSpace(string(output)))
+		}
+	}
+
+	if len(errors) > 0 {
+		return fmt.Errorf("failed to roll back rules: %s", strings.Join(errors, "; "))
+	}
+
+	return nil
+}
@@ -0,0 +1,38 @@
+package services
+
+import (
+	"testing"
+
+	"linuxtorouter/internal/models"
+
+	"github.com/google/nftables"
+)
+
+func TestNftablesStateRuleRoundTrip(t *testing.T) {
+	s := &NftablesService{}
+	table := &nftables.Table{Name: "filter", Family: nftables.TableFamilyIPv4}
+	input := models.FirewallRuleInput{
+		Family: models.FamilyIPv4,
+		Table:  "filter",
+		Chain:  "INPUT",
+		State:  "RELATED,ESTABLISHED",
+		Target: "ACCEPT",
+	}
+
+	exprs, _, err := s.buildRuleExprs(table, input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rule := &nftables.Rule{Table: table, Chain: &nftables.Chain{Name: "INPUT", Table: table}, Exprs: exprs}
+	_, got, unsupported := s.decodeRule(nil, table, rule)
+
+	if len(unsupported) > 0 {
+		t.Errorf("state rule reported unsupported parts: %q", unsupported)
+	}
+	if got.State != input.State {
+		t.Errorf("state: got %q, want %q", got.State, input.State)
+	}
+	if got.Target != input.Target {
+		t.Errorf("target: got %q, want %q", got.Target, input.Target)
+	}
+}
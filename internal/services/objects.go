@@ -0,0 +1,974 @@
+package services
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"linuxtorouter/internal/database"
+	"linuxtorouter/internal/models"
+)
+
+// objectRuleTag prefixes the comment of every rule rendered from an object
+// rule: "objrule:<id> <comment>"
+const objectRuleTag = "objrule:"
+
+// maxObjectRuleExpansion caps the number of kernel rules a single object
+// rule may render into
+const maxObjectRuleExpansion = 64
+
+// objectNamePattern matches the accepted object names
+var objectNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]{0,62}$`)
+
+var (
+	ErrObjectNotFound = errors.New("object not found")
+	ErrObjectExists   = errors.New("an object with this name already exists")
+	ErrObjectInUse    = errors.New("object is still referenced")
+)
+
+// FirewallObjectService stores address, group and service objects and the
+// rules referencing them in SQLite. Object rules are rendered into plain
+// rules on the firewall backend, tagged with the object rule ID, and
+// re-rendered in place whenever an object they use changes.
+type FirewallObjectService struct {
+	db       *database.DB
+	firewall FirewallBackend
+}
+
+func NewFirewallObjectService(db *database.DB, firewall FirewallBackend) *FirewallObjectService {
+	return &FirewallObjectService{db: db, firewall: firewall}
+}
+
+// ListObjects returns all objects ordered by name, with UsedBy filled in
+func (s *FirewallObjectService) ListObjects() ([]models.FirewallObject, error) {
+	objects, _, err := s.ListObjectsAndRules()
+	return objects, err
+}
+
+// ListObjectsAndRules returns all objects with UsedBy filled in and the
+// object rules with their state in the running firewall
+func (s *FirewallObjectService) ListObjectsAndRules() ([]models.FirewallObject, []models.ObjectRule, error) {
+	objects, err := s.LoadObjects()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	rules, err := s.loadRules()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	byName := objectsByName(objects)
+	for i := range objects {
+		objects[i].UsedBy = objectUsage(objects[i].Name, objects, byName, rules)
+	}
+
+	return objects, rules, nil
+}
+
+// GetObject returns a single object
+func (s *FirewallObjectService) GetObject(id int64) (*models.FirewallObject, error) {
+	objects, err := s.ListObjects()
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range objects {
+		if objects[i].ID == id {
+			return &objects[i], nil
+		}
+	}
+
+	return nil, ErrObjectNotFound
+}
+
+// CreateObject validates and stores a new object
+func (s *FirewallObjectService) CreateObject(obj models.FirewallObject) (int64, error) {
+	objects, err := s.LoadObjects()
+	if err != nil {
+		return 0, err
+	}
+
+	obj.Values = normalizeObjectValues(obj.Type, obj.Values)
+	if err := validateObject(obj, objectsByName(append(objects, obj))); err != nil {
+		return 0, err
+	}
+
+	result, err := s.db.Exec(
+		"INSERT INTO firewall_objects (name, type, description, entries) VALUES (?, ?, ?, ?)",
+		obj.Name, obj.Type, obj.Description, strings.Join(obj.Values, "\n"),
+	)
+	if err != nil {
+		if strings.Contains(err.Error(), "UNIQUE constraint failed") {
+			return 0, ErrObjectExists
+		}
+		return 0, fmt.Errorf("failed to create object: %w", err)
+	}
+
+	id, _ := result.LastInsertId()
+	return id, nil
+}
+
+// UpdateObject changes the description and values of an object and
+// re-renders every rule using it, directly or through a group. The name
+// and type cannot change. All affected rules are rendered before anything
+// is written, so an update that would break a rule is rejected as a whole.
+// It returns the number of rules re-applied.
+func (s *FirewallObjectService) UpdateObject(obj models.FirewallObject) (int, error) {
+	objects, err := s.LoadObjects()
+	if err != nil {
+		return 0, err
+	}
+
+	var old *models.FirewallObject
+	for i := range objects {
+		if objects[i].ID == obj.ID {
+			old = &objects[i]
+		}
+	}
+	if old == nil {
+		return 0, ErrObjectNotFound
+	}
+
+	obj.Name = old.Name
+	obj.Type = old.Type
+	obj.Values = normalizeObjectValues(obj.Type, obj.Values)
+	*old = obj
+
+	byName := objectsByName(objects)
+	if err := validateObject(obj, byName); err != nil {
+		return 0, err
+	}
+
+	rules, err := s.loadRules()
+	if err != nil {
+		return 0, err
+	}
+
+	type rendered struct {
+		rule   models.ObjectRule
+		inputs []models.FirewallRuleInput
+	}
+	var affected []rendered
+	for _, rule := range rules {
+		// Missing rules pick up the new values when they are re-applied
+		if rule.State == models.ObjectRuleMissing || !ruleReferences(rule.Input, obj.Name, byName) {
+			continue
+		}
+		inputs, err := renderObjectRule(rule, byName)
+		if err != nil {
+			return 0, fmt.Errorf("rule %d in %s %s: %w", rule.ID, rule.Input.Table, rule.Input.Chain, err)
+		}
+		affected = append(affected, rendered{rule, inputs})
+	}
+
+	if _, err := s.db.Exec(
+		"UPDATE firewall_objects SET description = ?, entries = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?",
+		obj.Description, strings.Join(obj.Values, "\n"), obj.ID,
+	); err != nil {
+		return 0, fmt.Errorf("failed to update object: %w", err)
+	}
+
+	for i, a := range affected {
+		if err := s.replaceRendered(a.rule, a.inputs); err != nil {
+			return i, err
+		}
+	}
+
+	return len(affected), nil
+}
+
+// DeleteObject removes an object that no rule or group references
+func (s *FirewallObjectService) DeleteObject(id int64) error {
+	obj, err := s.GetObject(id)
+	if err != nil {
+		return err
+	}
+	if len(obj.UsedBy) > 0 {
+		return fmt.Errorf("%w by %s", ErrObjectInUse, strings.Join(obj.UsedBy, ", "))
+	}
+
+	if _, err := s.db.Exec("DELETE FROM firewall_objects WHERE id = ?", id); err != nil {
+		return fmt.Errorf("failed to delete object: %w", err)
+	}
+	return nil
+}
+
+// GetRule returns an object rule. A deleted rule is returned with the
+// deleted state, so rules a rollback brought back can still be edited.
+func (s *FirewallObjectService) GetRule(id int64) (*models.ObjectRule, error) {
+	var rule models.ObjectRule
+	var input string
+	err := s.db.QueryRow(
+		"SELECT id, input, created_at FROM firewall_object_rules WHERE id = ?", id,
+	).Scan(&rule.ID, &input, &rule.CreatedAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		rule.State = models.ObjectRuleDeleted
+		err = s.db.QueryRow(
+			"SELECT id, input, created_at FROM firewall_object_rules_deleted WHERE id = ?", id,
+		).Scan(&rule.ID, &input, &rule.CreatedAt)
+	}
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("object rule %d not found", id)
+		}
+		return nil, fmt.Errorf("failed to get object rule: %w", err)
+	}
+
+	if err := json.Unmarshal([]byte(input), &rule.Input); err != nil {
+		return nil, fmt.Errorf("failed to decode object rule %d: %w", id, err)
+	}
+	return &rule, nil
+}
+
+// AddRule stores a rule referencing objects and adds its rendered rules at
+// input.Position, or at the end of the chain when it is 0
+func (s *FirewallObjectService) AddRule(input models.FirewallRuleInput) (int64, error) {
+	objects, err := s.LoadObjects()
+	if err != nil {
+		return 0, err
+	}
+
+	position := input.Position
+	input.Position = 0
+	rule := models.ObjectRule{Input: input}
+
+	// Render once up front so invalid rules are not stored
+	byName := objectsByName(objects)
+	if _, err := renderObjectRule(rule, byName); err != nil {
+		return 0, err
+	}
+
+	encoded, err := json.Marshal(input)
+	if err != nil {
+		return 0, fmt.Errorf("failed to encode object rule: %w", err)
+	}
+	result, err := s.db.Exec("INSERT INTO firewall_object_rules (input) VALUES (?)", string(encoded))
+	if err != nil {
+		return 0, fmt.Errorf("failed to store object rule: %w", err)
+	}
+	rule.ID, _ = result.LastInsertId()
+
+	inputs, err := renderObjectRule(rule, byName)
+	if err == nil {
+		err = s.addRendered(inputs, position)
+	}
+	if err != nil {
+		s.db.Exec("DELETE FROM firewall_object_rules WHERE id = ?", rule.ID)
+		return 0, err
+	}
+
+	return rule.ID, nil
+}
+
+// UpdateRule changes an object rule and re-renders it in place. The family,
+// table and chain of the rule cannot change. Editing a deleted rule whose
+// rendered rules are back in the firewall stores it again.
+func (s *FirewallObjectService) UpdateRule(id int64, input models.FirewallRuleInput) error {
+	old, err := s.GetRule(id)
+	if err != nil {
+		return err
+	}
+
+	objects, err := s.LoadObjects()
+	if err != nil {
+		return err
+	}
+
+	input.Family = old.Input.Family
+	input.Table = old.Input.Table
+	input.Chain = old.Input.Chain
+	input.Position = 0
+	rule := models.ObjectRule{ID: id, Input: input, CreatedAt: old.CreatedAt}
+
+	inputs, err := renderObjectRule(rule, objectsByName(objects))
+	if err != nil {
+		return err
+	}
+
+	encoded, err := json.Marshal(input)
+	if err != nil {
+		return fmt.Errorf("failed to encode object rule: %w", err)
+	}
+	if old.State == models.ObjectRuleDeleted {
+		if err := s.undeleteRule(id); err != nil {
+			return err
+		}
+	}
+	if _, err := s.db.Exec("UPDATE firewall_object_rules SET input = ? WHERE id = ?", string(encoded), id); err != nil {
+		return fmt.Errorf("failed to update object rule: %w", err)
+	}
+
+	return s.replaceRendered(rule, inputs)
+}
+
+// DeleteRule removes all rules rendered from an object rule. The rule
+// itself is kept as deleted, so a rollback that brings its rendered rules
+// back leaves them editable.
+func (s *FirewallObjectService) DeleteRule(id int64) error {
+	rule, err := s.GetRule(id)
+	if err != nil {
+		return err
+	}
+
+	if _, err := s.deleteRendered(*rule); err != nil {
+		return err
+	}
+
+	if rule.State == models.ObjectRuleDeleted {
+		return nil
+	}
+	return s.markDeleted(id)
+}
+
+// ReapplyRule renders an object rule with the current objects, replacing
+// its rendered rules in place or appending them to the chain when they are
+// missing
+func (s *FirewallObjectService) ReapplyRule(id int64) error {
+	rule, err := s.GetRule(id)
+	if err != nil {
+		return err
+	}
+	if rule.State == models.ObjectRuleDeleted {
+		return fmt.Errorf("object rule %d was deleted; restore it first", id)
+	}
+
+	objects, err := s.LoadObjects()
+	if err != nil {
+		return err
+	}
+	inputs, err := renderObjectRule(*rule, objectsByName(objects))
+	if err != nil {
+		return err
+	}
+	return s.replaceRendered(*rule, inputs)
+}
+
+// ForgetRule deletes an object rule none of whose rendered rules are in the
+// running firewall, without touching the firewall
+func (s *FirewallObjectService) ForgetRule(id int64) error {
+	rule, err := s.GetRule(id)
+	if err != nil {
+		return err
+	}
+	if rule.State == models.ObjectRuleDeleted {
+		return fmt.Errorf("object rule %d is already deleted", id)
+	}
+
+	present, err := s.isRendered(*rule)
+	if err != nil {
+		return err
+	}
+	if present {
+		return fmt.Errorf("object rule %d is still in the firewall; delete its rules instead", id)
+	}
+	return s.markDeleted(id)
+}
+
+// RestoreRule stores a deleted object rule again, e.g. after a rollback
+// brought its rendered rules back
+func (s *FirewallObjectService) RestoreRule(id int64) error {
+	rule, err := s.GetRule(id)
+	if err != nil {
+		return err
+	}
+	if rule.State != models.ObjectRuleDeleted {
+		return fmt.Errorf("object rule %d is not deleted", id)
+	}
+	return s.undeleteRule(id)
+}
+
+// markDeleted moves an object rule to the deleted rules
+func (s *FirewallObjectService) markDeleted(id int64) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to delete object rule: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(
+		`INSERT OR REPLACE INTO firewall_object_rules_deleted (id, input, created_at)
+		 SELECT id, input, created_at FROM firewall_object_rules WHERE id = ?`, id,
+	); err != nil {
+		return fmt.Errorf("failed to delete object rule: %w", err)
+	}
+	if _, err := tx.Exec("DELETE FROM firewall_object_rules WHERE id = ?", id); err != nil {
+		return fmt.Errorf("failed to delete object rule: %w", err)
+	}
+	return tx.Commit()
+}
+
+// undeleteRule moves a deleted object rule back to the stored rules
+func (s *FirewallObjectService) undeleteRule(id int64) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to restore object rule: %w", err)
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(
+		`INSERT INTO firewall_object_rules (id, input, created_at)
+		 SELECT id, input, created_at FROM firewall_object_rules_deleted WHERE id = ?`, id,
+	); err != nil {
+		return fmt.Errorf("failed to restore object rule: %w", err)
+	}
+	if _, err := tx.Exec("DELETE FROM firewall_object_rules_deleted WHERE id = ?", id); err != nil {
+		return fmt.Errorf("failed to restore object rule: %w", err)
+	}
+	return tx.Commit()
+}
+
+// ObjectRuleID returns the object rule a listed rule was rendered from
+func ObjectRuleID(comment string) (int64, bool) {
+	rest, found := strings.CutPrefix(ruleComment(comment), objectRuleTag)
+	if !found {
+		return 0, false
+	}
+
+	tag, _, _ := strings.Cut(rest, " ")
+	id, err := strconv.ParseInt(tag, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return id, true
+}
+
+// LoadObjects returns all objects ordered by name, without UsedBy
+func (s *FirewallObjectService) LoadObjects() ([]models.FirewallObject, error) {
+	rows, err := s.db.Query(
+		"SELECT id, name, type, description, entries, created_at, updated_at FROM firewall_objects ORDER BY name",
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list objects: %w", err)
+	}
+	defer rows.Close()
+
+	var objects []models.FirewallObject
+	for rows.Next() {
+		var obj models.FirewallObject
+		var entries string
+		if err := rows.Scan(&obj.ID, &obj.Name, &obj.Type, &obj.Description, &entries, &obj.CreatedAt, &obj.UpdatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan object: %w", err)
+		}
+		obj.Values = normalizeObjectValues(obj.Type, strings.Split(entries, "\n"))
+		objects = append(objects, obj)
+	}
+
+	return objects, rows.Err()
+}
+
+// loadRules reads the stored object rules and compares them with the
+// running firewall. Rules none of whose rendered rules are in their chain
+// are marked missing, and deleted rules whose rendered rules are in it are
+// included and marked deleted. Nothing is changed here: ReapplyRule,
+// ForgetRule and RestoreRule reconcile on request.
+func (s *FirewallObjectService) loadRules() ([]models.ObjectRule, error) {
+	stored, err := s.queryRules("SELECT id, input, created_at FROM firewall_object_rules ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+	deleted, err := s.queryRules("SELECT id, input, created_at FROM firewall_object_rules_deleted ORDER BY id")
+	if err != nil {
+		return nil, err
+	}
+
+	// Read each chain once
+	type chainKey struct {
+		family       models.IPFamily
+		table, chain string
+	}
+	present := make(map[chainKey]map[int64]bool)
+	rendered := func(rule models.ObjectRule) (bool, bool) {
+		key := chainKey{rule.Input.Family, rule.Input.Table, rule.Input.Chain}
+		ids, ok := present[key]
+		if !ok {
+			ids = s.chainRuleIDs(key.family, key.table, key.chain)
+			present[key] = ids
+		}
+		// Without the chain we cannot tell
+		if ids == nil {
+			return false, false
+		}
+		return ids[rule.ID], true
+	}
+
+	rules := make([]models.ObjectRule, 0, len(stored))
+	for _, rule := range stored {
+		if found, known := rendered(rule); known && !found {
+			rule.State = models.ObjectRuleMissing
+		}
+		rules = append(rules, rule)
+	}
+	for _, rule := range deleted {
+		if found, _ := rendered(rule); found {
+			rule.State = models.ObjectRuleDeleted
+			rules = append(rules, rule)
+		}
+	}
+	sort.Slice(rules, func(i, j int) bool { return rules[i].ID < rules[j].ID })
+
+	return rules, nil
+}
+
+// queryRules reads object rules from the stored or deleted rules
+func (s *FirewallObjectService) queryRules(query string) ([]models.ObjectRule, error) {
+	rows, err := s.db.Query(query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list object rules: %w", err)
+	}
+	defer rows.Close()
+
+	var rules []models.ObjectRule
+	for rows.Next() {
+		var rule models.ObjectRule
+		var input string
+		if err := rows.Scan(&rule.ID, &input, &rule.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan object rule: %w", err)
+		}
+		if err := json.Unmarshal([]byte(input), &rule.Input); err != nil {
+			return nil, fmt.Errorf("failed to decode object rule %d: %w", rule.ID, err)
+		}
+		rules = append(rules, rule)
+	}
+
+	return rules, rows.Err()
+}
+
+// chainRuleIDs returns the object rules with rendered rules in a chain, or
+// nil when the chain cannot be read
+func (s *FirewallObjectService) chainRuleIDs(family models.IPFamily, table, chain string) map[int64]bool {
+	info, err := s.firewall.GetChain(family, table, chain)
+	if err != nil {
+		return nil
+	}
+	ids := make(map[int64]bool)
+	for _, r := range info.Rules {
+		if id, ok := ObjectRuleID(r.Comment); ok {
+			ids[id] = true
+		}
+	}
+	return ids
+}
+
+// isRendered reports whether any rule rendered from an object rule is in
+// the running firewall
+func (s *FirewallObjectService) isRendered(rule models.ObjectRule) (bool, error) {
+	ids := s.chainRuleIDs(rule.Input.Family, rule.Input.Table, rule.Input.Chain)
+	if ids == nil {
+		return false, fmt.Errorf("failed to read %s %s", rule.Input.Table, rule.Input.Chain)
+	}
+	return ids[rule.ID], nil
+}
+
+// addRendered adds rendered rules starting at position, or appends them
+// when position is 0, removing the ones already added if one fails
+func (s *FirewallObjectService) addRendered(inputs []models.FirewallRuleInput, position int) error {
+	for i, input := range inputs {
+		if position > 0 {
+			input.Position = position + i
+		}
+		if err := s.firewall.AddRule(input); err != nil {
+			if id, ok := ObjectRuleID(input.Comment); ok {
+				s.deleteRendered(models.ObjectRule{ID: id, Input: input})
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// replaceRendered swaps the rendered rules of an object rule for new ones
+// at the position of the first old one
+func (s *FirewallObjectService) replaceRendered(rule models.ObjectRule, inputs []models.FirewallRuleInput) error {
+	position, err := s.deleteRendered(rule)
+	if err != nil {
+		return err
+	}
+	return s.addRendered(inputs, position)
+}
+
+// deleteRendered removes the rules rendered from an object rule, from the
+// bottom of the chain up so the numbers of the remaining ones do not
+// shift, and returns the position of the first one (0 if there were none)
+func (s *FirewallObjectService) deleteRendered(rule models.ObjectRule) (int, error) {
+	info, err := s.firewall.GetChain(rule.Input.Family, rule.Input.Table, rule.Input.Chain)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read %s %s: %w", rule.Input.Table, rule.Input.Chain, err)
+	}
+
+	position := 0
+	for i := len(info.Rules) - 1; i >= 0; i-- {
+		id, ok := ObjectRuleID(info.Rules[i].Comment)
+		if !ok || id != rule.ID {
+			continue
+		}
+		if err := s.firewall.DeleteRule(rule.Input.Family, rule.Input.Table, rule.Input.Chain, info.Rules[i].Num); err != nil {
+			return 0, err
+		}
+		position = info.Rules[i].Num
+	}
+
+	return position, nil
+}
+
+// renderObjectRule expands the objects of a rule into plain rules, one per
+// combination of source, destination and protocol
+func renderObjectRule(rule models.ObjectRule, byName map[string]*models.FirewallObject) ([]models.FirewallRuleInput, error) {
+	input := rule.Input
+	if !input.UsesObjects() {
+		return nil, fmt.Errorf("rule does not reference any object")
+	}
+	if input.SourceObject != "" && input.Source != "" {
+		return nil, fmt.Errorf("use either a source address or a source object")
+	}
+	if input.DestinationObject != "" && input.Destination != "" {
+		return nil, fmt.Errorf("use either a destination address or a destination object")
+	}
+	if input.ServiceObject != "" && (input.Protocol != "" && input.Protocol != "all" || input.DPort != "") {
+		return nil, fmt.Errorf("use either a protocol and port or a service object")
+	}
+	if strings.ContainsAny(input.Comment, "\"\n") {
+		return nil, fmt.Errorf("comment must not contain quotes or line breaks")
+	}
+
+	sources := []string{input.Source}
+	if input.SourceObject != "" {
+		addrs, err := objectAddresses(input.SourceObject, input.Family, byName)
+		if err != nil {
+			return nil, fmt.Errorf("source: %w", err)
+		}
+		sources = addrs
+	}
+
+	destinations := []string{input.Destination}
+	if input.DestinationObject != "" {
+		addrs, err := objectAddresses(input.DestinationObject, input.Family, byName)
+		if err != nil {
+			return nil, fmt.Errorf("destination: %w", err)
+		}
+		destinations = addrs
+	}
+
+	services := []objectService{{protocol: input.Protocol, ports: input.DPort}}
+	if input.ServiceObject != "" {
+		svc, err := objectServices(input.ServiceObject, input.Family, byName)
+		if err != nil {
+			return nil, fmt.Errorf("service: %w", err)
+		}
+		services = svc
+	}
+
+	if n := len(sources) * len(destinations) * len(services); n > maxObjectRuleExpansion {
+		return nil, fmt.Errorf("rule would expand into %d rules, the limit is %d", n, maxObjectRuleExpansion)
+	}
+
+	comment := objectRuleTag + strconv.FormatInt(rule.ID, 10)
+	if input.Comment != "" {
+		comment += " " + input.Comment
+	}
+
+	var inputs []models.FirewallRuleInput
+	for _, src := range sources {
+		for _, dst := range destinations {
+			for _, svc := range services {
+				out := input
+				out.Position = 0
+				out.Source = src
+				out.Destination = dst
+				out.Protocol = svc.protocol
+				out.DPort = svc.ports
+				out.Comment = comment
+				out.SourceObject = ""
+				out.DestinationObject = ""
+				out.ServiceObject = ""
+				if _, err := ruleSpecFromInput(out); err != nil {
+					return nil, err
+				}
+				inputs = append(inputs, out)
+			}
+		}
+	}
+
+	return inputs, nil
+}
+
+// objectService is one protocol of a service object with its ports
+type objectService struct {
+	protocol string
+	ports    string
+}
+
+// objectAddresses resolves an address object or group into the addresses
+// of the given family
+func objectAddresses(name string, family models.IPFamily, byName map[string]*models.FirewallObject) ([]string, error) {
+	obj, ok := byName[name]
+	if !ok {
+		return nil, fmt.Errorf("object %s does not exist", name)
+	}
+	if obj.Type != models.ObjectTypeAddress && obj.Type != models.ObjectTypeGroup {
+		return nil, fmt.Errorf("object %s is not an address object or group", name)
+	}
+
+	all, err := expandAddresses(name, byName, map[string]bool{})
+	if err != nil {
+		return nil, err
+	}
+
+	var addrs []string
+	seen := make(map[string]bool)
+	for _, addr := range all {
+		if seen[addr] || validateAddressFamily(family, addr) != nil {
+			continue
+		}
+		seen[addr] = true
+		addrs = append(addrs, addr)
+	}
+
+	if len(addrs) == 0 {
+		label := "IPv4"
+		if family == models.FamilyIPv6 {
+			label = "IPv6"
+		}
+		return nil, fmt.Errorf("object %s has no %s addresses", name, label)
+	}
+	return addrs, nil
+}
+
+// expandAddresses flattens an address object or group, following nested
+// groups and rejecting cycles
+func expandAddresses(name string, byName map[string]*models.FirewallObject, visiting map[string]bool) ([]string, error) {
+	obj, ok := byName[name]
+	if !ok {
+		return nil, fmt.Errorf("object %s does not exist", name)
+	}
+
+	switch obj.Type {
+	case models.ObjectTypeAddress:
+		return obj.Values, nil
+	case models.ObjectTypeGroup:
+		if visiting[name] {
+			return nil, fmt.Errorf("group %s contains itself", name)
+		}
+		visiting[name] = true
+		defer delete(visiting, name)
+
+		var addrs []string
+		for _, member := range obj.Values {
+			memberAddrs, err := expandAddresses(member, byName, visiting)
+			if err != nil {
+				return nil, err
+			}
+			addrs = append(addrs, memberAddrs...)
+		}
+		return addrs, nil
+	default:
+		return nil, fmt.Errorf("object %s is not an address object or group", name)
+	}
+}
+
+// objectServices resolves a service object into one entry per protocol.
+// ICMP entries of the other address family are skipped.
+func objectServices(name string, family models.IPFamily, byName map[string]*models.FirewallObject) ([]objectService, error) {
+	obj, ok := byName[name]
+	if !ok {
+		return nil, fmt.Errorf("object %s does not exist", name)
+	}
+	if obj.Type != models.ObjectTypeService {
+		return nil, fmt.Errorf("object %s is not a service object", name)
+	}
+
+	var services []objectService
+	for _, value := range obj.Values {
+		svc, err := parseServiceEntry(value)
+		if err != nil {
+			return nil, err
+		}
+		if svc.protocol == "icmp" && family == models.FamilyIPv6 || svc.protocol == "ipv6-icmp" && family != models.FamilyIPv6 {
+			continue
+		}
+		services = append(services, svc)
+	}
+
+	if len(services) == 0 {
+		return nil, fmt.Errorf("service %s has no entries for this address family", name)
+	}
+	return services, nil
+}
+
+// parseServiceEntry parses a service entry such as "tcp/80,443",
+// "udp/5000-5010" or "icmp". "icmpv6" is stored as "ipv6-icmp", the name
+// both backends know.
+func parseServiceEntry(entry string) (objectService, error) {
+	protocol, ports, hasPorts := strings.Cut(entry, "/")
+	protocol = strings.ToLower(strings.TrimSpace(protocol))
+	if protocol == "icmpv6" {
+		protocol = "ipv6-icmp"
+	}
+
+	switch protocol {
+	case "tcp", "udp", "sctp":
+	case "icmp", "ipv6-icmp":
+		if hasPorts {
+			return objectService{}, fmt.Errorf("%s does not have ports", protocol)
+		}
+	default:
+		return objectService{}, fmt.Errorf("unsupported service protocol %q", protocol)
+	}
+
+	ports, err := normalizePorts(ports)
+	if err != nil {
+		return objectService{}, fmt.Errorf("invalid service entry %q: %w", entry, err)
+	}
+	if hasPorts && ports == "" {
+		return objectService{}, fmt.Errorf("invalid service entry %q: missing ports", entry)
+	}
+
+	return objectService{protocol: protocol, ports: ports}, nil
+}
+
+// validateObject checks an object's name, type and values. byName must
+// contain the object itself so that group cycles are detected.
+func validateObject(obj models.FirewallObject, byName map[string]*models.FirewallObject) error {
+	if !objectNamePattern.MatchString(obj.Name) {
+		return fmt.Errorf("invalid object name %q: use letters, digits, '.', '_' and '-'", obj.Name)
+	}
+	if strings.ContainsAny(obj.Description, "\n") {
+		return fmt.Errorf("description must not contain line breaks")
+	}
+	if len(obj.Values) == 0 {
+		return fmt.Errorf("object must have at least one entry")
+	}
+
+	switch obj.Type {
+	case models.ObjectTypeAddress:
+		for _, value := range obj.Values {
+			if net.ParseIP(value) != nil {
+				continue
+			}
+			if _, _, err := net.ParseCIDR(value); err != nil {
+				return fmt.Errorf("%q is not an address or network", value)
+			}
+		}
+	case models.ObjectTypeGroup:
+		for _, member := range obj.Values {
+			if member == obj.Name {
+				return fmt.Errorf("group %s cannot contain itself", obj.Name)
+			}
+		}
+		if _, err := expandAddresses(obj.Name, byName, map[string]bool{}); err != nil {
+			return err
+		}
+	case models.ObjectTypeService:
+		for _, value := range obj.Values {
+			if _, err := parseServiceEntry(value); err != nil {
+				return err
+			}
+		}
+	default:
+		return fmt.Errorf("invalid object type %q", obj.Type)
+	}
+
+	return nil
+}
+
+// normalizeObjectValues trims the values and drops empty and duplicate ones
+func normalizeObjectValues(objType string, values []string) []string {
+	var result []string
+	seen := make(map[string]bool)
+	for _, value := range values {
+		value = strings.TrimSpace(value)
+		if objType == models.ObjectTypeService {
+			value = strings.ToLower(strings.ReplaceAll(value, " ", ""))
+		}
+		if value == "" || seen[value] {
+			continue
+		}
+		seen[value] = true
+		result = append(result, value)
+	}
+	return result
+}
+
+func objectsByName(objects []models.FirewallObject) map[string]*models.FirewallObject {
+	byName := make(map[string]*models.FirewallObject, len(objects))
+	for i := range objects {
+		byName[objects[i].Name] = &objects[i]
+	}
+	return byName
+}
+
+// ruleReferences reports whether a rule uses the named object, directly or
+// through a group
+func ruleReferences(input models.FirewallRuleInput, name string, byName map[string]*models.FirewallObject) bool {
+	if input.ServiceObject == name {
+		return true
+	}
+	for _, ref := range []string{input.SourceObject, input.DestinationObject} {
+		if ref != "" && groupContains(ref, name, byName, map[string]bool{}) {
+			return true
+		}
+	}
+	return false
+}
+
+// groupContains reports whether ref is name or a group containing it
+func groupContains(ref, name string, byName map[string]*models.FirewallObject, visiting map[string]bool) bool {
+	if ref == name {
+		return true
+	}
+	obj, ok := byName[ref]
+	if !ok || obj.Type != models.ObjectTypeGroup || visiting[ref] {
+		return false
+	}
+	visiting[ref] = true
+	for _, member := range obj.Values {
+		if groupContains(member, name, byName, visiting) {
+			return true
+		}
+	}
+	return false
+}
+
+// objectUsage describes the groups and rules that reference an object
+// directly
+func objectUsage(name string, objects []models.FirewallObject, byName map[string]*models.FirewallObject, rules []models.ObjectRule) []string {
+	var usage []string
+	for _, obj := range objects {
+		if obj.Type != models.ObjectTypeGroup {
+			continue
+		}
+		for _, member := range obj.Values {
+			if member == name {
+				usage = append(usage, "group "+obj.Name)
+				break
+			}
+		}
+	}
+	sort.Strings(usage)
+
+	for _, rule := range rules {
+		in := rule.Input
+		if in.SourceObject != name && in.DestinationObject != name && in.ServiceObject != name {
+			continue
+		}
+		desc := fmt.Sprintf("rule %d (%s %s %s -j %s)", rule.ID, in.Family, in.Table, in.Chain, in.Target)
+		if in.Comment != "" {
+			desc += " " + in.Comment
+		}
+		switch rule.State {
+		case models.ObjectRuleMissing:
+			desc += " [not in the firewall]"
+		case models.ObjectRuleDeleted:
+			desc += " [deleted, back in the firewall]"
+		}
+		usage = append(usage, desc)
+	}
+
+	return usage
+}
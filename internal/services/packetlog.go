@@ -0,0 +1,636 @@
+package services
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"linuxtorouter/internal/database"
+	"linuxtorouter/internal/models"
+
+	"github.com/mdlayher/netlink"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// packetLogRingSize is the number of packets kept in memory
+	packetLogRingSize = 1000
+	// packetLogRetention is the number of packets kept in SQLite
+	packetLogRetention = 100000
+	// packetLogFlushInterval is how often new packets are written to SQLite
+	packetLogFlushInterval = 2 * time.Second
+	// packetLogMaxPending is the number of packets kept for the next flush
+	// while writing to SQLite fails; beyond it the oldest are dropped
+	packetLogMaxPending = 10000
+	// packetLogRetryInterval is the delay before reconnecting after an error
+	packetLogRetryInterval = 30 * time.Second
+	// packetLogCopyRange is the number of packet bytes copied to userspace,
+	// enough for the IP and transport headers
+	packetLogCopyRange = 128
+)
+
+// nfnetlink_log message types, attributes and commands from
+// linux/netfilter/nfnetlink_log.h
+const (
+	nfnlSubsysULOG = 4
+
+	nfulnlMsgPacket = 0
+	nfulnlMsgConfig = 1
+
+	nfulaPrefix     = 10
+	nfulaIfindexIn  = 4
+	nfulaIfindexOut = 5
+	nfulaTimestamp  = 3
+	nfulaPayload    = 9
+
+	nfulaCfgCmd  = 1
+	nfulaCfgMode = 2
+
+	nfulnlCfgCmdBind   = 1
+	nfulnlCopyPacket   = 2
+	nfnetlinkVersion0  = 0
+	nfulnlMaxPrefixLen = 64
+	logTargetPrefixLen = 29
+)
+
+// validateLogOptions checks the LOG and NFLOG options of a rule input
+func validateLogOptions(input models.FirewallRuleInput) error {
+	if input.Target != "LOG" && input.Target != "NFLOG" {
+		if input.LogPrefix != "" || input.LogLevel != "" || input.NFLogGroup != "" {
+			return fmt.Errorf("log options require a LOG or NFLOG target")
+		}
+		return nil
+	}
+
+	maxPrefix := logTargetPrefixLen
+	if input.Target == "NFLOG" {
+		maxPrefix = nfulnlMaxPrefixLen
+	}
+	if len(input.LogPrefix) > maxPrefix {
+		return fmt.Errorf("log prefix is longer than %d characters", maxPrefix)
+	}
+	if strings.ContainsAny(input.LogPrefix, "\"\n\r") {
+		return fmt.Errorf("log prefix must not contain quotes or line breaks")
+	}
+
+	if input.LogLevel != "" {
+		if input.Target != "LOG" {
+			return fmt.Errorf("log level only applies to the LOG target")
+		}
+		if logLevelIndex(input.LogLevel) < 0 {
+			return fmt.Errorf("invalid log level: %s", input.LogLevel)
+		}
+	}
+
+	if input.NFLogGroup != "" {
+		if input.Target != "NFLOG" {
+			return fmt.Errorf("NFLOG group only applies to the NFLOG target")
+		}
+		if _, err := strconv.ParseUint(input.NFLogGroup, 10, 16); err != nil {
+			return fmt.Errorf("invalid NFLOG group: %s", input.NFLogGroup)
+		}
+	}
+
+	return nil
+}
+
+// logLevelIndex returns the syslog priority of a level name or number, or
+// -1 if it is not valid
+func logLevelIndex(level string) int {
+	if n, err := strconv.Atoi(level); err == nil {
+		if n >= 0 && n < len(models.LogLevels) {
+			return n
+		}
+		return -1
+	}
+	for i, name := range models.LogLevels {
+		if strings.EqualFold(level, name) {
+			return i
+		}
+	}
+	return -1
+}
+
+// logLevelName converts a numeric level as written by iptables-save to its
+// name
+func logLevelName(level string) string {
+	if i := logLevelIndex(level); i >= 0 {
+		return models.LogLevels[i]
+	}
+	return level
+}
+
+// PacketLogService collects packets sent to an NFLOG group. The most
+// recent packets are kept in a ring buffer for the live view and all of
+// them are written to SQLite, which keeps the last packetLogRetention.
+type PacketLogService struct {
+	db    *database.DB
+	group int
+
+	mu      sync.Mutex
+	ring    []models.PacketLogEntry
+	next    int
+	pending []models.PacketLogEntry
+	// clears counts Clear calls, so a failed flush does not bring back
+	// packets cleared meanwhile
+	clears  int
+	running bool
+	lastErr error
+
+	ifnames map[uint32]string
+}
+
+func NewPacketLogService(db *database.DB, group int) *PacketLogService {
+	return &PacketLogService{
+		db:      db,
+		group:   group,
+		ring:    make([]models.PacketLogEntry, 0, packetLogRingSize),
+		ifnames: make(map[uint32]string),
+	}
+}
+
+// Group returns the NFLOG group the collector listens on
+func (s *PacketLogService) Group() int {
+	return s.group
+}
+
+// Status reports whether the collector is receiving and the last error
+func (s *PacketLogService) Status() (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.running, s.lastErr
+}
+
+// Start loads the most recent packets from SQLite and starts collecting
+func (s *PacketLogService) Start() {
+	if err := s.loadRecent(); err != nil {
+		log.Printf("Warning: Failed to load packet log: %v", err)
+	}
+	go s.collect()
+	go s.flushLoop()
+}
+
+func (s *PacketLogService) loadRecent() error {
+	rows, err := s.db.Query(`SELECT id, logged_at, nflog_group, prefix, family, in_interface, out_interface,
+		protocol, source, destination, sport, dport, length
+		FROM packet_log ORDER BY id DESC LIMIT ?`, packetLogRingSize)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var entries []models.PacketLogEntry
+	for rows.Next() {
+		e, err := scanPacketLogEntry(rows)
+		if err != nil {
+			return err
+		}
+		entries = append(entries, e)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i := len(entries) - 1; i >= 0; i-- {
+		s.push(entries[i])
+	}
+	return nil
+}
+
+// push adds an entry to the ring buffer; the caller holds the lock
+func (s *PacketLogService) push(e models.PacketLogEntry) {
+	if len(s.ring) < packetLogRingSize {
+		s.ring = append(s.ring, e)
+		return
+	}
+	s.ring[s.next] = e
+	s.next = (s.next + 1) % packetLogRingSize
+}
+
+// collect receives packets, reconnecting after errors
+func (s *PacketLogService) collect() {
+	for {
+		err := s.receive()
+
+		s.mu.Lock()
+		s.running = false
+		changed := s.lastErr == nil || s.lastErr.Error() != err.Error()
+		s.lastErr = err
+		s.mu.Unlock()
+
+		if changed {
+			log.Printf("Packet log collector stopped: %v", err)
+		}
+		time.Sleep(packetLogRetryInterval)
+	}
+}
+
+// receive binds to the NFLOG group and handles packets until an error
+func (s *PacketLogService) receive() error {
+	conn, err := netlink.Dial(unix.NETLINK_NETFILTER, nil)
+	if err != nil {
+		return fmt.Errorf("failed to open netlink socket: %w", err)
+	}
+	defer conn.Close()
+
+	cmd, err := netlink.MarshalAttributes([]netlink.Attribute{
+		{Type: nfulaCfgCmd, Data: []byte{nfulnlCfgCmdBind}},
+	})
+	if err != nil {
+		return err
+	}
+	if err := s.configure(conn, cmd); err != nil {
+		return fmt.Errorf("failed to bind NFLOG group %d: %w", s.group, err)
+	}
+
+	mode := make([]byte, 6)
+	binary.BigEndian.PutUint32(mode, packetLogCopyRange)
+	mode[4] = nfulnlCopyPacket
+	modeAttrs, err := netlink.MarshalAttributes([]netlink.Attribute{
+		{Type: nfulaCfgMode, Data: mode},
+	})
+	if err != nil {
+		return err
+	}
+	if err := s.configure(conn, modeAttrs); err != nil {
+		return fmt.Errorf("failed to set NFLOG copy mode: %w", err)
+	}
+
+	s.mu.Lock()
+	s.running, s.lastErr = true, nil
+	s.mu.Unlock()
+	log.Printf("Packet log collector listening on NFLOG group %d", s.group)
+
+	for {
+		msgs, err := conn.Receive()
+		if err != nil {
+			return fmt.Errorf("failed to receive packets: %w", err)
+		}
+		for _, msg := range msgs {
+			if msg.Header.Type != netlink.HeaderType(nfnlSubsysULOG<<8|nfulnlMsgPacket) || len(msg.Data) < 4 {
+				continue
+			}
+			if entry, ok := s.parsePacket(msg.Data); ok {
+				s.mu.Lock()
+				s.push(entry)
+				s.pending = append(s.pending, entry)
+				s.mu.Unlock()
+			}
+		}
+	}
+}
+
+// configure sends an NFULNL_MSG_CONFIG message for the group
+func (s *PacketLogService) configure(conn *netlink.Conn, attrs []byte) error {
+	data := make([]byte, 4, 4+len(attrs))
+	data[0] = unix.AF_UNSPEC
+	data[1] = nfnetlinkVersion0
+	binary.BigEndian.PutUint16(data[2:], uint16(s.group))
+	data = append(data, attrs...)
+
+	_, err := conn.Execute(netlink.Message{
+		Header: netlink.Header{
+			Type:  netlink.HeaderType(nfnlSubsysULOG<<8 | nfulnlMsgConfig),
+			Flags: netlink.Request | netlink.Acknowledge,
+		},
+		Data: data,
+	})
+	return err
+}
+
+// parsePacket decodes an NFULNL_MSG_PACKET message
+func (s *PacketLogService) parsePacket(data []byte) (models.PacketLogEntry, bool) {
+	entry := models.PacketLogEntry{
+		Time:  time.Now(),
+		Group: int(binary.BigEndian.Uint16(data[2:4])),
+	}
+
+	ad, err := netlink.NewAttributeDecoder(data[4:])
+	if err != nil {
+		return entry, false
+	}
+	ad.ByteOrder = binary.BigEndian
+
+	var payload []byte
+	for ad.Next() {
+		b := ad.Bytes()
+		switch ad.Type() {
+		case nfulaPrefix:
+			entry.Prefix = strings.TrimRight(string(b), "\x00")
+		case nfulaIfindexIn:
+			if len(b) == 4 {
+				entry.InInterface = s.ifname(binary.BigEndian.Uint32(b))
+			}
+		case nfulaIfindexOut:
+			if len(b) == 4 {
+				entry.OutInterface = s.ifname(binary.BigEndian.Uint32(b))
+			}
+		case nfulaTimestamp:
+			if len(b) == 16 {
+				sec := binary.BigEndian.Uint64(b[0:8])
+				usec := binary.BigEndian.Uint64(b[8:16])
+				entry.Time = time.Unix(int64(sec), int64(usec)*1000)
+			}
+		case nfulaPayload:
+			payload = b
+		}
+	}
+	if ad.Err() != nil {
+		return entry, false
+	}
+
+	return entry, parsePacketHeaders(payload, data[0], &entry)
+}
+
+// ifname resolves an interface index, caching the result
+func (s *PacketLogService) ifname(index uint32) string {
+	s.mu.Lock()
+	name, ok := s.ifnames[index]
+	s.mu.Unlock()
+	if ok {
+		return name
+	}
+
+	name = strconv.Itoa(int(index))
+	if iface, err := net.InterfaceByIndex(int(index)); err == nil {
+		name = iface.Name
+	}
+	s.mu.Lock()
+	s.ifnames[index] = name
+	s.mu.Unlock()
+	return name
+}
+
+// parsePacketHeaders fills the addresses, protocol and ports of an entry
+// from the copied IPv4 or IPv6 packet
+func parsePacketHeaders(b []byte, family byte, e *models.PacketLogEntry) bool {
+	var proto byte
+	var l4 []byte
+
+	switch family {
+	case unix.AF_INET:
+		if len(b) < 20 {
+			return false
+		}
+		ihl := int(b[0]&0x0f) * 4
+		e.Family = models.FamilyIPv4
+		e.Length = int(binary.BigEndian.Uint16(b[2:4]))
+		e.Source = net.IP(b[12:16]).String()
+		e.Destination = net.IP(b[16:20]).String()
+		proto = b[9]
+		// Only the first fragment carries the transport header
+		if binary.BigEndian.Uint16(b[6:8])&0x1fff == 0 && len(b) >= ihl {
+			l4 = b[ihl:]
+		}
+	case unix.AF_INET6:
+		if len(b) < 40 {
+			return false
+		}
+		e.Family = models.FamilyIPv6
+		e.Length = int(binary.BigEndian.Uint16(b[4:6])) + 40
+		e.Source = net.IP(b[8:24]).String()
+		e.Destination = net.IP(b[24:40]).String()
+		proto = b[6]
+		l4 = b[40:]
+		// Skip hop-by-hop, routing and destination options headers
+		for (proto == 0 || proto == 43 || proto == 60) && len(l4) >= 8 {
+			next, size := l4[0], (int(l4[1])+1)*8
+			if len(l4) < size {
+				l4 = nil
+				break
+			}
+			proto, l4 = next, l4[size:]
+		}
+		if proto == 44 {
+			l4 = nil
+		}
+	default:
+		return false
+	}
+
+	e.Protocol = strconv.Itoa(int(proto))
+	if name, ok := conntrackProtocols[proto]; ok {
+		e.Protocol = name
+	}
+	if (proto == 6 || proto == 17 || proto == 132 || proto == 136) && len(l4) >= 4 {
+		e.SPort = binary.BigEndian.Uint16(l4[0:2])
+		e.DPort = binary.BigEndian.Uint16(l4[2:4])
+	}
+	return true
+}
+
+// flushLoop periodically writes new packets to SQLite
+func (s *PacketLogService) flushLoop() {
+	ticker := time.NewTicker(packetLogFlushInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if err := s.flush(); err != nil {
+			log.Printf("Failed to store packet log: %v", err)
+		}
+	}
+}
+
+// flush writes the pending packets to SQLite. If that fails they are put
+// back in front of the packets received meanwhile and retried on the next
+// tick.
+func (s *PacketLogService) flush() error {
+	s.mu.Lock()
+	pending := s.pending
+	clears := s.clears
+	s.pending = nil
+	s.mu.Unlock()
+	if len(pending) == 0 {
+		return nil
+	}
+
+	err := s.store(pending)
+	if err != nil {
+		s.mu.Lock()
+		if s.clears == clears {
+			s.pending = append(pending, s.pending...)
+			if excess := len(s.pending) - packetLogMaxPending; excess > 0 {
+				s.pending = s.pending[excess:]
+				err = fmt.Errorf("%w (dropped %d unsaved packets)", err, excess)
+			}
+		}
+		s.mu.Unlock()
+	}
+	return err
+}
+
+// store inserts packets and trims the table to packetLogRetention rows
+func (s *PacketLogService) store(pending []models.PacketLogEntry) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare(`INSERT INTO packet_log (logged_at, nflog_group, prefix, family, in_interface,
+		out_interface, protocol, source, destination, sport, dport, length)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`)
+	if err != nil {
+		return err
+	}
+	defer stmt.Close()
+
+	for _, e := range pending {
+		if _, err := stmt.Exec(e.Time, e.Group, e.Prefix, e.Family, e.InInterface, e.OutInterface,
+			e.Protocol, e.Source, e.Destination, e.SPort, e.DPort, e.Length); err != nil {
+			return err
+		}
+	}
+
+	if _, err := tx.Exec(`DELETE FROM packet_log WHERE id <= (SELECT MAX(id) FROM packet_log) - ?`, packetLogRetention); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Recent returns up to limit packets from the ring buffer that match the
+// filter, newest first
+func (s *PacketLogService) Recent(filter models.PacketLogFilter, limit int) ([]models.PacketLogEntry, error) {
+	match, err := packetLogMatcher(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var result []models.PacketLogEntry
+	for i := 0; i < len(s.ring) && len(result) < limit; i++ {
+		// The newest entry is just before next once the ring is full
+		e := s.ring[(s.next-1-i+2*len(s.ring))%len(s.ring)]
+		if match(e) {
+			result = append(result, e)
+		}
+	}
+	return result, nil
+}
+
+// Search returns up to limit stored packets that match the filter, newest
+// first
+func (s *PacketLogService) Search(filter models.PacketLogFilter, limit int) ([]models.PacketLogEntry, error) {
+	match, err := packetLogMatcher(filter)
+	if err != nil {
+		return nil, err
+	}
+
+	query := `SELECT id, logged_at, nflog_group, prefix, family, in_interface, out_interface,
+		protocol, source, destination, sport, dport, length FROM packet_log`
+	var where []string
+	var args []interface{}
+	if filter.Prefix != "" {
+		where = append(where, "prefix LIKE ?")
+		args = append(args, "%"+filter.Prefix+"%")
+	}
+	if filter.Port != "" {
+		where = append(where, "(sport = ? OR dport = ?)")
+		args = append(args, filter.Port, filter.Port)
+	}
+	if len(where) > 0 {
+		query += " WHERE " + strings.Join(where, " AND ")
+	}
+	query += " ORDER BY id DESC"
+
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to search packet log: %w", err)
+	}
+	defer rows.Close()
+
+	var result []models.PacketLogEntry
+	for rows.Next() && len(result) < limit {
+		e, err := scanPacketLogEntry(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to search packet log: %w", err)
+		}
+		if match(e) {
+			result = append(result, e)
+		}
+	}
+	return result, rows.Err()
+}
+
+// Clear removes all logged packets
+func (s *PacketLogService) Clear() error {
+	s.mu.Lock()
+	s.ring = s.ring[:0]
+	s.next = 0
+	s.pending = nil
+	s.clears++
+	s.mu.Unlock()
+
+	if _, err := s.db.Exec(`DELETE FROM packet_log`); err != nil {
+		return fmt.Errorf("failed to clear packet log: %w", err)
+	}
+	return nil
+}
+
+// packetLogRow is implemented by *sql.Rows
+type packetLogRow interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanPacketLogEntry(row packetLogRow) (models.PacketLogEntry, error) {
+	var e models.PacketLogEntry
+	err := row.Scan(&e.ID, &e.Time, &e.Group, &e.Prefix, &e.Family, &e.InInterface, &e.OutInterface,
+		&e.Protocol, &e.Source, &e.Destination, &e.SPort, &e.DPort, &e.Length)
+	return e, err
+}
+
+// packetLogMatcher compiles a filter into a match function
+func packetLogMatcher(filter models.PacketLogFilter) (func(models.PacketLogEntry) bool, error) {
+	var network *net.IPNet
+	if filter.Address != "" {
+		addr := filter.Address
+		if !strings.Contains(addr, "/") {
+			if ip := net.ParseIP(addr); ip != nil && ip.To4() == nil {
+				addr += "/128"
+			} else {
+				addr += "/32"
+			}
+		}
+		_, n, err := net.ParseCIDR(addr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid address: %s", filter.Address)
+		}
+		network = n
+	}
+
+	var port uint16
+	if filter.Port != "" {
+		n, err := strconv.ParseUint(filter.Port, 10, 16)
+		if err != nil || n == 0 {
+			return nil, fmt.Errorf("invalid port: %s", filter.Port)
+		}
+		port = uint16(n)
+	}
+
+	inNetwork := func(addr string) bool {
+		ip := net.ParseIP(addr)
+		return ip != nil && network.Contains(ip)
+	}
+
+	return func(e models.PacketLogEntry) bool {
+		if filter.Prefix != "" && !strings.Contains(strings.ToLower(e.Prefix), strings.ToLower(filter.Prefix)) {
+			return false
+		}
+		if network != nil && !inNetwork(e.Source) && !inNetwork(e.Destination) {
+			return false
+		}
+		if port != 0 && e.SPort != port && e.DPort != port {
+			return false
+		}
+		return true
+	}, nil
+}
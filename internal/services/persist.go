@@ -7,6 +7,8 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+
+	"linuxtorouter/internal/models"
 )
 
 type PersistService struct {
@@ -149,14 +151,22 @@ func (s *PersistService) ImportConfig(reader io.Reader) error {
 }
 
 func (s *PersistService) RestoreAll(
-	iptables *IPTablesService,
+	ipsets *IPSetService,
+	firewall FirewallBackend,
 	routes *IPRouteService,
 	rules *IPRuleService,
 ) error {
 	var errors []string
 
-	if err := iptables.RestoreRules(); err != nil {
-		errors = append(errors, "iptables: "+err.Error())
+	// Sets first: rules that match on them cannot be restored without them
+	if err := ipsets.RestoreSets(); err != nil {
+		errors = append(errors, "ipsets: "+err.Error())
+	}
+
+	for _, family := range models.IPFamilies {
+		if err := firewall.RestoreRules(family); err != nil {
+			errors = append(errors, firewall.Name()+" "+string(family)+": "+err.Error())
+		}
 	}
 
 	if err := routes.RestoreRoutes(); err != nil {
@@ -207,25 +217,65 @@ func (s *PersistService) GenerateRestoreScript() string {
 
 CONFIG_DIR="%s"
 
+# Restore ipsets before the iptables rules that reference them
+if [ -f "$CONFIG_DIR/ipset/ipsets.conf" ]; then
+    echo "Restoring ipsets..."
+    ipset restore -exist < "$CONFIG_DIR/ipset/ipsets.conf"
+fi
+
 # Restore iptables rules
 if [ -f "$CONFIG_DIR/iptables/rules.v4" ]; then
     echo "Restoring iptables rules..."
     iptables-restore < "$CONFIG_DIR/iptables/rules.v4"
 fi
 
-# Restore routes
+if [ -f "$CONFIG_DIR/iptables/rules.v6" ]; then
+    echo "Restoring ip6tables rules..."
+    ip6tables-restore < "$CONFIG_DIR/iptables/rules.v6"
+fi
+
+# Restore nftables rulesets (nftables firewall backend)
+for ruleset in "$CONFIG_DIR/nftables"/ruleset-*.nft; do
+    if [ -f "$ruleset" ]; then
+        echo "Restoring nftables ruleset: $(basename "$ruleset")"
+        nft -f "$ruleset"
+    fi
+done
+
+# Restore nexthop objects before the routes that use them, groups after
+# the nexthops they contain
+if [ -f "$CONFIG_DIR/routes/nexthops" ]; then
+    echo "Restoring nexthops..."
+    for pass in single group; do
+        # The file has no newline after its last line
+        while IFS= read -r line || [ -n "$line" ]; do
+            [ -z "$line" ] && continue
+            [[ "$line" =~ ^# ]] && continue
+            if [[ " $line " == *" group "* ]]; then
+                [ "$pass" = "group" ] || continue
+            else
+                [ "$pass" = "single" ] || continue
+            fi
+            ip nexthop replace $line || echo "Failed to restore nexthop: $line"
+        done < "$CONFIG_DIR/routes/nexthops"
+    done
+fi
+
+# Restore routes; <table>.v6.conf holds the IPv6 routes of a table
 for table_file in "$CONFIG_DIR/routes"/*.conf; do
     if [ -f "$table_file" ]; then
         table=$(basename "$table_file" .conf)
-        echo "Restoring routes for table: $table"
-        while IFS= read -r line; do
+        family="-4"
+        if [[ "$table" == *.v6 ]]; then
+            table="${table%%.v6}"
+            family="-6"
+        fi
+        echo "Restoring routes for table: $table ($family)"
+        # The file has no newline after its last line
+        while IFS= read -r line || [ -n "$line" ]; do
             [ -z "$line" ] && continue
             [[ "$line" =~ ^# ]] && continue
-            if [ "$table" = "main" ]; then
-                ip route add $line 2>/dev/null || true
-            else
-                ip route add $line table "$table" 2>/dev/null || true
-            fi
+            ip $family route replace $line table "$table" || echo "Failed to restore route: $line"
         done < "$table_file"
     fi
 done
@@ -0,0 +1,447 @@
+package services
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"linuxtorouter/internal/models"
+)
+
+// portForwardTag prefixes the comment of every rule that belongs to a port
+// forward: "portforward:<id>:<role> <description>"
+const portForwardTag = "portforward:"
+
+// Roles of the rules that make up a port forward
+const (
+	pfRoleDNAT        = "dnat"
+	pfRoleForward     = "forward"
+	pfRoleHairpinDNAT = "hairpin-dnat"
+	pfRoleHairpinSNAT = "hairpin-snat"
+)
+
+// portForwardIDBytes is the number of random bytes in a port forward ID
+const portForwardIDBytes = 4
+
+// portForwardChains are the chains port forward rules are placed in
+var portForwardChains = []struct{ table, chain string }{
+	{"nat", "PREROUTING"},
+	{"filter", "FORWARD"},
+	{"nat", "POSTROUTING"},
+}
+
+// PortForwardService manages port forwards as groups of firewall rules.
+// The rules are tagged through their comment and are the only record of a
+// port forward, so Save Rules and the boot restore persist them with the
+// rest of the firewall config.
+type PortForwardService struct {
+	firewall FirewallBackend
+}
+
+func NewPortForwardService(firewall FirewallBackend) *PortForwardService {
+	return &PortForwardService{firewall: firewall}
+}
+
+// List returns the port forwards of an address family in the order their
+// DNAT rules appear in nat PREROUTING. Each table is read once; rules
+// parsed from iptables-save are mapped from their spec, others are looked
+// up through the backend.
+func (s *PortForwardService) List(family models.IPFamily) ([]models.PortForward, error) {
+	var forwards []*models.PortForward
+	byID := make(map[string]*models.PortForward)
+	tables := make(map[string][]models.ChainInfo)
+
+	for _, loc := range portForwardChains {
+		chains, ok := tables[loc.table]
+		if !ok {
+			var err error
+			if chains, err = s.firewall.ListChains(family, loc.table); err != nil {
+				return nil, fmt.Errorf("failed to read %s: %w", loc.table, err)
+			}
+			tables[loc.table] = chains
+		}
+
+		var info *models.ChainInfo
+		for i := range chains {
+			if chains[i].Name == loc.chain {
+				info = &chains[i]
+			}
+		}
+		if info == nil {
+			continue
+		}
+
+		for _, rule := range info.Rules {
+			id, role, description, ok := parsePortForwardTag(ruleComment(rule.Comment))
+			if !ok {
+				continue
+			}
+
+			var input *models.FirewallRuleInput
+			if rule.Spec != nil {
+				input, _ = RuleInputFromSpec(rule.Spec, family)
+				input.Table = loc.table
+			} else {
+				var err error
+				if input, _, err = s.firewall.RuleInput(family, loc.table, loc.chain, rule.Num); err != nil {
+					return nil, err
+				}
+			}
+
+			pf, ok := byID[id]
+			if !ok {
+				pf = &models.PortForward{ID: id, Family: family}
+				byID[id] = pf
+				forwards = append(forwards, pf)
+			}
+			applyPortForwardRule(pf, role, description, input)
+		}
+	}
+
+	result := make([]models.PortForward, 0, len(forwards))
+	for _, pf := range forwards {
+		result = append(result, *pf)
+	}
+	return result, nil
+}
+
+// Get returns a single port forward
+func (s *PortForwardService) Get(family models.IPFamily, id string) (*models.PortForward, error) {
+	forwards, err := s.List(family)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range forwards {
+		if forwards[i].ID == id {
+			return &forwards[i], nil
+		}
+	}
+
+	return nil, fmt.Errorf("port forward %s not found", id)
+}
+
+// Create adds the rules of a new port forward and returns its ID
+func (s *PortForwardService) Create(pf models.PortForward) (string, error) {
+	id, err := newPortForwardID()
+	if err != nil {
+		return "", err
+	}
+	pf.ID = id
+
+	if err := s.addRules(pf); err != nil {
+		return "", err
+	}
+
+	return id, nil
+}
+
+// Update replaces the rules of a port forward. If the new rules cannot be
+// added the old ones are put back.
+func (s *PortForwardService) Update(pf models.PortForward) error {
+	old, err := s.Get(pf.Family, pf.ID)
+	if err != nil {
+		return err
+	}
+
+	// Check the new definition before touching the firewall
+	if _, err := portForwardRules(pf); err != nil {
+		return err
+	}
+
+	if err := s.deleteRules(pf.Family, pf.ID); err != nil {
+		return err
+	}
+
+	if err := s.addRules(pf); err != nil {
+		if restoreErr := s.addRules(*old); restoreErr != nil {
+			return fmt.Errorf("%w (restoring the previous rules failed: %v)", err, restoreErr)
+		}
+		return err
+	}
+
+	return nil
+}
+
+// Delete removes all rules of a port forward
+func (s *PortForwardService) Delete(family models.IPFamily, id string) error {
+	if _, err := s.Get(family, id); err != nil {
+		return err
+	}
+	return s.deleteRules(family, id)
+}
+
+// addRules inserts the rules of a port forward at the top of their chains,
+// removing the ones already added if one of them fails
+func (s *PortForwardService) addRules(pf models.PortForward) error {
+	inputs, err := portForwardRules(pf)
+	if err != nil {
+		return err
+	}
+
+	for _, input := range inputs {
+		if err := s.firewall.AddRule(input); err != nil {
+			s.deleteRules(pf.Family, pf.ID)
+			return err
+		}
+	}
+
+	return nil
+}
+
+// deleteRules removes every rule tagged with the port forward ID. Rules are
+// deleted from the bottom of each chain so the numbers of the remaining
+// ones do not shift.
+func (s *PortForwardService) deleteRules(family models.IPFamily, id string) error {
+	for _, loc := range portForwardChains {
+		info, err := s.firewall.GetChain(family, loc.table, loc.chain)
+		if err != nil {
+			return fmt.Errorf("failed to read %s %s: %w", loc.table, loc.chain, err)
+		}
+
+		for i := len(info.Rules) - 1; i >= 0; i-- {
+			ruleID, _, _, ok := parsePortForwardTag(ruleComment(info.Rules[i].Comment))
+			if !ok || ruleID != id {
+				continue
+			}
+			if err := s.firewall.DeleteRule(family, loc.table, loc.chain, info.Rules[i].Num); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// portForwardRules validates a port forward and builds its rules
+func portForwardRules(pf models.PortForward) ([]models.FirewallRuleInput, error) {
+	if pf.Interface == "" {
+		return nil, fmt.Errorf("external interface is required")
+	}
+	if pf.Protocol != "tcp" && pf.Protocol != "udp" {
+		return nil, fmt.Errorf("protocol must be tcp or udp")
+	}
+
+	externalPort, err := normalizePorts(pf.ExternalPort)
+	if err != nil {
+		return nil, fmt.Errorf("invalid external port: %w", err)
+	}
+	if externalPort == "" {
+		return nil, fmt.Errorf("external port is required")
+	}
+
+	if ip := net.ParseIP(pf.InternalHost); ip == nil {
+		return nil, fmt.Errorf("internal host must be an IP address")
+	}
+	if err := validateAddressFamily(pf.Family, pf.InternalHost); err != nil {
+		return nil, fmt.Errorf("invalid internal host: %w", err)
+	}
+
+	internalPort := pf.InternalPort
+	if internalPort != "" {
+		if p, err := strconv.ParseUint(internalPort, 10, 16); err != nil || p == 0 {
+			return nil, fmt.Errorf("internal port must be a single port number")
+		}
+	}
+
+	if pf.Source != "" {
+		if err := validateAddressFamily(pf.Family, pf.Source); err != nil {
+			return nil, fmt.Errorf("invalid source: %w", err)
+		}
+	}
+
+	if strings.ContainsAny(pf.Description, "\"\n") {
+		return nil, fmt.Errorf("description must not contain quotes or line breaks")
+	}
+
+	// Without an internal port the destination port is left unchanged
+	toDestination := pf.InternalHost
+	forwardPort := externalPort
+	if internalPort != "" {
+		toDestination = joinHostPort(pf.InternalHost, internalPort)
+		forwardPort = internalPort
+	}
+
+	comment := func(role string) string {
+		c := portForwardTag + pf.ID + ":" + role
+		if pf.Description != "" {
+			c += " " + pf.Description
+		}
+		return c
+	}
+
+	inputs := []models.FirewallRuleInput{
+		{
+			Family:        pf.Family,
+			Table:         "nat",
+			Chain:         "PREROUTING",
+			Position:      1,
+			Protocol:      pf.Protocol,
+			InInterface:   pf.Interface,
+			Source:        pf.Source,
+			DPort:         externalPort,
+			Target:        "DNAT",
+			ToDestination: toDestination,
+			Comment:       comment(pfRoleDNAT),
+		},
+		{
+			Family:      pf.Family,
+			Table:       "filter",
+			Chain:       "FORWARD",
+			Position:    1,
+			Protocol:    pf.Protocol,
+			InInterface: pf.Interface,
+			Source:      pf.Source,
+			Destination: pf.InternalHost,
+			DPort:       forwardPort,
+			Target:      "ACCEPT",
+			Comment:     comment(pfRoleForward),
+		},
+	}
+
+	if pf.Hairpin {
+		if pf.PublicAddress == "" || pf.LANNetwork == "" {
+			return nil, fmt.Errorf("hairpin NAT requires the public address and the LAN network")
+		}
+		if err := validateAddressFamily(pf.Family, pf.PublicAddress); err != nil {
+			return nil, fmt.Errorf("invalid public address: %w", err)
+		}
+		if err := validateAddressFamily(pf.Family, pf.LANNetwork); err != nil {
+			return nil, fmt.Errorf("invalid LAN network: %w", err)
+		}
+
+		// LAN clients reach the forward through the public address and
+		// are masqueraded so the replies come back through the router
+		inputs = append(inputs,
+			models.FirewallRuleInput{
+				Family:        pf.Family,
+				Table:         "nat",
+				Chain:         "PREROUTING",
+				Position:      1,
+				Protocol:      pf.Protocol,
+				Source:        pf.LANNetwork,
+				Destination:   pf.PublicAddress,
+				DPort:         externalPort,
+				Target:        "DNAT",
+				ToDestination: toDestination,
+				Comment:       comment(pfRoleHairpinDNAT),
+			},
+			models.FirewallRuleInput{
+				Family:      pf.Family,
+				Table:       "nat",
+				Chain:       "POSTROUTING",
+				Position:    1,
+				Protocol:    pf.Protocol,
+				Source:      pf.LANNetwork,
+				Destination: pf.InternalHost,
+				DPort:       forwardPort,
+				Target:      "MASQUERADE",
+				Comment:     comment(pfRoleHairpinSNAT),
+			},
+		)
+	}
+
+	return inputs, nil
+}
+
+// applyPortForwardRule fills the fields of a port forward from one of its
+// rules
+func applyPortForwardRule(pf *models.PortForward, role, description string, input *models.FirewallRuleInput) {
+	pf.Description = description
+
+	switch role {
+	case pfRoleDNAT:
+		pf.Interface = input.InInterface
+		pf.Protocol = input.Protocol
+		pf.Source = trimHostPrefix(input.Source)
+		pf.ExternalPort = input.DPort
+		pf.InternalHost, pf.InternalPort = splitHostPort(input.ToDestination)
+	case pfRoleHairpinDNAT:
+		pf.Hairpin = true
+		pf.PublicAddress = trimHostPrefix(input.Destination)
+		pf.LANNetwork = input.Source
+	}
+}
+
+// trimHostPrefix drops the /32 or /128 iptables adds to single addresses
+func trimHostPrefix(addr string) string {
+	return strings.TrimSuffix(strings.TrimSuffix(addr, "/32"), "/128")
+}
+
+// parsePortForwardTag splits a rule comment into the port forward ID, the
+// rule's role and the description
+func parsePortForwardTag(comment string) (id, role, description string, ok bool) {
+	rest, found := strings.CutPrefix(comment, portForwardTag)
+	if !found {
+		return "", "", "", false
+	}
+
+	tag, description, _ := strings.Cut(rest, " ")
+	id, role, found = strings.Cut(tag, ":")
+	if !found || id == "" {
+		return "", "", "", false
+	}
+
+	return id, role, description, true
+}
+
+// ruleComment strips the "/* */" delimiters of a listed rule comment
+func ruleComment(comment string) string {
+	return strings.TrimSuffix(strings.TrimPrefix(comment, "/* "), " */")
+}
+
+// normalizePorts accepts a port, a range written with ":" or "-" or a comma
+// separated list and returns it in iptables syntax
+func normalizePorts(ports string) (string, error) {
+	ports = strings.ReplaceAll(strings.TrimSpace(ports), "-", ":")
+	if ports == "" {
+		return "", nil
+	}
+
+	for _, part := range strings.Split(ports, ",") {
+		for _, p := range strings.SplitN(part, ":", 2) {
+			if n, err := strconv.ParseUint(p, 10, 16); err != nil || n == 0 {
+				return "", fmt.Errorf("%q is not a port number", p)
+			}
+		}
+	}
+
+	return ports, nil
+}
+
+// joinHostPort formats a NAT target, bracketing IPv6 addresses
+func joinHostPort(host, port string) string {
+	if strings.Contains(host, ":") {
+		return "[" + host + "]:" + port
+	}
+	return host + ":" + port
+}
+
+// splitHostPort is the inverse of joinHostPort; the port is empty when the
+// target has none
+func splitHostPort(to string) (host, port string) {
+	if strings.HasPrefix(to, "[") {
+		end := strings.Index(to, "]")
+		if end < 0 {
+			return to, ""
+		}
+		return to[1:end], strings.TrimPrefix(to[end+1:], ":")
+	}
+	if strings.Count(to, ":") == 1 {
+		host, port, _ = strings.Cut(to, ":")
+		return host, port
+	}
+	return to, ""
+}
+
+// newPortForwardID returns a random identifier for a port forward
+func newPortForwardID() (string, error) {
+	b := make([]byte, portForwardIDBytes)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to generate port forward id: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
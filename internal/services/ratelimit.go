@@ -0,0 +1,348 @@
+package services
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"linuxtorouter/internal/models"
+)
+
+// ratePattern matches the rates accepted by the limit and hashlimit matches
+var ratePattern = regexp.MustCompile(`^([0-9]+)/(s|sec|second|m|min|minute|h|hour|d|day)$`)
+
+// hashLimitNamePattern matches hashlimit table names, which are limited to
+// 15 characters and appear under /proc/net/ipt_hashlimit
+var hashLimitNamePattern = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,15}$`)
+
+// recentNamePattern matches recent list names, which appear under
+// /proc/net/xt_recent
+var recentNamePattern = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,200}$`)
+
+// hashLimitKeys are the keys hashlimit can track separately
+var hashLimitKeys = map[string]bool{"srcip": true, "dstip": true, "srcport": true, "dstport": true}
+
+// parseRate splits a rate such as "5/min" into the count and the unit name
+// ("second", "minute", "hour" or "day")
+func parseRate(rate string) (uint64, string, error) {
+	m := ratePattern.FindStringSubmatch(rate)
+	if m == nil {
+		return 0, "", fmt.Errorf("invalid rate %q: use e.g. 5/minute", rate)
+	}
+	count, err := strconv.ParseUint(m[1], 10, 32)
+	if err != nil || count == 0 {
+		return 0, "", fmt.Errorf("invalid rate %q: use e.g. 5/minute", rate)
+	}
+
+	units := map[string]string{"s": "second", "sec": "second", "m": "minute", "min": "minute", "h": "hour", "d": "day"}
+	unit := m[2]
+	if long, ok := units[unit]; ok {
+		unit = long
+	}
+	return count, unit, nil
+}
+
+// parsePositive parses a count that must be between 1 and max
+func parsePositive(name, value string, max uint64) error {
+	n, err := strconv.ParseUint(value, 10, 32)
+	if err != nil || n == 0 || n > max {
+		return fmt.Errorf("invalid %s: %s (1-%d)", name, value, max)
+	}
+	return nil
+}
+
+// validateRateOptions checks the limit, hashlimit, connlimit and recent
+// options of a rule input
+func validateRateOptions(input models.FirewallRuleInput) error {
+	if input.Limit == "" && input.LimitBurst != "" {
+		return fmt.Errorf("limit burst requires a rate limit")
+	}
+	if input.Limit != "" {
+		if _, _, err := parseRate(input.Limit); err != nil {
+			return err
+		}
+		if input.LimitBurst != "" {
+			if err := parsePositive("limit burst", input.LimitBurst, 10000); err != nil {
+				return err
+			}
+		}
+	}
+
+	if input.HashLimit == "" {
+		if input.HashLimitBurst != "" || input.HashLimitMode != "" || input.HashLimitName != "" || input.HashLimitAbove {
+			return fmt.Errorf("hashlimit options require a per-address rate")
+		}
+	} else {
+		if _, _, err := parseRate(input.HashLimit); err != nil {
+			return err
+		}
+		if input.HashLimitBurst != "" {
+			if err := parsePositive("hashlimit burst", input.HashLimitBurst, 10000); err != nil {
+				return err
+			}
+		}
+		if !hashLimitNamePattern.MatchString(input.HashLimitName) {
+			return fmt.Errorf("hashlimit name is required: up to 15 letters, digits, '.', '_' or '-'")
+		}
+		if input.HashLimitMode != "" {
+			seen := make(map[string]bool)
+			for _, key := range strings.Split(input.HashLimitMode, ",") {
+				if !hashLimitKeys[key] || seen[key] {
+					return fmt.Errorf("invalid hashlimit mode: %s", input.HashLimitMode)
+				}
+				seen[key] = true
+			}
+		}
+	}
+
+	if input.ConnLimit == "" && input.ConnLimitMask != "" {
+		return fmt.Errorf("connlimit mask requires a connection limit")
+	}
+	if input.ConnLimit != "" {
+		if _, err := strconv.ParseUint(input.ConnLimit, 10, 32); err != nil {
+			return fmt.Errorf("invalid connection limit: %s", input.ConnLimit)
+		}
+		if input.ConnLimitMask != "" {
+			bits := 32
+			if input.Family == models.FamilyIPv6 {
+				bits = 128
+			}
+			n, err := strconv.Atoi(input.ConnLimitMask)
+			if err != nil || n < 0 || n > bits {
+				return fmt.Errorf("invalid connlimit mask: %s (0-%d)", input.ConnLimitMask, bits)
+			}
+		}
+	}
+
+	if input.RecentName == "" {
+		if input.RecentAction != "" || input.RecentSeconds != "" || input.RecentHitCount != "" {
+			return fmt.Errorf("recent options require a list name")
+		}
+	} else {
+		if !recentNamePattern.MatchString(input.RecentName) {
+			return fmt.Errorf("invalid recent list name: %s", input.RecentName)
+		}
+		switch input.RecentAction {
+		case "set", "remove":
+			if input.RecentSeconds != "" || input.RecentHitCount != "" {
+				return fmt.Errorf("seconds and hit count only apply to rcheck and update")
+			}
+		case "rcheck", "update":
+		case "":
+			return fmt.Errorf("recent action is required")
+		default:
+			return fmt.Errorf("invalid recent action: %s", input.RecentAction)
+		}
+		if input.RecentSeconds != "" {
+			if err := parsePositive("recent seconds", input.RecentSeconds, 1<<31-1); err != nil {
+				return err
+			}
+		}
+		if input.RecentHitCount != "" {
+			if err := parsePositive("recent hit count", input.RecentHitCount, 255); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// rateMatches builds the limit, hashlimit, connlimit and recent matches of
+// a validated rule input
+func rateMatches(input models.FirewallRuleInput) []models.RuleMatch {
+	var matches []models.RuleMatch
+	option := func(name string, values ...string) models.RuleOption {
+		return models.RuleOption{Name: name, Values: values}
+	}
+
+	if input.Limit != "" {
+		m := models.RuleMatch{Module: "limit", Options: []models.RuleOption{option("limit", input.Limit)}}
+		if input.LimitBurst != "" {
+			m.Options = append(m.Options, option("limit-burst", input.LimitBurst))
+		}
+		matches = append(matches, m)
+	}
+
+	if input.HashLimit != "" {
+		m := models.RuleMatch{Module: "hashlimit"}
+		if input.HashLimitAbove {
+			m.Options = append(m.Options, option("hashlimit-above", input.HashLimit))
+		} else {
+			m.Options = append(m.Options, option("hashlimit-upto", input.HashLimit))
+		}
+		if input.HashLimitBurst != "" {
+			m.Options = append(m.Options, option("hashlimit-burst", input.HashLimitBurst))
+		}
+		if input.HashLimitMode != "" {
+			m.Options = append(m.Options, option("hashlimit-mode", input.HashLimitMode))
+		}
+		m.Options = append(m.Options, option("hashlimit-name", input.HashLimitName))
+		matches = append(matches, m)
+	}
+
+	if input.ConnLimit != "" {
+		m := models.RuleMatch{Module: "connlimit", Options: []models.RuleOption{option("connlimit-above", input.ConnLimit)}}
+		if input.ConnLimitMask != "" {
+			m.Options = append(m.Options, option("connlimit-mask", input.ConnLimitMask))
+		}
+		matches = append(matches, m)
+	}
+
+	if input.RecentName != "" {
+		m := models.RuleMatch{Module: "recent", Options: []models.RuleOption{option(input.RecentAction)}}
+		if input.RecentSeconds != "" {
+			m.Options = append(m.Options, option("seconds", input.RecentSeconds))
+		}
+		if input.RecentHitCount != "" {
+			m.Options = append(m.Options, option("hitcount", input.RecentHitCount))
+		}
+		m.Options = append(m.Options, option("name", input.RecentName), option("rsource"))
+		matches = append(matches, m)
+	}
+
+	return matches
+}
+
+// rateInputFromOption fills the rate options of input from an option of a
+// limit, hashlimit, connlimit or recent match, reporting whether the form
+// can represent it. Options iptables-save adds with their default values
+// are accepted and dropped.
+func rateInputFromOption(input *models.FirewallRuleInput, module string, opt models.RuleOption) bool {
+	if opt.Negated {
+		return false
+	}
+	value := opt.Value()
+	single := len(opt.Values) == 1
+	flag := len(opt.Values) == 0
+
+	switch module {
+	case "limit":
+		switch {
+		case opt.Name == "limit" && single:
+			input.Limit = value
+		case opt.Name == "limit-burst" && single:
+			if value != "5" {
+				input.LimitBurst = value
+			}
+		default:
+			return false
+		}
+	case "hashlimit":
+		switch {
+		case (opt.Name == "hashlimit-upto" || opt.Name == "hashlimit") && single:
+			input.HashLimit = value
+		case opt.Name == "hashlimit-above" && single:
+			input.HashLimit, input.HashLimitAbove = value, true
+		case opt.Name == "hashlimit-burst" && single:
+			if value != "5" {
+				input.HashLimitBurst = value
+			}
+		case opt.Name == "hashlimit-mode" && single:
+			input.HashLimitMode = value
+		case opt.Name == "hashlimit-name" && single:
+			input.HashLimitName = value
+		default:
+			return false
+		}
+	case "connlimit":
+		full := "32"
+		if input.Family == models.FamilyIPv6 {
+			full = "128"
+		}
+		switch {
+		case opt.Name == "connlimit-above" && single:
+			input.ConnLimit = value
+		case opt.Name == "connlimit-mask" && single:
+			if value != full {
+				input.ConnLimitMask = value
+			}
+		case opt.Name == "connlimit-saddr" && flag:
+		default:
+			return false
+		}
+	case "recent":
+		full := "255.255.255.255"
+		if input.Family == models.FamilyIPv6 {
+			full = "ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff"
+		}
+		switch {
+		case (opt.Name == "set" || opt.Name == "rcheck" || opt.Name == "update" || opt.Name == "remove") && flag:
+			input.RecentAction = opt.Name
+		case opt.Name == "name" && single:
+			input.RecentName = value
+		case opt.Name == "seconds" && single:
+			input.RecentSeconds = value
+		case opt.Name == "hitcount" && single:
+			input.RecentHitCount = value
+		case opt.Name == "mask" && single && value == full, opt.Name == "rsource" && flag:
+		default:
+			return false
+		}
+	default:
+		return false
+	}
+	return true
+}
+
+// describeRateMatch summarizes a limit, hashlimit, connlimit or recent
+// match for the Options column, e.g. "hashlimit: over 10/sec per srcip,
+// table ssh". It reports false for matches with options the summary
+// cannot show.
+func describeRateMatch(m models.RuleMatch, family models.IPFamily) (string, bool) {
+	input := models.FirewallRuleInput{Family: family}
+	for _, opt := range m.Options {
+		if !rateInputFromOption(&input, m.Module, opt) {
+			return "", false
+		}
+	}
+
+	var text string
+	switch m.Module {
+	case "limit":
+		text = "limit: up to " + input.Limit
+		if input.LimitBurst != "" {
+			text += ", burst " + input.LimitBurst
+		}
+	case "hashlimit":
+		text = "hashlimit: up to " + input.HashLimit
+		if input.HashLimitAbove {
+			text = "hashlimit: over " + input.HashLimit
+		}
+		if input.HashLimitMode != "" {
+			text += " per " + input.HashLimitMode
+		}
+		if input.HashLimitBurst != "" {
+			text += ", burst " + input.HashLimitBurst
+		}
+		text += ", table " + input.HashLimitName
+	case "connlimit":
+		text = "connlimit: over " + input.ConnLimit + " connections per source"
+		if input.ConnLimitMask != "" {
+			text += " /" + input.ConnLimitMask
+		}
+	case "recent":
+		text = "recent " + input.RecentName + ": "
+		switch input.RecentAction {
+		case "set":
+			text += "add source"
+		case "remove":
+			text += "remove source"
+		default:
+			text += "source seen"
+			if input.RecentHitCount != "" {
+				text += " " + input.RecentHitCount + " times"
+			}
+			if input.RecentSeconds != "" {
+				text += " in " + input.RecentSeconds + "s"
+			}
+			if input.RecentAction == "update" {
+				text += ", refresh"
+			}
+		}
+	default:
+		return "", false
+	}
+	return text, true
+}
@@ -0,0 +1,376 @@
+package services
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"linuxtorouter/internal/models"
+
+	"github.com/vishvananda/netlink"
+)
+
+// rtTablesDropIn is the file under rt_tables.d holding the tables created
+// from the UI
+const rtTablesDropIn = "linuxtorouter.conf"
+
+// reservedTables are the tables the kernel and iproute2 define themselves
+var reservedTables = map[int]string{
+	0:   "unspec",
+	253: "default",
+	254: "main",
+	255: "local",
+}
+
+var (
+	rtTablesLine = regexp.MustCompile(`^\s*(0x[0-9a-fA-F]+|\d+)\s+(\S+)`)
+	tableNameRe  = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_.-]*$`)
+)
+
+// rtTablesDropInPath returns the drop-in file of the tables created here
+func (s *IPRouteService) rtTablesDropInPath() string {
+	return filepath.Join(s.rtTablesPath+".d", rtTablesDropIn)
+}
+
+// readRTTables reads the tables of an rt_tables file
+func readRTTables(path string) ([]models.RoutingTable, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var tables []models.RoutingTable
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(strings.TrimSpace(line), "#") || strings.TrimSpace(line) == "" {
+			continue
+		}
+
+		matches := rtTablesLine.FindStringSubmatch(line)
+		if matches != nil {
+			id, err := strconv.ParseUint(matches[1], 0, 32)
+			if err != nil {
+				continue
+			}
+			tables = append(tables, models.RoutingTable{
+				ID:   int(id),
+				Name: matches[2],
+				File: path,
+			})
+		}
+	}
+
+	return tables, scanner.Err()
+}
+
+// GetRoutingTables returns the named tables of rt_tables and of the
+// rt_tables.d/*.conf drop-ins, as iproute2 reads them
+func (s *IPRouteService) GetRoutingTables() ([]models.RoutingTable, error) {
+	tables, err := readRTTables(s.rtTablesPath)
+	if err != nil {
+		// Return default tables if file doesn't exist
+		tables = []models.RoutingTable{
+			{ID: 255, Name: "local"},
+			{ID: 254, Name: "main"},
+			{ID: 253, Name: "default"},
+		}
+	}
+
+	dropIns, _ := filepath.Glob(filepath.Join(s.rtTablesPath+".d", "*.conf"))
+	sort.Strings(dropIns)
+	seen := make(map[int]bool)
+	for _, t := range tables {
+		seen[t.ID] = true
+	}
+	for _, path := range dropIns {
+		more, err := readRTTables(path)
+		if err != nil {
+			continue
+		}
+		for _, t := range more {
+			if !seen[t.ID] {
+				seen[t.ID] = true
+				tables = append(tables, t)
+			}
+		}
+	}
+
+	// Tables can be changed in the main file and in our drop-in
+	for i := range tables {
+		t := &tables[i]
+		_, reserved := reservedTables[t.ID]
+		t.Editable = !reserved && (t.File == s.rtTablesPath || t.File == s.rtTablesDropInPath())
+	}
+
+	return tables, nil
+}
+
+// findTable returns the named table
+func (s *IPRouteService) findTable(name string) (models.RoutingTable, []models.RoutingTable, error) {
+	tables, err := s.GetRoutingTables()
+	if err != nil {
+		return models.RoutingTable{}, nil, err
+	}
+	for _, t := range tables {
+		if t.Name == name {
+			return t, tables, nil
+		}
+	}
+	return models.RoutingTable{}, nil, fmt.Errorf("unknown routing table: %s", name)
+}
+
+// validateTableName checks a new table name against the existing tables
+func validateTableName(name string, tables []models.RoutingTable) error {
+	if !tableNameRe.MatchString(name) {
+		return fmt.Errorf("invalid table name %q: use letters, digits, '_', '.' and '-', starting with a letter", name)
+	}
+	if name == "all" {
+		return fmt.Errorf("%q is reserved", name)
+	}
+	// The saved IPv6 routes of table x are in x.v6.conf
+	if strings.HasSuffix(name, ".v6") {
+		return fmt.Errorf("invalid table name %q: names cannot end in .v6", name)
+	}
+	for _, t := range tables {
+		if t.Name == name {
+			return fmt.Errorf("table %s already exists", name)
+		}
+	}
+	return nil
+}
+
+// CreateTable names a new routing table in the drop-in file. Without an ID
+// the first free one from 100 is used.
+func (s *IPRouteService) CreateTable(id int, name string) (models.RoutingTable, error) {
+	tables, err := s.GetRoutingTables()
+	if err != nil {
+		return models.RoutingTable{}, err
+	}
+	if err := validateTableName(name, tables); err != nil {
+		return models.RoutingTable{}, err
+	}
+
+	used := make(map[int]string)
+	for _, t := range tables {
+		used[t.ID] = t.Name
+	}
+	for reserved, n := range reservedTables {
+		used[reserved] = n
+	}
+
+	if id == 0 {
+		for id = 100; used[id] != ""; id++ {
+		}
+	}
+	if id < 1 || int64(id) > 0xFFFFFFFF {
+		return models.RoutingTable{}, fmt.Errorf("table ID must be between 1 and 4294967295")
+	}
+	if other, ok := used[id]; ok {
+		return models.RoutingTable{}, fmt.Errorf("table ID %d is already used by %s", id, other)
+	}
+
+	table := models.RoutingTable{ID: id, Name: name}
+	err = s.editRTTables(s.rtTablesDropInPath(), func(lines []string) []string {
+		return append(lines, fmt.Sprintf("%d\t%s", id, name))
+	})
+	if err != nil {
+		return models.RoutingTable{}, err
+	}
+	return table, nil
+}
+
+// RenameTable changes the name of a table. A table from the main
+// rt_tables file moves to the drop-in. The saved routes of the table
+// follow the new name.
+func (s *IPRouteService) RenameTable(oldName, newName string) error {
+	table, tables, err := s.findTable(oldName)
+	if err != nil {
+		return err
+	}
+	if !table.Editable {
+		return fmt.Errorf("table %s cannot be renamed", oldName)
+	}
+	if err := validateTableName(newName, tables); err != nil {
+		return err
+	}
+
+	// The new name is written first: if removing the old line fails, the
+	// main file still names the table and iproute2 keeps reading it first
+	err = s.editRTTables(s.rtTablesDropInPath(), func(lines []string) []string {
+		lines = removeTableLine(table.ID)(lines)
+		return append(lines, fmt.Sprintf("%d\t%s", table.ID, newName))
+	})
+	if err != nil {
+		return err
+	}
+	if table.File != s.rtTablesDropInPath() {
+		if err := s.editRTTables(table.File, removeTableLine(table.ID)); err != nil {
+			return err
+		}
+	}
+
+	for _, family := range models.IPFamilies {
+		oldPath := filepath.Join(s.configDir, "routes", routeFileName(family, oldName))
+		newPath := filepath.Join(s.configDir, "routes", routeFileName(family, newName))
+		if err := os.Rename(oldPath, newPath); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to rename saved routes: %w", err)
+		}
+	}
+	return nil
+}
+
+// DeleteTable removes the name of a table. It refuses while live or saved
+// IP rules look the table up, or it holds live or saved routes; its empty
+// saved routes files go with it.
+func (s *IPRouteService) DeleteTable(name string) error {
+	table, _, err := s.findTable(name)
+	if err != nil {
+		return err
+	}
+	if !table.Editable {
+		return fmt.Errorf("table %s cannot be deleted", name)
+	}
+
+	for _, family := range models.IPFamilies {
+		rules, err := netlink.RuleList(routeFamily(family))
+		if err != nil {
+			return fmt.Errorf("failed to list IP rules: %w", err)
+		}
+		for _, rule := range rules {
+			if rule.Table == table.ID {
+				return fmt.Errorf("table %s is still used by the %s IP rule with priority %d", name, family, rule.Priority)
+			}
+		}
+
+		routes, err := s.listRoutes(family, table.ID)
+		if err != nil {
+			return err
+		}
+		if len(routes) > 0 {
+			return fmt.Errorf("table %s still holds %d %s routes", name, len(routes), family)
+		}
+
+		path := filepath.Join(s.configDir, "routes", routeFileName(family, name))
+		if n, err := countConfigLines(path, nil); err != nil {
+			return err
+		} else if n > 0 {
+			return fmt.Errorf("table %s still has %d saved %s routes in %s", name, n, family, path)
+		}
+	}
+
+	rulesPath := filepath.Join(s.configDir, "rules", "ip-rules.conf")
+	n, err := countConfigLines(rulesPath, func(fields []string) bool {
+		for j := 0; j+1 < len(fields); j++ {
+			if (fields[j] == "lookup" || fields[j] == "table") && fields[j+1] == name {
+				return true
+			}
+		}
+		return false
+	})
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		return fmt.Errorf("table %s is still used by %d saved IP rules in %s", name, n, rulesPath)
+	}
+
+	if err := s.editRTTables(table.File, removeTableLine(table.ID)); err != nil {
+		return err
+	}
+
+	for _, family := range models.IPFamilies {
+		path := filepath.Join(s.configDir, "routes", routeFileName(family, name))
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove saved routes: %w", err)
+		}
+	}
+	return nil
+}
+
+// countConfigLines counts the lines of a saved config file that are not
+// blank or comments and, with a match function, whose fields it accepts.
+// A missing file has none.
+func countConfigLines(path string, match func([]string) bool) (int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+
+	n := 0
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		if match == nil || match(fields) {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// removeTableLine drops the line naming a table ID
+func removeTableLine(id int) func([]string) []string {
+	return func(lines []string) []string {
+		var kept []string
+		for _, line := range lines {
+			if matches := rtTablesLine.FindStringSubmatch(line); matches != nil {
+				if n, err := strconv.ParseUint(matches[1], 0, 32); err == nil && int(n) == id {
+					continue
+				}
+			}
+			kept = append(kept, line)
+		}
+		return kept
+	}
+}
+
+// editRTTables rewrites the lines of an rt_tables file. The first change
+// to an existing file keeps a copy of it as <file>.orig, and the new
+// contents replace the file in one rename.
+func (s *IPRouteService) editRTTables(path string, edit func([]string) []string) error {
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to read %s: %w", path, err)
+	}
+
+	if err == nil {
+		backup := path + ".orig"
+		if _, err := os.Stat(backup); os.IsNotExist(err) {
+			if err := os.WriteFile(backup, data, 0644); err != nil {
+				return fmt.Errorf("failed to back up %s: %w", path, err)
+			}
+		}
+	}
+
+	var lines []string
+	if len(data) > 0 {
+		lines = strings.Split(strings.TrimRight(string(data), "\n"), "\n")
+	} else if path == s.rtTablesDropInPath() {
+		lines = []string{"# Routing tables managed by the router GUI"}
+	}
+	lines = edit(lines)
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create %s: %w", filepath.Dir(path), err)
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(strings.Join(lines, "\n")+"\n"), 0644); err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	return nil
+}
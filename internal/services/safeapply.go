@@ -0,0 +1,219 @@
+package services
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"linuxtorouter/internal/models"
+)
+
+// safeApplier implements the confirm-or-rollback flow shared by the
+// firewall backends. Snapshots are opaque blobs keyed by whatever the
+// backend needs to restore them (e.g. the address family).
+type safeApplier struct {
+	snapshot func() (map[string][]byte, error)
+	restore  func(map[string][]byte) error
+
+	mu      sync.Mutex
+	pending *pendingChange
+}
+
+// pendingChange holds the ruleset snapshots taken before an unconfirmed change
+type pendingChange struct {
+	snapshots map[string][]byte
+	info      models.PendingFirewallChange
+	// deadlines and fingerprints hold the deadline set by each change in
+	// info.Changes and the ruleset it was armed on
+	deadlines    []time.Time
+	fingerprints []string
+	timer        *time.Timer
+	onRollback   func(models.PendingFirewallChange, error)
+}
+
+func newSafeApplier(snapshot func() (map[string][]byte, error), restore func(map[string][]byte) error) *safeApplier {
+	return &safeApplier{snapshot: snapshot, restore: restore}
+}
+
+// BeginSafeApply snapshots the running ruleset and arms a timer that restores
+// the snapshot unless ConfirmChanges is called before the timeout expires.
+// If a change is already pending, the original snapshot is kept and the
+// timer is restarted.
+func (s *safeApplier) BeginSafeApply(timeout time.Duration, description string, onRollback func(models.PendingFirewallChange, error)) error {
+	if timeout <= 0 {
+		return fmt.Errorf("invalid confirm timeout")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	snapshots, err := s.snapshot()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	if s.pending == nil {
+		s.pending = &pendingChange{
+			snapshots: snapshots,
+			info:      models.PendingFirewallChange{StartedAt: now},
+		}
+	} else {
+		s.pending.timer.Stop()
+	}
+
+	s.pending.info.Deadline = now.Add(timeout)
+	s.pending.info.Changes = append(s.pending.info.Changes, description)
+	s.pending.deadlines = append(s.pending.deadlines, s.pending.info.Deadline)
+	s.pending.fingerprints = append(s.pending.fingerprints, rulesetFingerprint(snapshots))
+	s.pending.onRollback = onRollback
+
+	pending := s.pending
+	pending.timer = time.AfterFunc(timeout, func() {
+		s.expirePending(pending)
+	})
+
+	return nil
+}
+
+// CancelSafeApply withdraws the BeginSafeApply of a change that failed,
+// provided the ruleset is still the one it was armed on. If it was the
+// only pending change the rollback is disarmed; otherwise its description
+// is dropped and the deadline of the change before it applies again. It
+// reports false, leaving the rollback pending, when the failed change left
+// the ruleset modified or the ruleset cannot be read.
+func (s *safeApplier) CancelSafeApply(description string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	p := s.pending
+	if p == nil {
+		return true, nil
+	}
+	i := len(p.info.Changes) - 1
+	for i >= 0 && p.info.Changes[i] != description {
+		i--
+	}
+	if i < 0 {
+		return true, nil
+	}
+
+	snapshots, err := s.snapshot()
+	if err != nil {
+		return false, err
+	}
+	if rulesetFingerprint(snapshots) != p.fingerprints[i] {
+		return false, nil
+	}
+
+	p.timer.Stop()
+	if len(p.info.Changes) == 1 {
+		s.pending = nil
+		return true, nil
+	}
+
+	// Copy so PendingChange results handed out earlier stay unchanged
+	p.info.Changes = append(append([]string{}, p.info.Changes[:i]...), p.info.Changes[i+1:]...)
+	p.deadlines = append(append([]time.Time{}, p.deadlines[:i]...), p.deadlines[i+1:]...)
+	p.fingerprints = append(append([]string{}, p.fingerprints[:i]...), p.fingerprints[i+1:]...)
+	p.info.Deadline = p.deadlines[len(p.deadlines)-1]
+	p.timer = time.AfterFunc(time.Until(p.info.Deadline), func() {
+		s.expirePending(p)
+	})
+	return true, nil
+}
+
+// snapshotCounters matches the packet and byte counters of iptables-save
+// chain lines and nft counter statements
+var snapshotCounters = regexp.MustCompile(`\[\d+:\d+\]|packets \d+ bytes \d+`)
+
+// rulesetFingerprint reduces snapshots to what decides the ruleset,
+// leaving out comments such as the iptables-save timestamps and counters
+func rulesetFingerprint(snapshots map[string][]byte) string {
+	keys := make([]string, 0, len(snapshots))
+	for key := range snapshots {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	for _, key := range keys {
+		b.WriteString("== " + key + "\n")
+		for _, line := range strings.Split(string(snapshots[key]), "\n") {
+			if strings.HasPrefix(strings.TrimSpace(line), "#") {
+				continue
+			}
+			b.WriteString(snapshotCounters.ReplaceAllString(line, "") + "\n")
+		}
+	}
+	return b.String()
+}
+
+// expirePending rolls back a pending change whose timer fired
+func (s *safeApplier) expirePending(p *pendingChange) {
+	s.mu.Lock()
+	if s.pending != p {
+		// Confirmed or rolled back in the meantime
+		s.mu.Unlock()
+		return
+	}
+	s.pending = nil
+	s.mu.Unlock()
+
+	err := s.restore(p.snapshots)
+	if p.onRollback != nil {
+		p.onRollback(p.info, err)
+	}
+}
+
+// ConfirmChanges keeps the pending change and cancels its rollback timer
+func (s *safeApplier) ConfirmChanges() (*models.PendingFirewallChange, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.pending == nil {
+		return nil, fmt.Errorf("no pending changes to confirm")
+	}
+
+	s.pending.timer.Stop()
+	info := s.pending.info
+	s.pending = nil
+
+	return &info, nil
+}
+
+// RollbackChanges restores the snapshot of a pending change immediately
+func (s *safeApplier) RollbackChanges() (*models.PendingFirewallChange, error) {
+	s.mu.Lock()
+	if s.pending == nil {
+		s.mu.Unlock()
+		return nil, fmt.Errorf("no pending changes to roll back")
+	}
+
+	p := s.pending
+	p.timer.Stop()
+	s.pending = nil
+	s.mu.Unlock()
+
+	if err := s.restore(p.snapshots); err != nil {
+		return nil, err
+	}
+
+	return &p.info, nil
+}
+
+// PendingChange returns the change awaiting confirmation, or nil
+func (s *safeApplier) PendingChange() *models.PendingFirewallChange {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.pending == nil {
+		return nil
+	}
+
+	info := s.pending.info
+	return &info
+}
@@ -0,0 +1,481 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"linuxtorouter/internal/database"
+	"linuxtorouter/internal/models"
+)
+
+// scheduleRuleTag prefixes the comment of every rule added by a schedule:
+// "sched:<id> <comment>"
+const scheduleRuleTag = "sched:"
+
+const (
+	// scheduleLookback is how far back the scheduler looks for the last
+	// start or stop to decide whether a schedule should be active
+	scheduleLookback = 31 * 24 * time.Hour
+	// scheduleLookahead bounds the search for the next start and stop
+	scheduleLookahead = 366 * 24 * time.Hour
+	// maxScheduleRules caps the number of rules in a schedule
+	maxScheduleRules = 64
+)
+
+// scheduleNamePattern matches the accepted schedule names
+var scheduleNamePattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9_.-]{0,62}$`)
+
+var (
+	ErrScheduleNotFound = errors.New("schedule not found")
+	ErrScheduleExists   = errors.New("a schedule with this name already exists")
+)
+
+// RuleScheduleService stores rule schedules in SQLite and, once started,
+// adds and removes their rules every minute. The state of each schedule is
+// derived from whichever of its start and stop fired last, so rules that
+// were removed by hand, by a rollback or by a restart are brought back in
+// line on the next run. Every change is recorded through audit.
+type RuleScheduleService struct {
+	db       *database.DB
+	firewall FirewallBackend
+	audit    func(action, details string)
+
+	// mu serializes runs of the scheduler and changes to schedules
+	mu sync.Mutex
+}
+
+func NewRuleScheduleService(db *database.DB, firewall FirewallBackend, audit func(action, details string)) *RuleScheduleService {
+	return &RuleScheduleService{db: db, firewall: firewall, audit: audit}
+}
+
+// Start runs the scheduler at the beginning of every minute
+func (s *RuleScheduleService) Start() {
+	go func() {
+		for {
+			now := time.Now()
+			time.Sleep(now.Truncate(time.Minute).Add(time.Minute).Sub(now))
+			s.Run()
+		}
+	}()
+}
+
+// List returns all schedules ordered by name, with their current state
+func (s *RuleScheduleService) List() ([]models.RuleSchedule, error) {
+	schedules, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	for i := range schedules {
+		sched := &schedules[i]
+		sched.Active = s.isActive(*sched)
+		if start, err := parseCron(sched.Start); err == nil {
+			sched.NextStart, _ = start.next(now, scheduleLookahead)
+		}
+		if stop, err := parseCron(sched.Stop); err == nil {
+			sched.NextStop, _ = stop.next(now, scheduleLookahead)
+		}
+	}
+	return schedules, nil
+}
+
+// Get returns a single schedule
+func (s *RuleScheduleService) Get(id int64) (*models.RuleSchedule, error) {
+	schedules, err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	for i := range schedules {
+		if schedules[i].ID == id {
+			return &schedules[i], nil
+		}
+	}
+	return nil, ErrScheduleNotFound
+}
+
+func (s *RuleScheduleService) load() ([]models.RuleSchedule, error) {
+	rows, err := s.db.Query(
+		`SELECT id, name, description, family, table_name, start_cron, stop_cron, rules, enabled, created_at, updated_at
+		FROM firewall_schedules ORDER BY name`,
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list schedules: %w", err)
+	}
+	defer rows.Close()
+
+	var schedules []models.RuleSchedule
+	for rows.Next() {
+		var sched models.RuleSchedule
+		var family string
+		if err := rows.Scan(&sched.ID, &sched.Name, &sched.Description, &family, &sched.Table, &sched.Start, &sched.Stop,
+			&sched.Rules, &sched.Enabled, &sched.CreatedAt, &sched.UpdatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan schedule: %w", err)
+		}
+		sched.Family = models.ParseIPFamily(family)
+		schedules = append(schedules, sched)
+	}
+
+	return schedules, rows.Err()
+}
+
+// Create stores a new schedule and applies its current state
+func (s *RuleScheduleService) Create(sched models.RuleSchedule) (int64, error) {
+	if err := validateSchedule(sched); err != nil {
+		return 0, err
+	}
+
+	s.mu.Lock()
+	result, err := s.db.Exec(
+		`INSERT INTO firewall_schedules (name, description, family, table_name, start_cron, stop_cron, rules, enabled)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		sched.Name, sched.Description, string(sched.Family), sched.Table, sched.Start, sched.Stop, sched.Rules, sched.Enabled,
+	)
+	s.mu.Unlock()
+	if err != nil {
+		if strings.Contains(err.Error(), "UNIQUE") {
+			return 0, ErrScheduleExists
+		}
+		return 0, fmt.Errorf("failed to create schedule: %w", err)
+	}
+
+	id, _ := result.LastInsertId()
+	s.Run()
+	return id, nil
+}
+
+// Update changes a schedule. Rules added under the old definition are
+// removed first, then the current state is applied again.
+func (s *RuleScheduleService) Update(sched models.RuleSchedule) error {
+	if err := validateSchedule(sched); err != nil {
+		return err
+	}
+
+	old, err := s.Get(sched.ID)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	if s.isActive(*old) {
+		if err := s.deactivate(*old); err != nil {
+			s.mu.Unlock()
+			return err
+		}
+		s.audit("firewall_schedule_deactivate", "Schedule: "+old.Name+", Reason: schedule changed")
+	}
+
+	_, err = s.db.Exec(
+		`UPDATE firewall_schedules SET name = ?, description = ?, family = ?, table_name = ?, start_cron = ?, stop_cron = ?,
+		rules = ?, enabled = ?, updated_at = CURRENT_TIMESTAMP WHERE id = ?`,
+		sched.Name, sched.Description, string(sched.Family), sched.Table, sched.Start, sched.Stop, sched.Rules, sched.Enabled, sched.ID,
+	)
+	s.mu.Unlock()
+	if err != nil {
+		if strings.Contains(err.Error(), "UNIQUE") {
+			return ErrScheduleExists
+		}
+		return fmt.Errorf("failed to update schedule: %w", err)
+	}
+
+	s.Run()
+	return nil
+}
+
+// Delete removes a schedule and any of its rules still in the firewall
+func (s *RuleScheduleService) Delete(id int64) error {
+	sched, err := s.Get(id)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.isActive(*sched) {
+		if err := s.deactivate(*sched); err != nil {
+			return err
+		}
+		s.audit("firewall_schedule_deactivate", "Schedule: "+sched.Name+", Reason: schedule deleted")
+	}
+
+	if _, err := s.db.Exec("DELETE FROM firewall_schedules WHERE id = ?", id); err != nil {
+		return fmt.Errorf("failed to delete schedule: %w", err)
+	}
+	return nil
+}
+
+// Run brings the rules of every schedule in line with its state. It does
+// nothing while a safe apply change is waiting for confirmation, since a
+// rollback would undo its work.
+func (s *RuleScheduleService) Run() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.firewall.PendingChange() != nil {
+		return
+	}
+
+	schedules, err := s.load()
+	if err != nil {
+		log.Printf("Scheduler: %v", err)
+		return
+	}
+
+	now := time.Now()
+	for _, sched := range schedules {
+		want, known := scheduleWanted(sched, now)
+		if !known {
+			continue
+		}
+
+		present, complete := s.ruleState(sched)
+		switch {
+		case want && !complete:
+			// Rules removed or changed by hand are replaced as a whole, so
+			// the chains never hold a mix of old and new rules
+			if present {
+				if err := s.deactivate(sched); err != nil {
+					log.Printf("Scheduler: failed to deactivate %s: %v", sched.Name, err)
+					s.audit("firewall_schedule_failed", "Schedule: "+sched.Name+", Error: "+err.Error())
+					continue
+				}
+				s.audit("firewall_schedule_deactivate", "Schedule: "+sched.Name+", Reason: rules out of date")
+			}
+			if err := s.activate(sched); err != nil {
+				log.Printf("Scheduler: failed to activate %s: %v", sched.Name, err)
+				s.audit("firewall_schedule_failed", "Schedule: "+sched.Name+", Error: "+err.Error())
+				continue
+			}
+			s.audit("firewall_schedule_activate", "Schedule: "+sched.Name+", Rules: "+strconv.Itoa(countScheduleRules(sched)))
+		case !want && present:
+			if err := s.deactivate(sched); err != nil {
+				log.Printf("Scheduler: failed to deactivate %s: %v", sched.Name, err)
+				s.audit("firewall_schedule_failed", "Schedule: "+sched.Name+", Error: "+err.Error())
+				continue
+			}
+			reason := "stop time"
+			if !sched.Enabled {
+				reason = "disabled"
+			}
+			s.audit("firewall_schedule_deactivate", "Schedule: "+sched.Name+", Reason: "+reason)
+		}
+	}
+}
+
+// scheduleWanted decides whether a schedule's rules should be in the
+// firewall: a disabled schedule never is, an enabled one is when its start
+// fired more recently than its stop. known is false when neither fired
+// within the lookback, leaving the rules as they are.
+func scheduleWanted(sched models.RuleSchedule, now time.Time) (want, known bool) {
+	if !sched.Enabled {
+		return false, true
+	}
+
+	start, err := parseCron(sched.Start)
+	if err != nil {
+		return false, false
+	}
+	stop, err := parseCron(sched.Stop)
+	if err != nil {
+		return false, false
+	}
+
+	lastStart, started := start.last(now, scheduleLookback)
+	lastStop, stopped := stop.last(now, scheduleLookback)
+	switch {
+	case started && stopped:
+		return lastStart.After(lastStop), true
+	case started || stopped:
+		return started, true
+	default:
+		return false, false
+	}
+}
+
+// ruleState reports whether any rule of the schedule is in the firewall and
+// whether each chain holds exactly the rules the schedule defines, in its
+// order. Rules are compared by comment and target, which both backends list.
+func (s *RuleScheduleService) ruleState(sched models.RuleSchedule) (present, complete bool) {
+	inputs, err := scheduleRules(sched)
+	if err != nil {
+		return false, false
+	}
+
+	var chains []string
+	want := make(map[string][]string)
+	for _, input := range inputs {
+		if _, ok := want[input.Chain]; !ok {
+			chains = append(chains, input.Chain)
+		}
+		want[input.Chain] = append(want[input.Chain], input.Comment+" -j "+input.Target)
+	}
+
+	complete = true
+	for _, chain := range chains {
+		info, err := s.firewall.GetChain(sched.Family, sched.Table, chain)
+		if err != nil {
+			complete = false
+			continue
+		}
+		var have []string
+		for _, r := range info.Rules {
+			if id, ok := ScheduleRuleID(r.Comment); ok && id == sched.ID {
+				have = append(have, ruleComment(r.Comment)+" -j "+r.Target)
+			}
+		}
+		if len(have) > 0 {
+			present = true
+		}
+		if strings.Join(have, "\n") != strings.Join(want[chain], "\n") {
+			complete = false
+		}
+	}
+	return present, complete
+}
+
+// isActive reports whether any rule of the schedule is in the firewall
+func (s *RuleScheduleService) isActive(sched models.RuleSchedule) bool {
+	present, _ := s.ruleState(sched)
+	return present
+}
+
+// activate inserts the rules of a schedule at the top of their chains,
+// removing the ones already added if one fails
+func (s *RuleScheduleService) activate(sched models.RuleSchedule) error {
+	inputs, err := scheduleRules(sched)
+	if err != nil {
+		return err
+	}
+
+	// Keep the written order within each chain
+	positions := make(map[string]int)
+	for _, input := range inputs {
+		positions[input.Chain]++
+		input.Position = positions[input.Chain]
+		if err := s.firewall.AddRule(input); err != nil {
+			s.deactivate(sched)
+			return err
+		}
+	}
+	return nil
+}
+
+// deactivate removes the rules of a schedule from the bottom of each chain
+// up, so the numbers of the remaining ones do not shift
+func (s *RuleScheduleService) deactivate(sched models.RuleSchedule) error {
+	inputs, err := scheduleRules(sched)
+	if err != nil {
+		return err
+	}
+
+	seen := make(map[string]bool)
+	for _, input := range inputs {
+		if seen[input.Chain] {
+			continue
+		}
+		seen[input.Chain] = true
+
+		info, err := s.firewall.GetChain(sched.Family, sched.Table, input.Chain)
+		if err != nil {
+			return fmt.Errorf("failed to read %s %s: %w", sched.Table, input.Chain, err)
+		}
+		for i := len(info.Rules) - 1; i >= 0; i-- {
+			id, ok := ScheduleRuleID(info.Rules[i].Comment)
+			if !ok || id != sched.ID {
+				continue
+			}
+			if err := s.firewall.DeleteRule(sched.Family, sched.Table, input.Chain, info.Rules[i].Num); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// ScheduleRuleID returns the schedule a listed rule was added by
+func ScheduleRuleID(comment string) (int64, bool) {
+	rest, found := strings.CutPrefix(ruleComment(comment), scheduleRuleTag)
+	if !found {
+		return 0, false
+	}
+
+	tag, _, _ := strings.Cut(rest, " ")
+	id, err := strconv.ParseInt(tag, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return id, true
+}
+
+// scheduleRules parses the rule lines of a schedule into rule inputs
+// tagged with the schedule ID
+func scheduleRules(sched models.RuleSchedule) ([]models.FirewallRuleInput, error) {
+	var inputs []models.FirewallRuleInput
+	for i, line := range strings.Split(sched.Rules, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		spec, err := ParseRuleSpec(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", i+1, err)
+		}
+		input, unsupported := RuleInputFromSpec(spec, sched.Family)
+		if len(unsupported) > 0 {
+			return nil, fmt.Errorf("line %d: unsupported options: %s", i+1, strings.Join(unsupported, " "))
+		}
+		input.Table = sched.Table
+		input.Comment = strings.TrimSpace(scheduleRuleTag + strconv.FormatInt(sched.ID, 10) + " " + input.Comment)
+		inputs = append(inputs, *input)
+	}
+	return inputs, nil
+}
+
+// countScheduleRules returns the number of rule lines of a schedule
+func countScheduleRules(sched models.RuleSchedule) int {
+	inputs, _ := scheduleRules(sched)
+	return len(inputs)
+}
+
+// validateSchedule checks a schedule and its rules
+func validateSchedule(sched models.RuleSchedule) error {
+	if !scheduleNamePattern.MatchString(sched.Name) {
+		return fmt.Errorf("invalid schedule name: use letters, digits, '.', '_' or '-'")
+	}
+	switch sched.Table {
+	case "filter", "nat", "mangle", "raw":
+	default:
+		return fmt.Errorf("invalid table: %s", sched.Table)
+	}
+	if _, err := parseCron(sched.Start); err != nil {
+		return fmt.Errorf("start: %w", err)
+	}
+	if _, err := parseCron(sched.Stop); err != nil {
+		return fmt.Errorf("stop: %w", err)
+	}
+
+	inputs, err := scheduleRules(sched)
+	if err != nil {
+		return err
+	}
+	if len(inputs) == 0 {
+		return fmt.Errorf("a schedule needs at least one rule")
+	}
+	if len(inputs) > maxScheduleRules {
+		return fmt.Errorf("a schedule can have at most %d rules", maxScheduleRules)
+	}
+	for i, input := range inputs {
+		if _, err := ruleSpecFromInput(input); err != nil {
+			return fmt.Errorf("rule %d: %w", i+1, err)
+		}
+	}
+	return nil
+}
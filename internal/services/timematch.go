@@ -0,0 +1,196 @@
+package services
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"linuxtorouter/internal/models"
+)
+
+// timeOfDayPattern matches the hh:mm[:ss] times of the time match
+var timeOfDayPattern = regexp.MustCompile(`^([01]?[0-9]|2[0-3]):[0-5][0-9](:[0-5][0-9])?$`)
+
+// timeMatchDateLayouts are the ISO 8601 forms accepted for DateStart and
+// DateStop, most precise first
+var timeMatchDateLayouts = []string{
+	"2006-01-02T15:04:05", "2006-01-02T15:04", "2006-01-02", "2006-01", "2006",
+}
+
+// usesTimeMatch reports whether any time match option is set
+func usesTimeMatch(input models.FirewallRuleInput) bool {
+	return input.TimeStart != "" || input.TimeStop != "" || input.Weekdays != "" ||
+		input.DateStart != "" || input.DateStop != "" || input.KernelTZ
+}
+
+// normalizeWeekdays converts day names or numbers (1 = Monday) into the
+// comma separated names iptables-save writes, in week order
+func normalizeWeekdays(days string) (string, error) {
+	selected := make([]bool, len(models.Weekdays))
+	for _, day := range strings.Split(days, ",") {
+		day = strings.TrimSpace(day)
+		found := false
+		for i, name := range models.Weekdays {
+			if strings.EqualFold(day, name) || day == fmt.Sprint(i+1) {
+				selected[i], found = true, true
+			}
+		}
+		if !found {
+			return "", fmt.Errorf("invalid weekday: %s", day)
+		}
+	}
+
+	var names []string
+	for i, ok := range selected {
+		if ok {
+			names = append(names, models.Weekdays[i])
+		}
+	}
+	return strings.Join(names, ","), nil
+}
+
+// parseTimeMatchDate parses a DateStart or DateStop value
+func parseTimeMatchDate(value string) (time.Time, error) {
+	for _, layout := range timeMatchDateLayouts {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("invalid date: %s (use e.g. 2024-06-01 or 2024-06-01T08:00)", value)
+}
+
+// validateTimeOptions checks the time match options of a rule input
+func validateTimeOptions(input models.FirewallRuleInput) error {
+	for _, t := range []struct{ name, value string }{{"start time", input.TimeStart}, {"stop time", input.TimeStop}} {
+		if t.value != "" && !timeOfDayPattern.MatchString(t.value) {
+			return fmt.Errorf("invalid %s: %s (use e.g. 22:00)", t.name, t.value)
+		}
+	}
+	if input.Weekdays != "" {
+		if _, err := normalizeWeekdays(input.Weekdays); err != nil {
+			return err
+		}
+	}
+
+	var start, stop time.Time
+	var err error
+	if input.DateStart != "" {
+		if start, err = parseTimeMatchDate(input.DateStart); err != nil {
+			return err
+		}
+	}
+	if input.DateStop != "" {
+		if stop, err = parseTimeMatchDate(input.DateStop); err != nil {
+			return err
+		}
+	}
+	if !start.IsZero() && !stop.IsZero() && !stop.After(start) {
+		return fmt.Errorf("stop date must be after the start date")
+	}
+
+	if input.KernelTZ && input.TimeStart == "" && input.TimeStop == "" && input.Weekdays == "" &&
+		input.DateStart == "" && input.DateStop == "" {
+		return fmt.Errorf("kernel time zone requires a time, weekday or date option")
+	}
+	return nil
+}
+
+// timeMatch builds the time match of a validated rule input, or returns
+// nil when it has no time options
+func timeMatch(input models.FirewallRuleInput) *models.RuleMatch {
+	if !usesTimeMatch(input) {
+		return nil
+	}
+
+	m := &models.RuleMatch{Module: "time"}
+	add := func(name, value string) {
+		if value != "" {
+			m.Options = append(m.Options, models.RuleOption{Name: name, Values: []string{value}})
+		}
+	}
+	add("timestart", input.TimeStart)
+	add("timestop", input.TimeStop)
+	if input.Weekdays != "" {
+		days, _ := normalizeWeekdays(input.Weekdays)
+		add("weekdays", days)
+	}
+	add("datestart", input.DateStart)
+	add("datestop", input.DateStop)
+	if input.KernelTZ {
+		m.Options = append(m.Options, models.RuleOption{Name: "kerneltz"})
+	}
+	return m
+}
+
+// timeInputFromOption fills the time options of input from an option of a
+// time match, reporting whether the form can represent it
+func timeInputFromOption(input *models.FirewallRuleInput, module string, opt models.RuleOption) bool {
+	if module != "time" || opt.Negated {
+		return false
+	}
+	value := opt.Value()
+	single := len(opt.Values) == 1
+
+	switch {
+	case opt.Name == "timestart" && single:
+		input.TimeStart = value
+	case opt.Name == "timestop" && single:
+		input.TimeStop = value
+	case opt.Name == "weekdays" && single:
+		input.Weekdays = value
+	case opt.Name == "datestart" && single:
+		input.DateStart = value
+	case opt.Name == "datestop" && single:
+		input.DateStop = value
+	case opt.Name == "kerneltz" && len(opt.Values) == 0:
+		input.KernelTZ = true
+	case opt.Name == "utc" && len(opt.Values) == 0:
+		// UTC is the default
+	default:
+		return false
+	}
+	return true
+}
+
+// describeTimeMatch summarizes a time match for the Options column, e.g.
+// "time: 22:00:00-06:00:00 Mon,Tue UTC". It reports false for matches with
+// options the summary cannot show, such as monthdays.
+func describeTimeMatch(m models.RuleMatch) (string, bool) {
+	if m.Module != "time" {
+		return "", false
+	}
+	var input models.FirewallRuleInput
+	for _, opt := range m.Options {
+		if !timeInputFromOption(&input, m.Module, opt) {
+			return "", false
+		}
+	}
+
+	parts := []string{"time:"}
+	if input.TimeStart != "" || input.TimeStop != "" {
+		start, stop := input.TimeStart, input.TimeStop
+		if start == "" {
+			start = "00:00"
+		}
+		if stop == "" {
+			stop = "23:59:59"
+		}
+		parts = append(parts, start+"-"+stop)
+	}
+	if input.Weekdays != "" {
+		parts = append(parts, input.Weekdays)
+	}
+	if input.DateStart != "" {
+		parts = append(parts, "from "+input.DateStart)
+	}
+	if input.DateStop != "" {
+		parts = append(parts, "until "+input.DateStop)
+	}
+	if input.KernelTZ {
+		parts = append(parts, "local time")
+	} else {
+		parts = append(parts, "UTC")
+	}
+	return strings.Join(parts, " "), true
+}
@@ -0,0 +1,604 @@
+package services
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+
+	"linuxtorouter/internal/models"
+)
+
+const (
+	// traceMaxDepth bounds the nesting of user chain jumps
+	traceMaxDepth = 32
+	// traceMaxRules bounds the number of rules evaluated per table and hook
+	traceMaxRules = 20000
+)
+
+// traceHookTables lists the tables traversed at each hook, in the order of
+// their netfilter priorities
+var traceHookTables = map[string][]string{
+	"PREROUTING":  {"raw", "mangle", "nat"},
+	"INPUT":       {"mangle", "filter", "nat"},
+	"FORWARD":     {"mangle", "filter"},
+	"OUTPUT":      {"raw", "mangle", "nat", "filter"},
+	"POSTROUTING": {"mangle", "nat"},
+}
+
+// traceProtocolNumbers maps protocol names used by iptables-save to their
+// numbers, so that "-p 6" and "-p tcp" compare equal
+var traceProtocolNumbers = map[string]int{
+	"icmp": 1, "tcp": 6, "udp": 17, "gre": 47, "esp": 50, "ah": 51,
+	"icmpv6": 58, "ipv6-icmp": 58, "sctp": 132,
+}
+
+// traceNonTerminating lists targets known to let the packet continue with
+// the next rule
+var traceNonTerminating = map[string]bool{
+	"LOG": true, "NFLOG": true, "ULOG": true, "MARK": true, "CONNMARK": true,
+	"CONNSECMARK": true, "SECMARK": true, "TCPMSS": true, "CT": true,
+	"NOTRACK": true, "TRACE": true, "SET": true, "CLASSIFY": true, "DSCP": true,
+	"TOS": true, "TTL": true, "HL": true, "ECN": true, "CHECKSUM": true,
+	"TEE": true, "AUDIT": true, "IDLETIMER": true, "LED": true, "RATEEST": true,
+	"TCPOPTSTRIP": true,
+}
+
+// TraceService predicts what the iptables ruleset does with a packet by
+// walking the parsed rules of every table the packet would traverse
+type TraceService struct {
+	firewall FirewallBackend
+}
+
+func NewTraceService(firewall FirewallBackend) *TraceService {
+	return &TraceService{firewall: firewall}
+}
+
+// tracer holds the state of a single trace
+type tracer struct {
+	firewall    FirewallBackend
+	packet      models.TracePacket
+	chains      map[string]map[string]models.ChainInfo
+	trace       *models.PacketTrace
+	unevaluated map[string]bool
+}
+
+// Trace walks the packet through the ruleset. Match modules that cannot be
+// evaluated from the packet fields are assumed to match and are reported.
+func (s *TraceService) Trace(packet models.TracePacket) (*models.PacketTrace, error) {
+	if s.firewall.Name() != "iptables" {
+		return nil, ErrNotSupported
+	}
+	if err := validateTracePacket(&packet); err != nil {
+		return nil, err
+	}
+
+	t := &tracer{
+		firewall:    s.firewall,
+		packet:      packet,
+		chains:      make(map[string]map[string]models.ChainInfo),
+		trace:       &models.PacketTrace{Packet: packet},
+		unevaluated: make(map[string]bool),
+	}
+
+	var hooks []string
+	switch {
+	case packet.InInterface != "" && packet.OutInterface != "":
+		hooks = []string{"PREROUTING", "FORWARD", "POSTROUTING"}
+	case packet.InInterface != "":
+		hooks = []string{"PREROUTING", "INPUT"}
+	default:
+		hooks = []string{"OUTPUT", "POSTROUTING"}
+	}
+	t.trace.Hooks = hooks
+
+	if packet.State != "NEW" {
+		t.note("The nat table only sees the first packet of a connection and is skipped for " + packet.State + " packets.")
+	}
+
+	verdict, err := t.run(hooks)
+	if err != nil {
+		return nil, err
+	}
+	t.trace.Verdict = verdict
+
+	for module := range t.unevaluated {
+		t.trace.Unevaluated = append(t.trace.Unevaluated, module)
+	}
+	sort.Strings(t.trace.Unevaluated)
+
+	return t.trace, nil
+}
+
+// validateTracePacket checks the packet and fills in its family and the
+// default state
+func validateTracePacket(p *models.TracePacket) error {
+	p.InInterface = strings.TrimSpace(p.InInterface)
+	p.OutInterface = strings.TrimSpace(p.OutInterface)
+	if p.InInterface == "" && p.OutInterface == "" {
+		return fmt.Errorf("enter an input interface, an output interface or both")
+	}
+
+	src := net.ParseIP(strings.TrimSpace(p.Source))
+	dst := net.ParseIP(strings.TrimSpace(p.Destination))
+	if src == nil {
+		return fmt.Errorf("invalid source address %q", p.Source)
+	}
+	if dst == nil {
+		return fmt.Errorf("invalid destination address %q", p.Destination)
+	}
+	if (src.To4() == nil) != (dst.To4() == nil) {
+		return fmt.Errorf("source and destination must be of the same address family")
+	}
+	p.Source, p.Destination = src.String(), dst.String()
+	p.Family = models.FamilyIPv4
+	if src.To4() == nil {
+		p.Family = models.FamilyIPv6
+	}
+
+	p.Protocol = strings.ToLower(strings.TrimSpace(p.Protocol))
+	if _, ok := traceProtocolNumbers[p.Protocol]; !ok {
+		return fmt.Errorf("unsupported protocol %q", p.Protocol)
+	}
+	if p.Protocol == "tcp" || p.Protocol == "udp" || p.Protocol == "sctp" {
+		for _, port := range []string{p.SPort, p.DPort} {
+			if port == "" {
+				continue
+			}
+			if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+				return fmt.Errorf("invalid port %q", port)
+			}
+		}
+	} else {
+		p.SPort, p.DPort = "", ""
+	}
+
+	p.State = strings.ToUpper(strings.TrimSpace(p.State))
+	if p.State == "" {
+		p.State = "NEW"
+	}
+	for _, state := range models.TraceStates {
+		if p.State == state {
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid conntrack state %q", p.State)
+}
+
+// run traverses the tables of each hook in order and returns the verdict
+func (t *tracer) run(hooks []string) (string, error) {
+	for _, hook := range hooks {
+		for _, table := range traceHookTables[hook] {
+			if table == "nat" && t.packet.State != "NEW" {
+				continue
+			}
+
+			chains, err := t.table(table)
+			if err != nil {
+				return "", err
+			}
+			if _, ok := chains[hook]; !ok {
+				continue
+			}
+
+			verdict, final, err := t.walk(table, hook, chains)
+			if err != nil {
+				return "", err
+			}
+			if final {
+				return verdict, nil
+			}
+		}
+	}
+	return "ACCEPT", nil
+}
+
+// table loads and caches the chains of a table. Tables other than filter
+// that cannot be read are treated as empty.
+func (t *tracer) table(table string) (map[string]models.ChainInfo, error) {
+	if chains, ok := t.chains[table]; ok {
+		return chains, nil
+	}
+
+	list, err := t.firewall.ListChains(t.packet.Family, table)
+	if err != nil && table == "filter" {
+		return nil, err
+	}
+	if err != nil {
+		t.note(fmt.Sprintf("The %s table could not be read and was skipped: %v", table, err))
+		list = nil
+	}
+
+	chains := make(map[string]models.ChainInfo, len(list))
+	for _, chain := range list {
+		for _, rule := range chain.Rules {
+			if rule.Spec == nil {
+				return nil, ErrNotSupported
+			}
+		}
+		chains[chain.Name] = chain
+	}
+	t.chains[table] = chains
+	return chains, nil
+}
+
+// traceFrame is a chain being traversed and the index of its next rule
+type traceFrame struct {
+	chain string
+	next  int
+}
+
+// walk traverses a built-in chain and the user chains it jumps to. It
+// returns the verdict and whether it ends the traversal of the packet.
+func (t *tracer) walk(table, hook string, chains map[string]models.ChainInfo) (string, bool, error) {
+	stack := []traceFrame{{chain: hook}}
+	evaluated := 0
+
+	for {
+		top := &stack[len(stack)-1]
+		chain := chains[top.chain]
+
+		if top.next >= len(chain.Rules) {
+			if len(stack) > 1 {
+				t.step(table, top.chain, len(stack)-1, nil, "No rule matched, return to "+stack[len(stack)-2].chain)
+				stack = stack[:len(stack)-1]
+				continue
+			}
+			return t.policy(table, hook, chains, len(stack)-1, top.chain)
+		}
+
+		rule := chain.Rules[top.next]
+		top.next++
+		evaluated++
+		if evaluated > traceMaxRules {
+			return "", false, fmt.Errorf("too many rules evaluated in %s %s, the ruleset may loop", table, hook)
+		}
+
+		matched, unevaluated := t.matchRule(rule.Spec)
+		if !matched {
+			continue
+		}
+
+		depth := len(stack) - 1
+		target := rule.Spec.Target
+		switch {
+		case target == "":
+			t.stepRule(table, top.chain, depth, rule, "Matched, no target: continue", unevaluated)
+		case target == "ACCEPT":
+			t.stepRule(table, top.chain, depth, rule, "ACCEPT", unevaluated)
+			return "ACCEPT", false, nil
+		case target == "DROP" || target == "REJECT":
+			t.stepRule(table, top.chain, depth, rule, target, unevaluated)
+			return target, true, nil
+		case target == "QUEUE" || target == "NFQUEUE":
+			t.stepRule(table, top.chain, depth, rule, target+": the verdict is left to a userspace program", unevaluated)
+			return target, true, nil
+		case target == "RETURN":
+			if len(stack) == 1 {
+				t.stepRule(table, top.chain, depth, rule, "RETURN from a built-in chain: policy applies", unevaluated)
+				return t.policy(table, hook, chains, depth, top.chain)
+			}
+			t.stepRule(table, top.chain, depth, rule, "RETURN to "+stack[len(stack)-2].chain, unevaluated)
+			stack = stack[:len(stack)-1]
+		case target == "DNAT" || target == "REDIRECT":
+			t.stepRule(table, top.chain, depth, rule, t.dnat(rule.Spec), unevaluated)
+			return "ACCEPT", false, nil
+		case target == "SNAT" || target == "MASQUERADE" || target == "NETMAP":
+			t.stepRule(table, top.chain, depth, rule, target+": source address rewritten", unevaluated)
+			return "ACCEPT", false, nil
+		default:
+			if _, ok := chains[target]; ok {
+				if len(stack) > traceMaxDepth {
+					return "", false, fmt.Errorf("chains nested deeper than %d in %s %s", traceMaxDepth, table, hook)
+				}
+				if rule.Spec.Goto {
+					t.stepRule(table, top.chain, depth, rule, "Go to "+target, unevaluated)
+					*top = traceFrame{chain: target}
+				} else {
+					t.stepRule(table, top.chain, depth, rule, "Jump to "+target, unevaluated)
+					stack = append(stack, traceFrame{chain: target})
+				}
+				continue
+			}
+			if !traceNonTerminating[target] {
+				t.note("Target " + target + " is not known to the tracer and was treated as non-terminating.")
+			}
+			t.stepRule(table, top.chain, depth, rule, target+": continue", unevaluated)
+		}
+	}
+}
+
+// policy applies the policy of a built-in chain
+func (t *tracer) policy(table, hook string, chains map[string]models.ChainInfo, depth int, chain string) (string, bool, error) {
+	policy := chains[hook].Policy
+	if policy == "" || policy == "-" {
+		policy = "ACCEPT"
+	}
+	action := "Policy " + policy
+	if chain != hook {
+		action = "No rule matched, policy of " + hook + ": " + policy
+	}
+	t.step(table, chain, depth, nil, action)
+	return policy, policy != "ACCEPT", nil
+}
+
+// dnat rewrites the destination of the packet and describes the change.
+// Routing is not re-evaluated, so the path of the packet stays the same.
+func (t *tracer) dnat(spec *models.RuleSpec) string {
+	if spec.Target == "REDIRECT" {
+		if opt := spec.TargetOption("to-ports"); opt != nil {
+			t.packet.DPort = strings.SplitN(strings.SplitN(opt.Value(), "-", 2)[0], ":", 2)[0]
+		}
+		t.note("REDIRECT delivers the packet to the router itself; the rest of the trace keeps the original path.")
+		return "REDIRECT to port " + t.packet.DPort
+	}
+
+	opt := spec.TargetOption("to-destination")
+	if opt == nil {
+		return "DNAT"
+	}
+
+	addr, port := splitTraceHostPort(opt.Value())
+	// Only the first address and port of a range are followed
+	addr = strings.SplitN(addr, "-", 2)[0]
+	port = strings.SplitN(port, "-", 2)[0]
+	if addr != "" {
+		t.packet.Destination = addr
+	}
+	if port != "" {
+		t.packet.DPort = port
+	}
+	t.note("Rules after the DNAT rule see the rewritten destination; routing is not re-evaluated.")
+	return "DNAT to " + opt.Value()
+}
+
+// splitTraceHostPort splits "addr", "addr:port" and "[addr]:port"
+func splitTraceHostPort(value string) (string, string) {
+	if strings.HasPrefix(value, "[") {
+		end := strings.Index(value, "]")
+		if end < 0 {
+			return value, ""
+		}
+		return value[1:end], strings.TrimPrefix(value[end+1:], ":")
+	}
+	if strings.Count(value, ":") == 1 {
+		addr, port, _ := strings.Cut(value, ":")
+		return addr, port
+	}
+	return value, ""
+}
+
+func (t *tracer) step(table, chain string, depth int, rule *models.FirewallRule, action string) {
+	step := models.TraceStep{Table: table, Chain: chain, Depth: depth, Action: action}
+	if rule != nil {
+		step.RuleNum = rule.Num
+		spec := *rule.Spec
+		spec.Counters = nil
+		step.Rule = FormatRuleSpec(&spec)
+	}
+	t.trace.Steps = append(t.trace.Steps, step)
+}
+
+func (t *tracer) stepRule(table, chain string, depth int, rule models.FirewallRule, action string, unevaluated []string) {
+	t.step(table, chain, depth, &rule, action)
+	t.trace.Steps[len(t.trace.Steps)-1].Unevaluated = unevaluated
+	for _, module := range unevaluated {
+		t.unevaluated[module] = true
+	}
+}
+
+// note adds a remark to the trace once
+func (t *tracer) note(note string) {
+	for _, n := range t.trace.Notes {
+		if n == note {
+			return
+		}
+	}
+	t.trace.Notes = append(t.trace.Notes, note)
+}
+
+// matchRule reports whether the rule matches the packet and lists the
+// match modules that were assumed to match
+func (t *tracer) matchRule(spec *models.RuleSpec) (bool, []string) {
+	p := t.packet
+
+	if spec.Source != "" && traceAddressMatch(spec.Source, p.Source) == spec.NotSource {
+		return false, nil
+	}
+	if spec.Destination != "" && traceAddressMatch(spec.Destination, p.Destination) == spec.NotDestination {
+		return false, nil
+	}
+	if spec.InInterface != "" && traceInterfaceMatch(spec.InInterface, p.InInterface) == spec.NotInInterface {
+		return false, nil
+	}
+	if spec.OutInterface != "" && traceInterfaceMatch(spec.OutInterface, p.OutInterface) == spec.NotOutInterface {
+		return false, nil
+	}
+	if spec.Protocol != "" && traceProtocolMatch(spec.Protocol, p.Protocol) == spec.NotProtocol {
+		return false, nil
+	}
+	// Trace packets are never fragments
+	if spec.Fragment && !spec.NotFragment {
+		return false, nil
+	}
+
+	var unevaluated []string
+	for _, m := range spec.Matches {
+		matched, known := t.evalMatch(m)
+		if known && !matched {
+			return false, nil
+		}
+		if !known {
+			unevaluated = append(unevaluated, m.Module)
+		}
+	}
+	return true, unevaluated
+}
+
+// evalMatch evaluates a match module. It returns known=false when an
+// option of the module cannot be decided from the packet fields and none
+// of the others rules the packet out.
+func (t *tracer) evalMatch(m models.RuleMatch) (matched, known bool) {
+	known = true
+	for _, opt := range m.Options {
+		result, ok := t.evalOption(m.Module, opt)
+		if !ok {
+			known = false
+			continue
+		}
+		if result == opt.Negated {
+			return false, true
+		}
+	}
+	return true, known
+}
+
+// evalOption evaluates a single option, without its negation
+func (t *tracer) evalOption(module string, opt models.RuleOption) (result, ok bool) {
+	p := t.packet
+	switch module {
+	case "comment":
+		return true, true
+	case "tcp", "udp", "sctp":
+		switch opt.Name {
+		case "dport", "destination-port":
+			return tracePortMatch(opt.Value(), p.DPort)
+		case "sport", "source-port":
+			return tracePortMatch(opt.Value(), p.SPort)
+		}
+	case "multiport":
+		switch opt.Name {
+		case "dports", "destination-ports":
+			return tracePortMatch(opt.Value(), p.DPort)
+		case "sports", "source-ports":
+			return tracePortMatch(opt.Value(), p.SPort)
+		case "ports":
+			dport, dok := tracePortMatch(opt.Value(), p.DPort)
+			sport, sok := tracePortMatch(opt.Value(), p.SPort)
+			if (dok && dport) || (sok && sport) {
+				return true, true
+			}
+			return false, dok && sok
+		}
+	case "conntrack":
+		if opt.Name == "ctstate" {
+			return traceStateMatch(opt.Value(), p.State), true
+		}
+	case "state":
+		if opt.Name == "state" {
+			return traceStateMatch(opt.Value(), p.State), true
+		}
+	case "iprange":
+		switch opt.Name {
+		case "src-range":
+			return traceRangeMatch(opt.Value(), p.Source)
+		case "dst-range":
+			return traceRangeMatch(opt.Value(), p.Destination)
+		}
+	}
+	return false, false
+}
+
+// traceAddressMatch checks an address against "addr" or "addr/prefix"
+func traceAddressMatch(value, addr string) bool {
+	ip := net.ParseIP(addr)
+	if !strings.Contains(value, "/") {
+		return ip.Equal(net.ParseIP(value))
+	}
+	_, network, err := net.ParseCIDR(value)
+	if err != nil {
+		// Dotted netmasks such as 10.0.0.0/255.0.0.0
+		base, mask, _ := strings.Cut(value, "/")
+		maskIP := net.ParseIP(mask).To4()
+		baseIP := net.ParseIP(base).To4()
+		if maskIP == nil || baseIP == nil || ip.To4() == nil {
+			return false
+		}
+		m := net.IPMask(maskIP)
+		return baseIP.Mask(m).Equal(ip.To4().Mask(m))
+	}
+	return network.Contains(ip)
+}
+
+// traceInterfaceMatch checks an interface name against a pattern, where a
+// trailing "+" matches any suffix
+func traceInterfaceMatch(pattern, iface string) bool {
+	if strings.HasSuffix(pattern, "+") {
+		return strings.HasPrefix(iface, strings.TrimSuffix(pattern, "+"))
+	}
+	return pattern == iface
+}
+
+func traceProtocolMatch(value, protocol string) bool {
+	value = strings.ToLower(value)
+	if value == "all" || value == "0" {
+		return true
+	}
+	if n, err := strconv.Atoi(value); err == nil {
+		return n == traceProtocolNumbers[protocol]
+	}
+	num, ok := traceProtocolNumbers[value]
+	return ok && num == traceProtocolNumbers[protocol]
+}
+
+// tracePortMatch checks a port against a comma separated list of ports and
+// "first:last" ranges. It cannot decide when the packet has no port.
+func tracePortMatch(list, port string) (result, ok bool) {
+	n, err := strconv.Atoi(port)
+	if err != nil {
+		return false, false
+	}
+	for _, item := range strings.Split(list, ",") {
+		first, last, isRange := strings.Cut(item, ":")
+		if !isRange {
+			last = first
+		}
+		if first == "" {
+			first = "0"
+		}
+		if last == "" {
+			last = "65535"
+		}
+		lo, err := strconv.Atoi(first)
+		if err != nil {
+			return false, false
+		}
+		hi, err := strconv.Atoi(last)
+		if err != nil {
+			return false, false
+		}
+		if n >= lo && n <= hi {
+			return true, true
+		}
+	}
+	return false, true
+}
+
+// traceStateMatch checks a conntrack state against a comma separated list
+func traceStateMatch(list, state string) bool {
+	for _, s := range strings.Split(list, ",") {
+		if strings.EqualFold(s, state) {
+			return true
+		}
+	}
+	return false
+}
+
+// traceRangeMatch checks an address against an iprange "first-last" range
+func traceRangeMatch(value, addr string) (result, ok bool) {
+	first, last, _ := strings.Cut(value, "-")
+	lo, hi, ip := net.ParseIP(first), net.ParseIP(last), net.ParseIP(addr)
+	if lo == nil || ip == nil {
+		return false, false
+	}
+	if hi == nil {
+		hi = lo
+	}
+	if (lo.To4() == nil) != (ip.To4() == nil) {
+		return false, true
+	}
+	lo, hi, ip = lo.To16(), hi.To16(), ip.To16()
+	return bytes.Compare(lo, ip) <= 0 && bytes.Compare(ip, hi) <= 0, true
+}
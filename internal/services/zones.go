@@ -0,0 +1,399 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"linuxtorouter/internal/database"
+	"linuxtorouter/internal/models"
+)
+
+// Managed chains the zone policies are compiled into. Everything in them is
+// replaced on every compile; rules elsewhere are never touched.
+const (
+	zoneInputChain       = "ZONE_INPUT"
+	zoneForwardChain     = "ZONE_FORWARD"
+	zonePostroutingChain = "ZONE_POSTROUTING"
+)
+
+// zoneChains maps each managed chain to the table it lives in and the
+// built-in chain that jumps to it
+var zoneChains = []struct{ table, chain, parent string }{
+	{"filter", zoneInputChain, "INPUT"},
+	{"filter", zoneForwardChain, "FORWARD"},
+	{"nat", zonePostroutingChain, "POSTROUTING"},
+}
+
+var (
+	// zoneNamePattern matches the accepted zone names
+	zoneNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,16}$`)
+	// interfaceNamePattern matches interface names, with the iptables
+	// "+" wildcard allowed at the end
+	interfaceNamePattern = regexp.MustCompile(`^[A-Za-z0-9_.@-]{1,15}\+?$`)
+)
+
+var ErrZoneNotFound = errors.New("zone not found")
+
+// ZoneService stores zones and inter-zone policies in SQLite and compiles
+// them into the managed ZONE_* chains of both address families
+type ZoneService struct {
+	db       *database.DB
+	firewall FirewallBackend
+}
+
+func NewZoneService(db *database.DB, firewall FirewallBackend) *ZoneService {
+	return &ZoneService{db: db, firewall: firewall}
+}
+
+// ListZones returns all zones ordered by name
+func (s *ZoneService) ListZones() ([]models.Zone, error) {
+	rows, err := s.db.Query(
+		"SELECT id, name, description, interfaces, input_action, masquerade, created_at, updated_at FROM firewall_zones ORDER BY name",
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list zones: %w", err)
+	}
+	defer rows.Close()
+
+	var zones []models.Zone
+	for rows.Next() {
+		var z models.Zone
+		var interfaces string
+		if err := rows.Scan(&z.ID, &z.Name, &z.Description, &interfaces, &z.InputAction, &z.Masquerade, &z.CreatedAt, &z.UpdatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan zone: %w", err)
+		}
+		z.Interfaces = splitZoneInterfaces(interfaces)
+		zones = append(zones, z)
+	}
+
+	return zones, rows.Err()
+}
+
+// GetZone returns a single zone
+func (s *ZoneService) GetZone(name string) (*models.Zone, error) {
+	zones, err := s.ListZones()
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range zones {
+		if zones[i].Name == name {
+			return &zones[i], nil
+		}
+	}
+
+	return nil, ErrZoneNotFound
+}
+
+// CreateZone validates and stores a new zone
+func (s *ZoneService) CreateZone(zone models.Zone) error {
+	zones, err := s.ListZones()
+	if err != nil {
+		return err
+	}
+
+	zone.Interfaces = splitZoneInterfaces(strings.Join(zone.Interfaces, "\n"))
+	if err := validateZone(zone, zones); err != nil {
+		return err
+	}
+
+	if _, err := s.db.Exec(
+		"INSERT INTO firewall_zones (name, description, interfaces, input_action, masquerade) VALUES (?, ?, ?, ?, ?)",
+		zone.Name, zone.Description, strings.Join(zone.Interfaces, "\n"), zone.InputAction, zone.Masquerade,
+	); err != nil {
+		if strings.Contains(err.Error(), "UNIQUE constraint failed") {
+			return fmt.Errorf("zone %s already exists", zone.Name)
+		}
+		return fmt.Errorf("failed to create zone: %w", err)
+	}
+
+	return nil
+}
+
+// UpdateZone changes everything about a zone except its name
+func (s *ZoneService) UpdateZone(zone models.Zone) error {
+	zones, err := s.ListZones()
+	if err != nil {
+		return err
+	}
+
+	var others []models.Zone
+	found := false
+	for _, z := range zones {
+		if z.Name == zone.Name {
+			found = true
+			continue
+		}
+		others = append(others, z)
+	}
+	if !found {
+		return ErrZoneNotFound
+	}
+
+	zone.Interfaces = splitZoneInterfaces(strings.Join(zone.Interfaces, "\n"))
+	if err := validateZone(zone, others); err != nil {
+		return err
+	}
+
+	if _, err := s.db.Exec(
+		"UPDATE firewall_zones SET description = ?, interfaces = ?, input_action = ?, masquerade = ?, updated_at = CURRENT_TIMESTAMP WHERE name = ?",
+		zone.Description, strings.Join(zone.Interfaces, "\n"), zone.InputAction, zone.Masquerade, zone.Name,
+	); err != nil {
+		return fmt.Errorf("failed to update zone: %w", err)
+	}
+
+	return nil
+}
+
+// DeleteZone removes a zone together with its policies
+func (s *ZoneService) DeleteZone(name string) error {
+	result, err := s.db.Exec("DELETE FROM firewall_zones WHERE name = ?", name)
+	if err != nil {
+		return fmt.Errorf("failed to delete zone: %w", err)
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return ErrZoneNotFound
+	}
+	return nil
+}
+
+// ListPolicies returns all inter-zone policies ordered by zone names
+func (s *ZoneService) ListPolicies() ([]models.ZonePolicy, error) {
+	rows, err := s.db.Query(
+		"SELECT id, from_zone, to_zone, action FROM firewall_zone_policies ORDER BY from_zone, to_zone",
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list zone policies: %w", err)
+	}
+	defer rows.Close()
+
+	var policies []models.ZonePolicy
+	for rows.Next() {
+		var p models.ZonePolicy
+		if err := rows.Scan(&p.ID, &p.FromZone, &p.ToZone, &p.Action); err != nil {
+			return nil, fmt.Errorf("failed to scan zone policy: %w", err)
+		}
+		policies = append(policies, p)
+	}
+
+	return policies, rows.Err()
+}
+
+// SetPolicy creates or replaces the policy between two zones
+func (s *ZoneService) SetPolicy(policy models.ZonePolicy) error {
+	if !validZoneAction(policy.Action) {
+		return fmt.Errorf("invalid action %q", policy.Action)
+	}
+	for _, name := range []string{policy.FromZone, policy.ToZone} {
+		if _, err := s.GetZone(name); err != nil {
+			return fmt.Errorf("zone %s: %w", name, err)
+		}
+	}
+
+	if _, err := s.db.Exec(
+		`INSERT INTO firewall_zone_policies (from_zone, to_zone, action) VALUES (?, ?, ?)
+		ON CONFLICT (from_zone, to_zone) DO UPDATE SET action = excluded.action`,
+		policy.FromZone, policy.ToZone, policy.Action,
+	); err != nil {
+		return fmt.Errorf("failed to save zone policy: %w", err)
+	}
+
+	return nil
+}
+
+// DeletePolicy removes an inter-zone policy
+func (s *ZoneService) DeletePolicy(id int64) error {
+	result, err := s.db.Exec("DELETE FROM firewall_zone_policies WHERE id = ?", id)
+	if err != nil {
+		return fmt.Errorf("failed to delete zone policy: %w", err)
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return fmt.Errorf("zone policy %d not found", id)
+	}
+	return nil
+}
+
+// Compile regenerates the managed chains of both families from the stored
+// zones and policies. It creates missing chains, replaces their contents
+// and makes sure each is jumped to exactly once from its built-in chain, so
+// running it again without changes leaves the firewall as it was. Each
+// family is swapped in one transaction.
+func (s *ZoneService) Compile() error {
+	zones, err := s.ListZones()
+	if err != nil {
+		return err
+	}
+	policies, err := s.ListPolicies()
+	if err != nil {
+		return err
+	}
+
+	for _, family := range models.IPFamilies {
+		if err := s.compileFamily(family, zones, policies); err != nil {
+			return fmt.Errorf("%s: %w", family, err)
+		}
+	}
+	return nil
+}
+
+func (s *ZoneService) compileFamily(family models.IPFamily, zones []models.Zone, policies []models.ZonePolicy) error {
+	rules := compileZoneRules(family, zones, policies)
+
+	chains := make([]ManagedChain, 0, len(zoneChains))
+	for _, zc := range zoneChains {
+		chains = append(chains, ManagedChain{
+			Table:  zc.table,
+			Chain:  zc.chain,
+			Parent: zc.parent,
+			Rules:  rules[zc.chain],
+		})
+	}
+	return s.firewall.ReplaceChains(family, chains)
+}
+
+// compileZoneRules builds the contents of each managed chain. Replies to
+// accepted connections are let through first; each zone and each policy
+// then becomes one rule per interface (pair).
+func compileZoneRules(family models.IPFamily, zones []models.Zone, policies []models.ZonePolicy) map[string][]models.FirewallRuleInput {
+	rules := make(map[string][]models.FirewallRuleInput)
+	byName := make(map[string]models.Zone, len(zones))
+	for _, z := range zones {
+		byName[z.Name] = z
+	}
+
+	established := func(table, chain string) models.FirewallRuleInput {
+		return models.FirewallRuleInput{
+			Family:  family,
+			Table:   table,
+			Chain:   chain,
+			State:   "ESTABLISHED,RELATED",
+			Target:  "ACCEPT",
+			Comment: "zone: established",
+		}
+	}
+
+	for _, z := range zones {
+		if z.InputAction == "" {
+			continue
+		}
+		if len(rules[zoneInputChain]) == 0 {
+			rules[zoneInputChain] = append(rules[zoneInputChain], established("filter", zoneInputChain))
+		}
+		for _, iface := range z.Interfaces {
+			rules[zoneInputChain] = append(rules[zoneInputChain], models.FirewallRuleInput{
+				Family:      family,
+				Table:       "filter",
+				Chain:       zoneInputChain,
+				InInterface: iface,
+				Target:      z.InputAction,
+				Comment:     "zone: " + z.Name + " input",
+			})
+		}
+	}
+
+	for _, p := range policies {
+		from, okFrom := byName[p.FromZone]
+		to, okTo := byName[p.ToZone]
+		if !okFrom || !okTo {
+			continue
+		}
+		if len(rules[zoneForwardChain]) == 0 {
+			rules[zoneForwardChain] = append(rules[zoneForwardChain], established("filter", zoneForwardChain))
+		}
+		for _, in := range from.Interfaces {
+			for _, out := range to.Interfaces {
+				rules[zoneForwardChain] = append(rules[zoneForwardChain], models.FirewallRuleInput{
+					Family:       family,
+					Table:        "filter",
+					Chain:        zoneForwardChain,
+					InInterface:  in,
+					OutInterface: out,
+					Target:       p.Action,
+					Comment:      "zone: " + p.FromZone + " to " + p.ToZone,
+				})
+			}
+		}
+	}
+
+	for _, z := range zones {
+		if !z.Masquerade {
+			continue
+		}
+		for _, iface := range z.Interfaces {
+			rules[zonePostroutingChain] = append(rules[zonePostroutingChain], models.FirewallRuleInput{
+				Family:       family,
+				Table:        "nat",
+				Chain:        zonePostroutingChain,
+				OutInterface: iface,
+				Target:       "MASQUERADE",
+				Comment:      "zone: " + z.Name + " masquerade",
+			})
+		}
+	}
+
+	return rules
+}
+
+// validateZone checks a zone and that none of its interfaces is already
+// assigned to one of the other zones
+func validateZone(zone models.Zone, others []models.Zone) error {
+	if !zoneNamePattern.MatchString(zone.Name) {
+		return fmt.Errorf("invalid zone name %q: use up to 16 letters, digits, '_' and '-'", zone.Name)
+	}
+	// These names are taken by the routes of the zones page
+	if zone.Name == "list" || zone.Name == "compile" || zone.Name == "policies" {
+		return fmt.Errorf("zone name %q is reserved", zone.Name)
+	}
+	if strings.ContainsAny(zone.Description, "\n") {
+		return fmt.Errorf("description must not contain line breaks")
+	}
+	if zone.InputAction != "" && !validZoneAction(zone.InputAction) {
+		return fmt.Errorf("invalid input action %q", zone.InputAction)
+	}
+
+	assigned := make(map[string]string)
+	for _, z := range others {
+		for _, iface := range z.Interfaces {
+			assigned[iface] = z.Name
+		}
+	}
+
+	for _, iface := range zone.Interfaces {
+		if !interfaceNamePattern.MatchString(iface) {
+			return fmt.Errorf("invalid interface name %q", iface)
+		}
+		if owner, ok := assigned[iface]; ok {
+			return fmt.Errorf("interface %s is already in zone %s", iface, owner)
+		}
+	}
+
+	return nil
+}
+
+func validZoneAction(action string) bool {
+	for _, a := range models.ZoneActions {
+		if action == a {
+			return true
+		}
+	}
+	return false
+}
+
+// splitZoneInterfaces splits a comma, space or newline separated interface
+// list, dropping duplicates
+func splitZoneInterfaces(value string) []string {
+	var result []string
+	seen := make(map[string]bool)
+	for _, iface := range strings.FieldsFunc(value, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\n' || r == '\r' || r == '\t'
+	}) {
+		if seen[iface] {
+			continue
+		}
+		seen[iface] = true
+		result = append(result, iface)
+	}
+	return result
+}